@@ -52,6 +52,19 @@ type InitialOption struct {
 	ExecutorTimeout time.Duration
 	// ExecutorTimeout default 15s
 	DagScheduleTimeout time.Duration
+	// CronMissThreshold default 30s, a cron slot delayed more than it will be regarded as missed
+	// and handled by the dag's catch-up policy
+	CronMissThreshold time.Duration
+
+	// DispatchStrategy decide how to choose worker for dag instance, default is "round-robin",
+	// it can be "round-robin", "least-loaded" or "consistent-hash"
+	DispatchStrategy string
+	dispatchStrategy mod.DispatchStrategy
+
+	// Pools define the named resource pools which limit the concurrency of tasks across the whole cluster,
+	// key is the pool name and value is the count of slots, tasks reference them by `pool` and `poolSlots`,
+	// the pools are not persisted, so all workers should define the same pools
+	Pools map[string]int
 
 	// Read dag define from directory
 	// each file will be pared to a dag, so you CAN'T define all dag in one file
@@ -92,6 +105,8 @@ func Init(opt *InitialOption) error {
 		&actions.Waiting{},
 		&actions.SSH{},
 		&actions.HTTP{},
+		&actions.SubDag{},
+		&actions.Approval{},
 	})
 
 	if opt.ReadDagFromDir != "" {
@@ -148,9 +163,13 @@ func (l *LeaderChangedHandler) Handle(cxt context.Context, e goevent.Event) {
 		wg.Init()
 		l.leaderCloser = append(l.leaderCloser, wg)
 
-		dis := mod.NewDefDispatcher()
+		dis := mod.NewDefDispatcher(l.opt.dispatchStrategy)
 		dis.Init()
 		l.leaderCloser = append(l.leaderCloser, dis)
+
+		sch := mod.NewDefScheduler(l.opt.CronMissThreshold)
+		sch.Init()
+		l.leaderCloser = append(l.leaderCloser, sch)
 		log.Println("leader initial")
 	}
 	// continue leader failed
@@ -167,6 +186,13 @@ func (l *LeaderChangedHandler) Close() {
 	l.leaderCloser = []mod.Closer{}
 }
 
+// Drain tell the worker to stop taking new dag instances, wait for its running task instances until ctx is done,
+// then release its remaining dag instances to other workers, you can close fastflow and exit after it returned.
+// subscribe event.WorkerDraining to watch the progress
+func Drain(ctx context.Context) error {
+	return mod.Drain(ctx)
+}
+
 // Close all closer
 func Close() {
 	for i := range closers {
@@ -189,12 +215,25 @@ func checkOption(opt *InitialOption) error {
 	if opt.DagScheduleTimeout == 0 {
 		opt.DagScheduleTimeout = 15 * time.Second
 	}
+	if opt.CronMissThreshold == 0 {
+		opt.CronMissThreshold = 30 * time.Second
+	}
 	if opt.ExecutorWorkerCnt == 0 {
 		opt.ExecutorWorkerCnt = 1000
 	}
 	if opt.ParserWorkersCnt == 0 {
 		opt.ParserWorkersCnt = 100
 	}
+	strategy, err := mod.NewDispatchStrategy(opt.DispatchStrategy)
+	if err != nil {
+		return err
+	}
+	opt.dispatchStrategy = strategy
+	for name, slots := range opt.Pools {
+		if slots <= 0 {
+			return fmt.Errorf("slots of pool[%s] must be positive", name)
+		}
+	}
 	return nil
 }
 
@@ -205,7 +244,7 @@ func initCommonComponent(opt *InitialOption) {
 	entity.StoreUnmarshal = opt.Store.Unmarshal
 
 	// Executor must init before parse otherwise will cause a error
-	exe := mod.NewDefExecutor(opt.ExecutorTimeout, opt.ExecutorWorkerCnt)
+	exe := mod.NewDefExecutor(opt.ExecutorTimeout, opt.ExecutorWorkerCnt, mod.WithPools(opt.Pools))
 	mod.SetExecutor(exe)
 	p := mod.NewDefParser(opt.ParserWorkersCnt, opt.ExecutorTimeout)
 	mod.SetParser(p)
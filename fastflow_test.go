@@ -2,9 +2,12 @@ package fastflow
 
 import (
 	"fmt"
+	memoryKeeper "github.com/linclin/fastflow/keeper/memory"
 	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/entity/run"
 	"github.com/linclin/fastflow/pkg/mod"
 	"github.com/linclin/fastflow/pkg/utils"
+	memoryStore "github.com/linclin/fastflow/store/memory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"gopkg.in/yaml.v3"
@@ -30,8 +33,47 @@ func Test_checkOption(t *testing.T) {
 				ExecutorWorkerCnt:  1000,
 				ExecutorTimeout:    time.Second * 30,
 				DagScheduleTimeout: time.Second * 15,
+				CronMissThreshold:  time.Second * 30,
+				dispatchStrategy:   &mod.RoundRobinStrategy{},
 			},
 		},
+		{
+			giveOpt: &InitialOption{
+				Keeper:           &mod.MockKeeper{},
+				Store:            &mod.MockStore{},
+				DispatchStrategy: "unknown",
+			},
+			wantOpt: &InitialOption{
+				Keeper:             &mod.MockKeeper{},
+				Store:              &mod.MockStore{},
+				ParserWorkersCnt:   100,
+				ExecutorWorkerCnt:  1000,
+				ExecutorTimeout:    time.Second * 30,
+				DagScheduleTimeout: time.Second * 15,
+				CronMissThreshold:  time.Second * 30,
+				DispatchStrategy:   "unknown",
+			},
+			wantErr: fmt.Errorf("dispatch strategy[unknown] is not supported"),
+		},
+		{
+			giveOpt: &InitialOption{
+				Keeper: &mod.MockKeeper{},
+				Store:  &mod.MockStore{},
+				Pools:  map[string]int{"api": 0},
+			},
+			wantOpt: &InitialOption{
+				Keeper:             &mod.MockKeeper{},
+				Store:              &mod.MockStore{},
+				ParserWorkersCnt:   100,
+				ExecutorWorkerCnt:  1000,
+				ExecutorTimeout:    time.Second * 30,
+				DagScheduleTimeout: time.Second * 15,
+				CronMissThreshold:  time.Second * 30,
+				dispatchStrategy:   &mod.RoundRobinStrategy{},
+				Pools:              map[string]int{"api": 0},
+			},
+			wantErr: fmt.Errorf("slots of pool[api] must be positive"),
+		},
 		{
 			giveOpt: &InitialOption{},
 			wantOpt: &InitialOption{},
@@ -189,3 +231,156 @@ tasks:
 		})
 	}
 }
+
+type shareDataAction struct {
+}
+
+func (a *shareDataAction) Name() string {
+	return "share-data"
+}
+
+func (a *shareDataAction) Run(ctx run.ExecuteContext, params interface{}) error {
+	v, _ := ctx.ShareData().Get("count")
+	ctx.ShareData().Set("count", v+"1")
+	return nil
+}
+
+// gateAction blocks until its gate is opened or the task instance is canceled
+type gateAction struct {
+	name string
+	gate chan struct{}
+}
+
+func (a *gateAction) Name() string {
+	return a.name
+}
+
+func (a *gateAction) Run(ctx run.ExecuteContext, params interface{}) error {
+	select {
+	case <-a.gate:
+		return nil
+	case <-ctx.Context().Done():
+		return ctx.Context().Err()
+	}
+}
+
+func TestInit_Memory(t *testing.T) {
+	keeper := memoryKeeper.NewKeeper(&memoryKeeper.KeeperOption{Key: "worker-1"})
+	assert.NoError(t, keeper.Init())
+	st := memoryStore.NewStore()
+	assert.NoError(t, st.Init())
+
+	cancelGate := &gateAction{name: "cancel-gate", gate: make(chan struct{})}
+	pauseGate := &gateAction{name: "pause-gate", gate: make(chan struct{})}
+	RegisterAction([]run.Action{&shareDataAction{}, cancelGate, pauseGate})
+	err := Init(&InitialOption{
+		Keeper:            keeper,
+		Store:             st,
+		ParserWorkersCnt:  10,
+		ExecutorWorkerCnt: 10,
+	})
+	assert.NoError(t, err)
+	defer Close()
+
+	waitDagIns := func(t *testing.T, dagInsId string, status entity.DagInstanceStatus) *entity.DagInstance {
+		var dagIns *entity.DagInstance
+		assert.Eventually(t, func() bool {
+			dagIns, err = mod.GetStore().GetDagInstance(dagInsId)
+			return err == nil && dagIns.Status == status
+		}, 10*time.Second, 100*time.Millisecond)
+		return dagIns
+	}
+	taskInsStatus := func(t *testing.T, dagInsId string) map[string]entity.TaskInstanceStatus {
+		tasks, err := mod.GetStore().ListTaskInstance(&mod.ListTaskInstanceInput{DagInsID: dagInsId})
+		assert.NoError(t, err)
+		ret := map[string]entity.TaskInstanceStatus{}
+		for _, task := range tasks {
+			ret[task.TaskID] = task.Status
+		}
+		return ret
+	}
+	createForeachDag := func(t *testing.T, dagId, actionName string) {
+		err := mod.GetStore().CreateDag(&entity.Dag{
+			BaseInfo: entity.BaseInfo{ID: dagId},
+			Status:   entity.DagStatusNormal,
+			Vars:     entity.DagVars{"items": {DefaultValue: `["a","b"]`}},
+			Tasks: []entity.Task{
+				{ID: "t1", ActionName: actionName, Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars, Key: "items"}},
+				{ID: "t2", ActionName: "share-data", DependOn: []string{"t1"}},
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	t.Run("share data", func(t *testing.T) {
+		err = mod.GetStore().CreateDag(&entity.Dag{
+			BaseInfo: entity.BaseInfo{ID: "memory-dag"},
+			Status:   entity.DagStatusNormal,
+			Tasks: []entity.Task{
+				{ID: "task1", ActionName: "share-data"},
+				{ID: "task2", ActionName: "share-data", DependOn: []string{"task1"}},
+			},
+		})
+		assert.NoError(t, err)
+		dagIns, err := mod.GetCommander().RunDag("memory-dag", nil)
+		assert.NoError(t, err)
+
+		dagIns = waitDagIns(t, dagIns.ID, entity.DagInstanceStatusSuccess)
+		v, _ := dagIns.ShareData.Get("count")
+		assert.Equal(t, "11", v)
+	})
+
+	t.Run("cancel running foreach", func(t *testing.T) {
+		createForeachDag(t, "cancel-foreach-dag", cancelGate.name)
+		dagIns, err := mod.GetCommander().RunDag("cancel-foreach-dag", nil)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			sts := taskInsStatus(t, dagIns.ID)
+			return sts["t1"] == entity.TaskInstanceStatusRunning &&
+				sts["t1[0]"] == entity.TaskInstanceStatusRunning && sts["t1[1]"] == entity.TaskInstanceStatusRunning
+		}, 10*time.Second, 100*time.Millisecond)
+
+		assert.NoError(t, mod.GetCommander().CancelDagIns(dagIns.ID))
+		dagIns = waitDagIns(t, dagIns.ID, entity.DagInstanceStatusFailed)
+		assert.Equal(t, mod.ReasonDagInsCanceled, dagIns.Reason)
+		assert.Nil(t, dagIns.Cmd)
+		assert.Equal(t, map[string]entity.TaskInstanceStatus{
+			"t1":    entity.TaskInstanceStatusCanceled,
+			"t1[0]": entity.TaskInstanceStatusCanceled,
+			"t1[1]": entity.TaskInstanceStatusCanceled,
+			"t2":    entity.TaskInstanceStatusCanceled,
+		}, taskInsStatus(t, dagIns.ID))
+	})
+
+	t.Run("pause and resume running foreach", func(t *testing.T) {
+		createForeachDag(t, "pause-foreach-dag", pauseGate.name)
+		dagIns, err := mod.GetCommander().RunDag("pause-foreach-dag", nil)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			sts := taskInsStatus(t, dagIns.ID)
+			return sts["t1[0]"] == entity.TaskInstanceStatusRunning && sts["t1[1]"] == entity.TaskInstanceStatusRunning
+		}, 10*time.Second, 100*time.Millisecond)
+
+		assert.NoError(t, mod.GetCommander().PauseDagIns(dagIns.ID))
+		waitDagIns(t, dagIns.ID, entity.DagInstanceStatusPaused)
+		// the running mapped tasks complete while the dag instance is paused, but the downstream task waits
+		close(pauseGate.gate)
+		assert.Eventually(t, func() bool {
+			sts := taskInsStatus(t, dagIns.ID)
+			return sts["t1[0]"] == entity.TaskInstanceStatusSuccess && sts["t1[1]"] == entity.TaskInstanceStatusSuccess
+		}, 10*time.Second, 100*time.Millisecond)
+		time.Sleep(time.Second)
+		sts := taskInsStatus(t, dagIns.ID)
+		assert.Equal(t, entity.TaskInstanceStatusRunning, sts["t1"])
+		assert.Equal(t, entity.TaskInstanceStatusInit, sts["t2"])
+
+		assert.NoError(t, mod.GetCommander().ResumeDagIns(dagIns.ID))
+		waitDagIns(t, dagIns.ID, entity.DagInstanceStatusSuccess)
+		assert.Equal(t, map[string]entity.TaskInstanceStatus{
+			"t1":    entity.TaskInstanceStatusSuccess,
+			"t1[0]": entity.TaskInstanceStatusSuccess,
+			"t1[1]": entity.TaskInstanceStatusSuccess,
+			"t2":    entity.TaskInstanceStatusSuccess,
+		}, taskInsStatus(t, dagIns.ID))
+	})
+}
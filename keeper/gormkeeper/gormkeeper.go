@@ -0,0 +1,495 @@
+package gormkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linclin/fastflow/keeper"
+	"github.com/linclin/fastflow/pkg/event"
+	"github.com/linclin/fastflow/pkg/log"
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/store"
+	"github.com/shiningrush/goevent"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const LeaderKey = "leader"
+
+// Keeper is the common gorm-based implementation of mod.Keeper,
+// the relational keepers just need to open it with the dialector of their database
+type Keeper struct {
+	opt              *KeeperOption
+	leaderClsName    string
+	heartbeatClsName string
+	mutexClsName     string
+
+	leaderFlag  atomic.Value
+	leaderEpoch int64
+	draining    atomic.Value
+	keyNumber   int
+	db          *gorm.DB
+
+	wg            sync.WaitGroup
+	firstInitWg   sync.WaitGroup
+	initCompleted bool
+	closeCh       chan struct{}
+}
+
+// KeeperOption
+type KeeperOption struct {
+	// Key the work key, must be the format like "xxxx-{{number}}", number is the code of worker
+	Key string
+	// the prefix will append to the tables
+	Prefix string
+	// UnhealthyTime default 5s, campaign and heartbeat time will be half of it
+	UnhealthyTime time.Duration
+	// Timeout default 2s
+	Timeout time.Duration
+	// IsDuplicateKeyError check if the error is caused by a duplicate primary key, it depends on the driver
+	IsDuplicateKeyError func(err error) bool
+	// MaxIdleConns, MaxOpenConns and ConnMaxLifetime configure the connection pool, zero means use default
+	MaxIdleConns    int
+	MaxOpenConns    int
+	ConnMaxLifetime time.Duration
+	// Labels of the worker, dag instances are dispatched by matching them with node selector
+	Labels map[string]string
+}
+
+// Election leader election dto, the leader keeps its lease by renewing ExpiredAt
+type Election struct {
+	ID        string `gorm:"column:id;primaryKey;size:64"`
+	WorkerKey string `gorm:"column:worker_key;size:255"`
+	// ExpiredAt is the unix milliseconds when the lease of leader is expired
+	ExpiredAt int64 `gorm:"column:expired_at"`
+	// Epoch increases every time the lease is taken over, it is used to fence the writes of stale leader
+	Epoch int64 `gorm:"column:epoch"`
+}
+
+// Heartbeat heart beat dto
+type Heartbeat struct {
+	WorkerKey string `gorm:"column:worker_key;primaryKey;size:255"`
+	// HeartbeatAt is the unix milliseconds of the latest heart beat
+	HeartbeatAt int64 `gorm:"column:heartbeat_at;index"`
+	// Labels, Capacity, Running and Draining are written by every heart beat
+	Labels   map[string]string `gorm:"column:labels;type:text;serializer:json"`
+	Capacity int               `gorm:"column:capacity"`
+	Running  int               `gorm:"column:running"`
+	Draining bool              `gorm:"column:draining"`
+}
+
+// LockDetail mutex dto
+type LockDetail struct {
+	Key string `gorm:"column:lock_key;primaryKey;size:255"`
+	// ExpiredAt is the unix milliseconds when the lock is expired
+	ExpiredAt int64  `gorm:"column:expired_at"`
+	Identity  string `gorm:"column:identity;size:255"`
+}
+
+// NewKeeper
+func NewKeeper(opt *KeeperOption) *Keeper {
+	k := &Keeper{
+		opt:     opt,
+		closeCh: make(chan struct{}),
+	}
+	k.leaderFlag.Store(false)
+	k.draining.Store(false)
+	return k
+}
+
+// Open connect to the database by dialector, create the tables and start to campaign and heart beat
+func (k *Keeper) Open(dialector gorm.Dialector) error {
+	if err := k.readOpt(); err != nil {
+		return err
+	}
+	store.InitFlakeGenerator(uint16(k.WorkerNumber()))
+
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: gormlogger.New(stdlog.New(os.Stdout, "\r\n", stdlog.LstdFlags), gormlogger.Config{
+		SlowThreshold: 200 * time.Millisecond,
+		LogLevel:      gormlogger.Warn,
+		// not found is a normal case for us, it will be returned as an error
+		IgnoreRecordNotFoundError: true,
+		Colorful:                  true,
+	})})
+	if err != nil {
+		return fmt.Errorf("connect client failed: %w", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("get db failed: %w", err)
+	}
+	if k.opt.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(k.opt.MaxIdleConns)
+	}
+	if k.opt.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(k.opt.MaxOpenConns)
+	}
+	if k.opt.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(k.opt.ConnMaxLifetime)
+	}
+	k.db = db
+	tables := map[string]interface{}{
+		k.leaderClsName:    &Election{},
+		k.heartbeatClsName: &Heartbeat{},
+		k.mutexClsName:     &LockDetail{},
+	}
+	for name, model := range tables {
+		if err := k.db.Table(name).AutoMigrate(model); err != nil {
+			return fmt.Errorf("migrate table %s failed: %w", name, err)
+		}
+	}
+
+	k.firstInitWg.Add(2)
+
+	k.wg.Add(1)
+	go k.goElect()
+	k.wg.Add(1)
+	go k.goHeartBeat()
+
+	k.firstInitWg.Wait()
+	k.initCompleted = true
+	return nil
+}
+
+func (k *Keeper) setLeaderFlag(isLeader bool) {
+	k.leaderFlag.Store(isLeader)
+	goevent.Publish(&event.LeaderChanged{
+		IsLeader:  isLeader,
+		WorkerKey: k.WorkerKey(),
+	})
+}
+
+func (k *Keeper) readOpt() error {
+	if k.opt.Key == "" {
+		return fmt.Errorf("worker key can not be empty")
+	}
+	if k.opt.UnhealthyTime == 0 {
+		k.opt.UnhealthyTime = time.Second * 5
+	}
+	if k.opt.Timeout == 0 {
+		k.opt.Timeout = time.Second * 2
+	}
+
+	number, err := keeper.CheckWorkerKey(k.opt.Key)
+	if err != nil {
+		return err
+	}
+	k.keyNumber = number
+
+	k.leaderClsName = "election"
+	k.heartbeatClsName = "heartbeat"
+	k.mutexClsName = "mutex"
+	if k.opt.Prefix != "" {
+		k.leaderClsName = fmt.Sprintf("%s_%s", k.opt.Prefix, k.leaderClsName)
+		k.heartbeatClsName = fmt.Sprintf("%s_%s", k.opt.Prefix, k.heartbeatClsName)
+		k.mutexClsName = fmt.Sprintf("%s_%s", k.opt.Prefix, k.mutexClsName)
+	}
+
+	return nil
+}
+
+func (k *Keeper) isDuplicateKeyError(err error) bool {
+	return k.opt.IsDuplicateKeyError != nil && k.opt.IsDuplicateKeyError(err)
+}
+
+// DB return the gorm db, it is nil before the keeper opened
+func (k *Keeper) DB() *gorm.DB {
+	return k.db
+}
+
+// IsLeader indicate the component if is leader node
+func (k *Keeper) IsLeader() bool {
+	return k.leaderFlag.Load().(bool)
+}
+
+// LeaderEpoch is the fencing epoch of the latest leader term of this worker
+func (k *Keeper) LeaderEpoch() int64 {
+	return atomic.LoadInt64(&k.leaderEpoch)
+}
+
+// AliveNodes get all alive nodes
+func (k *Keeper) AliveNodes() ([]string, error) {
+	nodes, err := k.AliveNodesWithLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	var aliveNodes []string
+	for i := range nodes {
+		aliveNodes = append(aliveNodes, nodes[i].WorkerKey)
+	}
+	return aliveNodes, nil
+}
+
+// AliveNodesWithLabels get all alive nodes with their labels and load
+func (k *Keeper) AliveNodesWithLabels() ([]mod.Node, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
+	defer cancel()
+
+	var ret []Heartbeat
+	err := k.db.WithContext(ctx).Table(k.heartbeatClsName).
+		Where("heartbeat_at > ?", time.Now().Add(-1*k.opt.UnhealthyTime).UnixMilli()).
+		Find(&ret).Error
+	if err != nil {
+		return nil, fmt.Errorf("find result failed: %w", err)
+	}
+
+	var aliveNodes []mod.Node
+	for i := range ret {
+		aliveNodes = append(aliveNodes, mod.Node{
+			WorkerKey: ret[i].WorkerKey,
+			Labels:    ret[i].Labels,
+			Capacity:  ret[i].Capacity,
+			Running:   ret[i].Running,
+			Draining:  ret[i].Draining,
+		})
+	}
+	return aliveNodes, nil
+}
+
+// IsAlive check if a worker still alive
+func (k *Keeper) IsAlive(workerKey string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
+	defer cancel()
+
+	var p Heartbeat
+	err := k.db.WithContext(ctx).Table(k.heartbeatClsName).
+		Where("worker_key = ? AND heartbeat_at > ?", workerKey, time.Now().Add(-1*k.opt.UnhealthyTime).UnixMilli()).
+		Take(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("query heart beat failed: %w", err)
+	}
+	return true, nil
+}
+
+// SetDraining mark the worker is draining or not, it makes a heart beat to publish it immediately
+func (k *Keeper) SetDraining(draining bool) error {
+	k.draining.Store(draining)
+	return k.heartBeat()
+}
+
+// IsDraining indicate the worker if is draining
+func (k *Keeper) IsDraining() bool {
+	return k.draining.Load().(bool)
+}
+
+// WorkerKey must match `xxxx-1` format
+func (k *Keeper) WorkerKey() string {
+	return k.opt.Key
+}
+
+// WorkerNumber get the the key number of Worker key, if here is a WorkKey like `worker-1`, then it will return "1"
+func (k *Keeper) WorkerNumber() int {
+	return k.keyNumber
+}
+
+// NewMutex(key string) create a new distributed mutex
+func (k *Keeper) NewMutex(key string) mod.DistributedMutex {
+	return &GormMutex{
+		key:     key,
+		clsName: k.mutexClsName,
+		keeper:  k,
+	}
+}
+
+// close component
+func (k *Keeper) Close() {
+	close(k.closeCh)
+	k.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
+	defer cancel()
+	if k.leaderFlag.Load().(bool) {
+		// expire the lease rather than delete it, the epoch must be kept increasing
+		err := k.db.WithContext(ctx).Table(k.leaderClsName).
+			Where("id = ? AND worker_key = ?", LeaderKey, k.opt.Key).
+			Update("expired_at", 0).Error
+		if err != nil {
+			log.Errorf("deregister leader failed: %s", err)
+		}
+	}
+
+	err := k.db.WithContext(ctx).Table(k.heartbeatClsName).
+		Where("worker_key = ?", k.opt.Key).
+		Delete(&Heartbeat{}).Error
+	if err != nil {
+		log.Errorf("deregister heart beat failed: %s", err)
+	}
+
+	k.closeDB()
+}
+
+// this function is just for testing
+func (k *Keeper) forceClose() {
+	close(k.closeCh)
+	k.wg.Wait()
+	k.closeDB()
+}
+
+func (k *Keeper) closeDB() {
+	sqlDB, err := k.db.DB()
+	if err != nil {
+		log.Errorf("get keeper db failed: %s", err)
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Errorf("close keeper db failed: %s", err)
+	}
+}
+
+func (k *Keeper) goElect() {
+	timerCh := time.Tick(k.opt.UnhealthyTime / 2)
+	closed := false
+	for !closed {
+		select {
+		case <-k.closeCh:
+			closed = true
+		case <-timerCh:
+			k.elect()
+		}
+	}
+	k.wg.Done()
+}
+
+func (k *Keeper) elect() {
+	if k.leaderFlag.Load().(bool) {
+		if err := k.continueLeader(); err != nil {
+			log.Errorf("continue leader failed: %s", err)
+			k.setLeaderFlag(false)
+			return
+		}
+	} else {
+		if err := k.campaign(); err != nil {
+			log.Errorf("campaign failed: %s", err)
+			return
+		}
+	}
+
+	if !k.initCompleted {
+		k.firstInitWg.Done()
+	}
+}
+
+// campaign take over the lease when it is not existed or expired,
+// the conditional update make sure only one worker can win even if they campaign at the same time
+func (k *Keeper) campaign() error {
+	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
+	defer cancel()
+
+	now := time.Now()
+	ret := k.db.WithContext(ctx).Table(k.leaderClsName).
+		Where("id = ? AND (expired_at < ? OR worker_key = ?)", LeaderKey, now.UnixMilli(), k.opt.Key).
+		Updates(map[string]interface{}{
+			"worker_key": k.opt.Key,
+			"expired_at": now.Add(k.opt.UnhealthyTime).UnixMilli(),
+			"epoch":      gorm.Expr("epoch + 1"),
+		})
+	if ret.Error != nil {
+		return fmt.Errorf("update failed: %w", ret.Error)
+	}
+	if ret.RowsAffected > 0 {
+		var election Election
+		if err := k.db.WithContext(ctx).Table(k.leaderClsName).Where("id = ?", LeaderKey).Take(&election).Error; err != nil {
+			return fmt.Errorf("get leader epoch failed: %w", err)
+		}
+		// the lease is taken over by others just now
+		if election.WorkerKey != k.opt.Key {
+			return nil
+		}
+		atomic.StoreInt64(&k.leaderEpoch, election.Epoch)
+		k.setLeaderFlag(true)
+		return nil
+	}
+
+	var cnt int64
+	if err := k.db.WithContext(ctx).Table(k.leaderClsName).Where("id = ?", LeaderKey).Count(&cnt).Error; err != nil {
+		return fmt.Errorf("count leader failed: %w", err)
+	}
+	// the lease is kept by others
+	if cnt > 0 {
+		return nil
+	}
+
+	err := k.db.WithContext(ctx).Table(k.leaderClsName).Create(&Election{
+		ID:        LeaderKey,
+		WorkerKey: k.opt.Key,
+		ExpiredAt: now.Add(k.opt.UnhealthyTime).UnixMilli(),
+		Epoch:     1,
+	}).Error
+	if err != nil {
+		if k.isDuplicateKeyError(err) {
+			log.Infof("campaign failed")
+			return nil
+		}
+		return fmt.Errorf("insert failed: %w", err)
+	}
+	atomic.StoreInt64(&k.leaderEpoch, 1)
+	k.setLeaderFlag(true)
+	return nil
+}
+
+func (k *Keeper) continueLeader() error {
+	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
+	defer cancel()
+	ret := k.db.WithContext(ctx).Table(k.leaderClsName).
+		Where("id = ? AND worker_key = ?", LeaderKey, k.opt.Key).
+		Update("expired_at", time.Now().Add(k.opt.UnhealthyTime).UnixMilli())
+	if ret.Error != nil {
+		return fmt.Errorf("update failed: %w", ret.Error)
+	}
+	if ret.RowsAffected == 0 {
+		return fmt.Errorf("leader lease is kept by others")
+	}
+	return nil
+}
+
+func (k *Keeper) goHeartBeat() {
+	timerCh := time.Tick(k.opt.UnhealthyTime / 2)
+	closed := false
+	for !closed {
+		select {
+		case <-k.closeCh:
+			closed = true
+		case <-timerCh:
+			if err := k.heartBeat(); err != nil {
+				log.Errorf("heart beat failed: %s", err)
+				continue
+			}
+			if !k.initCompleted {
+				k.firstInitWg.Done()
+			}
+		}
+	}
+	k.wg.Done()
+}
+
+func (k *Keeper) heartBeat() error {
+	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
+	defer cancel()
+	capacity, running := mod.WorkerLoad()
+	err := k.db.WithContext(ctx).Table(k.heartbeatClsName).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "worker_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"heartbeat_at", "labels", "capacity", "running", "draining"}),
+	}).Create(&Heartbeat{
+		WorkerKey:   k.opt.Key,
+		HeartbeatAt: time.Now().UnixMilli(),
+		Labels:      k.opt.Labels,
+		Capacity:    capacity,
+		Running:     running,
+		Draining:    k.IsDraining(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("upsert heart beat failed: %w", err)
+	}
+	return nil
+}
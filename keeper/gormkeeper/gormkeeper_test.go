@@ -0,0 +1,164 @@
+package gormkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+)
+
+func initWorkers(t *testing.T, keys ...string) []*Keeper {
+	path := filepath.Join(t.TempDir(), "fastflow.db") + "?_busy_timeout=5000"
+	var workers []*Keeper
+	for _, key := range keys {
+		k := NewKeeper(&KeeperOption{
+			Key:           key,
+			Prefix:        "test",
+			UnhealthyTime: time.Second,
+			IsDuplicateKeyError: func(err error) bool {
+				var sqliteErr sqlite3.Error
+				return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+			},
+			MaxOpenConns: 1,
+			Labels:       map[string]string{"key": key},
+		})
+		assert.NoError(t, k.Open(sqlite.Open(path)))
+		workers = append(workers, k)
+	}
+	return workers
+}
+
+func TestKeeper_Sanity(t *testing.T) {
+	workers := initWorkers(t, "worker-1", "worker-2", "worker-3")
+	w1, w2, w3 := workers[0], workers[1], workers[2]
+	assert.True(t, w1.IsLeader())
+	assert.False(t, w2.IsLeader())
+	assert.False(t, w3.IsLeader())
+	assert.Equal(t, int64(1), w1.LeaderEpoch())
+	assert.Equal(t, int64(0), w2.LeaderEpoch())
+	nodes, err := w2.AliveNodes()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"worker-1", "worker-2", "worker-3"}, nodes)
+	labeledNodes, err := w2.AliveNodesWithLabels()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []mod.Node{
+		{WorkerKey: "worker-1", Labels: map[string]string{"key": "worker-1"}},
+		{WorkerKey: "worker-2", Labels: map[string]string{"key": "worker-2"}},
+		{WorkerKey: "worker-3", Labels: map[string]string{"key": "worker-3"}},
+	}, labeledNodes)
+	assert.False(t, w3.IsDraining())
+	assert.NoError(t, w3.SetDraining(true))
+	assert.True(t, w3.IsDraining())
+	labeledNodes, err = w2.AliveNodesWithLabels()
+	assert.NoError(t, err)
+	for _, n := range labeledNodes {
+		assert.Equal(t, n.WorkerKey == "worker-3", n.Draining)
+	}
+	alive, err := w2.IsAlive("worker-1")
+	assert.NoError(t, err)
+	assert.True(t, alive)
+	alive, err = w2.IsAlive("worker-4")
+	assert.NoError(t, err)
+	assert.False(t, alive)
+
+	// leader exits normally, the lease is released
+	w1.Close()
+	time.Sleep(time.Second)
+	assert.True(t, w2.IsLeader() != w3.IsLeader())
+	assert.Equal(t, int64(2), w2.LeaderEpoch()+w3.LeaderEpoch())
+	nodes, err = w2.AliveNodes()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"worker-2", "worker-3"}, nodes)
+	w2.Close()
+	w3.Close()
+}
+
+func TestKeeper_Crash(t *testing.T) {
+	workers := initWorkers(t, "worker-1", "worker-2", "worker-3")
+	w1, w2, w3 := workers[0], workers[1], workers[2]
+	assert.True(t, w1.IsLeader())
+
+	// leader crashed, the others should wait the lease and heart beat expired
+	w1.forceClose()
+	time.Sleep(500 * time.Millisecond)
+	alive, err := w2.IsAlive("worker-1")
+	assert.NoError(t, err)
+	assert.True(t, alive)
+	assert.False(t, w2.IsLeader() || w3.IsLeader())
+
+	time.Sleep(2 * time.Second)
+	assert.True(t, w2.IsLeader() != w3.IsLeader())
+	assert.Equal(t, int64(2), w2.LeaderEpoch()+w3.LeaderEpoch())
+	nodes, err := w3.AliveNodes()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"worker-2", "worker-3"}, nodes)
+	alive, err = w2.IsAlive("worker-1")
+	assert.NoError(t, err)
+	assert.False(t, alive)
+	w2.Close()
+	w3.Close()
+}
+
+func TestGormMutex_Sanity(t *testing.T) {
+	workers := initWorkers(t, "worker-1", "worker-2")
+	defer func() {
+		for _, w := range workers {
+			w.Close()
+		}
+	}()
+	mux := workers[0].NewMutex("key")
+	mux2 := workers[1].NewMutex("key")
+	err := mux.Lock(context.TODO())
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		assert.NoError(t, mux.Unlock(context.TODO()))
+	}()
+
+	err = mux2.Lock(context.TODO())
+	assert.NoError(t, err)
+	err = mux2.Unlock(context.TODO())
+	assert.NoError(t, err)
+
+	// lock timeout
+	err = mux.Lock(context.TODO())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+	defer cancel()
+	err = mux2.Lock(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	err = mux2.Lock(context.TODO(), mod.LockNoWait())
+	assert.Equal(t, data.ErrMutexLocked, err)
+	assert.NoError(t, mux.Unlock(context.TODO()))
+
+	// race lock after expired
+	err = mux.Lock(context.TODO(), mod.LockTTL(time.Millisecond*200))
+	assert.NoError(t, err)
+	err = mux2.Lock(context.TODO())
+	assert.NoError(t, err)
+	err = mux.Unlock(context.TODO())
+	assert.Equal(t, data.ErrMutexAlreadyUnlock, err)
+	err = mux2.Unlock(context.TODO())
+	assert.NoError(t, err)
+
+	// reentrant
+	err = mux.Lock(context.TODO(), mod.Reentrant("m1"))
+	assert.NoError(t, err)
+	err = mux2.Lock(context.TODO(), mod.Reentrant("m1"))
+	assert.NoError(t, err)
+	err = mux2.Unlock(context.TODO())
+	assert.NoError(t, err)
+	err = mux.Unlock(context.TODO())
+	assert.Equal(t, data.ErrMutexAlreadyUnlock, err)
+
+	err = mux.Unlock(context.TODO())
+	assert.Equal(t, fmt.Errorf("the mutex is not locked"), err)
+}
@@ -0,0 +1,133 @@
+package gormkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"gorm.io/gorm"
+)
+
+// GormMutex is a distributed mutex based on the mutex table, a lock is a row which is identified by key
+type GormMutex struct {
+	key string
+
+	clsName    string
+	keeper     *Keeper
+	lockDetail *LockDetail
+}
+
+func (m *GormMutex) Lock(ctx context.Context, ops ...mod.LockOptionOp) error {
+	opt := mod.NewLockOption(ops)
+	if err := m.spinLock(ctx, opt); err != nil {
+		return err
+	}
+	// already keep lock
+	if m.lockDetail != nil {
+		return nil
+	}
+	if opt.NoWait {
+		return data.ErrMutexLocked
+	}
+
+	// when get lock failed, loop to get it
+	ticker := time.NewTicker(opt.SpinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.spinLock(ctx, opt); err != nil {
+				// the query is interrupted by context
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+			// already keep lock
+			if m.lockDetail != nil {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *GormMutex) spinLock(ctx context.Context, opt *mod.LockOption) error {
+	detail := LockDetail{}
+	err := m.keeper.db.WithContext(ctx).Table(m.clsName).Where("lock_key = ?", m.key).Take(&detail).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("get lock detail failed: %w", err)
+	}
+
+	// no lock
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		d := &LockDetail{
+			Key:       m.key,
+			ExpiredAt: time.Now().Add(opt.TTL).UnixMilli(),
+			Identity:  opt.ReentrantIdentity,
+		}
+		err := m.keeper.db.WithContext(ctx).Table(m.clsName).Create(d).Error
+		if err != nil {
+			if m.keeper.isDuplicateKeyError(err) {
+				// race lock failed, ready to get lock next time
+				return nil
+			}
+			return fmt.Errorf("insert lock detail failed: %w", err)
+		}
+		m.lockDetail = d
+		return nil
+	}
+
+	// lock existed, we should check it is expired
+	if detail.ExpiredAt < time.Now().UnixMilli() {
+		exp := time.Now().Add(opt.TTL).UnixMilli()
+		ret := m.keeper.db.WithContext(ctx).Table(m.clsName).
+			Where("lock_key = ? AND expired_at = ?", m.key, detail.ExpiredAt).
+			Updates(map[string]interface{}{
+				"expired_at": exp,
+				"identity":   opt.ReentrantIdentity,
+			})
+		if ret.Error != nil {
+			return fmt.Errorf("get lock failed: %w", ret.Error)
+		}
+		// lock is keep by others
+		if ret.RowsAffected == 0 {
+			return nil
+		}
+		detail.ExpiredAt = exp
+		detail.Identity = opt.ReentrantIdentity
+		m.lockDetail = &detail
+		return nil
+	}
+
+	// lock existed, we should check it is reentrant
+	if opt.ReentrantIdentity != "" && detail.Identity == opt.ReentrantIdentity {
+		m.lockDetail = &detail
+		return nil
+	}
+
+	// lock is keep by others, return to loop
+	return nil
+}
+
+func (m *GormMutex) Unlock(ctx context.Context) error {
+	if m.lockDetail == nil {
+		return fmt.Errorf("the mutex is not locked")
+	}
+
+	ret := m.keeper.db.WithContext(ctx).Table(m.clsName).
+		Where("lock_key = ? AND expired_at = ?", m.key, m.lockDetail.ExpiredAt).
+		Delete(&LockDetail{})
+	if ret.Error != nil {
+		return fmt.Errorf("delete lock detail failed: %w", ret.Error)
+	}
+	m.lockDetail = nil
+	if ret.RowsAffected == 0 {
+		return data.ErrMutexAlreadyUnlock
+	}
+	return nil
+}
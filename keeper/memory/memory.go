@@ -0,0 +1,130 @@
+package memory
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/linclin/fastflow/keeper"
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/store"
+)
+
+// Keeper memory implement, there is only one node which is always the leader,
+// so it is used for single process and testing
+type Keeper struct {
+	opt       *KeeperOption
+	keyNumber int
+	draining  atomic.Value
+
+	locks map[string]*lockDetail
+	mutex sync.Mutex
+}
+
+// KeeperOption
+type KeeperOption struct {
+	// Key the work key, must be the format like "xxxx-{{number}}", number is the code of worker
+	// default is "memory-0"
+	Key string
+	// Labels of the worker, dag instances are dispatched by matching them with node selector
+	Labels map[string]string
+}
+
+// NewKeeper
+func NewKeeper(opt *KeeperOption) *Keeper {
+	if opt == nil {
+		opt = &KeeperOption{}
+	}
+	k := &Keeper{
+		opt:   opt,
+		locks: map[string]*lockDetail{},
+	}
+	k.draining.Store(false)
+	return k
+}
+
+// Init
+func (k *Keeper) Init() error {
+	if err := k.readOpt(); err != nil {
+		return err
+	}
+	store.InitFlakeGenerator(uint16(k.WorkerNumber()))
+	return nil
+}
+
+func (k *Keeper) readOpt() error {
+	if k.opt.Key == "" {
+		k.opt.Key = "memory-0"
+	}
+
+	number, err := keeper.CheckWorkerKey(k.opt.Key)
+	if err != nil {
+		return err
+	}
+	k.keyNumber = number
+	return nil
+}
+
+// IsLeader indicate the component if is leader node
+func (k *Keeper) IsLeader() bool {
+	return true
+}
+
+// LeaderEpoch is always 1, because the only node keeps the leadership all the time
+func (k *Keeper) LeaderEpoch() int64 {
+	return 1
+}
+
+// AliveNodes get all alive nodes
+func (k *Keeper) AliveNodes() ([]string, error) {
+	return []string{k.opt.Key}, nil
+}
+
+// AliveNodesWithLabels get all alive nodes with their labels and load
+func (k *Keeper) AliveNodesWithLabels() ([]mod.Node, error) {
+	capacity, running := mod.WorkerLoad()
+	return []mod.Node{{
+		WorkerKey: k.opt.Key,
+		Labels:    k.opt.Labels,
+		Capacity:  capacity,
+		Running:   running,
+		Draining:  k.IsDraining(),
+	}}, nil
+}
+
+// SetDraining mark the worker is draining or not
+func (k *Keeper) SetDraining(draining bool) error {
+	k.draining.Store(draining)
+	return nil
+}
+
+// IsDraining indicate the worker if is draining
+func (k *Keeper) IsDraining() bool {
+	return k.draining.Load().(bool)
+}
+
+// IsAlive check if a worker still alive
+func (k *Keeper) IsAlive(workerKey string) (bool, error) {
+	return workerKey == k.opt.Key, nil
+}
+
+// WorkerKey must match `xxxx-1` format
+func (k *Keeper) WorkerKey() string {
+	return k.opt.Key
+}
+
+// WorkerNumber get the the key number of Worker key, if here is a WorkKey like `worker-1`, then it will return "1"
+func (k *Keeper) WorkerNumber() int {
+	return k.keyNumber
+}
+
+// NewMutex(key string) create a new distributed mutex
+func (k *Keeper) NewMutex(key string) mod.DistributedMutex {
+	return &MemoryMutex{
+		key:    key,
+		keeper: k,
+	}
+}
+
+// close component
+func (k *Keeper) Close() {
+}
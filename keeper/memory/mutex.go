@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils/data"
+)
+
+type lockDetail struct {
+	expiredAt time.Time
+	identity  string
+}
+
+// MemoryMutex is a mutex within process, it has the same behaviors as other distributed mutex
+// such as ttl and reentrant
+type MemoryMutex struct {
+	key string
+
+	keeper     *Keeper
+	lockDetail *lockDetail
+}
+
+func (m *MemoryMutex) Lock(ctx context.Context, ops ...mod.LockOptionOp) error {
+	opt := mod.NewLockOption(ops)
+	if m.spinLock(opt) {
+		return nil
+	}
+	if opt.NoWait {
+		return data.ErrMutexLocked
+	}
+
+	// when get lock failed, loop to get it
+	ticker := time.NewTicker(opt.SpinInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if m.spinLock(opt) {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// spinLock return true if the lock is kept
+func (m *MemoryMutex) spinLock(opt *mod.LockOption) bool {
+	m.keeper.mutex.Lock()
+	defer m.keeper.mutex.Unlock()
+
+	detail, ok := m.keeper.locks[m.key]
+	// no lock or lock is expired
+	if !ok || detail.expiredAt.Before(time.Now()) {
+		d := &lockDetail{
+			expiredAt: time.Now().Add(opt.TTL),
+			identity:  opt.ReentrantIdentity,
+		}
+		m.keeper.locks[m.key] = d
+		m.lockDetail = d
+		return true
+	}
+
+	// lock existed, we should check it is reentrant
+	if opt.ReentrantIdentity != "" && detail.identity == opt.ReentrantIdentity {
+		m.lockDetail = detail
+		return true
+	}
+
+	// lock is keep by others
+	return false
+}
+
+func (m *MemoryMutex) Unlock(ctx context.Context) error {
+	if m.lockDetail == nil {
+		return fmt.Errorf("the mutex is not locked")
+	}
+
+	m.keeper.mutex.Lock()
+	defer m.keeper.mutex.Unlock()
+	// the lock is expired and kept by others
+	if m.keeper.locks[m.key] != m.lockDetail {
+		m.lockDetail = nil
+		return data.ErrMutexAlreadyUnlock
+	}
+	delete(m.keeper.locks, m.key)
+	m.lockDetail = nil
+	return nil
+}
@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryMutex_Sanity(t *testing.T) {
+	k := NewKeeper(&KeeperOption{Key: "worker-1"})
+	assert.NoError(t, k.Init())
+	mux := k.NewMutex("key")
+	mux2 := k.NewMutex("key")
+	err := mux.Lock(context.TODO())
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		assert.NoError(t, mux.Unlock(context.TODO()))
+	}()
+
+	err = mux2.Lock(context.TODO())
+	assert.NoError(t, err)
+	err = mux2.Unlock(context.TODO())
+	assert.NoError(t, err)
+
+	// lock timeout
+	err = mux.Lock(context.TODO())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+	defer cancel()
+	err = mux2.Lock(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	err = mux2.Lock(context.TODO(), mod.LockNoWait())
+	assert.Equal(t, data.ErrMutexLocked, err)
+	assert.NoError(t, mux.Unlock(context.TODO()))
+
+	// race lock after expired
+	err = mux.Lock(context.TODO(), mod.LockTTL(time.Millisecond*200))
+	assert.NoError(t, err)
+	err = mux2.Lock(context.TODO())
+	assert.NoError(t, err)
+	err = mux.Unlock(context.TODO())
+	assert.Equal(t, data.ErrMutexAlreadyUnlock, err)
+	err = mux2.Unlock(context.TODO())
+	assert.NoError(t, err)
+
+	// reentrant
+	err = mux.Lock(context.TODO(), mod.Reentrant("m1"))
+	assert.NoError(t, err)
+	err = mux2.Lock(context.TODO(), mod.Reentrant("m1"))
+	assert.NoError(t, err)
+	err = mux2.Unlock(context.TODO())
+	assert.NoError(t, err)
+	err = mux.Unlock(context.TODO())
+	assert.Equal(t, data.ErrMutexAlreadyUnlock, err)
+
+	err = mux.Unlock(context.TODO())
+	assert.Equal(t, fmt.Errorf("the mutex is not locked"), err)
+}
+
+func TestKeeper(t *testing.T) {
+	k := NewKeeper(nil)
+	assert.NoError(t, k.Init())
+	assert.True(t, k.IsLeader())
+	assert.Equal(t, int64(1), k.LeaderEpoch())
+	assert.Equal(t, "memory-0", k.WorkerKey())
+	assert.Equal(t, 0, k.WorkerNumber())
+	nodes, err := k.AliveNodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"memory-0"}, nodes)
+	alive, err := k.IsAlive("memory-0")
+	assert.NoError(t, err)
+	assert.True(t, alive)
+	alive, err = k.IsAlive("worker-1")
+	assert.NoError(t, err)
+	assert.False(t, alive)
+}
@@ -22,6 +22,10 @@ import (
 
 const LeaderKey = "leader"
 
+// EpochKey is the id of the document which keeps the leader epoch,
+// it has no "updatedAt" field, so it will not be deleted by the ttl index
+const EpochKey = "epoch"
+
 // Keeper mongo implement
 type Keeper struct {
 	opt              *KeeperOption
@@ -30,6 +34,8 @@ type Keeper struct {
 	mutexClsName     string
 
 	leaderFlag  atomic.Value
+	leaderEpoch int64
+	draining    atomic.Value
 	keyNumber   int
 	mongoClient *mongo.Client
 	mongoDb     *mongo.Database
@@ -53,6 +59,8 @@ type KeeperOption struct {
 	UnhealthyTime time.Duration
 	// Timeout default 2s
 	Timeout time.Duration
+	// Labels of the worker, dag instances are dispatched by matching them with node selector
+	Labels map[string]string
 }
 
 // NewKeeper
@@ -62,6 +70,7 @@ func NewKeeper(opt *KeeperOption) *Keeper {
 		closeCh: make(chan struct{}),
 	}
 	k.leaderFlag.Store(false)
+	k.draining.Store(false)
 	return k
 }
 
@@ -181,8 +190,27 @@ func (k *Keeper) IsLeader() bool {
 	return k.leaderFlag.Load().(bool)
 }
 
+// LeaderEpoch is the fencing epoch of the latest leader term of this worker
+func (k *Keeper) LeaderEpoch() int64 {
+	return atomic.LoadInt64(&k.leaderEpoch)
+}
+
 // AliveNodes get all alive nodes
 func (k *Keeper) AliveNodes() ([]string, error) {
+	nodes, err := k.AliveNodesWithLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	var aliveNodes []string
+	for i := range nodes {
+		aliveNodes = append(aliveNodes, nodes[i].WorkerKey)
+	}
+	return aliveNodes, nil
+}
+
+// AliveNodesWithLabels get all alive nodes with their labels and load
+func (k *Keeper) AliveNodesWithLabels() ([]mod.Node, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
 	defer cancel()
 	// mongodb background worker delete expired date every 60s, so can not believe it
@@ -200,9 +228,15 @@ func (k *Keeper) AliveNodes() ([]string, error) {
 		return nil, fmt.Errorf("decode failed: %w", err)
 	}
 
-	var aliveNodes []string
+	var aliveNodes []mod.Node
 	for i := range ret {
-		aliveNodes = append(aliveNodes, ret[i].WorkerKey)
+		aliveNodes = append(aliveNodes, mod.Node{
+			WorkerKey: ret[i].WorkerKey,
+			Labels:    ret[i].Labels,
+			Capacity:  ret[i].Capacity,
+			Running:   ret[i].Running,
+			Draining:  ret[i].Draining,
+		})
 	}
 	return aliveNodes, nil
 }
@@ -229,6 +263,17 @@ func (k *Keeper) IsAlive(workerKey string) (bool, error) {
 	return true, nil
 }
 
+// SetDraining mark the worker is draining or not, it makes a heart beat to publish it immediately
+func (k *Keeper) SetDraining(draining bool) error {
+	k.draining.Store(draining)
+	return k.heartBeat()
+}
+
+// IsDraining indicate the worker if is draining
+func (k *Keeper) IsDraining() bool {
+	return k.draining.Load().(bool)
+}
+
 // WorkerKey must match `xxxx-1` format
 func (k *Keeper) WorkerKey() string {
 	return k.opt.Key
@@ -285,8 +330,12 @@ func (k *Keeper) forceClose() {
 
 // Payload header beat dto
 type Payload struct {
-	WorkerKey string    `bson:"_id"`
-	UpdatedAt time.Time `bson:"updatedAt"`
+	WorkerKey string            `bson:"_id"`
+	UpdatedAt time.Time         `bson:"updatedAt"`
+	Labels    map[string]string `bson:"labels,omitempty"`
+	Capacity  int               `bson:"capacity,omitempty"`
+	Running   int               `bson:"running,omitempty"`
+	Draining  bool              `bson:"draining,omitempty"`
 }
 
 // LeaderPayload leader election dto
@@ -296,6 +345,12 @@ type LeaderPayload struct {
 	UpdatedAt time.Time `bson:"updatedAt"`
 }
 
+// EpochPayload leader epoch dto
+type EpochPayload struct {
+	ID  string `bson:"_id"`
+	Seq int64  `bson:"seq"`
+}
+
 func (k *Keeper) goElect() {
 	timerCh := time.Tick(k.opt.UnhealthyTime / 2)
 	closed := false
@@ -332,7 +387,7 @@ func (k *Keeper) elect() {
 func (k *Keeper) campaign() error {
 	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
 	defer cancel()
-	cur, err := k.mongoDb.Collection(k.leaderClsName).Find(ctx, bson.D{})
+	cur, err := k.mongoDb.Collection(k.leaderClsName).Find(ctx, bson.M{"_id": LeaderKey})
 	if err != nil {
 		return fmt.Errorf("find data failed: %w", err)
 	}
@@ -343,8 +398,7 @@ func (k *Keeper) campaign() error {
 
 	if len(ret) > 0 {
 		if ret[0].WorkerKey == k.opt.Key {
-			k.setLeaderFlag(true)
-			return nil
+			return k.becomeLeader(ctx)
 		}
 		if ret[0].UpdatedAt.Before(time.Now().Add(-1 * k.opt.UnhealthyTime)) {
 			ret, err := k.mongoDb.Collection(k.leaderClsName).UpdateOne(ctx,
@@ -363,7 +417,7 @@ func (k *Keeper) campaign() error {
 
 			}
 			if ret.ModifiedCount > 0 {
-				k.setLeaderFlag(true)
+				return k.becomeLeader(ctx)
 			}
 		}
 	}
@@ -382,8 +436,24 @@ func (k *Keeper) campaign() error {
 			log.Errorf("insert campaign rec failed: %s", err)
 			return fmt.Errorf("insert failed: %w", err)
 		}
-		k.setLeaderFlag(true)
+		return k.becomeLeader(ctx)
+	}
+	return nil
+}
+
+// becomeLeader increase the leader epoch, so that the writes of previous leader can be fenced
+func (k *Keeper) becomeLeader(ctx context.Context) error {
+	var p EpochPayload
+	err := k.mongoDb.Collection(k.leaderClsName).FindOneAndUpdate(ctx,
+		bson.M{"_id": EpochKey},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&p)
+	if err != nil {
+		return fmt.Errorf("increase leader epoch failed: %w", err)
 	}
+	atomic.StoreInt64(&k.leaderEpoch, p.Seq)
+	k.setLeaderFlag(true)
 	return nil
 }
 
@@ -432,6 +502,7 @@ func (k *Keeper) goHeartBeat() {
 func (k *Keeper) heartBeat() error {
 	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
 	defer cancel()
+	capacity, running := mod.WorkerLoad()
 	_, err := k.mongoDb.Collection(k.heartbeatClsName).UpdateOne(ctx,
 		bson.M{
 			"_id": k.opt.Key,
@@ -439,6 +510,10 @@ func (k *Keeper) heartBeat() error {
 		bson.M{
 			"$set": bson.M{
 				"updatedAt": time.Now(),
+				"labels":    k.opt.Labels,
+				"capacity":  capacity,
+				"running":   running,
+				"draining":  k.IsDraining(),
 			},
 		},
 		&options.UpdateOptions{
@@ -33,6 +33,9 @@ func (m *MongoMutex) Lock(ctx context.Context, ops ...mod.LockOptionOp) error {
 	if m.lockDetail != nil {
 		return nil
 	}
+	if opt.NoWait {
+		return data.ErrMutexLocked
+	}
 
 	// when get lock failed, loop to get it
 	ticker := time.NewTicker(opt.SpinInterval)
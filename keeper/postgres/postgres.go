@@ -0,0 +1,65 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/linclin/fastflow/keeper/gormkeeper"
+	"gorm.io/driver/postgres"
+)
+
+// Keeper postgres implement
+type Keeper struct {
+	*gormkeeper.Keeper
+	opt *KeeperOption
+}
+
+// KeeperOption
+type KeeperOption struct {
+	// Key the work key, must be the format like "xxxx-{{number}}", number is the code of worker
+	Key string
+	// postgres connection string, such as "host=localhost user=fastflow password=fastflow dbname=fastflow port=5432"
+	ConnStr string
+	// the prefix will append to the tables
+	Prefix string
+	// UnhealthyTime default 5s, campaign and heartbeat time will be half of it
+	UnhealthyTime time.Duration
+	// Timeout default 2s
+	Timeout time.Duration
+	// Labels of the worker, dag instances are dispatched by matching them with node selector
+	Labels map[string]string
+}
+
+// NewKeeper
+func NewKeeper(opt *KeeperOption) *Keeper {
+	return &Keeper{
+		Keeper: gormkeeper.NewKeeper(&gormkeeper.KeeperOption{
+			Key:                 opt.Key,
+			Prefix:              opt.Prefix,
+			UnhealthyTime:       opt.UnhealthyTime,
+			Timeout:             opt.Timeout,
+			Labels:              opt.Labels,
+			IsDuplicateKeyError: isDuplicateKeyError,
+			MaxIdleConns:        10,
+			MaxOpenConns:        100,
+			ConnMaxLifetime:     time.Hour,
+		}),
+		opt: opt,
+	}
+}
+
+// Init
+func (k *Keeper) Init() error {
+	if k.opt.Key == "" || k.opt.ConnStr == "" {
+		return fmt.Errorf("worker key or connection string can not be empty")
+	}
+	return k.Open(postgres.Open(k.opt.ConnStr))
+}
+
+func isDuplicateKeyError(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23505 is the code of unique violation
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
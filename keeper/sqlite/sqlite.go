@@ -0,0 +1,64 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/linclin/fastflow/keeper/gormkeeper"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"gorm.io/driver/sqlite"
+)
+
+// Keeper sqlite implement, the workers must share the same database file
+type Keeper struct {
+	*gormkeeper.Keeper
+	opt *KeeperOption
+}
+
+// KeeperOption
+type KeeperOption struct {
+	// Key the work key, must be the format like "xxxx-{{number}}", number is the code of worker
+	Key string
+	// sqlite database file path or dsn, such as "fastflow.db"
+	Path string
+	// the prefix will append to the tables
+	Prefix string
+	// UnhealthyTime default 5s, campaign and heartbeat time will be half of it
+	UnhealthyTime time.Duration
+	// Timeout default 2s
+	Timeout time.Duration
+	// Labels of the worker, dag instances are dispatched by matching them with node selector
+	Labels map[string]string
+}
+
+// NewKeeper
+func NewKeeper(opt *KeeperOption) *Keeper {
+	return &Keeper{
+		Keeper: gormkeeper.NewKeeper(&gormkeeper.KeeperOption{
+			Key:                 opt.Key,
+			Prefix:              opt.Prefix,
+			UnhealthyTime:       opt.UnhealthyTime,
+			Timeout:             opt.Timeout,
+			Labels:              opt.Labels,
+			IsDuplicateKeyError: isDuplicateKeyError,
+			// sqlite only allows one writer at a time, so share a single connection to avoid "database is locked"
+			MaxOpenConns: 1,
+		}),
+		opt: opt,
+	}
+}
+
+// Init
+func (k *Keeper) Init() error {
+	if k.opt.Key == "" || k.opt.Path == "" {
+		return fmt.Errorf("worker key or database path can not be empty")
+	}
+	return k.Open(sqlite.Open(k.opt.Path))
+}
+
+func isDuplicateKeyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
@@ -0,0 +1,75 @@
+package actions
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity/run"
+	"github.com/linclin/fastflow/pkg/mod"
+)
+
+const (
+	ActionKeyApproval = "approval"
+)
+
+// ApprovalParams
+type ApprovalParams struct {
+	// Support "d|h|m|s|ms" such as 5s, default is 1s
+	CheckInterval string `yaml:"checkInterval" json:"checkInterval"`
+}
+
+// Approval action blocks until the task instance is approved or rejected by Commander,
+// it will be failed when the task instance timeout, so you should set a suitable "timeoutSecs" to the task
+type Approval struct {
+}
+
+// Name
+func (a *Approval) Name() string {
+	return ActionKeyApproval
+}
+
+// ParameterNew
+func (a *Approval) ParameterNew() interface{} {
+	return &ApprovalParams{}
+}
+
+// FailoverPolicy the approval is kept in task instance, so it can wait for approval again
+func (a *Approval) FailoverPolicy() run.FailoverPolicy {
+	return run.FailoverPolicyRerun
+}
+
+// Run
+func (a *Approval) Run(ctx run.ExecuteContext, params interface{}) error {
+	interval := time.Second
+	if p, ok := params.(*ApprovalParams); ok && p.CheckInterval != "" {
+		d, err := ParseDuration(p.CheckInterval)
+		if err != nil {
+			return err
+		}
+		interval = d
+	}
+	info, ok := run.TaskInsInfoFromContext(ctx.Context())
+	if !ok {
+		return fmt.Errorf("[Action approval]task instance info is not found in context")
+	}
+
+	ctx.Trace("[Action approval]waiting for approval")
+	err := run.LoopDo(ctx, func() error {
+		taskIns, err := mod.GetStore().GetTaskIns(info.TaskInsID)
+		if err != nil {
+			return err
+		}
+		if taskIns.Approval == nil {
+			return nil
+		}
+		ctx.Trace(taskIns.Approval.String())
+		if !taskIns.Approval.IsApproved() {
+			return run.NewClassifiedError(run.ErrorClassRejected, fmt.Errorf("[Action approval]%s", taskIns.Approval))
+		}
+		return run.EndLoop
+	}, run.LoopInterval(interval))
+	if ctx.Context().Err() != nil {
+		ctx.Trace("[Action approval]waiting for approval timed out or canceled")
+	}
+	return err
+}
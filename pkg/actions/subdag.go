@@ -0,0 +1,114 @@
+package actions
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/entity/run"
+	"github.com/linclin/fastflow/pkg/mod"
+)
+
+const (
+	ActionKeySubDag = "sub-dag"
+)
+
+// SubDagParams
+type SubDagParams struct {
+	DagID string            `yaml:"dagId" json:"dagId"`
+	Vars  map[string]string `yaml:"vars" json:"vars"`
+	// Support "d|h|m|s|ms" such as 5s, default is 1s
+	CheckInterval string `yaml:"checkInterval" json:"checkInterval"`
+}
+
+// SubDag action runs another dag and waits for it to finish,
+// the final status of the sub dag instance will be the status of task instance
+type SubDag struct {
+}
+
+// Name
+func (s *SubDag) Name() string {
+	return ActionKeySubDag
+}
+
+// ParameterNew
+func (s *SubDag) ParameterNew() interface{} {
+	return &SubDagParams{}
+}
+
+// FailoverPolicy the rerun task instance will attach to the sub dag instance which is already run
+func (s *SubDag) FailoverPolicy() run.FailoverPolicy {
+	return run.FailoverPolicyRerun
+}
+
+// Run
+func (s *SubDag) Run(ctx run.ExecuteContext, params interface{}) error {
+	p, ok := params.(*SubDagParams)
+	if !ok {
+		return fmt.Errorf("[Action sub-dag]params type mismatch, want *SubDagParams, got %T", params)
+	}
+	if p.DagID == "" {
+		return fmt.Errorf("[Action sub-dag]SubDagParams dagId cannot be empty")
+	}
+	interval := time.Second
+	if p.CheckInterval != "" {
+		d, err := ParseDuration(p.CheckInterval)
+		if err != nil {
+			return err
+		}
+		interval = d
+	}
+	info, ok := run.TaskInsInfoFromContext(ctx.Context())
+	if !ok {
+		return fmt.Errorf("[Action sub-dag]task instance info is not found in context")
+	}
+
+	subDagIns, err := s.runOrAttach(info, p)
+	if err != nil {
+		return fmt.Errorf("[Action sub-dag]run sub dag[%s] failed: %w", p.DagID, err)
+	}
+	ctx.Tracef("[Action sub-dag]waiting sub dag instance[%s]", subDagIns.ID)
+
+	err = run.LoopDo(ctx, func() error {
+		dagIns, err := mod.GetStore().GetDagInstance(subDagIns.ID)
+		if err != nil {
+			return err
+		}
+		switch dagIns.Status {
+		case entity.DagInstanceStatusSuccess:
+			return run.EndLoop
+		case entity.DagInstanceStatusFailed:
+			return fmt.Errorf("[Action sub-dag]sub dag instance[%s] failed: %s", dagIns.ID, dagIns.Reason)
+		}
+		return nil
+	}, run.LoopInterval(interval))
+	// the task instance is canceled or timeout, so the sub dag instance is no longer needed
+	if ctx.Context().Err() != nil {
+		if cErr := mod.GetCommander().CancelDagIns(subDagIns.ID); cErr != nil {
+			ctx.Tracef("[Action sub-dag]cancel sub dag instance[%s] failed: %s", subDagIns.ID, cErr)
+		}
+	}
+	return err
+}
+
+// runOrAttach will attach to the latest sub dag instance of the task instance whatever its status,
+// so that a task instance which is executed again(such as failover from a dead worker) never runs the sub dag twice,
+// the completed sub dag instance just gives its status, retry it by itself if it needs to run again
+func (s *SubDag) runOrAttach(info run.TaskInsInfo, p *SubDagParams) (*entity.DagInstance, error) {
+	dagIns, err := mod.GetStore().ListDagInstance(&mod.ListDagInstanceInput{
+		ParentTaskInsID: info.TaskInsID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var latest *entity.DagInstance
+	for _, d := range dagIns {
+		if latest == nil || d.CreatedAt > latest.CreatedAt || (d.CreatedAt == latest.CreatedAt && d.ID > latest.ID) {
+			latest = d
+		}
+	}
+	if latest != nil {
+		return latest, nil
+	}
+	return mod.GetCommander().RunDag(p.DagID, p.Vars, mod.CommParent(info.DagInsID, info.TaskInsID))
+}
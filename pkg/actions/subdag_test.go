@@ -0,0 +1,95 @@
+package actions
+
+import (
+	"context"
+	"testing"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/entity/run"
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// runDagCommander only records the sub dag instances which are run
+type runDagCommander struct {
+	mod.Commander
+	runDagIds []string
+}
+
+func (c *runDagCommander) RunDag(dagId string, specVar map[string]string, ops ...mod.CommandOptSetter) (*entity.DagInstance, error) {
+	c.runDagIds = append(c.runDagIds, dagId)
+	return &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "new-sub-ins"}, Status: entity.DagInstanceStatusInit}, nil
+}
+
+func TestSubDag_Run(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		giveSubIns  []*entity.DagInstance
+		giveStatus  entity.DagInstanceStatus
+		wantErr     string
+		wantRunDag  bool
+		wantWaitIns string
+	}{
+		{
+			caseDesc:    "no sub dag instance",
+			giveStatus:  entity.DagInstanceStatusSuccess,
+			wantRunDag:  true,
+			wantWaitIns: "new-sub-ins",
+		},
+		{
+			caseDesc: "failover after sub dag instance succeeded",
+			giveSubIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "sub-ins", CreatedAt: 1}, Status: entity.DagInstanceStatusSuccess},
+			},
+			giveStatus:  entity.DagInstanceStatusSuccess,
+			wantWaitIns: "sub-ins",
+		},
+		{
+			caseDesc: "failover after sub dag instance failed",
+			giveSubIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "sub-ins", CreatedAt: 1}, Status: entity.DagInstanceStatusFailed},
+			},
+			giveStatus:  entity.DagInstanceStatusFailed,
+			wantErr:     "[Action sub-dag]sub dag instance[sub-ins] failed: reason",
+			wantWaitIns: "sub-ins",
+		},
+		{
+			caseDesc: "attach to the latest sub dag instance",
+			giveSubIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "new-ins", CreatedAt: 2}, Status: entity.DagInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "old-ins", CreatedAt: 1}, Status: entity.DagInstanceStatusFailed},
+			},
+			giveStatus:  entity.DagInstanceStatusSuccess,
+			wantWaitIns: "new-ins",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &mod.MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, "task-ins", args.Get(0).(*mod.ListDagInstanceInput).ParentTaskInsID)
+			}).Return(tc.giveSubIns, nil)
+			var waitIns string
+			mStore.On("GetDagInstance", mock.Anything).Return(func(id string) *entity.DagInstance {
+				waitIns = id
+				return &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: id}, Status: tc.giveStatus, Reason: "reason"}
+			}, nil)
+			mod.SetStore(mStore)
+			comm := &runDagCommander{}
+			mod.SetCommander(comm)
+
+			ctx := run.WithTaskInsInfo(context.Background(), run.TaskInsInfo{DagInsID: "dag-ins", TaskInsID: "task-ins"})
+			err := (&SubDag{}).Run(run.NewDefExecuteContext(ctx, nil, func(string, ...run.TraceOp) {}, nil, nil, nil),
+				&SubDagParams{DagID: "sub-dag", CheckInterval: "10ms"})
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantRunDag, len(comm.runDagIds) == 1)
+			assert.Equal(t, tc.wantWaitIns, waitIns)
+		})
+	}
+}
@@ -32,6 +32,11 @@ func (s *Waiting) ParameterNew() interface{} {
 	return &WaitingParams{}
 }
 
+// FailoverPolicy waiting can be executed again safely
+func (s *Waiting) FailoverPolicy() run.FailoverPolicy {
+	return run.FailoverPolicyRerun
+}
+
 // Run
 func (s *Waiting) Run(ctx run.ExecuteContext, params interface{}) error {
 	p := params.(*WaitingParams)
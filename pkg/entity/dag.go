@@ -9,6 +9,7 @@ import (
 
 	"github.com/linclin/fastflow/pkg/log"
 	"github.com/linclin/fastflow/pkg/utils"
+	"github.com/linclin/fastflow/pkg/utils/data"
 	"github.com/linclin/fastflow/pkg/utils/value"
 )
 
@@ -20,14 +21,118 @@ func NewDag() *Dag {
 }
 
 // Dag
+// Cron support standard 5 fields or 6 fields(with seconds) expression, such as "0 2 * * *",
+// it is fired in CronTimezone(IANA name such as "Asia/Shanghai", default is local timezone)
+// NodeSelector such as "zone=a, os in (linux,darwin)" limits the workers which can run the dag instances,
+// it matches the labels registered by workers through keeper
+// MaxActiveRuns limits the count of active instances of the dag in the whole cluster, zero means no limit,
+// if ConcurrencyKey such as "upgrade-{{cluster}}" is set, it is rendered by vars and the instances
+// having the same key share the limit, even if they belong to different dags
 type Dag struct {
-	BaseInfo `yaml:",inline" json:",inline" bson:"inline"`
-	Name     string    `yaml:"name,omitempty" json:"name,omitempty" bson:"name,omitempty"`
-	Desc     string    `yaml:"desc,omitempty" json:"desc,omitempty" bson:"desc,omitempty"`
-	Cron     string    `yaml:"cron,omitempty" json:"cron,omitempty" bson:"cron,omitempty"`
-	Vars     DagVars   `yaml:"vars,omitempty" json:"vars,omitempty" bson:"vars,omitempty" gorm:"type:json"`
-	Status   DagStatus `yaml:"status,omitempty" json:"status,omitempty" bson:"status,omitempty" gorm:"type:string"`
-	Tasks    []Task    `yaml:"tasks,omitempty" json:"tasks,omitempty" bson:"tasks,omitempty" gorm:"-"`
+	BaseInfo     `yaml:",inline" json:",inline" bson:"inline"`
+	Name         string            `yaml:"name,omitempty" json:"name,omitempty" bson:"name,omitempty"`
+	Desc         string            `yaml:"desc,omitempty" json:"desc,omitempty" bson:"desc,omitempty"`
+	Cron         string            `yaml:"cron,omitempty" json:"cron,omitempty" bson:"cron,omitempty"`
+	CronTimezone string            `yaml:"cronTimezone,omitempty" json:"cronTimezone,omitempty" bson:"cronTimezone,omitempty"`
+	CronCatchUp  CronCatchUpPolicy `yaml:"cronCatchUp,omitempty" json:"cronCatchUp,omitempty" bson:"cronCatchUp,omitempty" gorm:"type:string"`
+	Vars         DagVars           `yaml:"vars,omitempty" json:"vars,omitempty" bson:"vars,omitempty" gorm:"type:json"`
+	Status       DagStatus         `yaml:"status,omitempty" json:"status,omitempty" bson:"status,omitempty" gorm:"type:string"`
+	NodeSelector string            `yaml:"nodeSelector,omitempty" json:"nodeSelector,omitempty" bson:"nodeSelector,omitempty"`
+	Tasks        []Task            `yaml:"tasks,omitempty" json:"tasks,omitempty" bson:"tasks,omitempty" gorm:"-"`
+
+	// MaxActiveRuns and ConcurrencyKey limit the active dag instances
+	MaxActiveRuns  int    `yaml:"maxActiveRuns,omitempty" json:"maxActiveRuns,omitempty" bson:"maxActiveRuns,omitempty"`
+	ConcurrencyKey string `yaml:"concurrencyKey,omitempty" json:"concurrencyKey,omitempty" bson:"concurrencyKey,omitempty"`
+	// Priority is the default priority of the dag instances, the higher one is dispatched and executed first
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty" bson:"priority,omitempty"`
+
+	// OnSuccess, OnFailure and Finally are the handler tasks which run after the main tasks completed,
+	// they can only depend on the tasks in the same list
+	OnSuccess TaskList `yaml:"onSuccess,omitempty" json:"onSuccess,omitempty" bson:"onSuccess,omitempty" gorm:"type:json"`
+	OnFailure TaskList `yaml:"onFailure,omitempty" json:"onFailure,omitempty" bson:"onFailure,omitempty" gorm:"type:json"`
+	Finally   TaskList `yaml:"finally,omitempty" json:"finally,omitempty" bson:"finally,omitempty" gorm:"type:json"`
+	// CompensateOnFailure compensate the succeeded tasks automatically after the dag instance failed
+	CompensateOnFailure bool `yaml:"compensateOnFailure,omitempty" json:"compensateOnFailure,omitempty" bson:"compensateOnFailure,omitempty"`
+}
+
+// DagHandlerType indicate when the handler tasks run
+type DagHandlerType string
+
+const (
+	// DagHandlerOnSuccess run after the main tasks succeeded
+	DagHandlerOnSuccess DagHandlerType = "onSuccess"
+	// DagHandlerOnFailure run after the main tasks failed or the dag instance is canceled
+	DagHandlerOnFailure DagHandlerType = "onFailure"
+	// DagHandlerFinally run after the main tasks succeeded or failed
+	DagHandlerFinally DagHandlerType = "finally"
+)
+
+// DagHandlerTypes are all handler types in the order of creating task instances
+var DagHandlerTypes = []DagHandlerType{DagHandlerOnSuccess, DagHandlerOnFailure, DagHandlerFinally}
+
+// IsTriggered check if the handler should run by the result of main tasks
+func (h DagHandlerType) IsTriggered(mainSucceeded bool) bool {
+	switch h {
+	case DagHandlerOnSuccess:
+		return mainSucceeded
+	case DagHandlerOnFailure:
+		return !mainSucceeded
+	case DagHandlerFinally:
+		return true
+	}
+	return false
+}
+
+// HandlerTasks return the handler tasks of the type
+func (d *Dag) HandlerTasks(h DagHandlerType) []Task {
+	switch h {
+	case DagHandlerOnSuccess:
+		return d.OnSuccess
+	case DagHandlerOnFailure:
+		return d.OnFailure
+	case DagHandlerFinally:
+		return d.Finally
+	}
+	return nil
+}
+
+// TaskList
+type TaskList []Task
+
+func (TaskList) GormDataType() string {
+	return "json"
+}
+
+// 实现 sql.Scanner 接口，Scan 将 value 扫描至 Jsonb
+func (t *TaskList) Scan(value interface{}) error {
+	bytesValue, _ := value.([]byte)
+	return json.Unmarshal(bytesValue, t)
+}
+
+// 实现 driver.Valuer 接口，Value 返回 json value
+func (t TaskList) Value() (driver.Value, error) {
+	return json.Marshal(t)
+}
+
+// CronCatchUpPolicy decide how to handle the cron slots missed by scheduler, default is "skip"
+type CronCatchUpPolicy string
+
+const (
+	// CronCatchUpSkip drop all missed slots, just fire the slot which is on time
+	CronCatchUpSkip CronCatchUpPolicy = "skip"
+	// CronCatchUpOnce fire the latest missed slot only once
+	CronCatchUpOnce CronCatchUpPolicy = "once"
+	// CronCatchUpAll fire every missed slot
+	CronCatchUpAll CronCatchUpPolicy = "all"
+)
+
+// DagSchedule record the cron progress of a dag, it is maintained by leader
+// so that leader failover neither skips nor double-fires a slot
+type DagSchedule struct {
+	// ID is same as the dag's id
+	BaseInfo `bson:"inline"`
+	// LastFiredAt is the unix time of the latest slot which has been fired
+	LastFiredAt int64 `json:"lastFiredAt,omitempty" bson:"lastFiredAt,omitempty"`
 }
 
 // SpecifiedVar
@@ -53,15 +158,53 @@ func (d *Dag) Run(trigger Trigger, specVars map[string]string) (*DagInstance, er
 		}
 	}
 
+	nodeSelector, err := d.mergeNodeSelector()
+	if err != nil {
+		return nil, err
+	}
+
 	return &DagInstance{
-		DagID:     d.ID,
-		Trigger:   trigger,
-		Vars:      dagInsVars,
-		ShareData: &ShareData{},
-		Status:    DagInstanceStatusInit,
+		DagID:          d.ID,
+		Trigger:        trigger,
+		Vars:           dagInsVars,
+		ShareData:      &ShareData{},
+		Status:         DagInstanceStatusInit,
+		NodeSelector:   nodeSelector,
+		MaxActiveRuns:  d.MaxActiveRuns,
+		ConcurrencyKey: dagInsVars.RenderString(d.ConcurrencyKey),
+		Priority:       d.Priority,
+
+		CompensateOnFailure: d.CompensateOnFailure,
 	}, nil
 }
 
+// mergeNodeSelector merge the node selectors of dag and its tasks,
+// all tasks of a dag instance run at the same worker, so the worker must satisfy all of them
+func (d *Dag) mergeNodeSelector() (string, error) {
+	var exprs []string
+	if d.NodeSelector != "" {
+		exprs = append(exprs, d.NodeSelector)
+	}
+	tasks := append([]Task{}, d.Tasks...)
+	for _, h := range DagHandlerTypes {
+		tasks = append(tasks, d.HandlerTasks(h)...)
+	}
+	for i := range tasks {
+		if tasks[i].NodeSelector != "" {
+			exprs = append(exprs, tasks[i].NodeSelector)
+		}
+	}
+	if len(exprs) == 0 {
+		return "", nil
+	}
+
+	selector := strings.Join(exprs, ", ")
+	if _, err := data.PareSelectors(selector); err != nil {
+		return "", fmt.Errorf("node selector is invalid: %w", err)
+	}
+	return selector, nil
+}
+
 type DagVars map[string]DagVar
 
 // DagVar
@@ -109,6 +252,25 @@ type DagInstance struct {
 	Status    DagInstanceStatus `json:"status,omitempty" bson:"status,omitempty" gorm:"type:string"`
 	Reason    string            `json:"reason,omitempty" bson:"reason,omitempty"`
 	Cmd       *Command          `json:"cmd,omitempty" bson:"cmd,omitempty" gorm:"type:json"`
+	// ParentDagInsID and ParentTaskInsID indicate the task instance which runs this dag instance as a sub dag
+	ParentDagInsID  string `json:"parentDagInsId,omitempty" bson:"parentDagInsId,omitempty"`
+	ParentTaskInsID string `json:"parentTaskInsId,omitempty" bson:"parentTaskInsId,omitempty"`
+	// NodeSelector is merged from the dag and its tasks, only the matched workers can run the instance
+	NodeSelector string `json:"nodeSelector,omitempty" bson:"nodeSelector,omitempty"`
+	// MaxActiveRuns is copied from dag, ConcurrencyKey is rendered from the key of dag
+	MaxActiveRuns  int    `json:"maxActiveRuns,omitempty" bson:"maxActiveRuns,omitempty"`
+	ConcurrencyKey string `json:"concurrencyKey,omitempty" bson:"concurrencyKey,omitempty" gorm:"index"`
+	// Priority the higher one is dispatched and executed first
+	Priority int `json:"priority,omitempty" bson:"priority,omitempty"`
+	// HandlerStatus and HandlerReason are the result of the latest handler tasks, they are recorded separately
+	// so that the handlers never change the status of dag instance which is decided by the main tasks
+	HandlerStatus DagInstanceStatus `json:"handlerStatus,omitempty" bson:"handlerStatus,omitempty" gorm:"type:string"`
+	HandlerReason string            `json:"handlerReason,omitempty" bson:"handlerReason,omitempty"`
+	// CompensateOnFailure is copied from dag
+	CompensateOnFailure bool `json:"compensateOnFailure,omitempty" bson:"compensateOnFailure,omitempty"`
+
+	// TaskOutputs get the outputs of task instances by task id, it is set by worker
+	TaskOutputs func() (map[string]StringMap, error) `json:"-" bson:"-" gorm:"-"`
 }
 
 var (
@@ -156,6 +318,10 @@ func (d *ShareData) UnmarshalBSON(data []byte) error {
 
 // MarshalJSON used by json
 func (d *ShareData) MarshalJSON() ([]byte, error) {
+	// marshal to a empty object instead of null, so that it will not be decoded to a nil pointer
+	if d.Dict == nil {
+		return []byte("{}"), nil
+	}
 	return json.Marshal(d.Dict)
 }
 
@@ -179,11 +345,22 @@ func (d *ShareData) Get(key string) (string, bool) {
 	return v, ok
 }
 
+// Delete keys from share data, it is thread-safe.
+func (d *ShareData) Delete(keys ...string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, k := range keys {
+		delete(d.Dict, k)
+	}
+}
+
 // Set value to share data, it is thread-safe.
 func (d *ShareData) Set(key string, val string) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	d.Dict = make(map[string]string)
+	if d.Dict == nil {
+		d.Dict = make(map[string]string)
+	}
 	d.Dict[key] = val
 	if d.Save != nil {
 		if err := d.Save(d); err != nil {
@@ -252,6 +429,74 @@ func (dagIns *DagInstance) VarsGetter() utils.KeyValueGetter {
 	}
 }
 
+// exprEnv build the environment of expression, only the referenced roots are loaded
+func (dagIns *DagInstance) exprEnv(roots []string) (map[string]interface{}, error) {
+	env := map[string]interface{}{}
+	for _, root := range roots {
+		switch root {
+		case exprRootVars:
+			vars := make(map[string]string, len(dagIns.Vars))
+			for k, v := range dagIns.Vars {
+				vars[k] = v.Value
+			}
+			env[root] = vars
+		case exprRootShareData:
+			data := map[string]string{}
+			if dagIns.ShareData != nil {
+				dagIns.ShareData.mutex.Lock()
+				for k, v := range dagIns.ShareData.Dict {
+					data[k] = v
+				}
+				dagIns.ShareData.mutex.Unlock()
+			}
+			env[root] = data
+		case exprRootTasks:
+			tasks := map[string]interface{}{}
+			if dagIns.TaskOutputs != nil {
+				outputs, err := dagIns.TaskOutputs()
+				if err != nil {
+					return nil, fmt.Errorf("get task outputs failed: %w", err)
+				}
+				for taskId, output := range outputs {
+					tasks[taskId] = map[string]interface{}{"outputs": map[string]interface{}(output)}
+				}
+			}
+			env[root] = tasks
+		}
+	}
+	return env, nil
+}
+
+// TaskOutputGetter get the output of task instance by key like `<taskId>.<outputKey>`,
+// the value which is not a string is returned as json
+func (dagIns *DagInstance) TaskOutputGetter() utils.KeyValueGetter {
+	return func(key string) (string, bool) {
+		taskId, outputKey, ok := strings.Cut(key, ".")
+		if !ok || dagIns.TaskOutputs == nil {
+			return "", false
+		}
+		outputs, err := dagIns.TaskOutputs()
+		if err != nil {
+			log.Error("get task outputs failed",
+				"dagInsId", dagIns.ID,
+				"err", err)
+			return "", false
+		}
+		v, ok := outputs[taskId][outputKey]
+		if !ok {
+			return "", false
+		}
+		if s, ok := v.(string); ok {
+			return s, true
+		}
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(bs), true
+	}
+}
+
 // VarsIterator
 func (dagIns *DagInstance) VarsIterator() utils.KeyValueIterator {
 	return func(iterateFunc utils.KeyValueIterateFunc) {
@@ -290,6 +535,117 @@ func (dagIns *DagInstance) Block(reason string) {
 	dagIns.Status = DagInstanceStatusBlocked
 }
 
+// CancelAll cancel all unfinished tasks of the dag instance, it is just set a command, command will execute by Parser,
+// the init dag instance has no task yet, so it is canceled by Dispatcher instead of being dispatched
+func (dagIns *DagInstance) CancelAll() error {
+	switch dagIns.Status {
+	case DagInstanceStatusInit, DagInstanceStatusScheduled, DagInstanceStatusRunning, DagInstanceStatusBlocked, DagInstanceStatusPaused:
+	default:
+		return fmt.Errorf("you can only cancel an init, scheduled, running, blocked or paused dag instance")
+	}
+	return dagIns.setCmd(&Command{Name: CommandNameCancelAll})
+}
+
+// Pause the dag instance, running tasks will continue but no new task will be executed,
+// it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Pause() error {
+	if dagIns.Status != DagInstanceStatusRunning {
+		return fmt.Errorf("you can only pause a running dag instance")
+	}
+	return dagIns.setCmd(&Command{Name: CommandNamePause})
+}
+
+// Resume the paused dag instance, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Resume() error {
+	if dagIns.Status != DagInstanceStatusPaused {
+		return fmt.Errorf("you can only resume a paused dag instance")
+	}
+	return dagIns.setCmd(&Command{Name: CommandNameResume})
+}
+
+func (dagIns *DagInstance) setCmd(cmd *Command) error {
+	if dagIns.Cmd != nil {
+		return fmt.Errorf("dag instance have a incomplete command")
+	}
+	dagIns.Cmd = cmd
+	return nil
+}
+
+// Approve the blocked or waiting tasks, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Approve(taskInsIds []string, operator, comment string) error {
+	return dagIns.setApprovalCmd(CommandNameApprove, taskInsIds, operator, comment)
+}
+
+// Reject the blocked or waiting tasks, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Reject(taskInsIds []string, operator, comment string) error {
+	return dagIns.setApprovalCmd(CommandNameReject, taskInsIds, operator, comment)
+}
+
+func (dagIns *DagInstance) setApprovalCmd(name CommandName, taskInsIds []string, operator, comment string) error {
+	if dagIns.Status != DagInstanceStatusRunning && dagIns.Status != DagInstanceStatusBlocked {
+		return fmt.Errorf("you can only %s tasks of a running or blocked dag instance", name)
+	}
+	return dagIns.setCmd(&Command{
+		Name:             name,
+		TargetTaskInsIDs: taskInsIds,
+		Operator:         operator,
+		Comment:          comment,
+	})
+}
+
+// Skip the tasks so that downstream tasks can continue, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Skip(taskInsIds []string, operator, reason string) error {
+	return dagIns.setForceCmd(CommandNameSkip, taskInsIds, operator, reason)
+}
+
+// MarkSuccess mark the tasks as success, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) MarkSuccess(taskInsIds []string, operator, reason string) error {
+	return dagIns.setForceCmd(CommandNameMarkSuccess, taskInsIds, operator, reason)
+}
+
+// ForceFail fail the tasks, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) ForceFail(taskInsIds []string, operator, reason string) error {
+	return dagIns.setForceCmd(CommandNameForceFail, taskInsIds, operator, reason)
+}
+
+func (dagIns *DagInstance) setForceCmd(name CommandName, taskInsIds []string, operator, reason string) error {
+	switch dagIns.Status {
+	case DagInstanceStatusRunning, DagInstanceStatusBlocked, DagInstanceStatusFailed, DagInstanceStatusPaused:
+	default:
+		return fmt.Errorf("you can only %s tasks of a running, blocked, failed or paused dag instance", name)
+	}
+	return dagIns.setCmd(&Command{
+		Name:             name,
+		TargetTaskInsIDs: taskInsIds,
+		Operator:         operator,
+		Comment:          reason,
+	})
+}
+
+// Rerun a task and its downstream tasks if includeDownstream is true,
+// unlike Retry, it also works for the succeeded tasks and dag instance
+func (dagIns *DagInstance) Rerun(taskInsId string, includeDownstream, clearShareData bool) error {
+	switch dagIns.Status {
+	case DagInstanceStatusSuccess, DagInstanceStatusFailed, DagInstanceStatusBlocked:
+	default:
+		return fmt.Errorf("you can only rerun tasks of a success, failed or blocked dag instance")
+	}
+	return dagIns.setCmd(&Command{
+		Name:              CommandNameRerun,
+		TargetTaskInsIDs:  []string{taskInsId},
+		IncludeDownstream: includeDownstream,
+		ClearShareData:    clearShareData,
+	})
+}
+
+// Compensate undo the succeeded tasks of the failed dag instance, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Compensate() error {
+	if dagIns.Status != DagInstanceStatusFailed {
+		return fmt.Errorf("you can only compensate a failed dag instance")
+	}
+	return dagIns.setCmd(&Command{Name: CommandNameCompensate})
+}
+
 // Retry a task, it is just set a command, command will execute by Parser
 func (dagIns *DagInstance) Retry(taskInsIds []string) error {
 	if dagIns.Cmd != nil {
@@ -318,19 +674,30 @@ func (dagIns *DagInstance) CanModifyStatus() bool {
 // Render variables
 func (vars DagInstanceVars) Render(p map[string]interface{}) (map[string]interface{}, error) {
 	err := value.MapValue(p).WalkString(func(walkContext *value.WalkContext, s string) error {
-		for varKey, varValue := range vars {
-			s = strings.ReplaceAll(s, fmt.Sprintf("{{%s}}", varKey), varValue.Value)
-		}
-		walkContext.Setter(s)
+		walkContext.Setter(vars.RenderString(s))
 		return nil
 	})
 	return p, err
 }
 
+// RenderString replace the "{{key}}" in string with the value of vars
+func (vars DagInstanceVars) RenderString(s string) string {
+	for varKey, varValue := range vars {
+		s = strings.ReplaceAll(s, fmt.Sprintf("{{%s}}", varKey), varValue.Value)
+	}
+	return s
+}
+
 // Command
 type Command struct {
 	Name             CommandName
 	TargetTaskInsIDs []string
+	// Operator and Comment are used by the commands which are performed by operator, such as approve or skip
+	Operator string
+	Comment  string
+	// IncludeDownstream and ClearShareData are used by the rerun command
+	IncludeDownstream bool
+	ClearShareData    bool
 }
 
 func (Command) GormDataType() string {
@@ -352,8 +719,22 @@ func (c Command) Value() (driver.Value, error) {
 type CommandName string
 
 const (
-	CommandNameRetry  = "retry"
-	CommandNameCancel = "cancel"
+	CommandNameRetry   = "retry"
+	CommandNameCancel  = "cancel"
+	CommandNameApprove = "approve"
+	CommandNameReject  = "reject"
+	// CommandNameCancelAll, CommandNamePause and CommandNameResume are applied to the whole dag instance
+	CommandNameCancelAll = "cancelAll"
+	CommandNamePause     = "pause"
+	CommandNameResume    = "resume"
+	// CommandNameSkip, CommandNameMarkSuccess and CommandNameForceFail set the status of tasks manually
+	CommandNameSkip        = "skip"
+	CommandNameMarkSuccess = "markSuccess"
+	CommandNameForceFail   = "forceFail"
+	// CommandNameRerun reset a task and its downstream tasks, then execute them again
+	CommandNameRerun = "rerun"
+	// CommandNameCompensate undo the succeeded tasks in reverse order
+	CommandNameCompensate = "compensate"
 )
 
 // DagInstanceStatus
@@ -364,6 +745,7 @@ const (
 	DagInstanceStatusScheduled DagInstanceStatus = "scheduled"
 	DagInstanceStatusRunning   DagInstanceStatus = "running"
 	DagInstanceStatusBlocked   DagInstanceStatus = "blocked"
+	DagInstanceStatusPaused    DagInstanceStatus = "paused"
 	DagInstanceStatusFailed    DagInstanceStatus = "failed"
 	DagInstanceStatusSuccess   DagInstanceStatus = "success"
 )
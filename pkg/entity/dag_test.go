@@ -6,6 +6,71 @@ import (
 	"testing"
 )
 
+func TestDag_Run(t *testing.T) {
+	tests := []struct {
+		caseDesc           string
+		giveDag            *Dag
+		giveVars           map[string]string
+		wantNodeSelector   string
+		wantConcurrencyKey string
+		wantErr            bool
+	}{
+		{
+			caseDesc: "no selector",
+			giveDag:  &Dag{Status: DagStatusNormal, Tasks: []Task{{ID: "task1"}}},
+		},
+		{
+			caseDesc: "merge dag and tasks",
+			giveDag: &Dag{
+				Status:       DagStatusNormal,
+				NodeSelector: "zone=a",
+				Tasks:        []Task{{ID: "task1", NodeSelector: "os in (linux,darwin)"}, {ID: "task2"}},
+			},
+			wantNodeSelector: "zone=a, os in (linux,darwin)",
+		},
+		{
+			caseDesc: "concurrency key",
+			giveDag: &Dag{
+				Status:         DagStatusNormal,
+				Vars:           DagVars{"cluster": {DefaultValue: "default"}},
+				MaxActiveRuns:  1,
+				ConcurrencyKey: "upgrade-{{cluster}}",
+				Priority:       5,
+			},
+			giveVars:           map[string]string{"cluster": "a"},
+			wantConcurrencyKey: "upgrade-a",
+		},
+		{
+			caseDesc: "invalid selector",
+			giveDag: &Dag{
+				Status: DagStatusNormal,
+				Tasks:  []Task{{ID: "task1", NodeSelector: "zone>a"}},
+			},
+			wantErr: true,
+		},
+		{
+			caseDesc: "stopped dag",
+			giveDag:  &Dag{Status: DagStatusStopped},
+			wantErr:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			dagIns, err := tc.giveDag.Run(TriggerManually, tc.giveVars)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, DagInstanceStatusInit, dagIns.Status)
+			assert.Equal(t, tc.wantNodeSelector, dagIns.NodeSelector)
+			assert.Equal(t, tc.giveDag.MaxActiveRuns, dagIns.MaxActiveRuns)
+			assert.Equal(t, tc.wantConcurrencyKey, dagIns.ConcurrencyKey)
+			assert.Equal(t, tc.giveDag.Priority, dagIns.Priority)
+		})
+	}
+}
+
 func TestDagInstance_VarsIterator(t *testing.T) {
 	dagIns := &DagInstance{
 		Vars: DagInstanceVars{
@@ -101,6 +166,225 @@ func TestDagInstance_Retry(t *testing.T) {
 	})
 }
 
+func TestDagInstance_Approve(t *testing.T) {
+	tests := []struct {
+		caseDesc   string
+		giveDagIns *DagInstance
+		giveReject bool
+		wantCmd    *Command
+		wantErr    error
+	}{
+		{
+			caseDesc:   "approve blocked",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusBlocked},
+			wantCmd: &Command{
+				Name:             CommandNameApprove,
+				TargetTaskInsIDs: []string{"task1"},
+				Operator:         "ops",
+				Comment:          "lgtm",
+			},
+		},
+		{
+			caseDesc:   "reject running",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusRunning},
+			giveReject: true,
+			wantCmd: &Command{
+				Name:             CommandNameReject,
+				TargetTaskInsIDs: []string{"task1"},
+				Operator:         "ops",
+				Comment:          "lgtm",
+			},
+		},
+		{
+			caseDesc:   "failed dag instance",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusFailed},
+			wantErr:    fmt.Errorf("you can only approve tasks of a running or blocked dag instance"),
+		},
+		{
+			caseDesc: "incomplete command",
+			giveDagIns: &DagInstance{
+				Status: DagInstanceStatusRunning,
+				Cmd:    &Command{Name: CommandNameRetry},
+			},
+			wantErr: fmt.Errorf("dag instance have a incomplete command"),
+			wantCmd: &Command{Name: CommandNameRetry},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var err error
+			if tc.giveReject {
+				err = tc.giveDagIns.Reject([]string{"task1"}, "ops", "lgtm")
+			} else {
+				err = tc.giveDagIns.Approve([]string{"task1"}, "ops", "lgtm")
+			}
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantCmd, tc.giveDagIns.Cmd)
+		})
+	}
+}
+
+func TestDagInstance_CancelAll(t *testing.T) {
+	tests := []struct {
+		caseDesc   string
+		giveDagIns *DagInstance
+		wantCmd    *Command
+		wantErr    error
+	}{
+		{
+			caseDesc:   "running",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusRunning},
+			wantCmd:    &Command{Name: CommandNameCancelAll},
+		},
+		{
+			caseDesc:   "paused",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusPaused},
+			wantCmd:    &Command{Name: CommandNameCancelAll},
+		},
+		{
+			caseDesc:   "init",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusInit},
+			wantCmd:    &Command{Name: CommandNameCancelAll},
+		},
+		{
+			caseDesc:   "finished",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusSuccess},
+			wantErr:    fmt.Errorf("you can only cancel an init, scheduled, running, blocked or paused dag instance"),
+		},
+		{
+			caseDesc:   "incomplete command",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusRunning, Cmd: &Command{Name: CommandNameRetry}},
+			wantCmd:    &Command{Name: CommandNameRetry},
+			wantErr:    fmt.Errorf("dag instance have a incomplete command"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			err := tc.giveDagIns.CancelAll()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantCmd, tc.giveDagIns.Cmd)
+		})
+	}
+}
+
+func TestDagInstance_Pause(t *testing.T) {
+	dagIns := &DagInstance{Status: DagInstanceStatusRunning}
+	assert.NoError(t, dagIns.Pause())
+	assert.Equal(t, &Command{Name: CommandNamePause}, dagIns.Cmd)
+
+	dagIns = &DagInstance{Status: DagInstanceStatusBlocked}
+	assert.Equal(t, fmt.Errorf("you can only pause a running dag instance"), dagIns.Pause())
+	assert.Nil(t, dagIns.Cmd)
+}
+
+func TestDagInstance_Resume(t *testing.T) {
+	dagIns := &DagInstance{Status: DagInstanceStatusPaused}
+	assert.NoError(t, dagIns.Resume())
+	assert.Equal(t, &Command{Name: CommandNameResume}, dagIns.Cmd)
+
+	dagIns = &DagInstance{Status: DagInstanceStatusRunning}
+	assert.Equal(t, fmt.Errorf("you can only resume a paused dag instance"), dagIns.Resume())
+	assert.Nil(t, dagIns.Cmd)
+}
+
+func TestDagInstance_Compensate(t *testing.T) {
+	dagIns := &DagInstance{Status: DagInstanceStatusFailed}
+	assert.NoError(t, dagIns.Compensate())
+	assert.Equal(t, &Command{Name: CommandNameCompensate}, dagIns.Cmd)
+
+	dagIns = &DagInstance{Status: DagInstanceStatusRunning}
+	assert.Equal(t, fmt.Errorf("you can only compensate a failed dag instance"), dagIns.Compensate())
+	assert.Nil(t, dagIns.Cmd)
+}
+
+func TestDagInstance_Skip(t *testing.T) {
+	tests := []struct {
+		caseDesc   string
+		giveDagIns *DagInstance
+		giveCall   func(dagIns *DagInstance) error
+		wantCmd    *Command
+		wantErr    error
+	}{
+		{
+			caseDesc:   "skip",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusBlocked},
+			giveCall: func(dagIns *DagInstance) error {
+				return dagIns.Skip([]string{"task1"}, "ops", "done by hand")
+			},
+			wantCmd: &Command{Name: CommandNameSkip, TargetTaskInsIDs: []string{"task1"}, Operator: "ops", Comment: "done by hand"},
+		},
+		{
+			caseDesc:   "mark success",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusFailed},
+			giveCall: func(dagIns *DagInstance) error {
+				return dagIns.MarkSuccess([]string{"task1"}, "ops", "done by hand")
+			},
+			wantCmd: &Command{Name: CommandNameMarkSuccess, TargetTaskInsIDs: []string{"task1"}, Operator: "ops", Comment: "done by hand"},
+		},
+		{
+			caseDesc:   "force fail",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusRunning},
+			giveCall: func(dagIns *DagInstance) error {
+				return dagIns.ForceFail([]string{"task1"}, "ops", "broken")
+			},
+			wantCmd: &Command{Name: CommandNameForceFail, TargetTaskInsIDs: []string{"task1"}, Operator: "ops", Comment: "broken"},
+		},
+		{
+			caseDesc:   "finished dag instance",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusSuccess},
+			giveCall: func(dagIns *DagInstance) error {
+				return dagIns.Skip([]string{"task1"}, "ops", "")
+			},
+			wantErr: fmt.Errorf("you can only skip tasks of a running, blocked, failed or paused dag instance"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			err := tc.giveCall(tc.giveDagIns)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantCmd, tc.giveDagIns.Cmd)
+		})
+	}
+}
+
+func TestDagInstance_Rerun(t *testing.T) {
+	tests := []struct {
+		caseDesc   string
+		giveDagIns *DagInstance
+		wantCmd    *Command
+		wantErr    error
+	}{
+		{
+			caseDesc:   "success dag instance",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusSuccess},
+			wantCmd: &Command{
+				Name:              CommandNameRerun,
+				TargetTaskInsIDs:  []string{"task1"},
+				IncludeDownstream: true,
+				ClearShareData:    true,
+			},
+		},
+		{
+			caseDesc:   "running dag instance",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusRunning},
+			wantErr:    fmt.Errorf("you can only rerun tasks of a success, failed or blocked dag instance"),
+		},
+		{
+			caseDesc:   "incomplete command",
+			giveDagIns: &DagInstance{Status: DagInstanceStatusFailed, Cmd: &Command{Name: CommandNameRetry}},
+			wantCmd:    &Command{Name: CommandNameRetry},
+			wantErr:    fmt.Errorf("dag instance have a incomplete command"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			err := tc.giveDagIns.Rerun("task1", true, true)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantCmd, tc.giveDagIns.Cmd)
+		})
+	}
+}
+
 func TestDagInstance_Block(t *testing.T) {
 	dagIns := &DagInstance{}
 	testHook(t, dagIns, string(DagInstanceStatusBlocked), DagInstanceStatusBlocked, func() {
@@ -250,6 +534,27 @@ func TestShareData_Set(t *testing.T) {
 			wantErr: fmt.Errorf("save failed"),
 			wantRet: map[string]string{},
 		},
+		{
+			giveData: &ShareData{
+				Dict: map[string]string{
+					"exist": "value",
+				},
+			},
+			giveKey:   "key",
+			giveValue: "value",
+			wantRet: map[string]string{
+				"exist": "value",
+				"key":   "value",
+			},
+		},
+		{
+			giveData:  &ShareData{},
+			giveKey:   "key",
+			giveValue: "value",
+			wantRet: map[string]string{
+				"key": "value",
+			},
+		},
 	}
 
 	for _, tc := range tests {
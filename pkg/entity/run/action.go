@@ -35,10 +35,92 @@ type RetryBeforeAction interface {
 	RetryBefore(ctx ExecuteContext, params interface{}) error
 }
 
+// BranchAction choose the downstream paths, it is called after Run succeeded and return the task ids
+// of the children which are selected, the others and their exclusive descendants will be skipped
+type BranchAction interface {
+	SelectBranches(ctx ExecuteContext, params interface{}) ([]string, error)
+}
+
+// CompensateAction undo the succeeded action, it is called in reverse topological order
+// when the dag instance is compensated
+type CompensateAction interface {
+	Compensate(ctx ExecuteContext, params interface{}) error
+}
+
+// FailoverPolicy indicate how to handle the running task instance when its worker is dead
+type FailoverPolicy string
+
+const (
+	// FailoverPolicyFail fail the task instance, it is the default policy
+	// because most of actions can not be executed twice safely
+	FailoverPolicyFail FailoverPolicy = "fail"
+	// FailoverPolicyRerun execute the action again from RunBefore
+	FailoverPolicyRerun FailoverPolicy = "rerun"
+	// FailoverPolicyResume skip Run and continue with RunAfter,
+	// it is suitable for the action which submits a job in Run and waits for it in RunAfter
+	FailoverPolicyResume FailoverPolicy = "resume"
+)
+
+// FailoverAction indicate how the task instance should be handled when its worker is dead
+type FailoverAction interface {
+	FailoverPolicy() FailoverPolicy
+}
+
+// FailoverPolicyOf return the failover policy of action
+func FailoverPolicyOf(act Action) FailoverPolicy {
+	if fAct, ok := act.(FailoverAction); ok {
+		return fAct.FailoverPolicy()
+	}
+	return FailoverPolicyFail
+}
+
 var (
 	EndLoop = errors.New("end loop")
 )
 
+const (
+	// ErrorClassDefault is the class of errors which are not classified
+	ErrorClassDefault = "error"
+	// ErrorClassTimeout is the class of errors caused by task timeout
+	ErrorClassTimeout = "timeout"
+	// ErrorClassRejected is the class of errors caused by a rejection, such as a rejected approval,
+	// the task instance failed with it is never retried automatically
+	ErrorClassRejected = "rejected"
+)
+
+// ClassifiedError is an error with class, retry policy of task use it to decide whether to retry
+type ClassifiedError struct {
+	Class string
+	Err   error
+}
+
+// NewClassifiedError wrap err with class, action can return it to indicate the class of error
+func NewClassifiedError(class string, err error) error {
+	return &ClassifiedError{Class: class, Err: err}
+}
+
+// Error
+func (e *ClassifiedError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClassOf return the class of err
+func ErrorClassOf(err error) string {
+	var cErr *ClassifiedError
+	if errors.As(err, &cErr) {
+		return cErr.Class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	return ErrorClassDefault
+}
+
 type LoopDoOptionOp func(loop *LoopDoOption)
 
 // LoopInterval indicate the interval of loop
@@ -15,6 +15,7 @@ func NewDefExecuteContext(
 	trace func(msg string, opt ...TraceOp),
 	dagVars utils.KeyValueGetter,
 	varsIterator utils.KeyValueIterator,
+	setOutput func(key string, value interface{}) error,
 ) *DefExecuteContext {
 	return &DefExecuteContext{
 		ctx:          ctx,
@@ -22,6 +23,7 @@ func NewDefExecuteContext(
 		trace:        trace,
 		varsGetter:   dagVars,
 		varsIterator: varsIterator,
+		setOutput:    setOutput,
 	}
 }
 
@@ -45,6 +47,9 @@ type ExecuteContext interface {
 	Tracef(msg string, a ...interface{})
 	GetVar(varName string) (string, bool)
 	IterateVars(iterateFunc utils.KeyValueIterateFunc)
+	// SetOutput save the output of the task instance, the value must can be marshaled to json,
+	// downstream tasks can reference it by `{{ .tasks.<taskId>.outputs.<key> }}`
+	SetOutput(key string, value interface{}) error
 }
 
 // ShareDataOperator used to operate share data
@@ -62,6 +67,7 @@ type DefExecuteContext struct {
 	trace        func(msg string, opt ...TraceOp)
 	varsGetter   func(string) (string, bool)
 	varsIterator utils.KeyValueIterator
+	setOutput    func(key string, value interface{}) error
 }
 
 // Context
@@ -127,6 +133,30 @@ func (e *DefExecuteContext) IterateVars(iterateFunc utils.KeyValueIterateFunc) {
 	e.varsIterator(iterateFunc)
 }
 
+// SetOutput save the output of the task instance
+func (e *DefExecuteContext) SetOutput(key string, value interface{}) error {
+	return e.setOutput(key, value)
+}
+
+type taskInsInfoKey struct{}
+
+// TaskInsInfo indicate the task instance which is running the action
+type TaskInsInfo struct {
+	DagInsID  string
+	TaskInsID string
+}
+
+// WithTaskInsInfo attach the info of running task instance to ctx
+func WithTaskInsInfo(ctx context.Context, info TaskInsInfo) context.Context {
+	return context.WithValue(ctx, taskInsInfoKey{}, info)
+}
+
+// TaskInsInfoFromContext get the info of running task instance from ctx
+func TaskInsInfoFromContext(ctx context.Context) (TaskInsInfo, bool) {
+	info, ok := ctx.Value(taskInsInfoKey{}).(TaskInsInfo)
+	return info, ok
+}
+
 // TraceOption
 type TraceOption struct {
 	Priority PersistPriority
@@ -56,6 +56,20 @@ func (_m *MockExecuteContext) IterateVars(iterateFunc utils.KeyValueIterateFunc)
 	_m.Called(iterateFunc)
 }
 
+// SetOutput provides a mock function with given fields: key, value
+func (_m *MockExecuteContext) SetOutput(key string, value interface{}) error {
+	ret := _m.Called(key, value)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, interface{}) error); ok {
+		r0 = rf(key, value)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // ShareData provides a mock function with given fields:
 func (_m *MockExecuteContext) ShareData() ShareDataOperator {
 	ret := _m.Called()
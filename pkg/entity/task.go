@@ -4,24 +4,37 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"runtime"
 	"time"
 
 	"github.com/linclin/fastflow/pkg/entity/run"
 	"github.com/linclin/fastflow/pkg/log"
 	"github.com/linclin/fastflow/pkg/utils"
+	"github.com/linclin/fastflow/pkg/utils/expr"
 )
 
 // Task
 type Task struct {
-	ID          string      `yaml:"id,omitempty" json:"id,omitempty"  bson:"id,omitempty" gorm:"primarykey"`
-	Name        string      `yaml:"name,omitempty" json:"name,omitempty"  bson:"name,omitempty"`
-	DagID       string      `yaml:"dagId,omitempty" json:"dagId,omitempty"  bson:"dagId,omitempty"`
-	DependOn    StringArray `yaml:"dependOn,omitempty" json:"dependOn,omitempty"  bson:"dependOn,omitempty" gorm:"type:json"`
-	ActionName  string      `yaml:"actionName,omitempty" json:"actionName,omitempty"  bson:"actionName,omitempty"`
-	TimeoutSecs int         `yaml:"timeoutSecs,omitempty" json:"timeoutSecs,omitempty"  bson:"timeoutSecs,omitempty"`
-	Params      StringMap   `yaml:"params,omitempty" json:"params,omitempty"  bson:"params,omitempty" gorm:"type:json"`
-	PreChecks   PreChecks   `yaml:"preCheck,omitempty" json:"preCheck,omitempty"  bson:"preCheck,omitempty" gorm:"type:json"`
+	ID          string       `yaml:"id,omitempty" json:"id,omitempty"  bson:"id,omitempty" gorm:"primarykey"`
+	Name        string       `yaml:"name,omitempty" json:"name,omitempty"  bson:"name,omitempty"`
+	DagID       string       `yaml:"dagId,omitempty" json:"dagId,omitempty"  bson:"dagId,omitempty"`
+	DependOn    StringArray  `yaml:"dependOn,omitempty" json:"dependOn,omitempty"  bson:"dependOn,omitempty" gorm:"type:json"`
+	ActionName  string       `yaml:"actionName,omitempty" json:"actionName,omitempty"  bson:"actionName,omitempty"`
+	TimeoutSecs int          `yaml:"timeoutSecs,omitempty" json:"timeoutSecs,omitempty"  bson:"timeoutSecs,omitempty"`
+	Params      StringMap    `yaml:"params,omitempty" json:"params,omitempty"  bson:"params,omitempty" gorm:"type:json"`
+	PreChecks   PreChecks    `yaml:"preCheck,omitempty" json:"preCheck,omitempty"  bson:"preCheck,omitempty" gorm:"type:json"`
+	RetryPolicy *RetryPolicy `yaml:"retry,omitempty" json:"retry,omitempty"  bson:"retry,omitempty" gorm:"type:json"`
+	TriggerRule TriggerRule  `yaml:"triggerRule,omitempty" json:"triggerRule,omitempty"  bson:"triggerRule,omitempty"`
+	Foreach     *Foreach     `yaml:"foreach,omitempty" json:"foreach,omitempty"  bson:"foreach,omitempty" gorm:"type:json"`
+	// NodeSelector is merged into the dag's, because all tasks of a dag instance run at the same worker
+	NodeSelector string `yaml:"nodeSelector,omitempty" json:"nodeSelector,omitempty"  bson:"nodeSelector,omitempty"`
+	// Pool is the name of resource pool, the task runs only after it acquires PoolSlots slots of the pool,
+	// zero PoolSlots means one slot
+	Pool      string `yaml:"pool,omitempty" json:"pool,omitempty"  bson:"pool,omitempty"`
+	PoolSlots int    `yaml:"poolSlots,omitempty" json:"poolSlots,omitempty"  bson:"poolSlots,omitempty"`
+	// Compensate define how to undo the task when the dag instance is compensated
+	Compensate *Compensate `yaml:"compensate,omitempty" json:"compensate,omitempty"  bson:"compensate,omitempty" gorm:"type:json"`
 }
 
 // GetGraphID
@@ -44,6 +57,177 @@ func (t *Task) GetStatus() TaskInstanceStatus {
 	return ""
 }
 
+// GetTriggerRule
+func (t *Task) GetTriggerRule() TriggerRule {
+	return t.TriggerRule
+}
+
+// GetForeach
+func (t *Task) GetForeach() *Foreach {
+	return t.Foreach
+}
+
+// GetMappedFrom
+func (t *Task) GetMappedFrom() string {
+	return ""
+}
+
+// GetPreChecks
+func (t *Task) GetPreChecks() PreChecks {
+	return t.PreChecks
+}
+
+// TriggerRule indicate how the status of upstream tasks trigger the task
+type TriggerRule string
+
+const (
+	// all upstream tasks succeeded or skipped, it is the default rule
+	TriggerRuleAllSuccess TriggerRule = "all_success"
+	// all upstream tasks failed or canceled, the skipped ones are ignored
+	TriggerRuleAllFailed TriggerRule = "all_failed"
+	// all upstream tasks completed, no matter succeeded or failed
+	TriggerRuleAllDone TriggerRule = "all_done"
+	// at least one upstream task succeeded, the skipped ones are not regarded as succeeded,
+	// it does not wait for other upstream tasks
+	TriggerRuleOneSuccess TriggerRule = "one_success"
+	// at least one upstream task failed, it does not wait for other upstream tasks
+	TriggerRuleOneFailed TriggerRule = "one_failed"
+	// all upstream tasks completed and none of them failed, the upstream tasks which are not triggered are allowed
+	TriggerRuleNoneFailed TriggerRule = "none_failed"
+)
+
+// IsValid
+func (r TriggerRule) IsValid() bool {
+	switch r {
+	case "", TriggerRuleAllSuccess, TriggerRuleAllFailed, TriggerRuleAllDone,
+		TriggerRuleOneSuccess, TriggerRuleOneFailed, TriggerRuleNoneFailed:
+		return true
+	}
+	return false
+}
+
+// HandleUpstreamFailure return if the failure of upstream tasks is regarded as handled when the task is triggered,
+// so that the failure will not fail the dag instance
+func (r TriggerRule) HandleUpstreamFailure() bool {
+	return r == TriggerRuleOneSuccess || r == TriggerRuleOneFailed || r == TriggerRuleAllFailed
+}
+
+// Foreach indicate the task should be expanded to mapped tasks, one for each item of a json list
+type Foreach struct {
+	Source TaskConditionSource `yaml:"source,omitempty" json:"source,omitempty"  bson:"source,omitempty"`
+	Key    string              `yaml:"key,omitempty" json:"key,omitempty"  bson:"key,omitempty"`
+	// MaxParallel is the max count of mapped tasks running at the same time, zero means no limit
+	MaxParallel int `yaml:"maxParallel,omitempty" json:"maxParallel,omitempty"  bson:"maxParallel,omitempty"`
+}
+
+// Validate
+func (f *Foreach) Validate() error {
+	switch f.Source {
+	case TaskConditionSourceVars, TaskConditionSourceShareData, TaskConditionSourceTaskOutput:
+	default:
+		return fmt.Errorf("foreach source %s is not valid", f.Source)
+	}
+	if f.Key == "" {
+		return fmt.Errorf("foreach key cannot be empty")
+	}
+	if f.MaxParallel < 0 {
+		return fmt.Errorf("foreach max parallel cannot be negative")
+	}
+	return nil
+}
+
+// Items return the items of the list which task is mapped over
+func (f *Foreach) Items(dagIns *DagInstance) ([]interface{}, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	if f.Source == TaskConditionSourceShareData && dagIns.ShareData == nil {
+		return nil, fmt.Errorf("foreach key[%s] is not found in %s", f.Key, f.Source)
+	}
+	kvGetter, err := f.Source.BuildKvGetter(dagIns)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := kvGetter(f.Key)
+	if !ok {
+		return nil, fmt.Errorf("foreach key[%s] is not found in %s", f.Key, f.Source)
+	}
+	var items []interface{}
+	if err := json.Unmarshal([]byte(v), &items); err != nil {
+		return nil, fmt.Errorf("foreach key[%s] is not a json list: %w", f.Key, err)
+	}
+	return items, nil
+}
+
+// 实现 sql.Scanner 接口，Scan 将 value 扫描至 Jsonb
+func (f *Foreach) Scan(value interface{}) error {
+	bytesValue, _ := value.([]byte)
+	return json.Unmarshal(bytesValue, f)
+}
+
+// 实现 driver.Valuer 接口，Value 返回 json value
+func (f Foreach) Value() (driver.Value, error) {
+	return json.Marshal(f)
+}
+
+type BackoffType string
+
+const (
+	BackoffTypeFixed       BackoffType = "fixed"
+	BackoffTypeExponential BackoffType = "exponential"
+)
+
+// RetryPolicy indicate how to retry a failed task instance automatically
+type RetryPolicy struct {
+	// MaxAttempts is the max count of attempts, include the first one
+	MaxAttempts     int         `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"  bson:"maxAttempts,omitempty"`
+	Backoff         BackoffType `yaml:"backoff,omitempty" json:"backoff,omitempty"  bson:"backoff,omitempty"`
+	IntervalSecs    int         `yaml:"intervalSecs,omitempty" json:"intervalSecs,omitempty"  bson:"intervalSecs,omitempty"`
+	MaxIntervalSecs int         `yaml:"maxIntervalSecs,omitempty" json:"maxIntervalSecs,omitempty"  bson:"maxIntervalSecs,omitempty"`
+	// Jitter is the ratio(0-1) of random deviation applied to interval
+	Jitter float64 `yaml:"jitter,omitempty" json:"jitter,omitempty"  bson:"jitter,omitempty"`
+	// RetryableErrors is the classes of error which can be retried, empty means all errors
+	RetryableErrors []string `yaml:"retryableErrors,omitempty" json:"retryableErrors,omitempty"  bson:"retryableErrors,omitempty"`
+}
+
+// CanRetry return if the task can be retried after the attempt failed with err
+func (p *RetryPolicy) CanRetry(attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	if len(p.RetryableErrors) == 0 {
+		return true
+	}
+	return isStrInArray(run.ErrorClassOf(err), p.RetryableErrors)
+}
+
+// NextInterval return the interval to wait before next attempt after the attempt failed
+func (p *RetryPolicy) NextInterval(attempt int) time.Duration {
+	interval := time.Duration(p.IntervalSecs) * time.Second
+	if p.Backoff == BackoffTypeExponential && attempt > 1 {
+		interval = interval << (attempt - 1)
+	}
+	maxInterval := time.Duration(p.MaxIntervalSecs) * time.Second
+	if maxInterval > 0 && (interval > maxInterval || interval < 0) {
+		interval = maxInterval
+	}
+	if p.Jitter > 0 {
+		interval += time.Duration(float64(interval) * p.Jitter * (rand.Float64()*2 - 1))
+	}
+	return interval
+}
+
+// 实现 sql.Scanner 接口，Scan 将 value 扫描至 Jsonb
+func (p *RetryPolicy) Scan(value interface{}) error {
+	bytesValue, _ := value.([]byte)
+	return json.Unmarshal(bytesValue, p)
+}
+
+// 实现 driver.Valuer 接口，Value 返回 json value
+func (p RetryPolicy) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
 type PreChecks map[string]*Check
 
 func (PreChecks) GormDataType() string {
@@ -61,20 +245,91 @@ func (c PreChecks) Value() (driver.Value, error) {
 	return json.Marshal(c)
 }
 
-// Check
+// Validate validate the pre-checks of task
+func (c PreChecks) Validate() error {
+	for k, check := range c {
+		if check == nil {
+			return fmt.Errorf("pre-check[%s] cannot be empty", k)
+		}
+		if err := check.Validate(); err != nil {
+			return fmt.Errorf("pre-check[%s] is invalid: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// Check is meet when all conditions and the expression are meet
 type Check struct {
 	Conditions []TaskCondition `yaml:"conditions,omitempty" json:"conditions,omitempty"  bson:"conditions,omitempty"`
-	Act        ActiveAction    `yaml:"act,omitempty" json:"act,omitempty"  bson:"act,omitempty"`
+	// Expr is an expression which can reference `vars`, `shareData` and `tasks`, such as
+	// `vars.replicas > 3 && vars.env != "prod"`, see package expr for the syntax
+	Expr string       `yaml:"expr,omitempty" json:"expr,omitempty"  bson:"expr,omitempty"`
+	Act  ActiveAction `yaml:"act,omitempty" json:"act,omitempty"  bson:"act,omitempty"`
+}
+
+// Validate
+func (c *Check) Validate() error {
+	switch c.Act {
+	case ActiveActionSkip, ActiveActionBlock:
+	default:
+		return fmt.Errorf("act %s is not valid", c.Act)
+	}
+	for i := range c.Conditions {
+		if err := c.Conditions[i].Validate(); err != nil {
+			return fmt.Errorf("condition[%d] is invalid: %w", i, err)
+		}
+	}
+	if c.Expr != "" {
+		if _, err := compileCheckExpr(c.Expr); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // IsMeet return if check is meet
-func (c *Check) IsMeet(dagIns *DagInstance) bool {
+func (c *Check) IsMeet(dagIns *DagInstance) (bool, error) {
 	for _, cd := range c.Conditions {
-		if !cd.IsMeet(dagIns) {
-			return false
+		meet, err := cd.IsMeet(dagIns)
+		if err != nil || !meet {
+			return false, err
 		}
 	}
-	return true
+	if c.Expr == "" {
+		return true, nil
+	}
+
+	e, err := compileCheckExpr(c.Expr)
+	if err != nil {
+		return false, err
+	}
+	env, err := dagIns.exprEnv(e.Roots())
+	if err != nil {
+		return false, err
+	}
+	return e.EvalBool(env)
+}
+
+// exprRoots are the identifiers which can be referenced by expression of check
+var exprRoots = []string{exprRootVars, exprRootShareData, exprRootTasks}
+
+const (
+	exprRootVars      = "vars"
+	exprRootShareData = "shareData"
+	exprRootTasks     = "tasks"
+)
+
+func compileCheckExpr(src string) (*expr.Expression, error) {
+	e, err := expr.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range e.Roots() {
+		if !isStrInArray(root, exprRoots) {
+			return nil, fmt.Errorf("expression[%s] references unknown identifier %s, it can only be one of %v", src, root, exprRoots)
+		}
+	}
+	return e, nil
 }
 
 type ActiveAction string
@@ -98,17 +353,34 @@ type TaskConditionSource string
 const (
 	TaskConditionSourceVars      TaskConditionSource = "vars"
 	TaskConditionSourceShareData TaskConditionSource = "share-data"
+	// TaskConditionSourceTaskOutput the key is like `<taskId>.<outputKey>`
+	TaskConditionSourceTaskOutput TaskConditionSource = "task-output"
 )
 
+// Validate
+func (t TaskConditionSource) Validate() error {
+	switch t {
+	case TaskConditionSourceVars, TaskConditionSourceShareData, TaskConditionSourceTaskOutput:
+		return nil
+	default:
+		return fmt.Errorf("task condition source %s is not valid", t)
+	}
+}
+
 // BuildKvGetter
-func (t TaskConditionSource) BuildKvGetter(dagIns *DagInstance) utils.KeyValueGetter {
+func (t TaskConditionSource) BuildKvGetter(dagIns *DagInstance) (utils.KeyValueGetter, error) {
 	switch t {
 	case TaskConditionSourceVars:
-		return dagIns.VarsGetter()
+		return dagIns.VarsGetter(), nil
 	case TaskConditionSourceShareData:
-		return dagIns.ShareData.Get
+		if dagIns.ShareData == nil {
+			return func(string) (string, bool) { return "", false }, nil
+		}
+		return dagIns.ShareData.Get, nil
+	case TaskConditionSourceTaskOutput:
+		return dagIns.TaskOutputGetter(), nil
 	default:
-		panic(fmt.Sprintf("task condition source %s is not valid", t))
+		return nil, t.Validate()
 	}
 }
 
@@ -120,22 +392,41 @@ type TaskCondition struct {
 	Op     Operator            `yaml:"op,omitempty" json:"op,omitempty"  bson:"op,omitempty"`
 }
 
+// Validate
+func (c *TaskCondition) Validate() error {
+	if err := c.Source.Validate(); err != nil {
+		return err
+	}
+	if c.Key == "" {
+		return fmt.Errorf("task condition key cannot be empty")
+	}
+	switch c.Op {
+	case OperatorIn, OperatorNotIn:
+		return nil
+	default:
+		return fmt.Errorf("task condition op %s is not valid", c.Op)
+	}
+}
+
 // IsMeet return if check is meet
-func (c *TaskCondition) IsMeet(dagIns *DagInstance) bool {
-	kvGetter := c.Source.BuildKvGetter(dagIns)
+func (c *TaskCondition) IsMeet(dagIns *DagInstance) (bool, error) {
+	kvGetter, err := c.Source.BuildKvGetter(dagIns)
+	if err != nil {
+		return false, err
+	}
 
 	v, ok := kvGetter(c.Key)
 	if !ok {
-		return false
+		return false, nil
 	}
 
 	switch c.Op {
 	case OperatorIn:
-		return isStrInArray(v, c.Values)
+		return isStrInArray(v, c.Values), nil
 	case OperatorNotIn:
-		return !isStrInArray(v, c.Values)
+		return !isStrInArray(v, c.Values), nil
 	}
-	return false
+	return false, fmt.Errorf("task condition op %s is not valid", c.Op)
 }
 
 func isStrInArray(str string, arr []string) bool {
@@ -163,6 +454,30 @@ type TaskInstance struct {
 	Status      TaskInstanceStatus `json:"status,omitempty" bson:"status,omitempty" gorm:"type:string"`
 	Reason      string             `json:"reason,omitempty" bson:"reason,omitempty" gorm:"type:text"`
 	PreChecks   PreChecks          `json:"preChecks,omitempty"  bson:"preChecks,omitempty" gorm:"type:json"`
+	RetryPolicy *RetryPolicy       `json:"retry,omitempty"  bson:"retry,omitempty" gorm:"type:json"`
+	TriggerRule TriggerRule        `json:"triggerRule,omitempty" bson:"triggerRule,omitempty" gorm:"type:string"`
+	Foreach     *Foreach           `json:"foreach,omitempty" bson:"foreach,omitempty" gorm:"type:json"`
+	MappedFrom  string             `json:"mappedFrom,omitempty" bson:"mappedFrom,omitempty"`
+	MapIndex    int                `json:"mapIndex,omitempty" bson:"mapIndex,omitempty"`
+	MapItem     string             `json:"mapItem,omitempty" bson:"mapItem,omitempty" gorm:"type:text"`
+	Attempts    int                `json:"attempts,omitempty" bson:"attempts,omitempty"`
+	NextRetryAt int64              `json:"nextRetryAt,omitempty" bson:"nextRetryAt,omitempty"`
+	Approval    *Approval          `json:"approval,omitempty" bson:"approval,omitempty" gorm:"type:json"`
+	// ShareDataKeys are the keys of share data which are written by the task instance
+	ShareDataKeys StringArray      `json:"shareDataKeys,omitempty" bson:"shareDataKeys,omitempty" gorm:"type:json"`
+	History       TaskInsHistories `json:"history,omitempty" bson:"history,omitempty" gorm:"type:json"`
+	Pool          string           `json:"pool,omitempty" bson:"pool,omitempty"`
+	PoolSlots     int              `json:"poolSlots,omitempty" bson:"poolSlots,omitempty"`
+	// Outputs are set by action, the values are decoded from json
+	Outputs StringMap `json:"outputs,omitempty" bson:"outputs,omitempty" gorm:"type:json"`
+	// SelectedBranches are the children selected by branch action, it is nil if the action is not a branch
+	SelectedBranches StringArray `json:"selectedBranches,omitempty" bson:"selectedBranches,omitempty" gorm:"type:json"`
+	// Handler is not empty if the task instance is a handler task of dag, it is not a part of the main tasks
+	Handler DagHandlerType `json:"handler,omitempty" bson:"handler,omitempty" gorm:"type:string"`
+
+	// Compensate is copied from the task, Compensation is the result of undoing the task instance
+	Compensate   *Compensate   `json:"compensate,omitempty" bson:"compensate,omitempty" gorm:"type:json"`
+	Compensation *Compensation `json:"compensation,omitempty" bson:"compensation,omitempty" gorm:"type:json"`
 
 	// used to save changes
 	Patch              func(*TaskInstance) error `json:"-" bson:"-" gorm:"-"`
@@ -191,6 +506,125 @@ func (t TraceInfos) Value() (driver.Value, error) {
 	return json.Marshal(t)
 }
 
+type TaskInsHistories []TaskInsHistory
+
+// TaskInsHistory is a finished execution of the task instance which is kept when it is rerun
+type TaskInsHistory struct {
+	Status   TaskInstanceStatus `json:"status,omitempty" bson:"status,omitempty"`
+	Reason   string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Attempts int                `json:"attempts,omitempty" bson:"attempts,omitempty"`
+	Traces   []TraceInfo        `json:"traces,omitempty" bson:"traces,omitempty"`
+	Time     int64              `json:"time,omitempty" bson:"time,omitempty"`
+}
+
+// 实现 sql.Scanner 接口，Scan 将 value 扫描至 Jsonb
+func (h *TaskInsHistories) Scan(value interface{}) error {
+	bytesValue, _ := value.([]byte)
+	return json.Unmarshal(bytesValue, h)
+}
+
+// 实现 driver.Valuer 接口，Value 返回 json value
+func (h TaskInsHistories) Value() (driver.Value, error) {
+	return json.Marshal(h)
+}
+
+// ApprovalDecision
+type ApprovalDecision string
+
+const (
+	ApprovalDecisionApproved ApprovalDecision = "approved"
+	ApprovalDecisionRejected ApprovalDecision = "rejected"
+)
+
+// Approval is the manual decision on a blocked task instance or a waiting approval action
+type Approval struct {
+	Decision ApprovalDecision `json:"decision,omitempty" bson:"decision,omitempty"`
+	Operator string           `json:"operator,omitempty" bson:"operator,omitempty"`
+	Comment  string           `json:"comment,omitempty" bson:"comment,omitempty"`
+	Time     int64            `json:"time,omitempty" bson:"time,omitempty"`
+}
+
+// NewApproval
+func NewApproval(decision ApprovalDecision, operator, comment string) *Approval {
+	return &Approval{
+		Decision: decision,
+		Operator: operator,
+		Comment:  comment,
+		Time:     time.Now().Unix(),
+	}
+}
+
+// IsApproved
+func (a *Approval) IsApproved() bool {
+	return a != nil && a.Decision == ApprovalDecisionApproved
+}
+
+// String used to trace the decision
+func (a *Approval) String() string {
+	if a.Comment == "" {
+		return fmt.Sprintf("%s by %s", a.Decision, a.Operator)
+	}
+	return fmt.Sprintf("%s by %s: %s", a.Decision, a.Operator, a.Comment)
+}
+
+// 实现 sql.Scanner 接口，Scan 将 value 扫描至 Jsonb
+func (a *Approval) Scan(value interface{}) error {
+	bytesValue, _ := value.([]byte)
+	return json.Unmarshal(bytesValue, a)
+}
+
+// 实现 driver.Valuer 接口，Value 返回 json value
+func (a Approval) Value() (driver.Value, error) {
+	return json.Marshal(a)
+}
+
+// Compensate define how to undo a succeeded task
+type Compensate struct {
+	// ActionName must implement run.CompensateAction, default is the action of task
+	ActionName string `yaml:"actionName,omitempty" json:"actionName,omitempty"  bson:"actionName,omitempty"`
+	// Params are rendered like the params of task, default are the params of task
+	Params      StringMap `yaml:"params,omitempty" json:"params,omitempty"  bson:"params,omitempty"`
+	TimeoutSecs int       `yaml:"timeoutSecs,omitempty" json:"timeoutSecs,omitempty"  bson:"timeoutSecs,omitempty"`
+}
+
+// 实现 sql.Scanner 接口，Scan 将 value 扫描至 Jsonb
+func (c *Compensate) Scan(value interface{}) error {
+	bytesValue, _ := value.([]byte)
+	return json.Unmarshal(bytesValue, c)
+}
+
+// 实现 driver.Valuer 接口，Value 返回 json value
+func (c Compensate) Value() (driver.Value, error) {
+	return json.Marshal(c)
+}
+
+// CompensationStatus
+type CompensationStatus string
+
+const (
+	CompensationStatusRunning CompensationStatus = "running"
+	CompensationStatusSuccess CompensationStatus = "success"
+	CompensationStatusFailed  CompensationStatus = "failed"
+)
+
+// Compensation is the result of undoing the task instance, it is recorded separately from the execution
+type Compensation struct {
+	Status CompensationStatus `json:"status,omitempty" bson:"status,omitempty"`
+	Reason string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Traces []TraceInfo        `json:"traces,omitempty" bson:"traces,omitempty"`
+}
+
+// 实现 sql.Scanner 接口，Scan 将 value 扫描至 Jsonb
+func (c *Compensation) Scan(value interface{}) error {
+	bytesValue, _ := value.([]byte)
+	return json.Unmarshal(bytesValue, c)
+}
+
+// 实现 driver.Valuer 接口，Value 返回 json value
+func (c Compensation) Value() (driver.Value, error) {
+	return json.Marshal(c)
+}
+
 // NewTaskInstance
 func NewTaskInstance(dagInsId string, t Task) *TaskInstance {
 	return &TaskInstance{
@@ -203,9 +637,41 @@ func NewTaskInstance(dagInsId string, t Task) *TaskInstance {
 		Params:      t.Params,
 		Status:      TaskInstanceStatusInit,
 		PreChecks:   t.PreChecks,
+		RetryPolicy: t.RetryPolicy,
+		TriggerRule: t.TriggerRule,
+		Foreach:     t.Foreach,
+		Pool:        t.Pool,
+		PoolSlots:   t.PoolSlots,
+		Compensate:  t.Compensate,
 	}
 }
 
+// NewMappedTaskInstance create the mapped task instance of the item of foreach list
+func NewMappedTaskInstance(group *TaskInstance, index int, item interface{}) (*TaskInstance, error) {
+	bs, err := json.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("marshal item[%d] failed: %w", index, err)
+	}
+	return &TaskInstance{
+		TaskID:      fmt.Sprintf("%s[%d]", group.TaskID, index),
+		DagInsID:    group.DagInsID,
+		Name:        group.Name,
+		ActionName:  group.ActionName,
+		TimeoutSecs: group.TimeoutSecs,
+		Params:      group.Params,
+		Status:      TaskInstanceStatusInit,
+		PreChecks:   group.PreChecks,
+		RetryPolicy: group.RetryPolicy,
+		MappedFrom:  group.TaskID,
+		MapIndex:    index,
+		MapItem:     string(bs),
+		Pool:        group.Pool,
+		PoolSlots:   group.PoolSlots,
+		Handler:     group.Handler,
+		Compensate:  group.Compensate,
+	}, nil
+}
+
 // GetGraphID
 func (t *TaskInstance) GetGraphID() string {
 	return t.TaskID
@@ -226,6 +692,26 @@ func (t *TaskInstance) GetStatus() TaskInstanceStatus {
 	return t.Status
 }
 
+// GetTriggerRule
+func (t *TaskInstance) GetTriggerRule() TriggerRule {
+	return t.TriggerRule
+}
+
+// GetForeach
+func (t *TaskInstance) GetForeach() *Foreach {
+	return t.Foreach
+}
+
+// GetMappedFrom
+func (t *TaskInstance) GetMappedFrom() string {
+	return t.MappedFrom
+}
+
+// GetPreChecks
+func (t *TaskInstance) GetPreChecks() PreChecks {
+	return t.PreChecks
+}
+
 // InitialDep
 func (t *TaskInstance) InitialDep(ctx run.ExecuteContext, patch func(*TaskInstance) error, dagIns *DagInstance) {
 	t.Patch = patch
@@ -236,13 +722,82 @@ func (t *TaskInstance) InitialDep(ctx run.ExecuteContext, patch func(*TaskInstan
 // SetStatus will persist task instance
 func (t *TaskInstance) SetStatus(s TaskInstanceStatus) error {
 	t.Status = s
-	patch := &TaskInstance{BaseInfo: BaseInfo{ID: t.ID}, Status: t.Status, Reason: t.Reason}
+	patch := &TaskInstance{
+		BaseInfo:         BaseInfo{ID: t.ID},
+		Status:           t.Status,
+		Reason:           t.Reason,
+		Attempts:         t.Attempts,
+		NextRetryAt:      t.NextRetryAt,
+		ShareDataKeys:    t.ShareDataKeys,
+		SelectedBranches: t.SelectedBranches,
+	}
 	if len(t.bufTraces) != 0 {
 		patch.Traces = append(t.Traces, t.bufTraces...)
 	}
 	return t.Patch(patch)
 }
 
+// Reset keep the current execution in history and set the task instance to init,
+// so that it can be executed again from scratch
+func (t *TaskInstance) Reset() {
+	if t.Status != TaskInstanceStatusInit {
+		t.History = append(t.History, TaskInsHistory{
+			Status:   t.Status,
+			Reason:   t.Reason,
+			Attempts: t.Attempts,
+			Traces:   t.Traces,
+			Time:     time.Now().Unix(),
+		})
+	}
+	t.Status = TaskInstanceStatusInit
+	t.Reason = ""
+	t.Traces = nil
+	t.Attempts = 0
+	t.NextRetryAt = 0
+	t.Approval = nil
+	t.ShareDataKeys = nil
+	t.Outputs = nil
+	t.SelectedBranches = nil
+	t.Compensation = nil
+}
+
+// SetOutput set the output of task instance and persist it, the value is saved as json
+func (t *TaskInstance) SetOutput(key string, value interface{}) error {
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal output[%s] failed: %w", key, err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return fmt.Errorf("unmarshal output[%s] failed: %w", key, err)
+	}
+	if t.Outputs == nil {
+		t.Outputs = StringMap{}
+	}
+	t.Outputs[key] = v
+	return t.Patch(&TaskInstance{BaseInfo: BaseInfo{ID: t.ID}, Outputs: t.Outputs})
+}
+
+// CanAutoRetry return if the task instance should be retried automatically after failed with err
+func (t *TaskInstance) CanAutoRetry(err error) bool {
+	// a rejection does not change by retrying, it needs a manual retry after the cause is handled
+	if run.ErrorClassOf(err) == run.ErrorClassRejected {
+		return false
+	}
+	return t.RetryPolicy.CanRetry(t.Attempts+1, err)
+}
+
+// AutoRetry set task instance to retrying, it increase the count of failed attempts
+// and the task instance will be executed again at NextRetryAt
+func (t *TaskInstance) AutoRetry(err error) error {
+	t.Attempts++
+	interval := t.RetryPolicy.NextInterval(t.Attempts)
+	t.NextRetryAt = time.Now().Add(interval).Unix()
+	t.Reason = err.Error()
+	t.Trace(fmt.Sprintf("attempt %d failed, will retry after %s", t.Attempts, interval), run.TraceOpPersistAfterAction)
+	return t.SetStatus(TaskInstanceStatusRetrying)
+}
+
 // Trace info
 func (t *TaskInstance) Trace(msg string, ops ...run.TraceOp) {
 	opt := run.NewTraceOption(ops...)
@@ -298,6 +853,15 @@ func (t *TaskInstance) Run(params interface{}, act run.Action) (err error) {
 			return fmt.Errorf("run failed: %w", err)
 		}
 
+		if branchAct, ok := act.(run.BranchAction); ok {
+			branches, err := branchAct.SelectBranches(t.Context, params)
+			if err != nil {
+				return fmt.Errorf("select branches failed: %w", err)
+			}
+			// an empty selection means skipping all children, so keep it not nil
+			t.SelectedBranches = append(StringArray{}, branches...)
+		}
+
 		if err := t.SetStatus(TaskInstanceStatusEnding); err != nil {
 			return err
 		}
@@ -329,6 +893,73 @@ func (t *TaskInstance) Run(params interface{}, act run.Action) (err error) {
 	return nil
 }
 
+// IsForeachGroup return if the task instance is the group of foreach, it runs nothing by itself,
+// and its status is computed by the mapped task instances
+func (t *TaskInstance) IsForeachGroup() bool {
+	return t.Foreach != nil && t.MappedFrom == ""
+}
+
+// CanCompensate return if the task instance should be compensated, the group of foreach is not compensated
+// because it runs nothing, and the succeeded compensation will not run again
+func (t *TaskInstance) CanCompensate() bool {
+	if t.Status != TaskInstanceStatusSuccess || t.Compensate == nil {
+		return false
+	}
+	if t.IsForeachGroup() {
+		return false
+	}
+	return t.Compensation == nil || t.Compensation.Status != CompensationStatusSuccess
+}
+
+// TraceCompensation trace info to the compensation, it is always persisted immediately
+func (t *TaskInstance) TraceCompensation(msg string, ops ...run.TraceOp) {
+	if t.Compensation == nil {
+		t.Compensation = &Compensation{}
+	}
+	t.Compensation.Traces = append(t.Compensation.Traces, TraceInfo{
+		Time:    time.Now().Unix(),
+		Message: msg,
+	})
+	if err := t.Patch(&TaskInstance{BaseInfo: BaseInfo{ID: t.ID}, Compensation: t.Compensation}); err != nil {
+		log.Error("save compensation trace failed",
+			"err", err,
+			"trace", t.Compensation.Traces)
+	}
+}
+
+// RunCompensate undo the task instance by the compensate action, the result is recorded to Compensation
+func (t *TaskInstance) RunCompensate(params interface{}, act run.CompensateAction) (err error) {
+	defer func() {
+		if rErr := recover(); rErr != nil {
+			err = fmt.Errorf("get panic when compensating: %s", rErr)
+		}
+		status, reason := CompensationStatusSuccess, ""
+		if err != nil {
+			status, reason = CompensationStatusFailed, err.Error()
+		}
+		if pErr := t.setCompensationStatus(status, reason); pErr != nil && err == nil {
+			err = pErr
+		}
+	}()
+
+	if err := t.setCompensationStatus(CompensationStatusRunning, ""); err != nil {
+		return err
+	}
+	if err := act.Compensate(t.Context, params); err != nil {
+		return fmt.Errorf("compensate failed: %w", err)
+	}
+	return nil
+}
+
+func (t *TaskInstance) setCompensationStatus(status CompensationStatus, reason string) error {
+	if t.Compensation == nil {
+		t.Compensation = &Compensation{}
+	}
+	t.Compensation.Status = status
+	t.Compensation.Reason = reason
+	return t.Patch(&TaskInstance{BaseInfo: BaseInfo{ID: t.ID}, Compensation: t.Compensation})
+}
+
 // DoPreCheck
 func (t *TaskInstance) DoPreCheck(dagIns *DagInstance) (isActive bool, err error) {
 	if t.PreChecks == nil {
@@ -336,11 +967,19 @@ func (t *TaskInstance) DoPreCheck(dagIns *DagInstance) (isActive bool, err error
 	}
 
 	for k, c := range t.PreChecks {
-		if c.IsMeet(dagIns) {
+		meet, checkErr := c.IsMeet(dagIns)
+		if checkErr != nil {
+			return false, fmt.Errorf("pre-check[%s] failed: %w", k, checkErr)
+		}
+		if meet {
 			switch c.Act {
 			case ActiveActionSkip:
 				t.Status = TaskInstanceStatusSkipped
 			case ActiveActionBlock:
+				// the block is already approved manually
+				if t.Approval.IsApproved() {
+					continue
+				}
 				t.Status = TaskInstanceStatusBlocked
 			default:
 				return false, fmt.Errorf("pre-check[%s] act is invalid: %s", k, c.Act)
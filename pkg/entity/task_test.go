@@ -1,6 +1,7 @@
 package entity
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
@@ -79,6 +80,284 @@ func TestTaskInstance_SetStatus(t *testing.T) {
 	}
 }
 
+func TestRetryPolicy_CanRetry(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		givePolicy  *RetryPolicy
+		giveAttempt int
+		giveErr     error
+		wantRet     bool
+	}{
+		{
+			caseDesc:    "no policy",
+			giveAttempt: 1,
+			giveErr:     fmt.Errorf("failed"),
+			wantRet:     false,
+		},
+		{
+			caseDesc:    "all errors",
+			givePolicy:  &RetryPolicy{MaxAttempts: 3},
+			giveAttempt: 2,
+			giveErr:     fmt.Errorf("failed"),
+			wantRet:     true,
+		},
+		{
+			caseDesc:    "exceed max attempts",
+			givePolicy:  &RetryPolicy{MaxAttempts: 3},
+			giveAttempt: 3,
+			giveErr:     fmt.Errorf("failed"),
+			wantRet:     false,
+		},
+		{
+			caseDesc:    "timeout is retryable",
+			givePolicy:  &RetryPolicy{MaxAttempts: 3, RetryableErrors: []string{run.ErrorClassTimeout}},
+			giveAttempt: 1,
+			giveErr:     fmt.Errorf("run failed: %w", context.DeadlineExceeded),
+			wantRet:     true,
+		},
+		{
+			caseDesc:    "classified error is retryable",
+			givePolicy:  &RetryPolicy{MaxAttempts: 3, RetryableErrors: []string{"http-5xx"}},
+			giveAttempt: 1,
+			giveErr:     fmt.Errorf("run failed: %w", run.NewClassifiedError("http-5xx", fmt.Errorf("bad gateway"))),
+			wantRet:     true,
+		},
+		{
+			caseDesc:    "error is not retryable",
+			givePolicy:  &RetryPolicy{MaxAttempts: 3, RetryableErrors: []string{run.ErrorClassTimeout}},
+			giveAttempt: 1,
+			giveErr:     fmt.Errorf("failed"),
+			wantRet:     false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.wantRet, tc.givePolicy.CanRetry(tc.giveAttempt, tc.giveErr))
+		})
+	}
+}
+
+func TestRetryPolicy_NextInterval(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		givePolicy  *RetryPolicy
+		giveAttempt int
+		wantMin     time.Duration
+		wantMax     time.Duration
+	}{
+		{
+			caseDesc:    "fixed",
+			givePolicy:  &RetryPolicy{Backoff: BackoffTypeFixed, IntervalSecs: 5},
+			giveAttempt: 3,
+			wantMin:     5 * time.Second,
+			wantMax:     5 * time.Second,
+		},
+		{
+			caseDesc:    "exponential",
+			givePolicy:  &RetryPolicy{Backoff: BackoffTypeExponential, IntervalSecs: 5},
+			giveAttempt: 3,
+			wantMin:     20 * time.Second,
+			wantMax:     20 * time.Second,
+		},
+		{
+			caseDesc:    "exponential with max interval",
+			givePolicy:  &RetryPolicy{Backoff: BackoffTypeExponential, IntervalSecs: 5, MaxIntervalSecs: 12},
+			giveAttempt: 3,
+			wantMin:     12 * time.Second,
+			wantMax:     12 * time.Second,
+		},
+		{
+			caseDesc:    "jitter",
+			givePolicy:  &RetryPolicy{Backoff: BackoffTypeFixed, IntervalSecs: 10, Jitter: 0.5},
+			giveAttempt: 1,
+			wantMin:     5 * time.Second,
+			wantMax:     15 * time.Second,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			interval := tc.givePolicy.NextInterval(tc.giveAttempt)
+			assert.GreaterOrEqual(t, interval, tc.wantMin)
+			assert.LessOrEqual(t, interval, tc.wantMax)
+		})
+	}
+}
+
+func TestTaskInstance_AutoRetry(t *testing.T) {
+	taskIns := &TaskInstance{
+		BaseInfo:    BaseInfo{ID: "test-id"},
+		Status:      TaskInstanceStatusInit,
+		Attempts:    1,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, IntervalSecs: 10},
+	}
+	var patched *TaskInstance
+	taskIns.Patch = func(instance *TaskInstance) error {
+		patched = instance
+		return nil
+	}
+
+	assert.True(t, taskIns.CanAutoRetry(fmt.Errorf("failed")))
+	start := time.Now().Unix()
+	assert.NoError(t, taskIns.AutoRetry(fmt.Errorf("failed")))
+	assert.Equal(t, TaskInstanceStatusRetrying, patched.Status)
+	assert.Equal(t, "failed", patched.Reason)
+	assert.Equal(t, 2, patched.Attempts)
+	assert.GreaterOrEqual(t, patched.NextRetryAt, start+10)
+	assert.Len(t, patched.Traces, 1)
+	assert.False(t, taskIns.CanAutoRetry(fmt.Errorf("failed")))
+
+	taskIns.Attempts = 1
+	assert.True(t, taskIns.CanAutoRetry(fmt.Errorf("failed")))
+	assert.False(t, taskIns.CanAutoRetry(run.NewClassifiedError(run.ErrorClassRejected, fmt.Errorf("rejected"))))
+}
+
+func TestTaskInstance_Reset(t *testing.T) {
+	taskIns := &TaskInstance{
+		Status:        TaskInstanceStatusSuccess,
+		Reason:        "reason",
+		Attempts:      2,
+		NextRetryAt:   100,
+		Traces:        []TraceInfo{{Time: 1, Message: "done"}},
+		Approval:      &Approval{Decision: ApprovalDecisionApproved},
+		ShareDataKeys: []string{"key"},
+		Outputs:       StringMap{"key": "value"},
+	}
+	taskIns.Reset()
+	assert.Equal(t, TaskInstanceStatusInit, taskIns.Status)
+	assert.Empty(t, taskIns.Reason)
+	assert.Empty(t, taskIns.Traces)
+	assert.Zero(t, taskIns.Attempts)
+	assert.Zero(t, taskIns.NextRetryAt)
+	assert.Nil(t, taskIns.Approval)
+	assert.Nil(t, taskIns.ShareDataKeys)
+	assert.Nil(t, taskIns.Outputs)
+	assert.Len(t, taskIns.History, 1)
+	assert.Equal(t, TaskInstanceStatusSuccess, taskIns.History[0].Status)
+	assert.Equal(t, "reason", taskIns.History[0].Reason)
+	assert.Equal(t, 2, taskIns.History[0].Attempts)
+	assert.Equal(t, []TraceInfo{{Time: 1, Message: "done"}}, taskIns.History[0].Traces)
+
+	// the task instance which never executed has no history
+	taskIns.Reset()
+	assert.Len(t, taskIns.History, 1)
+}
+
+func TestForeach_Items(t *testing.T) {
+	dagIns := &DagInstance{
+		Vars: DagInstanceVars{
+			"hosts":   DagInstanceVar{Value: `["host1","host2"]`},
+			"invalid": DagInstanceVar{Value: "host1"},
+		},
+		ShareData: &ShareData{
+			Dict: map[string]string{
+				"ports": `[80,443]`,
+			},
+		},
+	}
+	tests := []struct {
+		caseDesc    string
+		giveForeach *Foreach
+		wantItems   []interface{}
+		wantErr     error
+	}{
+		{
+			caseDesc:    "vars",
+			giveForeach: &Foreach{Source: TaskConditionSourceVars, Key: "hosts"},
+			wantItems:   []interface{}{"host1", "host2"},
+		},
+		{
+			caseDesc:    "share data",
+			giveForeach: &Foreach{Source: TaskConditionSourceShareData, Key: "ports"},
+			wantItems:   []interface{}{float64(80), float64(443)},
+		},
+		{
+			caseDesc:    "not found",
+			giveForeach: &Foreach{Source: TaskConditionSourceVars, Key: "ports"},
+			wantErr:     fmt.Errorf("foreach key[ports] is not found in vars"),
+		},
+		{
+			caseDesc:    "not a list",
+			giveForeach: &Foreach{Source: TaskConditionSourceVars, Key: "invalid"},
+			wantErr:     fmt.Errorf("foreach key[invalid] is not a json list: invalid character 'h' looking for beginning of value"),
+		},
+		{
+			caseDesc:    "invalid source",
+			giveForeach: &Foreach{Source: "test", Key: "hosts"},
+			wantErr:     fmt.Errorf("foreach source test is not valid"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			items, err := tc.giveForeach.Items(dagIns)
+			if tc.wantErr != nil {
+				assert.EqualError(t, err, tc.wantErr.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantItems, items)
+		})
+	}
+}
+
+func TestTaskInstance_SetOutput(t *testing.T) {
+	var patched *TaskInstance
+	taskIns := &TaskInstance{
+		BaseInfo: BaseInfo{ID: "task-ins"},
+		Patch: func(instance *TaskInstance) error {
+			patched = instance
+			return nil
+		},
+	}
+	assert.NoError(t, taskIns.SetOutput("version", "v1"))
+	assert.NoError(t, taskIns.SetOutput("result", struct {
+		Count int      `json:"count"`
+		Hosts []string `json:"hosts"`
+	}{Count: 2, Hosts: []string{"a", "b"}}))
+	want := StringMap{
+		"version": "v1",
+		"result": map[string]interface{}{
+			"count": float64(2),
+			"hosts": []interface{}{"a", "b"},
+		},
+	}
+	assert.Equal(t, want, taskIns.Outputs)
+	assert.Equal(t, &TaskInstance{BaseInfo: BaseInfo{ID: "task-ins"}, Outputs: want}, patched)
+
+	assert.Error(t, taskIns.SetOutput("invalid", make(chan int)))
+	assert.NotContains(t, taskIns.Outputs, "invalid")
+}
+
+func TestNewMappedTaskInstance(t *testing.T) {
+	group := &TaskInstance{
+		BaseInfo:   BaseInfo{ID: "group-id"},
+		TaskID:     "task",
+		DagInsID:   "dag-ins",
+		ActionName: "ssh",
+		Params:     map[string]interface{}{"host": "{{.item.host}}"},
+		Status:     TaskInstanceStatusInit,
+		Foreach:    &Foreach{Source: TaskConditionSourceVars, Key: "hosts"},
+		Pool:       "ssh",
+		PoolSlots:  2,
+	}
+	ins, err := NewMappedTaskInstance(group, 1, map[string]interface{}{"host": "host2"})
+	assert.NoError(t, err)
+	assert.Equal(t, &TaskInstance{
+		TaskID:     "task[1]",
+		DagInsID:   "dag-ins",
+		ActionName: "ssh",
+		Params:     map[string]interface{}{"host": "{{.item.host}}"},
+		Status:     TaskInstanceStatusInit,
+		MappedFrom: "task",
+		MapIndex:   1,
+		MapItem:    `{"host":"host2"}`,
+		Pool:       "ssh",
+		PoolSlots:  2,
+	}, ins)
+}
+
 func TestTaskInstance_Trace(t *testing.T) {
 	tests := []struct {
 		giveTaskIns     *TaskInstance
@@ -299,6 +578,173 @@ func TestTaskInstance_Run(t *testing.T) {
 	}
 }
 
+type branchAction struct {
+	run.MockAction
+	branches []string
+	err      error
+}
+
+func (a *branchAction) SelectBranches(ctx run.ExecuteContext, params interface{}) ([]string, error) {
+	return a.branches, a.err
+}
+
+func TestTaskInstance_RunBranch(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveBranches []string
+		giveErr      error
+		wantErr      string
+		wantBranches StringArray
+		wantStatus   TaskInstanceStatus
+	}{
+		{
+			caseDesc:     "select one",
+			giveBranches: []string{"continue"},
+			wantBranches: StringArray{"continue"},
+			wantStatus:   TaskInstanceStatusSuccess,
+		},
+		{
+			caseDesc:     "select none",
+			wantBranches: StringArray{},
+			wantStatus:   TaskInstanceStatusSuccess,
+		},
+		{
+			caseDesc:   "failed",
+			giveErr:    fmt.Errorf("check failed"),
+			wantErr:    "select branches failed: check failed",
+			wantStatus: TaskInstanceStatusRunning,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			act := &branchAction{branches: tc.giveBranches, err: tc.giveErr}
+			act.On("Name").Return("branch")
+			act.On("Run", mock.Anything, mock.Anything).Return(nil)
+			act.On("RunBefore", mock.Anything, mock.Anything).Return(nil)
+			act.On("RunAfter", mock.Anything, mock.Anything).Return(nil)
+
+			var patched *TaskInstance
+			taskIns := &TaskInstance{BaseInfo: BaseInfo{ID: "check"}, Status: TaskInstanceStatusInit}
+			taskIns.Patch = func(instance *TaskInstance) error {
+				patched = instance
+				return nil
+			}
+
+			err := taskIns.Run(nil, act)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantBranches, taskIns.SelectedBranches)
+			assert.Equal(t, tc.wantBranches, patched.SelectedBranches)
+			assert.Equal(t, tc.wantStatus, taskIns.Status)
+		})
+	}
+}
+
+type compensateFunc func(ctx run.ExecuteContext, params interface{}) error
+
+func (f compensateFunc) Compensate(ctx run.ExecuteContext, params interface{}) error {
+	return f(ctx, params)
+}
+
+func TestTaskInstance_RunCompensate(t *testing.T) {
+	tests := []struct {
+		caseDesc   string
+		giveFunc   compensateFunc
+		wantErr    string
+		wantStatus CompensationStatus
+	}{
+		{
+			caseDesc: "success",
+			giveFunc: func(ctx run.ExecuteContext, params interface{}) error {
+				return nil
+			},
+			wantStatus: CompensationStatusSuccess,
+		},
+		{
+			caseDesc: "panic",
+			giveFunc: func(ctx run.ExecuteContext, params interface{}) error {
+				panic("delete nothing")
+			},
+			wantErr:    "get panic when compensating: delete nothing",
+			wantStatus: CompensationStatusFailed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched []CompensationStatus
+			taskIns := &TaskInstance{BaseInfo: BaseInfo{ID: "create-vm"}, Status: TaskInstanceStatusSuccess}
+			taskIns.Patch = func(instance *TaskInstance) error {
+				patched = append(patched, instance.Compensation.Status)
+				return nil
+			}
+
+			err := taskIns.RunCompensate(nil, tc.giveFunc)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				assert.Equal(t, tc.wantErr, taskIns.Compensation.Reason)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, []CompensationStatus{CompensationStatusRunning, tc.wantStatus}, patched)
+			// the status of execution is not changed by compensation
+			assert.Equal(t, TaskInstanceStatusSuccess, taskIns.Status)
+		})
+	}
+}
+
+func TestTaskInstance_CanCompensate(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		giveTaskIns *TaskInstance
+		want        bool
+	}{
+		{
+			caseDesc:    "succeeded",
+			giveTaskIns: &TaskInstance{Status: TaskInstanceStatusSuccess, Compensate: &Compensate{}},
+			want:        true,
+		},
+		{
+			caseDesc: "compensation failed before",
+			giveTaskIns: &TaskInstance{
+				Status:       TaskInstanceStatusSuccess,
+				Compensate:   &Compensate{},
+				Compensation: &Compensation{Status: CompensationStatusFailed},
+			},
+			want: true,
+		},
+		{
+			caseDesc: "already compensated",
+			giveTaskIns: &TaskInstance{
+				Status:       TaskInstanceStatusSuccess,
+				Compensate:   &Compensate{},
+				Compensation: &Compensation{Status: CompensationStatusSuccess},
+			},
+		},
+		{
+			caseDesc:    "not succeeded",
+			giveTaskIns: &TaskInstance{Status: TaskInstanceStatusSkipped, Compensate: &Compensate{}},
+		},
+		{
+			caseDesc:    "no compensate",
+			giveTaskIns: &TaskInstance{Status: TaskInstanceStatusSuccess},
+		},
+		{
+			caseDesc:    "group of foreach",
+			giveTaskIns: &TaskInstance{Status: TaskInstanceStatusSuccess, Compensate: &Compensate{}, Foreach: &Foreach{}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.giveTaskIns.CanCompensate())
+		})
+	}
+}
+
 func TestTaskConditionSource_BuildKvGetter(t *testing.T) {
 	tests := []struct {
 		caseDesc   string
@@ -307,7 +753,7 @@ func TestTaskConditionSource_BuildKvGetter(t *testing.T) {
 		giveKey    string
 		wantFind   bool
 		wantVal    string
-		wantPanic  string
+		wantErr    string
 	}{
 		{
 			caseDesc:   "vars",
@@ -339,33 +785,78 @@ func TestTaskConditionSource_BuildKvGetter(t *testing.T) {
 			wantVal:  "value2",
 		},
 		{
-			caseDesc:   "panic",
+			caseDesc:   "task output",
+			giveSource: TaskConditionSourceTaskOutput,
+			giveDagIns: &DagInstance{
+				TaskOutputs: func() (map[string]StringMap, error) {
+					return map[string]StringMap{"task1": {"version": "v1"}}, nil
+				},
+			},
+			giveKey:  "task1.version",
+			wantFind: true,
+			wantVal:  "v1",
+		},
+		{
+			caseDesc:   "task output as json",
+			giveSource: TaskConditionSourceTaskOutput,
+			giveDagIns: &DagInstance{
+				TaskOutputs: func() (map[string]StringMap, error) {
+					return map[string]StringMap{"task1": {"hosts": []interface{}{"a", "b"}, "count": float64(2)}}, nil
+				},
+			},
+			giveKey:  "task1.hosts",
+			wantFind: true,
+			wantVal:  `["a","b"]`,
+		},
+		{
+			caseDesc:   "task output not found",
+			giveSource: TaskConditionSourceTaskOutput,
+			giveDagIns: &DagInstance{
+				TaskOutputs: func() (map[string]StringMap, error) {
+					return map[string]StringMap{"task1": {"version": "v1"}}, nil
+				},
+			},
+			giveKey: "task2.version",
+		},
+		{
+			caseDesc:   "task output failed",
+			giveSource: TaskConditionSourceTaskOutput,
+			giveDagIns: &DagInstance{
+				TaskOutputs: func() (map[string]StringMap, error) {
+					return nil, fmt.Errorf("list failed")
+				},
+			},
+			giveKey: "task1.version",
+		},
+		{
+			caseDesc:   "invalid task output key",
+			giveSource: TaskConditionSourceTaskOutput,
+			giveDagIns: &DagInstance{},
+			giveKey:    "version",
+		},
+		{
+			caseDesc:   "invalid source",
 			giveSource: "test",
 			giveDagIns: &DagInstance{
 				Vars: DagInstanceVars{
 					"key1": DagInstanceVar{Value: "value1"},
 				},
 			},
-			giveKey:   "key1",
-			wantPanic: "task condition source test is not valid",
+			giveKey: "key1",
+			wantErr: "task condition source test is not valid",
 		},
 	}
 
 	for _, tc := range tests {
-		doTest := func() {
-			if tc.wantPanic != "" {
-				defer func() {
-					err := recover()
-					assert.Equal(t, tc.wantPanic, err, tc.caseDesc)
-				}()
-			}
-
-			g := tc.giveSource.BuildKvGetter(tc.giveDagIns)
-			val, ok := g(tc.giveKey)
-			assert.Equal(t, tc.wantVal, val, tc.caseDesc)
-			assert.Equal(t, tc.wantFind, ok, tc.caseDesc)
+		g, err := tc.giveSource.BuildKvGetter(tc.giveDagIns)
+		if tc.wantErr != "" {
+			assert.EqualError(t, err, tc.wantErr, tc.caseDesc)
+			continue
 		}
-		doTest()
+		assert.NoError(t, err, tc.caseDesc)
+		val, ok := g(tc.giveKey)
+		assert.Equal(t, tc.wantVal, val, tc.caseDesc)
+		assert.Equal(t, tc.wantFind, ok, tc.caseDesc)
 	}
 }
 
@@ -627,6 +1118,47 @@ func TestTaskInstance_DoPreCheck(t *testing.T) {
 				},
 			},
 		},
+		{
+			caseDesc: "block approved",
+			giveTaskIns: &TaskInstance{
+				PreChecks: PreChecks{
+					"first": {
+						Conditions: []TaskCondition{
+							{
+								Source: TaskConditionSourceVars,
+								Key:    "key1",
+								Values: []string{"value1"},
+								Op:     OperatorIn,
+							},
+						},
+						Act: ActiveActionBlock,
+					},
+				},
+				Approval: &Approval{Decision: ApprovalDecisionApproved},
+			},
+			giveDagIns: &DagInstance{
+				Vars: DagInstanceVars{
+					"key1": {Value: "value1"},
+				},
+			},
+			wantRet: false,
+			wantTaskIns: &TaskInstance{
+				PreChecks: PreChecks{
+					"first": {
+						Conditions: []TaskCondition{
+							{
+								Source: TaskConditionSourceVars,
+								Key:    "key1",
+								Values: []string{"value1"},
+								Op:     OperatorIn,
+							},
+						},
+						Act: ActiveActionBlock,
+					},
+				},
+				Approval: &Approval{Decision: ApprovalDecisionApproved},
+			},
+		},
 		{
 			caseDesc: "invalid-act",
 			giveTaskIns: &TaskInstance{
@@ -652,16 +1184,181 @@ func TestTaskInstance_DoPreCheck(t *testing.T) {
 			wantRet: false,
 			wantErr: fmt.Errorf("pre-check[first] act is invalid: invalid-act"),
 		},
+		{
+			caseDesc: "expr meet",
+			giveTaskIns: &TaskInstance{
+				PreChecks: PreChecks{
+					"first": {
+						Expr: `vars.replicas > 3 && jsonPath(shareData.result, "$.ready") && "linux" in tasks.os.outputs.platforms`,
+						Act:  ActiveActionSkip,
+					},
+				},
+			},
+			giveDagIns: &DagInstance{
+				Vars: DagInstanceVars{
+					"replicas": {Value: "5"},
+				},
+				ShareData: &ShareData{
+					Dict: map[string]string{"result": `{"ready":true}`},
+				},
+				TaskOutputs: func() (map[string]StringMap, error) {
+					return map[string]StringMap{"os": {"platforms": []interface{}{"linux"}}}, nil
+				},
+			},
+			wantRet: true,
+			wantTaskIns: &TaskInstance{
+				PreChecks: PreChecks{
+					"first": {
+						Expr: `vars.replicas > 3 && jsonPath(shareData.result, "$.ready") && "linux" in tasks.os.outputs.platforms`,
+						Act:  ActiveActionSkip,
+					},
+				},
+				Status: TaskInstanceStatusSkipped,
+			},
+		},
+		{
+			caseDesc: "expr not meet",
+			giveTaskIns: &TaskInstance{
+				PreChecks: PreChecks{
+					"first": {
+						Conditions: []TaskCondition{
+							{
+								Source: TaskConditionSourceVars,
+								Key:    "env",
+								Values: []string{"test"},
+								Op:     OperatorIn,
+							},
+						},
+						Expr: `vars.replicas > 10`,
+						Act:  ActiveActionSkip,
+					},
+				},
+			},
+			giveDagIns: &DagInstance{
+				Vars: DagInstanceVars{
+					"env":      {Value: "test"},
+					"replicas": {Value: "5"},
+				},
+			},
+			wantRet: false,
+			wantTaskIns: &TaskInstance{
+				PreChecks: PreChecks{
+					"first": {
+						Conditions: []TaskCondition{
+							{
+								Source: TaskConditionSourceVars,
+								Key:    "env",
+								Values: []string{"test"},
+								Op:     OperatorIn,
+							},
+						},
+						Expr: `vars.replicas > 10`,
+						Act:  ActiveActionSkip,
+					},
+				},
+			},
+		},
+		{
+			caseDesc: "expr failed",
+			giveTaskIns: &TaskInstance{
+				PreChecks: PreChecks{
+					"first": {
+						Expr: `vars.env > 1`,
+						Act:  ActiveActionSkip,
+					},
+				},
+			},
+			giveDagIns: &DagInstance{
+				Vars: DagInstanceVars{
+					"env": {Value: "test"},
+				},
+			},
+			wantRet: false,
+			wantErr: fmt.Errorf("pre-check[first] failed: evaluate expression[vars.env > 1] failed: cannot compare string with number"),
+		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.caseDesc, func(t *testing.T) {
 			ret, err := tc.giveTaskIns.DoPreCheck(tc.giveDagIns)
 			assert.Equal(t, tc.wantRet, ret)
-			assert.Equal(t, tc.wantErr, err)
+			if tc.wantErr != nil {
+				assert.EqualError(t, err, tc.wantErr.Error())
+			} else {
+				assert.NoError(t, err)
+			}
 			if err == nil {
 				assert.Equal(t, tc.wantTaskIns, tc.giveTaskIns)
 			}
 		})
 	}
 }
+
+func TestCheck_Validate(t *testing.T) {
+	tests := []struct {
+		caseDesc  string
+		giveCheck *Check
+		wantErr   string
+	}{
+		{
+			caseDesc: "normal",
+			giveCheck: &Check{
+				Conditions: []TaskCondition{
+					{Source: TaskConditionSourceVars, Key: "env", Values: []string{"prod"}, Op: OperatorNotIn},
+				},
+				Expr: `vars.replicas > 3 && shareData.ready == true && tasks.os.outputs.cores >= 4`,
+				Act:  ActiveActionBlock,
+			},
+		},
+		{
+			caseDesc:  "invalid act",
+			giveCheck: &Check{Act: "run"},
+			wantErr:   "act run is not valid",
+		},
+		{
+			caseDesc: "invalid source",
+			giveCheck: &Check{
+				Conditions: []TaskCondition{{Source: "env", Key: "env", Op: OperatorIn}},
+				Act:        ActiveActionSkip,
+			},
+			wantErr: "condition[0] is invalid: task condition source env is not valid",
+		},
+		{
+			caseDesc: "empty key",
+			giveCheck: &Check{
+				Conditions: []TaskCondition{{Source: TaskConditionSourceVars, Op: OperatorIn}},
+				Act:        ActiveActionSkip,
+			},
+			wantErr: "condition[0] is invalid: task condition key cannot be empty",
+		},
+		{
+			caseDesc: "invalid op",
+			giveCheck: &Check{
+				Conditions: []TaskCondition{{Source: TaskConditionSourceVars, Key: "env", Op: "eq"}},
+				Act:        ActiveActionSkip,
+			},
+			wantErr: "condition[0] is invalid: task condition op eq is not valid",
+		},
+		{
+			caseDesc:  "broken expr",
+			giveCheck: &Check{Expr: `vars.replicas >`, Act: ActiveActionSkip},
+			wantErr:   "compile expression[vars.replicas >] failed: unexpected end of expression",
+		},
+		{
+			caseDesc:  "unknown identifier",
+			giveCheck: &Check{Expr: `env.replicas > 1`, Act: ActiveActionSkip},
+			wantErr:   "expression[env.replicas > 1] references unknown identifier env, it can only be one of [vars shareData tasks]",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			err := tc.giveCheck.Validate()
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
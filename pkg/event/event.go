@@ -12,6 +12,8 @@ const (
 	KeyLeaderChanged                = "LeaderChanged"
 	KeyDispatchInitDagInsCompleted  = "DispatchInitDagInsCompleted"
 	KeyParseScheduleDagInsCompleted = "ParseScheduleDagInsCompleted"
+	KeyWorkerDraining               = "WorkerDraining"
+	KeyPoolUsageChanged             = "PoolUsageChanged"
 )
 
 // DagInstanceUpdated will raise when dag instance he updated
@@ -87,3 +89,34 @@ type ParseScheduleDagInsCompleted struct {
 func (e *ParseScheduleDagInsCompleted) Topic() []string {
 	return []string{KeyParseScheduleDagInsCompleted}
 }
+
+// WorkerDraining will raise when the draining worker makes progress
+type WorkerDraining struct {
+	WorkerKey string
+	Stage     string
+	// RunningTaskCnt is the count of task instances which are still running at this worker
+	RunningTaskCnt int
+	// ReleasedDagInsCnt is the count of dag instances released to dispatcher
+	ReleasedDagInsCnt int
+}
+
+// Topic
+func (e *WorkerDraining) Topic() []string {
+	return []string{KeyWorkerDraining}
+}
+
+// PoolUsageChanged will raise when the task instances of this worker acquire, release or wait for the slots of a pool
+type PoolUsageChanged struct {
+	WorkerKey string
+	Pool      string
+	Slots     int
+	// InUseSlots is the count of slots which are kept by this worker
+	InUseSlots int
+	// WaitingTaskCnt is the count of task instances of this worker which are waiting for slots
+	WaitingTaskCnt int
+}
+
+// Topic
+func (e *PoolUsageChanged) Topic() []string {
+	return []string{KeyPoolUsageChanged}
+}
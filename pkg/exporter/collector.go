@@ -9,6 +9,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shiningrush/goevent"
 	"net/http"
+	"sync"
 	"sync/atomic"
 )
 
@@ -54,6 +55,22 @@ var (
 		"The count of parse scheduled dag instance failed.",
 		[]string{"worker_key"}, nil,
 	)
+
+	poolSlotsDesc = prometheus.NewDesc(
+		"fastflow_pool_slots",
+		"The count of slots of resource pool.",
+		[]string{"worker_key", "pool"}, nil,
+	)
+	poolInUseSlotsDesc = prometheus.NewDesc(
+		"fastflow_pool_slots_in_use",
+		"The count of slots of resource pool which are kept by the worker.",
+		[]string{"worker_key", "pool"}, nil,
+	)
+	poolWaitingTaskCountDesc = prometheus.NewDesc(
+		"fastflow_pool_task_waiting",
+		"The count of task waiting for slots of resource pool.",
+		[]string{"worker_key", "pool"}, nil,
+	)
 )
 
 // ExecutorCollector
@@ -187,6 +204,57 @@ func (c *LeaderCollector) Collect(ch chan<- prometheus.Metric) {
 	)
 }
 
+// PoolCollector
+type PoolCollector struct {
+	// usage is the latest usage of each pool
+	usage sync.Map
+}
+
+// Topic is goevent's topic
+func (c *PoolCollector) Topic() []string {
+	return []string{event.KeyPoolUsageChanged}
+}
+
+// Handle is goevent's handler
+func (c *PoolCollector) Handle(cxt context.Context, e goevent.Event) {
+	if poolEvent, ok := e.(*event.PoolUsageChanged); ok {
+		c.usage.Store(poolEvent.Pool, poolEvent)
+	}
+}
+
+// Describe the metrics of pools explicitly, because there may be no pool used when registering
+func (c *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolSlotsDesc
+	ch <- poolInUseSlotsDesc
+	ch <- poolWaitingTaskCountDesc
+}
+
+// Collect
+func (c *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.usage.Range(func(key, value interface{}) bool {
+		usage := value.(*event.PoolUsageChanged)
+		ch <- prometheus.MustNewConstMetric(
+			poolSlotsDesc,
+			prometheus.GaugeValue,
+			float64(usage.Slots),
+			usage.WorkerKey, usage.Pool,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			poolInUseSlotsDesc,
+			prometheus.GaugeValue,
+			float64(usage.InUseSlots),
+			usage.WorkerKey, usage.Pool,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			poolWaitingTaskCountDesc,
+			prometheus.GaugeValue,
+			float64(usage.WaitingTaskCnt),
+			usage.WorkerKey, usage.Pool,
+		)
+		return true
+	})
+}
+
 // HttpHandler used to handle metrics request
 // you can use it like that
 //
@@ -202,11 +270,16 @@ func HttpHandler() http.Handler {
 	if err := goevent.Subscribe(leaderCollector); err != nil {
 		panic(err)
 	}
+	poolCollector := &PoolCollector{}
+	if err := goevent.Subscribe(poolCollector); err != nil {
+		panic(err)
+	}
 
 	reg := prometheus.NewPedanticRegistry()
 	reg.MustRegister(
 		execCollector,
 		leaderCollector,
+		poolCollector,
 		// Add the standard process and Go metrics to the custom registry.
 		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
 		prometheus.NewGoCollector(),
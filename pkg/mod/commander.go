@@ -4,7 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/linclin/fastflow/pkg/entity"
-	"math/rand"
+	"github.com/linclin/fastflow/pkg/utils/data"
 	"strings"
 	"time"
 )
@@ -14,7 +14,8 @@ type DefCommander struct {
 }
 
 // RunDag
-func (c *DefCommander) RunDag(dagId string, specVars map[string]string) (*entity.DagInstance, error) {
+func (c *DefCommander) RunDag(dagId string, specVars map[string]string, ops ...CommandOptSetter) (*entity.DagInstance, error) {
+	opt := initOption(ops)
 	dag, err := GetStore().GetDag(dagId)
 	if err != nil {
 		return nil, err
@@ -24,6 +25,11 @@ func (c *DefCommander) RunDag(dagId string, specVars map[string]string) (*entity
 	if err != nil {
 		return nil, err
 	}
+	dagIns.ParentDagInsID = opt.parentDagInsID
+	dagIns.ParentTaskInsID = opt.parentTaskInsID
+	if opt.priority != nil {
+		dagIns.Priority = *opt.priority
+	}
 
 	if err := GetStore().CreateDagIns(dagIns); err != nil {
 		return nil, err
@@ -57,17 +63,149 @@ func (c *DefCommander) RetryDagIns(dagInsId string, ops ...CommandOptSetter) err
 func (c *DefCommander) RetryTask(taskInsIds []string, ops ...CommandOptSetter) error {
 	opt := initOption(ops)
 	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
-		if !isWorkerAlive {
-			aliveNodes, err := GetKeeper().AliveNodes()
-			if err != nil {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Retry(taskInsIds)
+	}, opt)
+}
+
+// ApproveTask approve the blocked tasks or the tasks waiting at approval action
+func (c *DefCommander) ApproveTask(taskInsIds []string, operator, comment string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Approve(taskInsIds, operator, comment)
+	}, opt)
+}
+
+// RejectTask reject the blocked tasks or the tasks waiting at approval action
+func (c *DefCommander) RejectTask(taskInsIds []string, operator, comment string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Reject(taskInsIds, operator, comment)
+	}, opt)
+}
+
+// SkipTask skip the tasks, so that the downstream tasks can continue
+func (c *DefCommander) SkipTask(taskInsIds []string, operator, reason string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Skip(taskInsIds, operator, reason)
+	}, opt)
+}
+
+// MarkTaskSuccess mark the tasks as success, it is usually used when the tasks are done by hand
+func (c *DefCommander) MarkTaskSuccess(taskInsIds []string, operator, reason string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.MarkSuccess(taskInsIds, operator, reason)
+	}, opt)
+}
+
+// ForceFailTask fail the tasks immediately
+func (c *DefCommander) ForceFailTask(taskInsIds []string, operator, reason string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.ForceFail(taskInsIds, operator, reason)
+	}, opt)
+}
+
+// RerunFrom rerun the task and its downstream tasks if includeDownstream is true,
+// it also works when the dag instance is already succeeded
+func (c *DefCommander) RerunFrom(taskInsId string, includeDownstream bool, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeCommand([]string{taskInsId}, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Rerun(taskInsId, includeDownstream, opt.clearShareData)
+	}, opt)
+}
+
+// CancelDagIns cancel all unfinished tasks of the dag instance, it also works when the worker is dead
+func (c *DefCommander) CancelDagIns(dagInsId string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeDagCommand(dagInsId, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		// the init dag instance has no worker, its command is executed by dispatcher
+		if dagIns.Status != entity.DagInstanceStatusInit {
+			if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
 				return err
 			}
-			dagIns.Worker = aliveNodes[rand.Intn(len(aliveNodes))]
 		}
-		return dagIns.Retry(taskInsIds)
+		return dagIns.CancelAll()
+	}, opt)
+}
+
+// PauseDagIns pause the dag instance, the running tasks will continue but no new task will be executed
+func (c *DefCommander) PauseDagIns(dagInsId string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeDagCommand(dagInsId, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Pause()
+	}, opt)
+}
+
+// ResumeDagIns resume the paused dag instance
+func (c *DefCommander) ResumeDagIns(dagInsId string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeDagCommand(dagInsId, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Resume()
 	}, opt)
 }
 
+// CompensateDagIns undo the succeeded tasks of the failed dag instance in reverse topological order,
+// the succeeded compensations will not run again, so it can be called again after some of them failed
+func (c *DefCommander) CompensateDagIns(dagInsId string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeDagCommand(dagInsId, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if err := reassignWorker(dagIns, isWorkerAlive); err != nil {
+			return err
+		}
+		return dagIns.Compensate()
+	}, opt)
+}
+
+// reassignWorker pick an alive worker to execute the command if the worker of dag instance is unhealthy,
+// the worker must match the node selector of dag instance and not be draining, the least loaded one is picked
+func reassignWorker(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+	if isWorkerAlive {
+		return nil
+	}
+	nodes, err := GetKeeper().AliveNodesWithLabels()
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return data.ErrNoAliveNodes
+	}
+	workers, reason := matchWorkers(dagIns, nodes)
+	if len(workers) == 0 {
+		return fmt.Errorf("%s: %w", reason, data.ErrNoAliveNodes)
+	}
+	dagIns.Worker = (&LeastLoadedStrategy{}).Select(dagIns, workers).WorkerKey
+	return nil
+}
+
 // CancelTask
 func (c *DefCommander) CancelTask(taskInsIds []string, ops ...CommandOptSetter) error {
 	opt := initOption(ops)
@@ -127,6 +265,13 @@ func executeCommand(
 		}
 	}
 
+	return executeDagCommand(dagInsId, perform, opt)
+}
+
+func executeDagCommand(
+	dagInsId string,
+	perform func(dagIns *entity.DagInstance, isWorkerAlive bool) error,
+	opt CommandOption) error {
 	dagIns, err := GetStore().GetDagInstance(dagInsId)
 	if err != nil {
 		return err
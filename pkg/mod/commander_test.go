@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/utils/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -15,6 +16,7 @@ func TestDefCommander_RunDag(t *testing.T) {
 		caseDesc      string
 		giveDagId     string
 		giveVars      map[string]string
+		giveOps       []CommandOptSetter
 		giveDag       *entity.Dag
 		giveGetErr    error
 		giveCreateErr error
@@ -38,6 +40,65 @@ func TestDefCommander_RunDag(t *testing.T) {
 				ShareData: &entity.ShareData{},
 			},
 		},
+		{
+			caseDesc:  "run as sub dag",
+			giveDagId: "test-dag",
+			giveOps:   []CommandOptSetter{CommParent("parent-dag-ins", "parent-task-ins")},
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID: "test-dag",
+				},
+				Status: entity.DagStatusNormal,
+			},
+			wantDagIns: &entity.DagInstance{
+				DagID:           "test-dag",
+				Vars:            entity.DagInstanceVars{},
+				Trigger:         entity.TriggerManually,
+				Status:          entity.DagInstanceStatusInit,
+				ShareData:       &entity.ShareData{},
+				ParentDagInsID:  "parent-dag-ins",
+				ParentTaskInsID: "parent-task-ins",
+			},
+		},
+		{
+			caseDesc:  "priority",
+			giveDagId: "test-dag",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID: "test-dag",
+				},
+				Status:   entity.DagStatusNormal,
+				Priority: 1,
+			},
+			wantDagIns: &entity.DagInstance{
+				DagID:     "test-dag",
+				Vars:      entity.DagInstanceVars{},
+				Trigger:   entity.TriggerManually,
+				Status:    entity.DagInstanceStatusInit,
+				ShareData: &entity.ShareData{},
+				Priority:  1,
+			},
+		},
+		{
+			caseDesc:  "override priority",
+			giveDagId: "test-dag",
+			giveOps:   []CommandOptSetter{CommPriority(10)},
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID: "test-dag",
+				},
+				Status:   entity.DagStatusNormal,
+				Priority: 1,
+			},
+			wantDagIns: &entity.DagInstance{
+				DagID:     "test-dag",
+				Vars:      entity.DagInstanceVars{},
+				Trigger:   entity.TriggerManually,
+				Status:    entity.DagInstanceStatusInit,
+				ShareData: &entity.ShareData{},
+				Priority:  10,
+			},
+		},
 		{
 			caseDesc:   "get failed",
 			giveDagId:  "test-dag",
@@ -89,7 +150,7 @@ func TestDefCommander_RunDag(t *testing.T) {
 			SetStore(mStore)
 
 			c := &DefCommander{}
-			dagIns, err := c.RunDag(tc.giveDagId, tc.giveVars)
+			dagIns, err := c.RunDag(tc.giveDagId, tc.giveVars, tc.giveOps...)
 			assert.Equal(t, tc.wantErr, err)
 			if err == nil {
 				assert.Equal(t, tc.wantDagIns, dagIns)
@@ -183,8 +244,7 @@ func TestDefCommander_RetryDagIns(t *testing.T) {
 
 			mKeep := &MockKeeper{}
 			mKeep.On("IsAlive", mock.Anything).Return(true, nil)
-			mKeep.On("AliveNodes").Run(func(args mock.Arguments) {
-			}).Return([]string{"alive-node-1"}, nil)
+			mKeep.On("AliveNodesWithLabels").Return([]Node{{WorkerKey: "alive-node-1"}}, nil)
 			SetKeeper(mKeep)
 
 			c := &DefCommander{}
@@ -200,7 +260,8 @@ func TestDefCommander_RetryTask(t *testing.T) {
 		caseDesc             string
 		giveTaskInsID        []string
 		giveIsAlive          bool
-		giveAliveNodes       []string
+		giveDagIns           *entity.DagInstance
+		giveAliveNodes       []Node
 		giveAliveNodesErr    error
 		wantErr              error
 		wantUpdateDagIns     *entity.DagInstance
@@ -218,10 +279,14 @@ func TestDefCommander_RetryTask(t *testing.T) {
 			},
 		},
 		{
-			caseDesc:       "unhealthy worker",
-			giveTaskInsID:  []string{"test task"},
-			giveIsAlive:    false,
-			giveAliveNodes: []string{"1", "2"},
+			caseDesc:      "unhealthy worker",
+			giveTaskInsID: []string{"test task"},
+			giveIsAlive:   false,
+			giveAliveNodes: []Node{
+				{WorkerKey: "1", Capacity: 10, Running: 8},
+				{WorkerKey: "2", Capacity: 10, Running: 2},
+				{WorkerKey: "3", Draining: true},
+			},
 			wantUpdateDagIns: &entity.DagInstance{
 				Worker: "2",
 				Cmd: &entity.Command{
@@ -231,11 +296,45 @@ func TestDefCommander_RetryTask(t *testing.T) {
 			},
 			wantAliveNodesCalled: true,
 		},
+		{
+			caseDesc:      "unhealthy worker with node selector",
+			giveTaskInsID: []string{"test task"},
+			giveIsAlive:   false,
+			giveDagIns:    &entity.DagInstance{Status: entity.DagInstanceStatusFailed, NodeSelector: "gpu=true"},
+			giveAliveNodes: []Node{
+				{WorkerKey: "1", Labels: map[string]string{"gpu": "true"}, Capacity: 10, Running: 8},
+				{WorkerKey: "2", Capacity: 10, Running: 2},
+			},
+			wantUpdateDagIns: &entity.DagInstance{
+				Worker: "1",
+				Cmd: &entity.Command{
+					Name:             entity.CommandNameRetry,
+					TargetTaskInsIDs: []string{"test task"},
+				},
+			},
+			wantAliveNodesCalled: true,
+		},
+		{
+			caseDesc:             "no alive node",
+			giveTaskInsID:        []string{"test task"},
+			giveIsAlive:          false,
+			giveAliveNodes:       []Node{},
+			wantAliveNodesCalled: true,
+			wantErr:              data.ErrNoAliveNodes,
+		},
+		{
+			caseDesc:             "no matched node",
+			giveTaskInsID:        []string{"test task"},
+			giveIsAlive:          false,
+			giveAliveNodes:       []Node{{WorkerKey: "1", Draining: true}},
+			wantAliveNodesCalled: true,
+			wantErr:              fmt.Errorf("no alive worker matches the node selector[]: %w", data.ErrNoAliveNodes),
+		},
 		{
 			caseDesc:             "get alive nodes failed",
 			giveTaskInsID:        []string{"test task"},
 			giveIsAlive:          false,
-			giveAliveNodes:       []string{"1", "2"},
+			giveAliveNodes:       []Node{{WorkerKey: "1"}},
 			giveAliveNodesErr:    fmt.Errorf("get failed"),
 			wantAliveNodesCalled: true,
 			wantErr:              fmt.Errorf("get failed"),
@@ -252,9 +351,11 @@ func TestDefCommander_RetryTask(t *testing.T) {
 			}).Return([]*entity.TaskInstance{
 				{},
 			}, nil)
-			mStore.On("GetDagInstance", mock.Anything).Return(&entity.DagInstance{
-				Status: entity.DagInstanceStatusFailed,
-			}, nil)
+			giveDagIns := tc.giveDagIns
+			if giveDagIns == nil {
+				giveDagIns = &entity.DagInstance{Status: entity.DagInstanceStatusFailed}
+			}
+			mStore.On("GetDagInstance", mock.Anything).Return(giveDagIns, nil)
 			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
 				assert.Equal(t, tc.wantUpdateDagIns, args.Get(0))
 			}).Return(nil)
@@ -263,7 +364,7 @@ func TestDefCommander_RetryTask(t *testing.T) {
 			isCalled := false
 			mKeep := &MockKeeper{}
 			mKeep.On("IsAlive", mock.Anything).Return(tc.giveIsAlive, nil)
-			mKeep.On("AliveNodes").Run(func(args mock.Arguments) {
+			mKeep.On("AliveNodesWithLabels").Run(func(args mock.Arguments) {
 				isCalled = true
 			}).Return(tc.giveAliveNodes, tc.giveAliveNodesErr)
 			SetKeeper(mKeep)
@@ -276,6 +377,139 @@ func TestDefCommander_RetryTask(t *testing.T) {
 	}
 }
 
+func TestDefCommander_ApproveTask(t *testing.T) {
+	tests := []struct {
+		caseDesc         string
+		giveTaskInsID    []string
+		giveReject       bool
+		giveDagIns       *entity.DagInstance
+		wantErr          error
+		wantUpdateDagIns *entity.DagInstance
+	}{
+		{
+			caseDesc:      "approve",
+			giveTaskInsID: []string{"test task"},
+			giveDagIns:    &entity.DagInstance{Status: entity.DagInstanceStatusBlocked},
+			wantUpdateDagIns: &entity.DagInstance{
+				Cmd: &entity.Command{
+					Name:             entity.CommandNameApprove,
+					TargetTaskInsIDs: []string{"test task"},
+					Operator:         "ops",
+					Comment:          "lgtm",
+				},
+			},
+		},
+		{
+			caseDesc:      "reject",
+			giveTaskInsID: []string{"test task"},
+			giveReject:    true,
+			giveDagIns:    &entity.DagInstance{Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagIns: &entity.DagInstance{
+				Cmd: &entity.Command{
+					Name:             entity.CommandNameReject,
+					TargetTaskInsIDs: []string{"test task"},
+					Operator:         "ops",
+					Comment:          "lgtm",
+				},
+			},
+		},
+		{
+			caseDesc:      "dag instance finished",
+			giveTaskInsID: []string{"test task"},
+			giveDagIns:    &entity.DagInstance{Status: entity.DagInstanceStatusSuccess},
+			wantErr:       fmt.Errorf("you can only approve tasks of a running or blocked dag instance"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return([]*entity.TaskInstance{
+				{},
+			}, nil)
+			mStore.On("GetDagInstance", mock.Anything).Return(tc.giveDagIns, nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, tc.wantUpdateDagIns, args.Get(0))
+			}).Return(nil)
+			SetStore(mStore)
+
+			mKeep := &MockKeeper{}
+			mKeep.On("IsAlive", mock.Anything).Return(true, nil)
+			SetKeeper(mKeep)
+
+			c := &DefCommander{}
+			var err error
+			if tc.giveReject {
+				err = c.RejectTask(tc.giveTaskInsID, "ops", "lgtm")
+			} else {
+				err = c.ApproveTask(tc.giveTaskInsID, "ops", "lgtm")
+			}
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
+
+func TestDefCommander_CancelDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc         string
+		giveIsAlive      bool
+		giveDagIns       *entity.DagInstance
+		wantErr          error
+		wantUpdateDagIns *entity.DagInstance
+	}{
+		{
+			caseDesc:    "normal",
+			giveIsAlive: true,
+			giveDagIns:  &entity.DagInstance{Worker: "1", Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagIns: &entity.DagInstance{
+				Worker: "1",
+				Cmd:    &entity.Command{Name: entity.CommandNameCancelAll},
+			},
+		},
+		{
+			caseDesc:   "unhealthy worker",
+			giveDagIns: &entity.DagInstance{Worker: "1", Status: entity.DagInstanceStatusPaused},
+			wantUpdateDagIns: &entity.DagInstance{
+				Worker: "2",
+				Cmd:    &entity.Command{Name: entity.CommandNameCancelAll},
+			},
+		},
+		{
+			caseDesc:   "init",
+			giveDagIns: &entity.DagInstance{Status: entity.DagInstanceStatusInit},
+			wantUpdateDagIns: &entity.DagInstance{
+				Cmd: &entity.Command{Name: entity.CommandNameCancelAll},
+			},
+		},
+		{
+			caseDesc:    "finished",
+			giveIsAlive: true,
+			giveDagIns:  &entity.DagInstance{Worker: "1", Status: entity.DagInstanceStatusFailed},
+			wantErr:     fmt.Errorf("you can only cancel an init, scheduled, running, blocked or paused dag instance"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &MockStore{}
+			mStore.On("GetDagInstance", "dag1").Return(tc.giveDagIns, nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, tc.wantUpdateDagIns, args.Get(0))
+			}).Return(nil)
+			SetStore(mStore)
+
+			mKeep := &MockKeeper{}
+			mKeep.On("IsAlive", mock.Anything).Return(tc.giveIsAlive, nil)
+			mKeep.On("AliveNodesWithLabels").Return([]Node{{WorkerKey: "2"}}, nil)
+			SetKeeper(mKeep)
+
+			c := &DefCommander{}
+			err := c.CancelDagIns("dag1")
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
+
 func TestDefCommander_CancelTask(t *testing.T) {
 
 }
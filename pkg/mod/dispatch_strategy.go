@@ -0,0 +1,90 @@
+package mod
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/linclin/fastflow/pkg/entity"
+)
+
+const (
+	// DispatchStrategyRoundRobin assign the dag instances to workers in turn
+	DispatchStrategyRoundRobin = "round-robin"
+	// DispatchStrategyLeastLoaded assign the dag instance to the worker which has the lowest load
+	DispatchStrategyLeastLoaded = "least-loaded"
+	// DispatchStrategyConsistentHash assign the instances of the same dag to the same worker
+	// as long as the alive workers do not change
+	DispatchStrategyConsistentHash = "consistent-hash"
+)
+
+// DispatchStrategy choose a worker for the dag instance, the candidates are alive,
+// match the node selector of dag instance and are not saturated, so there is at least one candidate
+type DispatchStrategy interface {
+	Select(dagIns *entity.DagInstance, candidates []*Node) *Node
+}
+
+// NewDispatchStrategy new a dispatch strategy by name, default is round-robin
+func NewDispatchStrategy(name string) (DispatchStrategy, error) {
+	switch name {
+	case "", DispatchStrategyRoundRobin:
+		return &RoundRobinStrategy{}, nil
+	case DispatchStrategyLeastLoaded:
+		return &LeastLoadedStrategy{}, nil
+	case DispatchStrategyConsistentHash:
+		return &ConsistentHashStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("dispatch strategy[%s] is not supported", name)
+	}
+}
+
+// RoundRobinStrategy
+type RoundRobinStrategy struct {
+	next int
+}
+
+// Select
+func (s *RoundRobinStrategy) Select(dagIns *entity.DagInstance, candidates []*Node) *Node {
+	n := candidates[s.next%len(candidates)]
+	s.next++
+	return n
+}
+
+// LeastLoadedStrategy compare the ratio of running to capacity,
+// the worker which did not report capacity is compared by its running count
+type LeastLoadedStrategy struct{}
+
+// Select
+func (s *LeastLoadedStrategy) Select(dagIns *entity.DagInstance, candidates []*Node) *Node {
+	selected := candidates[0]
+	for _, n := range candidates[1:] {
+		if load(n) < load(selected) {
+			selected = n
+		}
+	}
+	return selected
+}
+
+func load(n *Node) float64 {
+	if n.Capacity > 0 {
+		return float64(n.Running) / float64(n.Capacity)
+	}
+	return float64(n.Running)
+}
+
+// ConsistentHashStrategy uses rendezvous hashing by dag id,
+// when a worker is gone, only the dags assigned to it are moved to others
+type ConsistentHashStrategy struct{}
+
+// Select
+func (s *ConsistentHashStrategy) Select(dagIns *entity.DagInstance, candidates []*Node) *Node {
+	var selected *Node
+	var maxScore uint64
+	for _, n := range candidates {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(dagIns.DagID + "/" + n.WorkerKey))
+		if score := h.Sum64(); selected == nil || score > maxScore {
+			selected, maxScore = n, score
+		}
+	}
+	return selected
+}
@@ -0,0 +1,101 @@
+package mod
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDispatchStrategy(t *testing.T) {
+	tests := []struct {
+		giveName string
+		wantRet  DispatchStrategy
+		wantErr  error
+	}{
+		{giveName: "", wantRet: &RoundRobinStrategy{}},
+		{giveName: DispatchStrategyRoundRobin, wantRet: &RoundRobinStrategy{}},
+		{giveName: DispatchStrategyLeastLoaded, wantRet: &LeastLoadedStrategy{}},
+		{giveName: DispatchStrategyConsistentHash, wantRet: &ConsistentHashStrategy{}},
+		{giveName: "random", wantErr: fmt.Errorf("dispatch strategy[random] is not supported")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.giveName, func(t *testing.T) {
+			ret, err := NewDispatchStrategy(tc.giveName)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantRet, ret)
+		})
+	}
+}
+
+func TestRoundRobinStrategy_Select(t *testing.T) {
+	nodes := []*Node{{WorkerKey: "worker-1"}, {WorkerKey: "worker-2"}}
+	s := &RoundRobinStrategy{}
+	var ret []string
+	for i := 0; i < 3; i++ {
+		ret = append(ret, s.Select(&entity.DagInstance{}, nodes).WorkerKey)
+	}
+	assert.Equal(t, []string{"worker-1", "worker-2", "worker-1"}, ret)
+}
+
+func TestLeastLoadedStrategy_Select(t *testing.T) {
+	tests := []struct {
+		caseDesc  string
+		giveNodes []*Node
+		wantKey   string
+	}{
+		{
+			caseDesc: "ratio",
+			giveNodes: []*Node{
+				{WorkerKey: "worker-1", Capacity: 10, Running: 5},
+				{WorkerKey: "worker-2", Capacity: 100, Running: 10},
+				{WorkerKey: "worker-3", Capacity: 10, Running: 2},
+			},
+			wantKey: "worker-2",
+		},
+		{
+			caseDesc: "no capacity",
+			giveNodes: []*Node{
+				{WorkerKey: "worker-1", Running: 3},
+				{WorkerKey: "worker-2", Running: 1},
+			},
+			wantKey: "worker-2",
+		},
+		{
+			caseDesc: "same load",
+			giveNodes: []*Node{
+				{WorkerKey: "worker-1"},
+				{WorkerKey: "worker-2"},
+			},
+			wantKey: "worker-1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			s := &LeastLoadedStrategy{}
+			assert.Equal(t, tc.wantKey, s.Select(&entity.DagInstance{}, tc.giveNodes).WorkerKey)
+		})
+	}
+}
+
+func TestConsistentHashStrategy_Select(t *testing.T) {
+	nodes := []*Node{{WorkerKey: "worker-1"}, {WorkerKey: "worker-2"}, {WorkerKey: "worker-3"}}
+	s := &ConsistentHashStrategy{}
+
+	// the instances of same dag are assigned to the same worker
+	selected := map[string]*Node{}
+	for i := 0; i < 20; i++ {
+		dagID := fmt.Sprintf("dag-%d", i)
+		selected[dagID] = s.Select(&entity.DagInstance{DagID: dagID}, nodes)
+		assert.Equal(t, selected[dagID], s.Select(&entity.DagInstance{DagID: dagID}, nodes))
+	}
+
+	// only the dags of the removed worker are moved
+	for dagID, n := range selected {
+		if n.WorkerKey == "worker-3" {
+			continue
+		}
+		assert.Equal(t, n, s.Select(&entity.DagInstance{DagID: dagID}, nodes[:2]))
+	}
+}
@@ -1,6 +1,8 @@
 package mod
 
 import (
+	"fmt"
+
 	"github.com/linclin/fastflow/pkg/entity"
 	"github.com/linclin/fastflow/pkg/event"
 	"github.com/linclin/fastflow/pkg/log"
@@ -10,17 +12,51 @@ import (
 	"time"
 )
 
+const (
+	activeRunsQueryLimit = 1000
+	// dispatchPageSize is the count of init dag instances loaded at a time,
+	// it also limits the count of dag instances dispatched in a round
+	dispatchPageSize = 1000
+)
+
+// dispatchResult is the result of dispatching a dag instance
+type dispatchResult int
+
+const (
+	// dispatchUnchanged means the instance keeps waiting and has nothing to write
+	dispatchUnchanged dispatchResult = iota
+	// dispatchScheduled means the instance is scheduled to a worker
+	dispatchScheduled
+	// dispatchCanceled means the instance is canceled before dispatching
+	dispatchCanceled
+	// dispatchWaiting means the instance keeps waiting with a new reason
+	dispatchWaiting
+)
+
+// activeDagInsStatus are the status of dag instances which occupy the max active runs
+var activeDagInsStatus = []entity.DagInstanceStatus{
+	entity.DagInstanceStatusScheduled,
+	entity.DagInstanceStatusRunning,
+	entity.DagInstanceStatusBlocked,
+	entity.DagInstanceStatusPaused,
+}
+
 // DefDispatcher
 type DefDispatcher struct {
-	closeCh chan struct{}
+	strategy DispatchStrategy
+	closeCh  chan struct{}
 
 	wg sync.WaitGroup
 }
 
-// NewDefDispatcher
-func NewDefDispatcher() *DefDispatcher {
+// NewDefDispatcher new a dispatcher with strategy, default is round-robin
+func NewDefDispatcher(strategy DispatchStrategy) *DefDispatcher {
+	if strategy == nil {
+		strategy = &RoundRobinStrategy{}
+	}
 	return &DefDispatcher{
-		closeCh: make(chan struct{}),
+		strategy: strategy,
+		closeCh:  make(chan struct{}),
 	}
 }
 
@@ -54,36 +90,214 @@ func (d *DefDispatcher) WatchInitDags() {
 
 // Do dispatch
 func (d *DefDispatcher) Do() error {
-	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
-		Status: []entity.DagInstanceStatus{
-			entity.DagInstanceStatusInit,
-		},
-		Limit: 1000,
-	})
-	if err != nil {
-		return err
+	var nodes []Node
+	limiter := &activeRunsLimiter{activeCnt: map[string]int{}}
+	var scheduledDagIns, canceledDagIns, waitingDagIns []*entity.DagInstance
+	seen := map[string]struct{}{}
+	// the instances which wait in queue keep their priority, so page the init instances until enough ones
+	// are dispatched, otherwise the dispatchable instances behind the waiting ones are starved
+	for offset := int64(0); ; offset += dispatchPageSize {
+		dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+			Status: []entity.DagInstanceStatus{
+				entity.DagInstanceStatusInit,
+			},
+			Limit:           dispatchPageSize,
+			Offset:          offset,
+			OrderByPriority: true,
+		})
+		if err != nil {
+			return err
+		}
+		if len(dagIns) == 0 {
+			break
+		}
+		if nodes == nil {
+			if nodes, err = GetKeeper().AliveNodesWithLabels(); err != nil {
+				return err
+			}
+			if len(nodes) == 0 {
+				return data.ErrNoAliveNodes
+			}
+		}
+
+		// the store releases the high priority instances first, and FIFO for the same priority
+		for i := range dagIns {
+			// the instance may be listed again if others are inserted before it meanwhile
+			if _, ok := seen[dagIns[i].ID]; ok {
+				continue
+			}
+			seen[dagIns[i].ID] = struct{}{}
+			ret, err := d.dispatch(dagIns[i], nodes, limiter)
+			if err != nil {
+				return err
+			}
+			switch ret {
+			case dispatchScheduled:
+				scheduledDagIns = append(scheduledDagIns, dagIns[i])
+			case dispatchCanceled:
+				canceledDagIns = append(canceledDagIns, dagIns[i])
+			case dispatchWaiting:
+				waitingDagIns = append(waitingDagIns, dagIns[i])
+			}
+		}
+		if len(dagIns) < dispatchPageSize || len(scheduledDagIns) >= dispatchPageSize || !hasFreeWorker(nodes) {
+			break
+		}
+	}
+
+	// all writes are deferred to the end of round, so that the offsets of pages are not shifted,
+	// and they are fenced by the leader epoch, a stale leader cannot overwrite the new one
+	epoch := GetKeeper().LeaderEpoch()
+	if len(canceledDagIns) > 0 {
+		if err := GetStore().BatchUpdateDagIns(canceledDagIns, WithLeaderEpoch(epoch), WithClearCmd()); err != nil {
+			return err
+		}
 	}
-	if len(dagIns) == 0 {
-		return nil
+	if updated := append(scheduledDagIns, waitingDagIns...); len(updated) > 0 {
+		if err := GetStore().BatchUpdateDagIns(updated, WithLeaderEpoch(epoch)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	nodes, err := GetKeeper().AliveNodes()
+// dispatch select a worker for the dag instance and change it in memory, the result tells how to write it
+func (d *DefDispatcher) dispatch(dagIns *entity.DagInstance, nodes []Node, limiter *activeRunsLimiter) (dispatchResult, error) {
+	// the instance canceled before dispatching has no task to cancel, so just fail it
+	if dagIns.Cmd != nil && dagIns.Cmd.Name == entity.CommandNameCancelAll {
+		dagIns.Fail(ReasonDagInsCanceled)
+		dagIns.Cmd = nil
+		return dispatchCanceled, nil
+	}
+	reason, err := limiter.check(dagIns)
 	if err != nil {
-		return err
+		return dispatchUnchanged, err
 	}
-	if len(nodes) == 0 {
-		return data.ErrNoAliveNodes
+	var candidates []*Node
+	if reason == "" {
+		candidates, reason = selectCandidates(dagIns, nodes)
 	}
+	if len(candidates) == 0 {
+		// leave it in init, the reason tells users why it is not dispatched, and it is only written when changed
+		if dagIns.Reason != reason {
+			dagIns.Reason = reason
+			return dispatchWaiting, nil
+		}
+		return dispatchUnchanged, nil
+	}
+
+	worker := d.strategy.Select(dagIns, candidates)
+	// the new instance will run at least one task, count it before next heart beat
+	worker.Running++
+	dagIns.Status = entity.DagInstanceStatusScheduled
+	dagIns.Worker = worker.WorkerKey
+	dagIns.Reason = ""
+	limiter.acquire(dagIns)
+	return dispatchScheduled, nil
+}
 
-	for i := range dagIns {
-		dagIns[i].Status = entity.DagInstanceStatusScheduled
-		dagIns[i].Worker = nodes[i%len(nodes)]
+// hasFreeWorker return if there is any worker which can take new dag instances
+func hasFreeWorker(nodes []Node) bool {
+	for i := range nodes {
+		if !nodes[i].Draining && !nodes[i].Saturated() {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := GetStore().BatchUpdateDagIns(dagIns); err != nil {
-		return err
+// selectCandidates return the matched workers which are not saturated,
+// if there is no candidate, it also returns the reason
+func selectCandidates(dagIns *entity.DagInstance, nodes []Node) ([]*Node, string) {
+	workers, reason := matchWorkers(dagIns, nodes)
+	if len(workers) == 0 {
+		return nil, reason
 	}
-	return nil
+
+	var candidates []*Node
+	for _, w := range workers {
+		if !w.Saturated() {
+			candidates = append(candidates, w)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Sprintf("all workers matching the node selector[%s] are saturated", dagIns.NodeSelector)
+	}
+	return candidates, ""
+}
+
+// matchWorkers return the workers which are not draining and whose labels match the node selector of dag instance,
+// if there is no one matched, it also returns the reason
+func matchWorkers(dagIns *entity.DagInstance, nodes []Node) ([]*Node, string) {
+	var selectors []data.Selector
+	if dagIns.NodeSelector != "" {
+		var err error
+		selectors, err = data.PareSelectors(dagIns.NodeSelector)
+		if err != nil {
+			return nil, fmt.Sprintf("node selector[%s] is invalid: %s", dagIns.NodeSelector, err)
+		}
+	}
+
+	var workers []*Node
+	for i := range nodes {
+		if !nodes[i].Draining && data.MatchSelectors(selectors, nodes[i].Labels) {
+			workers = append(workers, &nodes[i])
+		}
+	}
+	if len(workers) == 0 {
+		return nil, fmt.Sprintf("no alive worker matches the node selector[%s]", dagIns.NodeSelector)
+	}
+	return workers, ""
+}
+
+// activeRunsLimiter enforce the max active runs of dag instances in a dispatching round,
+// the instances having the same concurrency key are in a group, otherwise the instances of the same dag are
+type activeRunsLimiter struct {
+	activeCnt map[string]int
+}
+
+func concurrencyGroup(dagIns *entity.DagInstance) (string, *ListDagInstanceInput) {
+	input := &ListDagInstanceInput{
+		Status: activeDagInsStatus,
+		Limit:  activeRunsQueryLimit,
+	}
+	if dagIns.ConcurrencyKey != "" {
+		input.ConcurrencyKey = dagIns.ConcurrencyKey
+		return fmt.Sprintf("concurrency key[%s]", dagIns.ConcurrencyKey), input
+	}
+	input.DagID = dagIns.DagID
+	return fmt.Sprintf("dag[%s]", dagIns.DagID), input
+}
+
+// check return the reason if the active runs of the group reach the limit
+func (l *activeRunsLimiter) check(dagIns *entity.DagInstance) (string, error) {
+	if dagIns.MaxActiveRuns <= 0 {
+		return "", nil
+	}
+
+	group, input := concurrencyGroup(dagIns)
+	cnt, ok := l.activeCnt[group]
+	if !ok {
+		ret, err := GetStore().ListDagInstance(input)
+		if err != nil {
+			return "", fmt.Errorf("list active dag instances of %s failed: %w", group, err)
+		}
+		cnt = len(ret)
+		l.activeCnt[group] = cnt
+	}
+	if cnt >= dagIns.MaxActiveRuns {
+		return fmt.Sprintf("the active runs of %s reach the limit[%d], wait in queue", group, dagIns.MaxActiveRuns), nil
+	}
+	return "", nil
+}
+
+// acquire count the dag instance which is dispatched in this round
+func (l *activeRunsLimiter) acquire(dagIns *entity.DagInstance) {
+	if dagIns.MaxActiveRuns <= 0 {
+		return
+	}
+	group, _ := concurrencyGroup(dagIns)
+	l.activeCnt[group]++
 }
 
 func (d *DefDispatcher) handlerErr(err error) {
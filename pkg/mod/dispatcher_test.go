@@ -16,44 +16,120 @@ func TestDefDispatcher_Do(t *testing.T) {
 		caseDesc              string
 		giveListRet           []*entity.DagInstance
 		giveListErr           error
-		giveAliveNodes        []string
+		giveAliveNodes        []Node
 		giveAliveErr          error
 		giveBatchUpdateErr    error
 		wantErr               error
 		wantAliveNodeCalled   bool
 		wantBatchUpdateCalled bool
 		wantBatchUpdateInput  []*entity.DagInstance
+		wantCanceledInput     []*entity.DagInstance
 	}{
 		{
 			caseDesc: "sanity",
 			giveListRet: []*entity.DagInstance{
-				{},
-				{},
-				{},
-				{},
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}},
+				{BaseInfo: entity.BaseInfo{ID: "ins3"}},
+				{BaseInfo: entity.BaseInfo{ID: "ins4"}},
 			},
-			giveAliveNodes:      []string{"worker-1", "worker-2", "worker-3"},
+			giveAliveNodes:      []Node{{WorkerKey: "worker-1"}, {WorkerKey: "worker-2"}, {WorkerKey: "worker-3"}},
 			wantAliveNodeCalled: true,
 			wantBatchUpdateInput: []*entity.DagInstance{
 				{
-					Status: entity.DagInstanceStatusScheduled,
-					Worker: "worker-1",
+					BaseInfo: entity.BaseInfo{ID: "ins1"},
+					Status:   entity.DagInstanceStatusScheduled,
+					Worker:   "worker-1",
 				},
 				{
-					Status: entity.DagInstanceStatusScheduled,
-					Worker: "worker-2",
+					BaseInfo: entity.BaseInfo{ID: "ins2"},
+					Status:   entity.DagInstanceStatusScheduled,
+					Worker:   "worker-2",
 				},
 				{
-					Status: entity.DagInstanceStatusScheduled,
-					Worker: "worker-3",
+					BaseInfo: entity.BaseInfo{ID: "ins3"},
+					Status:   entity.DagInstanceStatusScheduled,
+					Worker:   "worker-3",
 				},
 				{
-					Status: entity.DagInstanceStatusScheduled,
-					Worker: "worker-1",
+					BaseInfo: entity.BaseInfo{ID: "ins4"},
+					Status:   entity.DagInstanceStatusScheduled,
+					Worker:   "worker-1",
 				},
 			},
 			wantBatchUpdateCalled: true,
 		},
+		{
+			caseDesc: "node selector",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, NodeSelector: "zone=a"},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, NodeSelector: "zone in (a,b)", Reason: "old reason"},
+				{BaseInfo: entity.BaseInfo{ID: "ins3"}, NodeSelector: "zone=c"},
+				{BaseInfo: entity.BaseInfo{ID: "ins4"}, NodeSelector: "zone=c", Reason: "no alive worker matches the node selector[zone=c]"},
+				{BaseInfo: entity.BaseInfo{ID: "ins5"}, NodeSelector: "zone>c"},
+			},
+			giveAliveNodes: []Node{
+				{WorkerKey: "worker-1", Labels: map[string]string{"zone": "a"}},
+				{WorkerKey: "worker-2", Labels: map[string]string{"zone": "b"}},
+				{WorkerKey: "worker-3"},
+			},
+			wantAliveNodeCalled: true,
+			wantBatchUpdateInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, NodeSelector: "zone=a", Status: entity.DagInstanceStatusScheduled, Worker: "worker-1"},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, NodeSelector: "zone in (a,b)", Status: entity.DagInstanceStatusScheduled, Worker: "worker-2"},
+				{BaseInfo: entity.BaseInfo{ID: "ins3"}, NodeSelector: "zone=c", Reason: "no alive worker matches the node selector[zone=c]"},
+				{BaseInfo: entity.BaseInfo{ID: "ins5"}, NodeSelector: "zone>c", Reason: "node selector[zone>c] is invalid: selector string 'zone>c' operator is not '=' or 'in'"},
+			},
+			wantBatchUpdateCalled: true,
+		},
+		{
+			caseDesc: "saturated worker",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}},
+				{BaseInfo: entity.BaseInfo{ID: "ins3"}, NodeSelector: "zone=a"},
+			},
+			giveAliveNodes: []Node{
+				{WorkerKey: "worker-1", Capacity: 10, Running: 10, Labels: map[string]string{"zone": "a"}},
+				{WorkerKey: "worker-2", Capacity: 10, Running: 1},
+			},
+			wantAliveNodeCalled: true,
+			wantBatchUpdateInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusScheduled, Worker: "worker-2"},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusScheduled, Worker: "worker-2"},
+				{BaseInfo: entity.BaseInfo{ID: "ins3"}, NodeSelector: "zone=a", Reason: "all workers matching the node selector[zone=a] are saturated"},
+			},
+			wantBatchUpdateCalled: true,
+		},
+		{
+			caseDesc: "draining worker",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}},
+			},
+			giveAliveNodes: []Node{
+				{WorkerKey: "worker-1", Draining: true},
+				{WorkerKey: "worker-2"},
+			},
+			wantAliveNodeCalled: true,
+			wantBatchUpdateInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusScheduled, Worker: "worker-2"},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusScheduled, Worker: "worker-2"},
+			},
+			wantBatchUpdateCalled: true,
+		},
+		{
+			caseDesc: "no worker matched",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, NodeSelector: "zone=a"},
+			},
+			giveAliveNodes:      []Node{{WorkerKey: "worker-1"}},
+			wantAliveNodeCalled: true,
+			wantBatchUpdateInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, NodeSelector: "zone=a", Reason: "no alive worker matches the node selector[zone=a]"},
+			},
+			wantBatchUpdateCalled: true,
+		},
 		{
 			caseDesc:    "list failed",
 			giveListErr: fmt.Errorf("list failed"),
@@ -73,14 +149,30 @@ func TestDefDispatcher_Do(t *testing.T) {
 		{
 			caseDesc:            "no alive node",
 			giveListRet:         []*entity.DagInstance{{}},
-			giveAliveNodes:      []string{},
+			giveAliveNodes:      []Node{},
 			wantErr:             data.ErrNoAliveNodes,
 			wantAliveNodeCalled: true,
 		},
+		{
+			caseDesc: "canceled before dispatching",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Cmd: &entity.Command{Name: entity.CommandNameCancelAll}},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}},
+			},
+			giveAliveNodes:      []Node{{WorkerKey: "node"}},
+			wantAliveNodeCalled: true,
+			wantCanceledInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusFailed, Reason: ReasonDagInsCanceled},
+			},
+			wantBatchUpdateInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusScheduled, Worker: "node"},
+			},
+			wantBatchUpdateCalled: true,
+		},
 		{
 			caseDesc:           "batch update failed",
 			giveListRet:        []*entity.DagInstance{{}},
-			giveAliveNodes:     []string{"node"},
+			giveAliveNodes:     []Node{{WorkerKey: "node"}},
 			giveBatchUpdateErr: fmt.Errorf("batch update failed"),
 			wantErr:            fmt.Errorf("batch update failed"),
 			wantBatchUpdateInput: []*entity.DagInstance{
@@ -93,26 +185,37 @@ func TestDefDispatcher_Do(t *testing.T) {
 
 	for _, tc := range tests {
 		calledList, calledAlive, calledBatch := false, false, false
+		var batchInput, canceledInput []*entity.DagInstance
 		litInput := &ListDagInstanceInput{
-			Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit},
-			Limit:  1000,
+			Status:          []entity.DagInstanceStatus{entity.DagInstanceStatusInit},
+			Limit:           1000,
+			OrderByPriority: true,
 		}
-		d := NewDefDispatcher()
+		d := NewDefDispatcher(nil)
 		mStore := &MockStore{}
 		mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
 			calledList = true
 			assert.Equal(t, litInput, args.Get(0), tc.caseDesc)
 		}).Return(tc.giveListRet, tc.giveListErr)
-		mStore.On("BatchUpdateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+		mStore.On("BatchUpdateDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 			calledBatch = true
-			assert.Equal(t, tc.wantBatchUpdateInput, args.Get(0), tc.caseDesc)
+			batchInput = append(batchInput, args.Get(0).([]*entity.DagInstance)...)
+			opt := NewUpdateOption([]UpdateOptionOp{args.Get(1).(UpdateOptionOp)})
+			assert.Equal(t, int64(2), opt.LeaderEpoch, tc.caseDesc)
 		}).Return(tc.giveBatchUpdateErr)
+		// the canceled instances are written with their cmd cleared
+		mStore.On("BatchUpdateDagIns", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			canceledInput = append(canceledInput, args.Get(0).([]*entity.DagInstance)...)
+			opt := NewUpdateOption([]UpdateOptionOp{args.Get(1).(UpdateOptionOp), args.Get(2).(UpdateOptionOp)})
+			assert.Equal(t, UpdateOption{LeaderEpoch: 2, ClearCmd: true}, *opt, tc.caseDesc)
+		}).Return(nil)
 		SetStore(mStore)
 
 		mKeeper := &MockKeeper{}
-		mKeeper.On("AliveNodes").Run(func(args mock.Arguments) {
+		mKeeper.On("AliveNodesWithLabels").Run(func(args mock.Arguments) {
 			calledAlive = true
 		}).Return(tc.giveAliveNodes, tc.giveAliveErr)
+		mKeeper.On("LeaderEpoch").Return(int64(2))
 		SetKeeper(mKeeper)
 
 		err := d.Do()
@@ -120,6 +223,8 @@ func TestDefDispatcher_Do(t *testing.T) {
 		assert.True(t, calledList, tc.caseDesc)
 		assert.Equal(t, tc.wantAliveNodeCalled, calledAlive, tc.caseDesc)
 		assert.Equal(t, tc.wantBatchUpdateCalled, calledBatch, tc.caseDesc)
+		assert.Equal(t, tc.wantBatchUpdateInput, batchInput, tc.caseDesc)
+		assert.Equal(t, tc.wantCanceledInput, canceledInput, tc.caseDesc)
 	}
 }
 
@@ -128,7 +233,7 @@ func TestDefDispatcher_InitAndClose(t *testing.T) {
 		caseDesc              string
 		giveListRet           []*entity.DagInstance
 		giveListErr           error
-		giveAliveNodes        []string
+		giveAliveNodes        []Node
 		giveAliveErr          error
 		giveBatchUpdateErr    error
 		wantAliveNodeCalled   bool
@@ -141,7 +246,7 @@ func TestDefDispatcher_InitAndClose(t *testing.T) {
 			giveListRet: []*entity.DagInstance{
 				{},
 			},
-			giveAliveNodes:      []string{"node"},
+			giveAliveNodes:      []Node{{WorkerKey: "node"}},
 			wantAliveNodeCalled: true,
 			wantBatchUpdateInput: []*entity.DagInstance{
 				{
@@ -162,25 +267,27 @@ func TestDefDispatcher_InitAndClose(t *testing.T) {
 		t.Run(tc.caseDesc, func(t *testing.T) {
 			calledList, calledAlive, calledBatch, calledLog := false, false, false, false
 			litInput := &ListDagInstanceInput{
-				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit},
-				Limit:  1000,
+				Status:          []entity.DagInstanceStatus{entity.DagInstanceStatusInit},
+				Limit:           1000,
+				OrderByPriority: true,
 			}
-			d := NewDefDispatcher()
+			d := NewDefDispatcher(nil)
 			mStore := &MockStore{}
 			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
 				calledList = true
 				assert.Equal(t, litInput, args.Get(0), tc.caseDesc)
 			}).Return(tc.giveListRet, tc.giveListErr)
-			mStore.On("BatchUpdateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+			mStore.On("BatchUpdateDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 				calledBatch = true
 				assert.Equal(t, tc.wantBatchUpdateInput, args.Get(0), tc.caseDesc)
 			}).Return(tc.giveBatchUpdateErr)
 			SetStore(mStore)
 
 			mKeeper := &MockKeeper{}
-			mKeeper.On("AliveNodes").Run(func(args mock.Arguments) {
+			mKeeper.On("AliveNodesWithLabels").Run(func(args mock.Arguments) {
 				calledAlive = true
 			}).Return(tc.giveAliveNodes, tc.giveAliveErr)
+			mKeeper.On("LeaderEpoch").Return(int64(2))
 			SetKeeper(mKeeper)
 
 			mLogger := &log.MockLogger{}
@@ -199,3 +306,172 @@ func TestDefDispatcher_InitAndClose(t *testing.T) {
 	}
 	log.SetLogger(&log.StdoutLogger{})
 }
+
+func TestDefDispatcher_DoMaxActiveRuns(t *testing.T) {
+	tests := []struct {
+		caseDesc      string
+		giveListRet   []*entity.DagInstance
+		giveActiveRet map[string][]*entity.DagInstance
+		giveActiveErr error
+		wantErr       error
+		wantScheduled []string
+		wantWaiting   []*entity.DagInstance
+	}{
+		{
+			caseDesc: "limit by dag",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins2", CreatedAt: 2}, DagID: "dag1", MaxActiveRuns: 2},
+				{BaseInfo: entity.BaseInfo{ID: "ins3", CreatedAt: 3}, DagID: "dag1", MaxActiveRuns: 2},
+				{BaseInfo: entity.BaseInfo{ID: "ins4", CreatedAt: 4}, DagID: "dag2"},
+			},
+			giveActiveRet: map[string][]*entity.DagInstance{
+				"dag1": {{BaseInfo: entity.BaseInfo{ID: "ins1"}}},
+			},
+			wantScheduled: []string{"ins2", "ins4"},
+			wantWaiting: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins3", CreatedAt: 3}, DagID: "dag1", MaxActiveRuns: 2, Reason: "the active runs of dag[dag1] reach the limit[2], wait in queue"},
+			},
+		},
+		{
+			caseDesc: "limit by concurrency key",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1", CreatedAt: 1}, DagID: "dag1", MaxActiveRuns: 1, ConcurrencyKey: "cluster-a"},
+				{BaseInfo: entity.BaseInfo{ID: "ins2", CreatedAt: 2}, DagID: "dag2", MaxActiveRuns: 1, ConcurrencyKey: "cluster-a"},
+				{BaseInfo: entity.BaseInfo{ID: "ins3", CreatedAt: 3}, DagID: "dag1", MaxActiveRuns: 1, ConcurrencyKey: "cluster-b"},
+			},
+			wantScheduled: []string{"ins1", "ins3"},
+			wantWaiting: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins2", CreatedAt: 2}, DagID: "dag2", MaxActiveRuns: 1, ConcurrencyKey: "cluster-a", Reason: "the active runs of concurrency key[cluster-a] reach the limit[1], wait in queue"},
+			},
+		},
+		{
+			// the store orders the instances by priority
+			caseDesc: "priority first",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins2", CreatedAt: 2}, DagID: "dag1", MaxActiveRuns: 1, Priority: 1},
+				{BaseInfo: entity.BaseInfo{ID: "ins1", CreatedAt: 1}, DagID: "dag1", MaxActiveRuns: 1},
+			},
+			wantScheduled: []string{"ins2"},
+			wantWaiting: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1", CreatedAt: 1}, DagID: "dag1", MaxActiveRuns: 1, Reason: "the active runs of dag[dag1] reach the limit[1], wait in queue"},
+			},
+		},
+		{
+			caseDesc: "list active failed",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, DagID: "dag1", MaxActiveRuns: 1},
+			},
+			giveActiveErr: fmt.Errorf("list failed"),
+			wantErr:       fmt.Errorf("list active dag instances of dag[dag1] failed: %w", fmt.Errorf("list failed")),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var scheduled []string
+			var waiting []*entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Return(func(input *ListDagInstanceInput) []*entity.DagInstance {
+				if input.Status[0] == entity.DagInstanceStatusInit {
+					return tc.giveListRet
+				}
+				assert.Equal(t, activeDagInsStatus, input.Status)
+				return tc.giveActiveRet[input.DagID+input.ConcurrencyKey]
+			}, func(input *ListDagInstanceInput) error {
+				if input.Status[0] == entity.DagInstanceStatusInit {
+					return nil
+				}
+				return tc.giveActiveErr
+			})
+			mStore.On("BatchUpdateDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				for _, dagIns := range args.Get(0).([]*entity.DagInstance) {
+					if dagIns.Status == entity.DagInstanceStatusScheduled {
+						scheduled = append(scheduled, dagIns.ID)
+						continue
+					}
+					waiting = append(waiting, dagIns)
+				}
+			}).Return(nil)
+			SetStore(mStore)
+
+			mKeeper := &MockKeeper{}
+			mKeeper.On("AliveNodesWithLabels").Return([]Node{{WorkerKey: "worker-1"}}, nil)
+			mKeeper.On("LeaderEpoch").Return(int64(1))
+			SetKeeper(mKeeper)
+
+			err := NewDefDispatcher(nil).Do()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantScheduled, scheduled)
+			assert.Equal(t, tc.wantWaiting, waiting)
+		})
+	}
+}
+
+func TestDefDispatcher_DoPaging(t *testing.T) {
+	waitReason := "the active runs of dag[busy] reach the limit[1], wait in queue"
+	var waiting []*entity.DagInstance
+	for i := 0; i < dispatchPageSize; i++ {
+		waiting = append(waiting, &entity.DagInstance{
+			BaseInfo:      entity.BaseInfo{ID: fmt.Sprintf("busy-%d", i), CreatedAt: int64(i)},
+			DagID:         "busy",
+			MaxActiveRuns: 1,
+			Priority:      1,
+			Reason:        waitReason,
+		})
+	}
+	pages := [][]*entity.DagInstance{
+		waiting,
+		{{BaseInfo: entity.BaseInfo{ID: "free"}, DagID: "free"}},
+	}
+
+	tests := []struct {
+		caseDesc      string
+		giveNodes     []Node
+		wantOffsets   []int64
+		wantScheduled []string
+	}{
+		{
+			caseDesc:      "page until dispatchable instances are found",
+			giveNodes:     []Node{{WorkerKey: "worker-1", Capacity: 10}},
+			wantOffsets:   []int64{0, dispatchPageSize},
+			wantScheduled: []string{"free"},
+		},
+		{
+			caseDesc:    "stop paging when all workers are saturated",
+			giveNodes:   []Node{{WorkerKey: "worker-1", Capacity: 10, Running: 10}},
+			wantOffsets: []int64{0},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var offsets []int64
+			var scheduled []string
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Return(func(input *ListDagInstanceInput) []*entity.DagInstance {
+				if input.Status[0] != entity.DagInstanceStatusInit {
+					return []*entity.DagInstance{{BaseInfo: entity.BaseInfo{ID: "running"}, DagID: "busy"}}
+				}
+				offsets = append(offsets, input.Offset)
+				if page := int(input.Offset / dispatchPageSize); page < len(pages) {
+					return pages[page]
+				}
+				return nil
+			}, nil)
+			mStore.On("BatchUpdateDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				for _, dagIns := range args.Get(0).([]*entity.DagInstance) {
+					scheduled = append(scheduled, dagIns.ID)
+				}
+			}).Return(nil)
+			SetStore(mStore)
+
+			mKeeper := &MockKeeper{}
+			mKeeper.On("AliveNodesWithLabels").Return(tc.giveNodes, nil)
+			mKeeper.On("LeaderEpoch").Return(int64(1))
+			SetKeeper(mKeeper)
+
+			assert.NoError(t, NewDefDispatcher(nil).Do())
+			assert.Equal(t, tc.wantOffsets, offsets)
+			// the unchanged reason of waiting instances is not written again
+			assert.Equal(t, tc.wantScheduled, scheduled)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package mod
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/event"
+	"github.com/linclin/fastflow/pkg/log"
+	"github.com/shiningrush/goevent"
+)
+
+const (
+	ReasonWorkerDrained = "the worker is drained, wait for dispatching again"
+
+	// DrainStageWaiting means the worker is waiting for its running task instances
+	DrainStageWaiting = "waiting"
+	// DrainStageReleasing means the worker is releasing its remaining dag instances
+	DrainStageReleasing = "releasing"
+	// DrainStageCompleted means the worker can exit now
+	DrainStageCompleted = "completed"
+
+	drainReleaseLimit = 1000
+)
+
+// drainCheckInterval is the interval of checking running task instances
+var drainCheckInterval = time.Second
+
+// Drain stop the worker taking new dag instances and starting new task instances,
+// the task instances waiting for pool slots are dropped because they have not started,
+// then wait for the running task instances until they are completed or ctx is done,
+// at last release the remaining scheduled and running dag instances to init, so that other workers can take them.
+// the dag instances whose task instances are still running after ctx done are kept by this worker,
+// they will be taken over by watch dog after the worker exits and handled by the failover policy of their actions.
+// the progress is published by event.WorkerDraining
+func Drain(ctx context.Context) error {
+	if err := GetKeeper().SetDraining(true); err != nil {
+		return fmt.Errorf("set draining failed: %w", err)
+	}
+	// the parked task instances are not counted as running, their dag instances would be kept as busy otherwise
+	if ids := GetExecutor().ReleaseParkedTaskIns(); len(ids) > 0 {
+		log.Infof("task instances%v waiting for pool slots are dropped, they will be executed by other workers", ids)
+	}
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	waiting := true
+	for waiting {
+		_, running := WorkerLoad()
+		publishDrainProgress(DrainStageWaiting, running, 0)
+		if running == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			log.Warnf("drain deadline exceeded, %d task instances are still running", running)
+			waiting = false
+		case <-ticker.C:
+		}
+	}
+
+	_, running := WorkerLoad()
+	publishDrainProgress(DrainStageReleasing, running, 0)
+	released, err := releaseDagIns()
+	if err != nil {
+		return fmt.Errorf("release dag instances failed: %w", err)
+	}
+	publishDrainProgress(DrainStageCompleted, running, released)
+	return nil
+}
+
+// releaseDagIns give the scheduled and running dag instances of this worker back to dispatcher,
+// except the ones which still have running task instances, otherwise their tasks would be executed twice
+func releaseDagIns() (int, error) {
+	busy, err := busyDagIns()
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	lastID := ""
+	for {
+		dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+			Worker: GetKeeper().WorkerKey(),
+			Status: []entity.DagInstanceStatus{
+				entity.DagInstanceStatusScheduled,
+				entity.DagInstanceStatusRunning,
+			},
+			Limit:     drainReleaseLimit,
+			OrderByID: true,
+			AfterID:   lastID,
+		})
+		if err != nil {
+			return released, err
+		}
+		for i := range dagIns {
+			lastID = dagIns[i].ID
+			if busy[dagIns[i].ID] {
+				log.Warnf("dag instance[%s] still has running task instances, it will not be released", dagIns[i].ID)
+				continue
+			}
+			// drop the tree before releasing, so that the commands will not be handled by this worker any more
+			GetParser().ReleaseDagIns(dagIns[i].ID)
+			if err := GetStore().PatchDagIns(&entity.DagInstance{
+				BaseInfo: dagIns[i].BaseInfo,
+				Status:   entity.DagInstanceStatusInit,
+				Reason:   ReasonWorkerDrained,
+			}); err != nil {
+				return released, err
+			}
+			released++
+		}
+		if len(dagIns) < drainReleaseLimit {
+			return released, nil
+		}
+	}
+}
+
+// busyDagIns return the dag instances which have task instances running in the executor
+func busyDagIns() (map[string]bool, error) {
+	busy := map[string]bool{}
+	ids := GetExecutor().RunningTaskIns()
+	if len(ids) == 0 {
+		return busy, nil
+	}
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		IDs: ids,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list running task instances failed: %w", err)
+	}
+	for _, t := range tasks {
+		busy[t.DagInsID] = true
+	}
+	return busy, nil
+}
+
+func publishDrainProgress(stage string, running, released int) {
+	log.Info("worker is draining",
+		"module", "drain",
+		"stage", stage,
+		"runningTaskCnt", running,
+		"releasedDagInsCnt", released)
+	goevent.Publish(&event.WorkerDraining{
+		WorkerKey:         GetKeeper().WorkerKey(),
+		Stage:             stage,
+		RunningTaskCnt:    running,
+		ReleasedDagInsCnt: released,
+	})
+}
@@ -0,0 +1,207 @@
+package mod
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/entity/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDrain(t *testing.T) {
+	oldInterval := drainCheckInterval
+	drainCheckInterval = 10 * time.Millisecond
+	defer func() {
+		drainCheckInterval = oldInterval
+	}()
+
+	tests := []struct {
+		caseDesc       string
+		giveSetErr     error
+		giveRunning    []int
+		giveTimeout    time.Duration
+		giveListRet    []*entity.DagInstance
+		giveListErr    error
+		giveTaskIns    []*entity.TaskInstance
+		wantErr        error
+		wantPatchInput []*entity.DagInstance
+	}{
+		{
+			caseDesc:    "running task completed",
+			giveRunning: []int{2, 1, 0},
+			giveTimeout: time.Minute,
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusScheduled},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusRunning},
+			},
+			wantPatchInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusInit, Reason: ReasonWorkerDrained},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusInit, Reason: ReasonWorkerDrained},
+			},
+		},
+		{
+			caseDesc:    "deadline exceeded",
+			giveRunning: []int{1},
+			giveTimeout: 50 * time.Millisecond,
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusRunning},
+			},
+			giveTaskIns: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, DagInsID: "ins1"},
+			},
+			wantPatchInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusInit, Reason: ReasonWorkerDrained},
+			},
+		},
+		{
+			caseDesc:    "set draining failed",
+			giveSetErr:  fmt.Errorf("set failed"),
+			giveTimeout: time.Minute,
+			wantErr:     fmt.Errorf("set draining failed: %w", fmt.Errorf("set failed")),
+		},
+		{
+			caseDesc:    "list failed",
+			giveRunning: []int{0},
+			giveTimeout: time.Minute,
+			giveListErr: fmt.Errorf("list failed"),
+			wantErr:     fmt.Errorf("release dag instances failed: %w", fmt.Errorf("list failed")),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mKeeper := &MockKeeper{}
+			mKeeper.On("SetDraining", true).Return(tc.giveSetErr)
+			mKeeper.On("WorkerKey").Return("worker-1")
+			SetKeeper(mKeeper)
+
+			loadCnt := 0
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Load").Return(func() int {
+				return 10
+			}, func() int {
+				running := tc.giveRunning[len(tc.giveRunning)-1]
+				if loadCnt < len(tc.giveRunning) {
+					running = tc.giveRunning[loadCnt]
+				}
+				loadCnt++
+				return running
+			})
+			var runningIds []string
+			for _, t := range tc.giveTaskIns {
+				runningIds = append(runningIds, t.ID)
+			}
+			mExecutor.On("RunningTaskIns").Return(runningIds)
+			mExecutor.On("ReleaseParkedTaskIns").Return([]string(nil))
+			SetExecutor(mExecutor)
+
+			var releaseIds []string
+			mParser := &MockParser{}
+			mParser.On("ReleaseDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				releaseIds = append(releaseIds, args.String(0))
+			})
+			SetParser(mParser)
+
+			var patchInput []*entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, &ListDagInstanceInput{
+					Worker:    "worker-1",
+					Status:    []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled, entity.DagInstanceStatusRunning},
+					Limit:     drainReleaseLimit,
+					OrderByID: true,
+				}, args.Get(0))
+			}).Return(tc.giveListRet, tc.giveListErr)
+			mStore.On("ListTaskInstance", &ListTaskInstanceInput{IDs: runningIds}).Return(tc.giveTaskIns, nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				patchInput = append(patchInput, args.Get(0).(*entity.DagInstance))
+			}).Return(nil)
+			SetStore(mStore)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.giveTimeout)
+			defer cancel()
+			err := Drain(ctx)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantPatchInput, patchInput)
+			var wantReleaseIds []string
+			for _, d := range tc.wantPatchInput {
+				wantReleaseIds = append(wantReleaseIds, d.ID)
+			}
+			assert.Equal(t, wantReleaseIds, releaseIds)
+		})
+	}
+	SetExecutor(nil)
+}
+
+func TestDrain_ParkedTaskIns(t *testing.T) {
+	// the only slot is held by other worker
+	slots := &fakeSlots{locked: map[string]bool{poolSlotKey("api", 0): true}}
+	mKeeper := &MockKeeper{}
+	mKeeper.On("SetDraining", true).Return(nil)
+	mKeeper.On("WorkerKey").Return("worker-1")
+	mKeeper.On("NewMutex", mock.Anything).Return(func(key string) DistributedMutex {
+		return &fakeSlotMutex{key: key, slots: slots}
+	})
+	SetKeeper(mKeeper)
+
+	e := NewDefExecutor(time.Minute, 1, WithPools(map[string]int{"api": 1}))
+	SetExecutor(e)
+	defer SetExecutor(nil)
+	newTaskIns := func(id string) (*entity.TaskInstance, context.Context) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		t.Cleanup(cancel)
+		taskIns := &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: id}, DagInsID: "ins1", Pool: "api"}
+		taskIns.InitialDep(run.NewDefExecuteContext(ctx, nil, nil, nil, nil, nil), func(*entity.TaskInstance) error {
+			return nil
+		}, nil)
+		e.cancelMap.Store(id, cancel)
+		return taskIns, ctx
+	}
+	parkedIns, parkedCtx := newTaskIns("task1")
+	release, err := e.acquirePoolSlots(parkedIns)
+	assert.NoError(t, err)
+	assert.Nil(t, release)
+	assert.Equal(t, []string{"task1"}, e.RunningTaskIns())
+
+	var releaseIds []string
+	mParser := &MockParser{}
+	mParser.On("ReleaseDagIns", mock.Anything).Run(func(args mock.Arguments) {
+		releaseIds = append(releaseIds, args.String(0))
+	})
+	SetParser(mParser)
+
+	var patchInput []*entity.DagInstance
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.Anything).Return([]*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusRunning},
+	}, nil)
+	mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+		patchInput = append(patchInput, args.Get(0).(*entity.DagInstance))
+	}).Return(nil)
+	SetStore(mStore)
+
+	// the parked task instance has not started, so its dag instance is released instead of being kept as busy
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	assert.NoError(t, Drain(ctx))
+	assert.Equal(t, []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusInit, Reason: ReasonWorkerDrained},
+	}, patchInput)
+	assert.Equal(t, []string{"ins1"}, releaseIds)
+	assert.Empty(t, e.RunningTaskIns())
+	assert.Error(t, parkedCtx.Err())
+	mStore.AssertNotCalled(t, "ListTaskInstance", mock.Anything)
+
+	// the draining pool does not park task instances any more
+	lateIns, _ := newTaskIns("task2")
+	release, err = e.acquirePoolSlots(lateIns)
+	assert.NoError(t, err)
+	assert.Nil(t, release)
+	assert.Empty(t, e.RunningTaskIns())
+	assert.Empty(t, e.pools["api"].parked)
+	assert.Empty(t, e.pools["api"].waiting)
+}
@@ -2,9 +2,11 @@ package mod
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/linclin/fastflow/pkg/render"
@@ -21,19 +23,24 @@ import (
 const (
 	ReasonSuccessAfterCanceled = "success after canceled"
 	ReasonParentCancel         = "parent success but already be canceled"
+	ReasonDagInsCanceled       = "dag instance is canceled"
 )
 
 // DefExecutor
 type DefExecutor struct {
 	cancelMap    sync.Map
 	workerNumber int
-	workerQueue  chan *entity.TaskInstance
+	workerQueue  *taskInsQueue
 	workerWg     sync.WaitGroup
 	initWg       sync.WaitGroup
 	timeout      time.Duration
 	initQueue    chan *initPayload
 
 	paramRender *render.TplRender
+	pools       map[string]*resourcePool
+
+	// runningCnt is the count of task instances which are executing or waiting for a free worker
+	runningCnt int64
 
 	closeCh chan struct{}
 	lock    sync.RWMutex
@@ -45,15 +52,35 @@ type initPayload struct {
 	taskIns *entity.TaskInstance
 }
 
+// ExecutorOption
+type ExecutorOption struct {
+	// Pools are the named resource pools, key is the pool name and value is the count of slots
+	Pools map[string]int
+}
+
+type ExecutorOptionOp func(opt *ExecutorOption)
+
+// WithPools define the resource pools which tasks can reference
+func WithPools(pools map[string]int) ExecutorOptionOp {
+	return func(opt *ExecutorOption) {
+		opt.Pools = pools
+	}
+}
+
 // NewDefExecutor
-func NewDefExecutor(timeout time.Duration, workers int) *DefExecutor {
+func NewDefExecutor(timeout time.Duration, workers int, ops ...ExecutorOptionOp) *DefExecutor {
+	opt := &ExecutorOption{}
+	for _, op := range ops {
+		op(opt)
+	}
 	return &DefExecutor{
 		workerNumber: workers,
-		workerQueue:  make(chan *entity.TaskInstance),
+		workerQueue:  newTaskInsQueue(),
 		timeout:      timeout,
 		initQueue:    make(chan *initPayload),
 		closeCh:      make(chan struct{}, 1),
 		paramRender:  render.NewTplRender(),
+		pools:        newResourcePools(opt.Pools),
 	}
 }
 
@@ -69,8 +96,13 @@ func (e *DefExecutor) Init() {
 }
 
 func (e *DefExecutor) subWorkerQueue() {
-	for taskIns := range e.workerQueue {
+	for {
+		taskIns, ok := e.workerQueue.Pop()
+		if !ok {
+			break
+		}
 		e.workerDo(taskIns)
+		atomic.AddInt64(&e.runningCnt, -1)
 	}
 	e.workerWg.Done()
 }
@@ -105,23 +137,99 @@ func (e *DefExecutor) initWorkerTask(dagIns *entity.DagInstance, taskIns *entity
 		defTimeout = time.Duration(taskIns.TimeoutSecs) * time.Second
 	}
 	c, cancel := context.WithTimeout(context.TODO(), defTimeout)
+	c = run.WithTaskInsInfo(c, run.TaskInsInfo{DagInsID: taskIns.DagInsID, TaskInsID: taskIns.ID})
 	dagIns.ShareData.Save = func(data *entity.ShareData) error {
 		return GetStore().PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: taskIns.DagInsID}, ShareData: data})
 	}
 	taskIns.InitialDep(
-		run.NewDefExecuteContext(c, dagIns.ShareData, taskIns.Trace, dagIns.VarsGetter(), dagIns.VarsIterator()),
+		run.NewDefExecuteContext(c, &recordShareData{ShareDataOperator: dagIns.ShareData, taskIns: taskIns}, taskIns.Trace, dagIns.VarsGetter(), dagIns.VarsIterator(), taskIns.SetOutput),
 		func(instance *entity.TaskInstance) error {
 			return GetStore().PatchTaskIns(instance)
 		}, dagIns)
 	e.cancelMap.Store(taskIns.ID, cancel)
-	e.workerQueue <- taskIns
+	atomic.AddInt64(&e.runningCnt, 1)
+	e.workerQueue.Push(taskIns, dagIns.Priority)
 }
 
-// Push task to execute
+// Load return the count of workers and the count of running task instances
+func (e *DefExecutor) Load() (capacity, running int) {
+	return e.workerNumber, int(atomic.LoadInt64(&e.runningCnt))
+}
+
+// RunningTaskIns return the ids of task instances which are executing or waiting for a free worker
+func (e *DefExecutor) RunningTaskIns() []string {
+	var ids []string
+	e.cancelMap.Range(func(key, value interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	return ids
+}
+
+// recordShareData records the keys written by the task instance,
+// so that they can be cleared when the task instance is rerun
+type recordShareData struct {
+	run.ShareDataOperator
+	taskIns *entity.TaskInstance
+	mux     sync.Mutex
+}
+
+// Set
+func (r *recordShareData) Set(key string, val string) {
+	r.ShareDataOperator.Set(key, val)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, k := range r.taskIns.ShareDataKeys {
+		if k == key {
+			return
+		}
+	}
+	r.taskIns.ShareDataKeys = append(r.taskIns.ShareDataKeys, key)
+}
+
+// withTaskOutputs let the dag instance get the outputs of its task instances from store
+func withTaskOutputs(dagIns *entity.DagInstance) {
+	dagIns.TaskOutputs = func() (map[string]entity.StringMap, error) {
+		taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+			DagInsID: dagIns.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		outputs := map[string]entity.StringMap{}
+		for _, t := range taskIns {
+			if len(t.Outputs) > 0 {
+				outputs[t.TaskID] = t.Outputs
+			}
+		}
+		return outputs, nil
+	}
+}
+
+// Push task to execute, the task instance waiting for the backoff of automatic retry is pushed by parser after the backoff
 func (e *DefExecutor) Push(dagIns *entity.DagInstance, taskIns *entity.TaskInstance) {
+	// the draining worker does not start new task instances, they will be executed by the worker taking over
+	if GetKeeper().IsDraining() {
+		log.Infof("worker is draining, task instance[%s] will not be executed here", taskIns.ID)
+		return
+	}
+
+	withTaskOutputs(dagIns)
 	isActive, err := taskIns.DoPreCheck(dagIns)
 	if err != nil {
 		log.Errorf("do task pre-check failed:%s", err)
+		// a pre-check which cannot be evaluated fails the task instead of leaving it pending forever
+		taskIns.Status = entity.TaskInstanceStatusFailed
+		taskIns.Reason = err.Error()
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: taskIns.BaseInfo,
+			Status:   taskIns.Status,
+			Reason:   taskIns.Reason,
+		}); err != nil {
+			log.Errorf("patch task[%s] failed: %s", taskIns.ID, err)
+			return
+		}
+		GetParser().EntryTaskIns(taskIns)
 		return
 	}
 
@@ -167,10 +275,19 @@ func (e *DefExecutor) workerDo(taskIns *entity.TaskInstance) {
 		return
 	}
 
+	release, err := e.acquirePoolSlots(taskIns)
+	if err == nil && release == nil {
+		// the task instance is parked in the pool, and it will be pushed again
+		return
+	}
+
 	goevent.Publish(&event.TaskBegin{
 		TaskIns: taskIns,
 	})
-	err := e.runAction(taskIns)
+	if err == nil {
+		err = e.runAction(taskIns)
+		release()
+	}
 	e.handleTaskError(taskIns, err)
 	e.cancelMap.Delete(taskIns.ID)
 	GetParser().EntryTaskIns(taskIns)
@@ -179,27 +296,144 @@ func (e *DefExecutor) workerDo(taskIns *entity.TaskInstance) {
 	})
 }
 
+// acquirePoolSlots acquire the slots of pool which task instance references without waiting,
+// when the slots are not enough, it parks the task instance in the pool and returns nil release function,
+// so that the worker can execute other task instances
+func (e *DefExecutor) acquirePoolSlots(taskIns *entity.TaskInstance) (func(), error) {
+	if taskIns.Pool == "" {
+		return func() {}, nil
+	}
+	pool, ok := e.pools[taskIns.Pool]
+	if !ok {
+		return nil, fmt.Errorf("pool[%s] is not defined", taskIns.Pool)
+	}
+	release, err := pool.tryAcquire(taskIns)
+	if err != nil || release != nil {
+		return release, err
+	}
+	if !pool.park(taskIns, func() {
+		e.requeue(taskIns)
+	}) {
+		// the task instance has not started, leave it to the worker taking over its dag instance
+		_ = e.CancelTaskIns([]string{taskIns.ID})
+	}
+	return nil, nil
+}
+
+// ReleaseParkedTaskIns drop the task instances waiting for pool slots and stop parking new ones,
+// they have not started, so they can be executed by the workers taking over their dag instances
+func (e *DefExecutor) ReleaseParkedTaskIns() []string {
+	var ids []string
+	for _, p := range e.pools {
+		for _, taskIns := range p.drain() {
+			_ = e.CancelTaskIns([]string{taskIns.ID})
+			ids = append(ids, taskIns.ID)
+		}
+	}
+	return ids
+}
+
+// requeue push the task instance which is already initialized to the worker queue again
+func (e *DefExecutor) requeue(taskIns *entity.TaskInstance) {
+	priority := 0
+	if taskIns.RelatedDagInstance != nil {
+		priority = taskIns.RelatedDagInstance.Priority
+	}
+	atomic.AddInt64(&e.runningCnt, 1)
+	e.workerQueue.Push(taskIns, priority)
+}
+
 func (e *DefExecutor) runAction(taskIns *entity.TaskInstance) error {
 	act := ActionMap[taskIns.ActionName]
 	if act == nil {
 		return fmt.Errorf("action not found: %s", taskIns.ActionName)
 	}
 
+	p, err := e.newActionParams(act, taskIns)
+	if err != nil {
+		return err
+	}
+	return taskIns.Run(p, act)
+}
+
+// newActionParams decode the params of task instance to the parameter of action,
+// it returns nil if the action does not need parameter
+func (e *DefExecutor) newActionParams(act run.Action, taskIns *entity.TaskInstance) (interface{}, error) {
 	if taskIns.Params == nil {
-		return taskIns.Run(nil, act)
+		return nil, nil
 	}
 	paramAct, ok := act.(run.ParameterAction)
 	if !ok {
-		return taskIns.Run(nil, act)
+		return nil, nil
 	}
 	p := paramAct.ParameterNew()
 	if p == nil {
-		return taskIns.Run(nil, act)
+		return nil, nil
 	}
 	if err := e.getFromTaskInstance(taskIns, p); err != nil {
-		return fmt.Errorf("get task params from task instance failed: %w", err)
+		return nil, fmt.Errorf("get task params from task instance failed: %w", err)
 	}
-	return taskIns.Run(p, act)
+	return p, nil
+}
+
+// Compensate undo the succeeded task instance by the compensate action, it blocks until the action returned
+func (e *DefExecutor) Compensate(dagIns *entity.DagInstance, taskIns *entity.TaskInstance) error {
+	timeout := e.timeout
+	if taskIns.Compensate.TimeoutSecs != 0 {
+		timeout = time.Duration(taskIns.Compensate.TimeoutSecs) * time.Second
+	}
+	c, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+	c = run.WithTaskInsInfo(c, run.TaskInsInfo{DagInsID: taskIns.DagInsID, TaskInsID: taskIns.ID})
+	dagIns.ShareData.Save = func(data *entity.ShareData) error {
+		return GetStore().PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: taskIns.DagInsID}, ShareData: data})
+	}
+	withTaskOutputs(dagIns)
+	taskIns.InitialDep(
+		run.NewDefExecuteContext(c, dagIns.ShareData, taskIns.TraceCompensation, dagIns.VarsGetter(), dagIns.VarsIterator(), taskIns.SetOutput),
+		func(instance *entity.TaskInstance) error {
+			return GetStore().PatchTaskIns(instance)
+		}, dagIns)
+
+	act, p, err := e.newCompensateAction(taskIns)
+	if err != nil {
+		// record the reason like a failed compensation, so that users can find it at the task instance
+		taskIns.Compensation = &entity.Compensation{Status: entity.CompensationStatusFailed, Reason: err.Error()}
+		if pErr := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo:     entity.BaseInfo{ID: taskIns.ID},
+			Compensation: taskIns.Compensation,
+		}); pErr != nil {
+			log.Errorf("patch task[%s] failed: %s", taskIns.ID, pErr)
+		}
+		return err
+	}
+	return taskIns.RunCompensate(p, act)
+}
+
+// newCompensateAction return the compensate action of task instance and its parameter
+func (e *DefExecutor) newCompensateAction(taskIns *entity.TaskInstance) (run.CompensateAction, interface{}, error) {
+	actName := taskIns.ActionName
+	if taskIns.Compensate.ActionName != "" {
+		actName = taskIns.Compensate.ActionName
+	}
+	act := ActionMap[actName]
+	if act == nil {
+		return nil, nil, fmt.Errorf("action not found: %s", actName)
+	}
+	compensateAct, ok := act.(run.CompensateAction)
+	if !ok {
+		return nil, nil, fmt.Errorf("action[%s] can not compensate", actName)
+	}
+
+	// the task instance is only used to compensate, so its params can be replaced to render
+	if taskIns.Compensate.Params != nil {
+		taskIns.Params = taskIns.Compensate.Params
+	}
+	p, err := e.newActionParams(act, taskIns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return compensateAct, p, nil
 }
 
 func (e *DefExecutor) getFromTaskInstance(taskIns *entity.TaskInstance, params interface{}) error {
@@ -237,9 +471,25 @@ func (e *DefExecutor) renderParams(taskIns *entity.TaskInstance) error {
 			data["shareData"] = dagInstance.ShareData.Dict
 		}
 	}
+	if taskIns.MappedFrom != "" {
+		var item interface{}
+		if err := json.Unmarshal([]byte(taskIns.MapItem), &item); err != nil {
+			return fmt.Errorf("unmarshal mapped item failed: %w", err)
+		}
+		data["item"] = item
+		data["itemIndex"] = taskIns.MapIndex
+	}
 
 	err := value.MapValue(taskIns.Params).WalkString(func(walkContext *value.WalkContext, v string) error {
 		if strings.Contains(v, "{{") && strings.Contains(v, "}}") {
+			// the outputs are loaded from store only when they are referenced
+			if _, ok := data["tasks"]; !ok && strings.Contains(v, ".tasks") {
+				tasks, err := taskOutputsData(dagInstance)
+				if err != nil {
+					return fmt.Errorf("get task outputs failed: %w", err)
+				}
+				data["tasks"] = tasks
+			}
 			result, err := e.paramRender.Render(v, data)
 			if err != nil {
 				return err
@@ -255,6 +505,22 @@ func (e *DefExecutor) renderParams(taskIns *entity.TaskInstance) error {
 	return nil
 }
 
+// taskOutputsData build the render data of task outputs, it is like `{"<taskId>": {"outputs": {"<key>": <value>}}}`
+func taskOutputsData(dagIns *entity.DagInstance) (map[string]interface{}, error) {
+	tasks := map[string]interface{}{}
+	if dagIns == nil || dagIns.TaskOutputs == nil {
+		return tasks, nil
+	}
+	outputs, err := dagIns.TaskOutputs()
+	if err != nil {
+		return nil, err
+	}
+	for taskId, o := range outputs {
+		tasks[taskId] = map[string]interface{}{"outputs": map[string]interface{}(o)}
+	}
+	return tasks, nil
+}
+
 // Close
 func (e *DefExecutor) Close() {
 	e.lock.Lock()
@@ -265,13 +531,25 @@ func (e *DefExecutor) Close() {
 
 	close(e.initQueue)
 	e.initWg.Wait()
-	close(e.workerQueue)
+	for _, p := range e.pools {
+		p.close()
+	}
+	e.workerQueue.Close()
 	e.workerWg.Wait()
 }
 
 func (e *DefExecutor) handleTaskError(taskIns *entity.TaskInstance, err error) {
 	_, ok := e.cancelMap.Load(taskIns.ID)
 	if err != nil {
+		if ok && taskIns.CanAutoRetry(err) {
+			if err := taskIns.AutoRetry(err); err != nil {
+				log.Error("set task instance retrying failed",
+					"task_id", taskIns.ID,
+					"err", err)
+			}
+			return
+		}
+
 		taskIns.Reason = err.Error()
 		setStatus := entity.TaskInstanceStatusFailed
 		if !ok {
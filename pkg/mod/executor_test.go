@@ -115,7 +115,7 @@ func TestDefExecutor_initWorkerTask(t *testing.T) {
 		{
 			name: "sync trace",
 			giveExecutor: &DefExecutor{
-				workerQueue: make(chan *entity.TaskInstance, 1),
+				workerQueue: newTaskInsQueue(),
 				timeout:     time.Second,
 				initQueue:   make(chan *initPayload, 1),
 			},
@@ -150,7 +150,7 @@ func TestDefExecutor_initWorkerTask(t *testing.T) {
 			name:         "after action trace",
 			giveTraceOpt: run.TraceOpPersistAfterAction,
 			giveExecutor: &DefExecutor{
-				workerQueue: make(chan *entity.TaskInstance, 1),
+				workerQueue: newTaskInsQueue(),
 				timeout:     time.Second,
 				initQueue:   make(chan *initPayload, 1),
 			},
@@ -178,7 +178,7 @@ func TestDefExecutor_initWorkerTask(t *testing.T) {
 			tc.giveExecutor.initWorkerTask(tc.giveDagIns, tc.giveTask)
 			_, ok := tc.giveExecutor.cancelMap.Load(tc.giveTask.ID)
 			assert.True(t, ok)
-			assert.Equal(t, tc.giveDagIns.ShareData, tc.giveTask.Context.ShareData())
+			assert.Equal(t, &recordShareData{ShareDataOperator: tc.giveDagIns.ShareData, taskIns: tc.giveTask}, tc.giveTask.Context.ShareData())
 
 			// check trace infos
 			tc.giveTask.Context.Tracef("test-tracef-%d", 1, tc.giveTraceOpt)
@@ -199,6 +199,19 @@ func TestDefExecutor_initWorkerTask(t *testing.T) {
 	}
 }
 
+func TestRecordShareData_Set(t *testing.T) {
+	shareData := &entity.ShareData{}
+	taskIns := &entity.TaskInstance{}
+	r := &recordShareData{ShareDataOperator: shareData, taskIns: taskIns}
+	r.Set("k1", "v1")
+	r.Set("k2", "v2")
+	r.Set("k1", "v3")
+	v, ok := shareData.Get("k1")
+	assert.True(t, ok)
+	assert.Equal(t, "v3", v)
+	assert.Equal(t, entity.StringArray{"k1", "k2"}, taskIns.ShareDataKeys)
+}
+
 func TestDefExecutor_WorkerDo(t *testing.T) {
 	relatedDagInstance := &entity.DagInstance{
 		Vars: map[string]entity.DagInstanceVar{
@@ -511,6 +524,84 @@ func TestDefExecutor_WorkerDo(t *testing.T) {
 	}
 }
 
+func TestDefExecutor_handleTaskError(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveTaskIns  *entity.TaskInstance
+		giveErr      error
+		isCancel     bool
+		wantStatus   entity.TaskInstanceStatus
+		wantAttempts int
+	}{
+		{
+			caseDesc: "failed without retry policy",
+			giveTaskIns: &entity.TaskInstance{
+				Status: entity.TaskInstanceStatusRunning,
+			},
+			giveErr:    fmt.Errorf("run failed"),
+			wantStatus: entity.TaskInstanceStatusFailed,
+		},
+		{
+			caseDesc: "auto retry",
+			giveTaskIns: &entity.TaskInstance{
+				Status:      entity.TaskInstanceStatusRunning,
+				RetryPolicy: &entity.RetryPolicy{MaxAttempts: 3},
+			},
+			giveErr:      fmt.Errorf("run failed"),
+			wantStatus:   entity.TaskInstanceStatusRetrying,
+			wantAttempts: 1,
+		},
+		{
+			caseDesc: "attempts exhausted",
+			giveTaskIns: &entity.TaskInstance{
+				Status:      entity.TaskInstanceStatusRunning,
+				RetryPolicy: &entity.RetryPolicy{MaxAttempts: 3},
+				Attempts:    2,
+			},
+			giveErr:      fmt.Errorf("run failed"),
+			wantStatus:   entity.TaskInstanceStatusFailed,
+			wantAttempts: 2,
+		},
+		{
+			caseDesc: "error is not retryable",
+			giveTaskIns: &entity.TaskInstance{
+				Status:      entity.TaskInstanceStatusRunning,
+				RetryPolicy: &entity.RetryPolicy{MaxAttempts: 3, RetryableErrors: []string{run.ErrorClassTimeout}},
+			},
+			giveErr:    fmt.Errorf("run failed"),
+			wantStatus: entity.TaskInstanceStatusFailed,
+		},
+		{
+			caseDesc: "canceled",
+			giveTaskIns: &entity.TaskInstance{
+				Status:      entity.TaskInstanceStatusRunning,
+				RetryPolicy: &entity.RetryPolicy{MaxAttempts: 3},
+			},
+			giveErr:    fmt.Errorf("run failed"),
+			isCancel:   true,
+			wantStatus: entity.TaskInstanceStatusCanceled,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched *entity.TaskInstance
+			tc.giveTaskIns.Patch = func(instance *entity.TaskInstance) error {
+				patched = instance
+				return nil
+			}
+			e := &DefExecutor{}
+			if !tc.isCancel {
+				e.cancelMap.Store(tc.giveTaskIns.ID, nil)
+			}
+			e.handleTaskError(tc.giveTaskIns, tc.giveErr)
+			assert.Equal(t, tc.wantStatus, patched.Status)
+			assert.Equal(t, tc.giveErr.Error(), patched.Reason)
+			assert.Equal(t, tc.wantAttempts, patched.Attempts)
+		})
+	}
+}
+
 func TestDefExecutor(t *testing.T) {
 	mStore := &MockStore{}
 	calledUpdateTask, calledEntryTaskIns := false, false
@@ -525,6 +616,10 @@ func TestDefExecutor(t *testing.T) {
 	})
 	SetParser(mParser)
 
+	mKeeper := &MockKeeper{}
+	mKeeper.On("IsDraining").Return(false)
+	SetKeeper(mKeeper)
+
 	e := NewDefExecutor(time.Minute, 100)
 	e.Init()
 	//dagIns := nil
@@ -802,3 +897,134 @@ func TestDefExecutor_renderParams(t *testing.T) {
 		})
 	}
 }
+
+func TestDefExecutor_renderParamsWithTaskOutputs(t *testing.T) {
+	e := &DefExecutor{paramRender: render.NewTplRender()}
+	taskIns := &entity.TaskInstance{
+		RelatedDagInstance: &entity.DagInstance{
+			TaskOutputs: func() (map[string]entity.StringMap, error) {
+				return map[string]entity.StringMap{
+					"build":     {"image": "app:v1"},
+					"get-hosts": {"hosts": []interface{}{"a", "b"}},
+				}, nil
+			},
+		},
+		Params: map[string]interface{}{
+			"image": "{{ .tasks.build.outputs.image }}",
+			"host":  `{{ index (index .tasks "get-hosts").outputs.hosts 1 }}`,
+			"plain": "plain",
+		},
+	}
+	assert.NoError(t, e.renderParams(taskIns))
+	assert.Equal(t, entity.StringMap{
+		"image": "app:v1",
+		"host":  "b",
+		"plain": "plain",
+	}, taskIns.Params)
+
+	taskIns.RelatedDagInstance.TaskOutputs = func() (map[string]entity.StringMap, error) {
+		return nil, fmt.Errorf("list failed")
+	}
+	taskIns.Params = map[string]interface{}{"image": "{{ .tasks.build.outputs.image }}"}
+	assert.Error(t, e.renderParams(taskIns))
+}
+
+type compensateAction struct {
+	run.MockAction
+	params interface{}
+	err    error
+}
+
+func (a *compensateAction) Compensate(ctx run.ExecuteContext, params interface{}) error {
+	ctx.Trace("undo")
+	a.params = params
+	return a.err
+}
+
+func TestDefExecutor_Compensate(t *testing.T) {
+	tests := []struct {
+		caseDesc         string
+		giveCompensate   *entity.Compensate
+		giveErr          error
+		wantErr          string
+		wantParams       interface{}
+		wantCompensation *entity.Compensation
+	}{
+		{
+			caseDesc:       "compensate with params",
+			giveCompensate: &entity.Compensate{Params: entity.StringMap{"field1": "{{.vars.ka.Value}}"}},
+			wantParams:     &TestParam{Field1: "va"},
+			wantCompensation: &entity.Compensation{
+				Status: entity.CompensationStatusSuccess,
+				Traces: []entity.TraceInfo{{Message: "undo"}},
+			},
+		},
+		{
+			caseDesc:       "use the params of task",
+			giveCompensate: &entity.Compensate{},
+			giveErr:        fmt.Errorf("resource is in use"),
+			wantErr:        "compensate failed: resource is in use",
+			wantParams:     &TestParam{Field1: "task"},
+			wantCompensation: &entity.Compensation{
+				Status: entity.CompensationStatusFailed,
+				Reason: "compensate failed: resource is in use",
+				Traces: []entity.TraceInfo{{Message: "undo"}},
+			},
+		},
+		{
+			caseDesc:       "action can not compensate",
+			giveCompensate: &entity.Compensate{ActionName: "noCompensate"},
+			wantErr:        "action[noCompensate] can not compensate",
+			wantCompensation: &entity.Compensation{
+				Status: entity.CompensationStatusFailed,
+				Reason: "action[noCompensate] can not compensate",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			act := &compensateAction{err: tc.giveErr}
+			act.On("Name").Return("test")
+			act.On("ParameterNew").Return(NewTestParam())
+			ActionMap = map[string]run.Action{
+				"test":         act,
+				"noCompensate": &run.MockAction{},
+			}
+
+			var patched *entity.Compensation
+			mStore := &MockStore{}
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patched = args.Get(0).(*entity.TaskInstance).Compensation
+			}).Return(nil)
+			SetStore(mStore)
+
+			e := &DefExecutor{timeout: time.Second, paramRender: render.NewTplRender()}
+			dagIns := &entity.DagInstance{
+				BaseInfo:  entity.BaseInfo{ID: "dag-ins"},
+				Vars:      entity.DagInstanceVars{"ka": {Value: "va"}},
+				ShareData: &entity.ShareData{},
+			}
+			taskIns := &entity.TaskInstance{
+				BaseInfo:   entity.BaseInfo{ID: "task-ins"},
+				DagInsID:   "dag-ins",
+				ActionName: "test",
+				Params:     entity.StringMap{"field1": "task"},
+				Status:     entity.TaskInstanceStatusSuccess,
+				Compensate: tc.giveCompensate,
+			}
+			err := e.Compensate(dagIns, taskIns)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantParams, act.params)
+			for i := range patched.Traces {
+				patched.Traces[i].Time = 0
+			}
+			assert.Equal(t, tc.wantCompensation, patched)
+			assert.Equal(t, entity.TaskInstanceStatusSuccess, taskIns.Status)
+		})
+	}
+}
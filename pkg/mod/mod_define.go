@@ -19,10 +19,20 @@ var (
 
 // Commander used to execute command
 type Commander interface {
-	RunDag(dagId string, specVar map[string]string) (*entity.DagInstance, error)
+	RunDag(dagId string, specVar map[string]string, ops ...CommandOptSetter) (*entity.DagInstance, error)
 	RetryDagIns(dagInsId string, ops ...CommandOptSetter) error
 	RetryTask(taskInsIds []string, ops ...CommandOptSetter) error
 	CancelTask(taskInsIds []string, ops ...CommandOptSetter) error
+	ApproveTask(taskInsIds []string, operator, comment string, ops ...CommandOptSetter) error
+	RejectTask(taskInsIds []string, operator, comment string, ops ...CommandOptSetter) error
+	SkipTask(taskInsIds []string, operator, reason string, ops ...CommandOptSetter) error
+	MarkTaskSuccess(taskInsIds []string, operator, reason string, ops ...CommandOptSetter) error
+	ForceFailTask(taskInsIds []string, operator, reason string, ops ...CommandOptSetter) error
+	RerunFrom(taskInsId string, includeDownstream bool, ops ...CommandOptSetter) error
+	CancelDagIns(dagInsId string, ops ...CommandOptSetter) error
+	PauseDagIns(dagInsId string, ops ...CommandOptSetter) error
+	ResumeDagIns(dagInsId string, ops ...CommandOptSetter) error
+	CompensateDagIns(dagInsId string, ops ...CommandOptSetter) error
 }
 
 // CommandOption
@@ -37,6 +47,14 @@ type CommandOption struct {
 	// syncInterval is just work at sync mode, it is the interval of watch dag instance
 	// default is 500ms
 	syncInterval time.Duration
+	// parentDagInsID and parentTaskInsID are just work at RunDag,
+	// they link the new dag instance to the task instance which runs it
+	parentDagInsID  string
+	parentTaskInsID string
+	// clearShareData is just work at RerunFrom, it clears the share data written by the rerun tasks
+	clearShareData bool
+	// priority is just work at RunDag, it overrides the priority of dag
+	priority *int
 }
 type CommandOptSetter func(opt *CommandOption)
 
@@ -68,6 +86,25 @@ var (
 			}
 		}
 	}
+	// CommParent is just work at RunDag, it links the new dag instance to the task instance which runs it
+	CommParent = func(dagInsId, taskInsId string) CommandOptSetter {
+		return func(opt *CommandOption) {
+			opt.parentDagInsID = dagInsId
+			opt.parentTaskInsID = taskInsId
+		}
+	}
+	// CommClearShareData is just work at RerunFrom, it clears the share data written by the rerun tasks
+	CommClearShareData = func() CommandOptSetter {
+		return func(opt *CommandOption) {
+			opt.clearShareData = true
+		}
+	}
+	// CommPriority is just work at RunDag, it overrides the priority of dag
+	CommPriority = func(priority int) CommandOptSetter {
+		return func(opt *CommandOption) {
+			opt.priority = &priority
+		}
+	}
 )
 
 // SetCommander
@@ -84,6 +121,15 @@ func GetCommander() Commander {
 type Executor interface {
 	Push(dagIns *entity.DagInstance, taskIns *entity.TaskInstance)
 	CancelTaskIns(taskInsIds []string) error
+	// Load return the capacity and the count of running task instances of executor
+	Load() (capacity, running int)
+	// RunningTaskIns return the ids of task instances which are executing or waiting for a free worker
+	RunningTaskIns() []string
+	// ReleaseParkedTaskIns drop the task instances waiting for pool slots and stop parking new ones,
+	// it returns the ids of dropped task instances
+	ReleaseParkedTaskIns() []string
+	// Compensate undo the succeeded task instance synchronously, the result is recorded to its compensation
+	Compensate(dagIns *entity.DagInstance, taskIns *entity.TaskInstance) error
 }
 
 // SetExecutor
@@ -96,6 +142,15 @@ func GetExecutor() Executor {
 	return defExc
 }
 
+// WorkerLoad get the load of the executor of current worker, keeper publishes it by heart beat,
+// it returns zero before the executor is set
+func WorkerLoad() (capacity, running int) {
+	if defExc == nil {
+		return 0, 0
+	}
+	return defExc.Load()
+}
+
 // Closer means the component need be closeFunc
 type Closer interface {
 	Close()
@@ -112,11 +167,16 @@ type Store interface {
 	UpdateDag(dagIns *entity.Dag) error
 	UpdateDagIns(dagIns *entity.DagInstance) error
 	UpdateTaskIns(taskIns *entity.TaskInstance) error
-	BatchUpdateDagIns(dagIns []*entity.DagInstance) error
+	// BatchUpdateDagIns is used by leader, the leader epoch should be attached by WithLeaderEpoch
+	// so that the writes of a stale leader will be rejected with data.ErrDataConflicted
+	BatchUpdateDagIns(dagIns []*entity.DagInstance, ops ...UpdateOptionOp) error
 	BatchUpdateTaskIns(taskIns []*entity.TaskInstance) error
 	GetTaskIns(taskIns string) (*entity.TaskInstance, error)
 	GetDag(dagId string) (*entity.Dag, error)
 	GetDagInstance(dagInsId string) (*entity.DagInstance, error)
+	GetDagSchedule(dagId string) (*entity.DagSchedule, error)
+	SaveDagSchedule(schedule *entity.DagSchedule) error
+	ListDag(input *ListDagInput) ([]*entity.Dag, error)
 	ListDagInstance(input *ListDagInstanceInput) ([]*entity.DagInstance, error)
 	ListTaskInstance(input *ListTaskInstanceInput) ([]*entity.TaskInstance, error)
 	Marshal(obj interface{}) ([]byte, error)
@@ -125,6 +185,8 @@ type Store interface {
 
 // ListDagInput
 type ListDagInput struct {
+	// HasCron means only query the dags which have cron expression
+	HasCron bool
 }
 
 // ListDagInstanceInput
@@ -136,6 +198,18 @@ type ListDagInstanceInput struct {
 	HasCmd     bool
 	Limit      int64
 	Offset     int64
+	// ParentDagInsID and ParentTaskInsID used to query the sub dag instances
+	ParentDagInsID  string
+	ParentTaskInsID string
+	// ConcurrencyKey used to query the instances sharing the same concurrency limit
+	ConcurrencyKey string
+	// OrderByPriority order the instances by priority desc, created time and id, all stores must keep this order
+	// because it is the dispatching order, otherwise they are ordered by the implementation of store
+	OrderByPriority bool
+	// OrderByID order the instances by id and only return the ones whose id is greater than AfterID,
+	// so that the caller can page them by the last id seen even if some of them are changed meanwhile
+	OrderByID bool
+	AfterID   string
 }
 
 // ListTaskInstanceInput
@@ -148,6 +222,40 @@ type ListTaskInstanceInput struct {
 	SelectField []string
 }
 
+// UpdateOption
+type UpdateOption struct {
+	// LeaderEpoch is the fencing epoch of the leader who performs the writes, 0 means no fencing
+	LeaderEpoch int64
+	// ClearCmd clear the cmd of dag instances, it is used when the cmd is handled by leader itself
+	ClearCmd bool
+}
+
+// UpdateOptionOp
+type UpdateOptionOp func(opt *UpdateOption)
+
+// NewUpdateOption
+func NewUpdateOption(ops []UpdateOptionOp) *UpdateOption {
+	opt := &UpdateOption{}
+	for _, op := range ops {
+		op(opt)
+	}
+	return opt
+}
+
+// WithLeaderEpoch attach leader epoch to the writes
+func WithLeaderEpoch(epoch int64) UpdateOptionOp {
+	return func(opt *UpdateOption) {
+		opt.LeaderEpoch = epoch
+	}
+}
+
+// WithClearCmd clear the cmd of dag instances with the writes
+func WithClearCmd() UpdateOptionOp {
+	return func(opt *UpdateOption) {
+		opt.ClearCmd = true
+	}
+}
+
 // SetStore
 func SetStore(e Store) {
 	defStore = e
@@ -162,11 +270,37 @@ func GetStore() Store {
 type Keeper interface {
 	Closer
 	IsLeader() bool
+	// LeaderEpoch is the fencing epoch of the latest leader term of this worker,
+	// it increases every time the leadership changes and is 0 if the worker has never been leader
+	LeaderEpoch() int64
 	IsAlive(workerKey string) (bool, error)
 	AliveNodes() ([]string, error)
+	// AliveNodesWithLabels get all alive nodes with the labels and the load they registered
+	AliveNodesWithLabels() ([]Node, error)
 	WorkerKey() string
 	WorkerNumber() int
 	NewMutex(key string) DistributedMutex
+	// SetDraining mark the worker is draining or not, it is published immediately,
+	// dispatcher will not assign dag instances to a draining worker
+	SetDraining(draining bool) error
+	IsDraining() bool
+}
+
+// Node is an alive worker and the labels it registered
+type Node struct {
+	WorkerKey string
+	Labels    map[string]string
+	// Capacity and Running are the load published by the latest heart beat,
+	// zero capacity means the worker did not report it
+	Capacity int
+	Running  int
+	// Draining worker can not accept new dag instances
+	Draining bool
+}
+
+// Saturated indicate the worker can not accept more task instances
+func (n *Node) Saturated() bool {
+	return n.Capacity > 0 && n.Running >= n.Capacity
 }
 
 // SetKeeper
@@ -183,6 +317,8 @@ func GetKeeper() Keeper {
 type Parser interface {
 	InitialDagIns(dagIns *entity.DagInstance)
 	EntryTaskIns(taskIns *entity.TaskInstance)
+	// ReleaseDagIns drop the task tree of dag instance, so that it is not driven by this worker any more
+	ReleaseDagIns(dagInsId string)
 }
 
 // SetParser
@@ -30,6 +30,11 @@ func (_m *MockParser) InitialDagIns(dagIns *entity.DagInstance) {
 	_m.Called(dagIns)
 }
 
+// ReleaseDagIns provides a mock function with given fields: dagInsId
+func (_m *MockParser) ReleaseDagIns(dagInsId string) {
+	_m.Called(dagInsId)
+}
+
 // MockExecutor is an autogenerated mock type for the Executor type
 type MockExecutor struct {
 	mock.Mock
@@ -49,6 +54,69 @@ func (_m *MockExecutor) CancelTaskIns(taskInsId []string) error {
 	return r0
 }
 
+// Compensate provides a mock function with given fields: dagIns, taskIns
+func (_m *MockExecutor) Compensate(dagIns *entity.DagInstance, taskIns *entity.TaskInstance) error {
+	ret := _m.Called(dagIns, taskIns)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*entity.DagInstance, *entity.TaskInstance) error); ok {
+		r0 = rf(dagIns, taskIns)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Load provides a mock function with given fields:
+func (_m *MockExecutor) Load() (int, int) {
+	ret := _m.Called()
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func() int); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 int
+	if rf, ok := ret.Get(1).(func() int); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Get(1).(int)
+	}
+
+	return r0, r1
+}
+
+// RunningTaskIns provides a mock function with given fields:
+func (_m *MockExecutor) RunningTaskIns() []string {
+	ret := _m.Called()
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func() []string); ok {
+		r0 = rf()
+	} else if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]string)
+	}
+
+	return r0
+}
+
+// ReleaseParkedTaskIns provides a mock function with given fields:
+func (_m *MockExecutor) ReleaseParkedTaskIns() []string {
+	ret := _m.Called()
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func() []string); ok {
+		r0 = rf()
+	} else if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]string)
+	}
+
+	return r0
+}
+
 // Push provides a mock function with given fields: dagIns, taskIns
 func (_m *MockExecutor) Push(data *entity.DagInstance, taskIns *entity.TaskInstance) {
 	_m.Called(data, taskIns)
@@ -82,6 +150,41 @@ func (_m *MockKeeper) AliveNodes() ([]string, error) {
 	return r0, r1
 }
 
+// AliveNodesWithLabels provides a mock function with given fields:
+func (_m *MockKeeper) AliveNodesWithLabels() ([]Node, error) {
+	ret := _m.Called()
+
+	var r0 []Node
+	if rf, ok := ret.Get(0).(func() []Node); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Node)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetDraining provides a mock function with given fields: draining
+func (_m *MockKeeper) SetDraining(draining bool) error {
+	ret := _m.Called(draining)
+	return ret.Error(0)
+}
+
+// IsDraining provides a mock function with given fields:
+func (_m *MockKeeper) IsDraining() bool {
+	ret := _m.Called()
+	return ret.Bool(0)
+}
+
 func (_m *MockKeeper) IsAlive(workerKey string) (bool, error) {
 	ret := _m.Called(workerKey)
 	return ret.Bool(0), ret.Error(1)
@@ -120,6 +223,20 @@ func (_m *MockKeeper) WorkerKey() string {
 	return r0
 }
 
+// LeaderEpoch provides a mock function with given fields:
+func (_m *MockKeeper) LeaderEpoch() int64 {
+	ret := _m.Called()
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func() int64); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	return r0
+}
+
 // WorkerNumber provides a mock function with given fields:
 func (_m *MockKeeper) WorkerNumber() int {
 	ret := _m.Called()
@@ -169,13 +286,20 @@ func (_m *MockStore) BatchCreatTaskIns(taskIns []*entity.TaskInstance) error {
 	return r0
 }
 
-// BatchUpdateDagIns provides a mock function with given fields: dagIns
-func (_m *MockStore) BatchUpdateDagIns(dagIns []*entity.DagInstance) error {
-	ret := _m.Called(dagIns)
+// BatchUpdateDagIns provides a mock function with given fields: dagIns, ops
+func (_m *MockStore) BatchUpdateDagIns(dagIns []*entity.DagInstance, ops ...UpdateOptionOp) error {
+	_va := make([]interface{}, len(ops))
+	for _i := range ops {
+		_va[_i] = ops[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, dagIns)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func([]*entity.DagInstance) error); ok {
-		r0 = rf(dagIns)
+	if rf, ok := ret.Get(0).(func([]*entity.DagInstance, ...UpdateOptionOp) error); ok {
+		r0 = rf(dagIns, ops...)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -276,6 +400,43 @@ func (_m *MockStore) GetDagInstance(dagInsId string) (*entity.DagInstance, error
 	return r0, r1
 }
 
+// GetDagSchedule provides a mock function with given fields: dagId
+func (_m *MockStore) GetDagSchedule(dagId string) (*entity.DagSchedule, error) {
+	ret := _m.Called(dagId)
+
+	var r0 *entity.DagSchedule
+	if rf, ok := ret.Get(0).(func(string) *entity.DagSchedule); ok {
+		r0 = rf(dagId)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*entity.DagSchedule)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(dagId)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SaveDagSchedule provides a mock function with given fields: schedule
+func (_m *MockStore) SaveDagSchedule(schedule *entity.DagSchedule) error {
+	ret := _m.Called(schedule)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*entity.DagSchedule) error); ok {
+		r0 = rf(schedule)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // GetTaskIns provides a mock function with given fields: taskIns
 func (_m *MockStore) GetTaskIns(taskIns string) (*entity.TaskInstance, error) {
 	ret := _m.Called(taskIns)
@@ -299,6 +460,29 @@ func (_m *MockStore) GetTaskIns(taskIns string) (*entity.TaskInstance, error) {
 	return r0, r1
 }
 
+// ListDag provides a mock function with given fields: input
+func (_m *MockStore) ListDag(input *ListDagInput) ([]*entity.Dag, error) {
+	ret := _m.Called(input)
+
+	var r0 []*entity.Dag
+	if rf, ok := ret.Get(0).(func(*ListDagInput) []*entity.Dag); ok {
+		r0 = rf(input)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*entity.Dag)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*ListDagInput) error); ok {
+		r1 = rf(input)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ListDagInstance provides a mock function with given fields: input
 func (_m *MockStore) ListDagInstance(input *ListDagInstanceInput) ([]*entity.DagInstance, error) {
 	ret := _m.Called(input)
@@ -432,9 +616,13 @@ func (_m *MockStore) Unmarshal(bytes []byte, ptr interface{}) error {
 }
 
 type MockTaskInfoGetter struct {
-	ID     string
-	Depend []string
-	Status entity.TaskInstanceStatus
+	ID          string
+	Depend      []string
+	Status      entity.TaskInstanceStatus
+	TriggerRule entity.TriggerRule
+	Foreach     *entity.Foreach
+	MappedFrom  string
+	PreChecks   entity.PreChecks
 }
 
 // GetDepend provides a mock function with given fields:
@@ -456,3 +644,23 @@ func (_m *MockTaskInfoGetter) GetID() string {
 func (_m *MockTaskInfoGetter) GetStatus() entity.TaskInstanceStatus {
 	return _m.Status
 }
+
+// GetTriggerRule provides a mock function with given fields:
+func (_m *MockTaskInfoGetter) GetTriggerRule() entity.TriggerRule {
+	return _m.TriggerRule
+}
+
+// GetForeach provides a mock function with given fields:
+func (_m *MockTaskInfoGetter) GetForeach() *entity.Foreach {
+	return _m.Foreach
+}
+
+// GetMappedFrom provides a mock function with given fields:
+func (_m *MockTaskInfoGetter) GetMappedFrom() string {
+	return _m.MappedFrom
+}
+
+// GetPreChecks provides a mock function with given fields:
+func (_m *MockTaskInfoGetter) GetPreChecks() entity.PreChecks {
+	return _m.PreChecks
+}
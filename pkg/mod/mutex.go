@@ -16,6 +16,8 @@ type LockOption struct {
 	TTL               time.Duration
 	ReentrantIdentity string
 	SpinInterval      time.Duration
+	// NoWait means trying to lock only once, data.ErrMutexLocked is returned if the mutex is kept by others
+	NoWait bool
 }
 
 type LockOptionOp func(option *LockOption)
@@ -43,6 +45,13 @@ func LockTTL(d time.Duration) LockOptionOp {
 	}
 }
 
+// LockNoWait mean try to lock only once without waiting
+func LockNoWait() LockOptionOp {
+	return func(option *LockOption) {
+		option.NoWait = true
+	}
+}
+
 // Reentrant mean lock it reentrant
 func Reentrant(identity string) LockOptionOp {
 	return func(option *LockOption) {
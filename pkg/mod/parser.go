@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/entity/run"
 	"github.com/linclin/fastflow/pkg/event"
 	"github.com/linclin/fastflow/pkg/log"
 	"github.com/linclin/fastflow/pkg/utils"
@@ -21,6 +22,8 @@ type DefParser struct {
 	workerWg     sync.WaitGroup
 	taskTrees    sync.Map
 	taskTimeout  time.Duration
+	// compensating is the dag instances whose tasks are being compensated
+	compensating sync.Map
 
 	closeCh chan struct{}
 	lock    sync.RWMutex
@@ -82,6 +85,11 @@ func (p *DefParser) watchScheduledDagIns() (err error) {
 		goevent.Publish(e)
 	}()
 
+	// the scheduled dag instances of draining worker will be released to dispatcher
+	if GetKeeper().IsDraining() {
+		return
+	}
+
 	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
 		Worker: GetKeeper().WorkerKey(),
 		Status: []entity.DagInstanceStatus{
@@ -162,45 +170,51 @@ func (p *DefParser) InitialDagIns(dagIns *entity.DagInstance) {
 		return
 	}
 
-	root, err := BuildRootNode(MapTaskInsToGetter(tasks))
+	mainTasks, handlers := splitHandlerTasks(tasks)
+	tree := &TaskTree{
+		DagIns:   dagIns,
+		handlers: handlers,
+	}
+	root, err := BuildRootNode(MapTaskInsToGetter(mainTasks))
+	if err == nil && dagIns.HandlerStatus == entity.DagInstanceStatusRunning {
+		// the main tasks have completed before, so resume the handlers
+		sts, taskInsId := root.ComputeStatus()
+		tree.handling, tree.mainStatus, tree.mainReason = true, sts, treeStatusReason(sts, taskInsId)
+		root, err = BuildRootNode(MapTaskInsToGetter(triggeredHandlers(handlers, sts == TreeStatusSuccess)))
+	}
 	if err != nil {
 		log.Errorf("dag instance[%s] build task tree failed: %s", dagIns.ID, err)
 		return
 	}
+	tree.Root = root
 
-	tree := &TaskTree{
-		DagIns: dagIns,
-		Root:   root,
-	}
 	executableTaskIds := tree.Root.GetExecutableTaskIds()
-	if len(executableTaskIds) == 0 {
+	mappedTaskIds, completedMappedTaskIds := tree.Root.GetResumableMappedTaskIds()
+	executableTaskIds = append(executableTaskIds, mappedTaskIds...)
+	if len(executableTaskIds) == 0 && len(completedMappedTaskIds) == 0 {
+		p.storeTree(tree)
 		sts, taskInsId := tree.Root.ComputeStatus()
-		switch sts {
-		case TreeStatusSuccess:
-			tree.DagIns.Success()
-		case TreeStatusBlocked:
-			tree.DagIns.Block(fmt.Sprintf("initial blocked because task ins[%s]", taskInsId))
-		case TreeStatusFailed:
-			tree.DagIns.Fail(fmt.Sprintf("initial failed because task ins[%s]", taskInsId))
-		default:
+		if sts == TreeStatusRunning {
 			log.Warn("initial a dag which has no executable tasks",
 				utils.LogKeyDagInsID, dagIns.ID)
+			// the running tasks(such as a resumed dag instance) will drive the tree after they completed
 			return
 		}
 
-		if err := GetStore().PatchDagIns(&entity.DagInstance{
-			BaseInfo: entity.BaseInfo{ID: dagIns.ID},
-			Status:   dagIns.Status}); err != nil {
-			log.Errorf("patch dag instance[%s] failed: %s", dagIns.ID, err)
-			return
+		if err := p.completeTree(tree, sts, fmt.Sprintf("initial %s because task ins[%s]", sts, taskInsId)); err != nil {
+			log.Errorf("complete dag instance[%s] failed: %s", dagIns.ID, err)
 		}
 		return
 	}
 
-	p.taskTrees.Store(dagIns.ID, tree)
+	p.storeTree(tree)
 	taskMap := getTasksMap(tasks)
 	for _, tid := range executableTaskIds {
-		GetExecutor().Push(dagIns, taskMap[tid])
+		p.pushTaskIns(tree, taskMap[tid])
+	}
+	// the group completed but it is not handled, so entry one of its mapped tasks again
+	for _, tid := range completedMappedTaskIds {
+		p.EntryTaskIns(taskMap[tid])
 	}
 }
 
@@ -217,6 +231,40 @@ func (p *DefParser) executeNext(taskIns *entity.TaskInstance) error {
 	if !ok {
 		return fmt.Errorf("dag instance[%s] does not found task tree", taskIns.DagInsID)
 	}
+	if tree.IsHalted() {
+		return p.releaseHaltedTree(tree)
+	}
+	if taskIns.MappedFrom != "" {
+		ids, group, find := tree.Root.GetNextMappedTaskIds(taskIns)
+		if !find {
+			return fmt.Errorf("mapped task instance[%s] does not found normal node", taskIns.ID)
+		}
+		if err := p.pushTasks(tree, ids); err != nil {
+			return err
+		}
+		if group == nil {
+			return nil
+		}
+
+		// all mapped tasks completed, so the group is completed
+		if err := GetStore().PatchTaskIns(group); err != nil {
+			return err
+		}
+		taskIns = group
+	}
+
+	if _, ok := tree.forced.LoadAndDelete(taskIns.ID); ok {
+		// the forced task which can not be executed yet will take effect after upstream tasks completed
+		if node := tree.Root.findNode(taskIns.ID); node != nil && !node.CanBeExecuted() {
+			node.Status = taskIns.Status
+			return nil
+		}
+	}
+	if taskIns.Status == entity.TaskInstanceStatusSuccess && taskIns.SelectedBranches != nil {
+		if err := p.skipUnselectedBranches(tree, taskIns); err != nil {
+			return err
+		}
+	}
 	ids, find := tree.Root.GetNextTaskIds(taskIns)
 	if !find {
 		return fmt.Errorf("task instance[%s] does not found normal node", taskIns.ID)
@@ -224,37 +272,260 @@ func (p *DefParser) executeNext(taskIns *entity.TaskInstance) error {
 	// only the tasks which is not success has no next task ids
 	if len(ids) == 0 {
 		treeStatus, taskId := tree.Root.ComputeStatus()
-		switch treeStatus {
-		case TreeStatusRunning:
+		if treeStatus == TreeStatusRunning {
 			return nil
-		case TreeStatusFailed:
-			tree.DagIns.Fail(fmt.Sprintf("task[%s] failed or canceled", taskId))
-		case TreeStatusBlocked:
-			tree.DagIns.Block(fmt.Sprintf("task[%s] blocked", taskId))
-		case TreeStatusSuccess:
-			tree.DagIns.Success()
 		}
+		return p.completeTree(tree, treeStatus, treeStatusReason(treeStatus, taskId))
+	}
+	if taskIns.Reason == ReasonSuccessAfterCanceled {
+		return p.cancelChildTasks(tree, ids)
+	}
 
-		// tree has already completed, delete from map
-		p.taskTrees.Delete(taskIns.DagInsID)
-		if err := GetStore().PatchDagIns(&entity.DagInstance{
-			BaseInfo: entity.BaseInfo{ID: tree.DagIns.ID},
-			Status:   tree.DagIns.Status,
-			Reason:   tree.DagIns.Reason,
+	return p.pushTasks(tree, ids)
+}
+
+// treeStatusReason return the reason of the completed tree
+func treeStatusReason(status TreeStatus, taskInsId string) string {
+	switch status {
+	case TreeStatusFailed:
+		return fmt.Sprintf("task[%s] failed or canceled", taskInsId)
+	case TreeStatusBlocked:
+		return fmt.Sprintf("task[%s] blocked", taskInsId)
+	}
+	return ""
+}
+
+// completeTree complete the dag instance after the tree completed. When the main tasks succeeded or failed,
+// the triggered handler tasks are started at first, and the dag instance is completed after them,
+// but its status is still decided by the main tasks, the result of handlers is recorded separately
+func (p *DefParser) completeTree(tree *TaskTree, status TreeStatus, reason string) error {
+	if tree.handling {
+		tree.DagIns.HandlerStatus = treeStatusToDagInsStatus(status)
+		tree.DagIns.HandlerReason = reason
+		status, reason = tree.mainStatus, tree.mainReason
+	} else {
+		started, err := p.startHandlers(tree, status, reason)
+		if err != nil || started {
+			return err
+		}
+	}
+
+	switch status {
+	case TreeStatusFailed:
+		tree.DagIns.Fail(reason)
+	case TreeStatusBlocked:
+		tree.DagIns.Block(reason)
+	case TreeStatusSuccess:
+		tree.DagIns.Success()
+	}
+
+	// tree has already completed, delete from map
+	p.dropTree(tree.DagIns.ID)
+	if err := GetStore().PatchDagIns(&entity.DagInstance{
+		BaseInfo:      entity.BaseInfo{ID: tree.DagIns.ID},
+		Status:        tree.DagIns.Status,
+		Reason:        tree.DagIns.Reason,
+		HandlerStatus: tree.DagIns.HandlerStatus,
+		HandlerReason: tree.DagIns.HandlerReason,
+	}); err != nil {
+		return err
+	}
+
+	if tree.DagIns.Status == entity.DagInstanceStatusFailed && tree.DagIns.CompensateOnFailure {
+		return p.compensateDagIns(tree.DagIns)
+	}
+	return nil
+}
+
+// startHandlers replace the root of tree with the handler tasks which are triggered by the result of main tasks,
+// the others are skipped. It returns false if there is no handler task to run.
+func (p *DefParser) startHandlers(tree *TaskTree, status TreeStatus, reason string) (bool, error) {
+	if status != TreeStatusSuccess && status != TreeStatusFailed {
+		return false, nil
+	}
+
+	triggered := triggeredHandlers(tree.handlers, status == TreeStatusSuccess)
+	triggeredIds := getTaskInsIds(triggered)
+	for _, t := range tree.handlers {
+		// the retrying handlers are skipped too, they may be retried with the main tasks
+		isPending := t.Status == entity.TaskInstanceStatusInit || t.Status == entity.TaskInstanceStatusRetrying
+		if !isPending || utils.StringsContain(triggeredIds, t.ID) {
+			continue
+		}
+		t.Status = entity.TaskInstanceStatusSkipped
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: t.ID},
+			Status:   t.Status,
+			Reason:   fmt.Sprintf("%s handler is not triggered because the main tasks %s", t.Handler, status),
+		}); err != nil {
+			return false, err
+		}
+	}
+	if len(triggered) == 0 {
+		return false, nil
+	}
+
+	// the handlers which have run before(the dag instance is retried) are executed again
+	for _, t := range triggered {
+		if t.Status == entity.TaskInstanceStatusInit {
+			continue
+		}
+		t.Reset()
+		if err := GetStore().UpdateTaskIns(t); err != nil {
+			return false, err
+		}
+	}
+	root, err := BuildRootNode(MapTaskInsToGetter(triggered))
+	if err != nil {
+		return false, err
+	}
+
+	tree.Root = root
+	tree.handling, tree.mainStatus, tree.mainReason = true, status, reason
+	tree.DagIns.HandlerStatus = entity.DagInstanceStatusRunning
+	tree.DagIns.HandlerReason = ""
+	// the reason of last handlers is cleared, otherwise it is shown with the running handlers
+	if err := GetStore().PatchDagIns(&entity.DagInstance{
+		BaseInfo:      entity.BaseInfo{ID: tree.DagIns.ID},
+		HandlerStatus: tree.DagIns.HandlerStatus,
+	}, "HandlerReason"); err != nil {
+		return false, err
+	}
+
+	taskMap := getTasksMap(triggered)
+	for _, id := range root.GetExecutableTaskIds() {
+		p.pushTaskIns(tree, taskMap[id])
+	}
+	return true, nil
+}
+
+func treeStatusToDagInsStatus(status TreeStatus) entity.DagInstanceStatus {
+	switch status {
+	case TreeStatusSuccess:
+		return entity.DagInstanceStatusSuccess
+	case TreeStatusBlocked:
+		return entity.DagInstanceStatusBlocked
+	}
+	return entity.DagInstanceStatusFailed
+}
+
+// splitHandlerTasks split the task instances of dag instance to the main tasks and the handler tasks
+func splitHandlerTasks(tasks []*entity.TaskInstance) (mainTasks, handlers []*entity.TaskInstance) {
+	for _, t := range tasks {
+		if t.Handler != "" {
+			handlers = append(handlers, t)
+			continue
+		}
+		mainTasks = append(mainTasks, t)
+	}
+	return
+}
+
+// triggeredHandlers return the handler tasks which are triggered by the result of main tasks
+func triggeredHandlers(handlers []*entity.TaskInstance, mainSucceeded bool) (triggered []*entity.TaskInstance) {
+	for _, t := range handlers {
+		if t.Handler.IsTriggered(mainSucceeded) {
+			triggered = append(triggered, t)
+		}
+	}
+	return
+}
+
+func getTaskInsIds(tasks []*entity.TaskInstance) (ids []string) {
+	for _, t := range tasks {
+		ids = append(ids, t.ID)
+	}
+	return
+}
+
+// skipUnselectedBranches skip the children which are not selected by the branch task and their exclusive descendants,
+// the branch task will be failed if it selects a task which is not its child
+func (p *DefParser) skipUnselectedBranches(tree *TaskTree, taskIns *entity.TaskInstance) error {
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: taskIns.DagInsID,
+	})
+	if err != nil {
+		return err
+	}
+
+	var selected []string
+	for _, taskId := range taskIns.SelectedBranches {
+		child := findChildTaskIns(tasks, taskIns.TaskID, taskId)
+		if child == nil {
+			taskIns.Status = entity.TaskInstanceStatusFailed
+			taskIns.Reason = fmt.Sprintf("branch selected task[%s] which is not its child", taskId)
+			return GetStore().PatchTaskIns(&entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: taskIns.ID},
+				Status:   taskIns.Status,
+				Reason:   taskIns.Reason,
+			})
+		}
+		selected = append(selected, child.ID)
+	}
+
+	for _, id := range tree.Root.SkipUnselectedBranches(taskIns.ID, selected) {
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			Status:   entity.TaskInstanceStatusSkipped,
+			Reason:   fmt.Sprintf("not selected by branch task[%s]", taskIns.TaskID),
 		}); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+func findChildTaskIns(tasks []*entity.TaskInstance, parentTaskId, taskId string) *entity.TaskInstance {
+	for _, t := range tasks {
+		if t.TaskID == taskId && t.MappedFrom == "" && utils.StringsContain(t.DependOn, parentTaskId) {
+			return t
+		}
+	}
+	return nil
+}
 
-		return nil
+// releaseHaltedTree release the halted tree after all running tasks completed,
+// and the dag instance will be failed if it is canceled
+func (p *DefParser) releaseHaltedTree(tree *TaskTree) error {
+	running, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: tree.DagIns.ID,
+		Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning, entity.TaskInstanceStatusEnding},
+	})
+	if err != nil {
+		return err
 	}
-	if taskIns.Reason == ReasonSuccessAfterCanceled {
-		return p.cancelChildTasks(tree, ids)
+	for _, t := range running {
+		// the group is not executed by executor, its status is computed by the mapped tasks
+		if !t.IsForeachGroup() {
+			return nil
+		}
+	}
+
+	p.dropTree(tree.DagIns.ID)
+	if !tree.IsCanceled() {
+		return nil
 	}
+	return p.completeCanceledTree(tree, tree.DagIns)
+}
 
-	return p.pushTasks(tree.DagIns, ids)
+// completeCanceledTree complete the canceled tree whose tasks have all stopped,
+// the handlers are started in a new tree if the main tasks are canceled
+func (p *DefParser) completeCanceledTree(tree *TaskTree, dagIns *entity.DagInstance) error {
+	next := &TaskTree{
+		DagIns:     dagIns,
+		handlers:   tree.handlers,
+		handling:   tree.handling,
+		mainStatus: tree.mainStatus,
+		mainReason: tree.mainReason,
+	}
+	p.storeTree(next)
+	return p.completeTree(next, TreeStatusFailed, ReasonDagInsCanceled)
 }
 
-func (p *DefParser) pushTasks(dagIns *entity.DagInstance, ids []string) error {
+func (p *DefParser) pushTasks(tree *TaskTree, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
 	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
 		IDs: ids,
 	})
@@ -262,9 +533,104 @@ func (p *DefParser) pushTasks(dagIns *entity.DagInstance, ids []string) error {
 		return err
 	}
 	for _, t := range tasks {
-		GetExecutor().Push(dagIns, t)
+		p.pushTaskIns(tree, t)
+	}
+
+	return nil
+}
+
+// pushTaskIns push task instance to executor, the task which has foreach will be expanded instead
+func (p *DefParser) pushTaskIns(tree *TaskTree, taskIns *entity.TaskInstance) {
+	// the task instance is waiting for the backoff of automatic retry
+	if taskIns.Status == entity.TaskInstanceStatusRetrying && taskIns.NextRetryAt > time.Now().Unix() {
+		tree.AfterRetryBackoff(taskIns.ID, time.Until(time.Unix(taskIns.NextRetryAt, 0)), func() {
+			p.pushTaskIns(tree, taskIns)
+		})
+		return
+	}
+	if taskIns.Foreach == nil || taskIns.MappedFrom != "" {
+		GetExecutor().Push(tree.DagIns, taskIns)
+		return
+	}
+
+	if err := p.expandForeach(tree, taskIns); err != nil {
+		log.Errorf("expand task instance[%s] failed: %s", taskIns.ID, err)
+	}
+}
+
+// expandForeach create mapped task instances for items of the foreach list, and push them to executor
+func (p *DefParser) expandForeach(tree *TaskTree, taskIns *entity.TaskInstance) error {
+	node := tree.Root.findNode(taskIns.ID)
+	if node == nil {
+		return fmt.Errorf("task instance[%s] does not found normal node", taskIns.ID)
+	}
+
+	// the group may already be expanded before restart or retry, then we just reset the failed mapped tasks
+	if len(node.mapped) == 0 {
+		withTaskOutputs(tree.DagIns)
+		items, err := taskIns.Foreach.Items(tree.DagIns)
+		if err != nil {
+			return p.completeGroup(taskIns, entity.TaskInstanceStatusFailed, fmt.Sprintf("get foreach items failed: %s", err))
+		}
+		if len(items) == 0 {
+			return p.completeGroup(taskIns, entity.TaskInstanceStatusSuccess, "")
+		}
+
+		var mappedIns []*entity.TaskInstance
+		for i := range items {
+			ins, err := entity.NewMappedTaskInstance(taskIns, i, items[i])
+			if err != nil {
+				return p.completeGroup(taskIns, entity.TaskInstanceStatusFailed, err.Error())
+			}
+			mappedIns = append(mappedIns, ins)
+		}
+		if err := GetStore().BatchCreatTaskIns(mappedIns); err != nil {
+			return err
+		}
+		for i := range mappedIns {
+			node.AppendMapped(NewTaskNodeFromGetter(mappedIns[i]))
+		}
+	} else {
+		for _, m := range node.mapped {
+			if m.Status != entity.TaskInstanceStatusFailed && m.Status != entity.TaskInstanceStatusCanceled {
+				continue
+			}
+			if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: m.TaskInsID},
+				Status:   entity.TaskInstanceStatusInit,
+			}); err != nil {
+				return err
+			}
+			m.Status = entity.TaskInstanceStatusInit
+		}
 	}
 
+	if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: taskIns.ID},
+		Status:   entity.TaskInstanceStatusRunning,
+		Traces: append(taskIns.Traces, entity.TraceInfo{
+			Time:    time.Now().Unix(),
+			Message: fmt.Sprintf("expanded to %d mapped task instances", len(node.mapped)),
+		}),
+	}); err != nil {
+		return err
+	}
+	node.Status = entity.TaskInstanceStatusRunning
+	return p.pushTasks(tree, node.scheduleMapped())
+}
+
+// completeGroup complete the group which does not need to execute mapped tasks
+func (p *DefParser) completeGroup(taskIns *entity.TaskInstance, status entity.TaskInstanceStatus, reason string) error {
+	taskIns.Status = status
+	taskIns.Reason = reason
+	if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: taskIns.ID},
+		Status:   taskIns.Status,
+		Reason:   taskIns.Reason,
+	}); err != nil {
+		return err
+	}
+	p.EntryTaskIns(taskIns)
 	return nil
 }
 
@@ -288,7 +654,7 @@ func (p *DefParser) cancelChildTasks(tree *TaskTree, ids []string) error {
 
 	// not equal running mean that all tasks already completed
 	if sts, _ := tree.Root.ComputeStatus(); sts != TreeStatusRunning {
-		p.taskTrees.Delete(tree.DagIns.ID)
+		p.dropTree(tree.DagIns.ID)
 	}
 
 	if !tree.DagIns.CanModifyStatus() {
@@ -298,6 +664,20 @@ func (p *DefParser) cancelChildTasks(tree *TaskTree, ids []string) error {
 	return GetStore().PatchDagIns(tree.DagIns)
 }
 
+// storeTree store the task tree of dag instance, the retry timers of the replaced one are stopped
+func (p *DefParser) storeTree(tree *TaskTree) {
+	if old, ok := p.taskTrees.Swap(tree.DagIns.ID, tree); ok && old.(*TaskTree) != tree {
+		old.(*TaskTree).StopRetryTimers()
+	}
+}
+
+// dropTree delete the task tree of dag instance and stop its retry timers
+func (p *DefParser) dropTree(dagInsId string) {
+	if tree, ok := p.taskTrees.LoadAndDelete(dagInsId); ok {
+		tree.(*TaskTree).StopRetryTimers()
+	}
+}
+
 func (p *DefParser) getTaskTree(dagInsId string) (*TaskTree, bool) {
 	tasks, ok := p.taskTrees.Load(dagInsId)
 	if !ok {
@@ -307,6 +687,11 @@ func (p *DefParser) getTaskTree(dagInsId string) (*TaskTree, bool) {
 	return tasks.(*TaskTree), true
 }
 
+// ReleaseDagIns drop the task tree of dag instance, the task instances completed later will not push next ones
+func (p *DefParser) ReleaseDagIns(dagInsId string) {
+	p.dropTree(dagInsId)
+}
+
 // EntryTaskIns
 func (p *DefParser) EntryTaskIns(taskIns *entity.TaskInstance) {
 	murmurHash := murmur3.New32()
@@ -361,33 +746,47 @@ func (p *DefParser) parseScheduleDagIns(dagIns *entity.DagInstance) error {
 			return err
 		}
 
+		// the handler tasks are initialized with the main tasks
+		dagTasks, handlerTypes := append([]entity.Task{}, dag.Tasks...), make([]entity.DagHandlerType, len(dag.Tasks))
+		for _, h := range entity.DagHandlerTypes {
+			for _, t := range dag.HandlerTasks(h) {
+				dagTasks = append(dagTasks, t)
+				handlerTypes = append(handlerTypes, h)
+			}
+		}
+
 		// the init of tasks is not complete, should continue/start it.
-		if len(dag.Tasks) != len(tasks) {
+		if len(dagTasks) != len(tasks) {
 			var needInitTaskIns []*entity.TaskInstance
-			for i := range dag.Tasks {
+			for i := range dagTasks {
 				notFound := true
 				for j := range tasks {
-					if dag.Tasks[i].ID == tasks[j].TaskID {
+					if dagTasks[i].ID == tasks[j].TaskID {
 						notFound = false
 					}
 				}
 
 				if notFound {
-					renderParams, err := dagIns.Vars.Render(dag.Tasks[i].Params)
+					renderParams, err := dagIns.Vars.Render(dagTasks[i].Params)
 					if err != nil {
 						return err
 					}
-					dag.Tasks[i].Params = renderParams
-					if dag.Tasks[i].TimeoutSecs == 0 {
-						dag.Tasks[i].TimeoutSecs = int(p.taskTimeout.Seconds())
+					dagTasks[i].Params = renderParams
+					if dagTasks[i].TimeoutSecs == 0 {
+						dagTasks[i].TimeoutSecs = int(p.taskTimeout.Seconds())
 					}
-					needInitTaskIns = append(needInitTaskIns, entity.NewTaskInstance(dagIns.ID, dag.Tasks[i]))
+					ins := entity.NewTaskInstance(dagIns.ID, dagTasks[i])
+					ins.Handler = handlerTypes[i]
+					needInitTaskIns = append(needInitTaskIns, ins)
 				}
 			}
 			if err := GetStore().BatchCreatTaskIns(needInitTaskIns); err != nil {
 				return err
 			}
 		}
+		if err := p.failoverTasks(tasks); err != nil {
+			return err
+		}
 
 		dagIns.Run()
 		if err := GetStore().PatchDagIns(&entity.DagInstance{
@@ -401,6 +800,48 @@ func (p *DefParser) parseScheduleDagIns(dagIns *entity.DagInstance) error {
 	return nil
 }
 
+// failoverTasks handle the task instances which are left running by a dead worker according to the failover policy
+// of their actions, no task instance should be running when the dag instance is scheduled,
+// unless it is taken over from a dead worker by watch dog
+func (p *DefParser) failoverTasks(tasks []*entity.TaskInstance) error {
+	for _, t := range tasks {
+		if t.Status != entity.TaskInstanceStatusRunning && t.Status != entity.TaskInstanceStatusEnding {
+			continue
+		}
+		// the status of group is computed by its mapped tasks
+		if t.IsForeachGroup() {
+			continue
+		}
+
+		policy := run.FailoverPolicyFail
+		if act := ActionMap[t.ActionName]; act != nil {
+			policy = run.FailoverPolicyOf(act)
+		}
+		switch policy {
+		case run.FailoverPolicyRerun:
+			t.Status = entity.TaskInstanceStatusInit
+		case run.FailoverPolicyResume:
+			t.Status = entity.TaskInstanceStatusEnding
+		default:
+			t.Status = entity.TaskInstanceStatusFailed
+			t.Reason = ReasonWorkerDead
+		}
+		t.Traces = append(t.Traces, entity.TraceInfo{
+			Time:    time.Now().Unix(),
+			Message: fmt.Sprintf("the worker is dead, failover with policy[%s]", policy),
+		})
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: t.BaseInfo,
+			Status:   t.Status,
+			Reason:   t.Reason,
+			Traces:   t.Traces,
+		}); err != nil {
+			return fmt.Errorf("failover task instance[%s] failed: %w", t.ID, err)
+		}
+	}
+	return nil
+}
+
 func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 	if dagIns.Cmd != nil {
 		switch dagIns.Cmd.Name {
@@ -428,6 +869,9 @@ func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 
 				t.Status = entity.TaskInstanceStatusRetrying
 				t.Reason = ""
+				t.Attempts = 0
+				t.NextRetryAt = 0
+				t.Approval = nil
 				if err := GetStore().UpdateTaskIns(t); err != nil {
 					return err
 				}
@@ -438,6 +882,97 @@ func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 			if err := GetExecutor().CancelTaskIns(dagIns.Cmd.TargetTaskInsIDs); err != nil {
 				return err
 			}
+		case entity.CommandNameApprove, entity.CommandNameReject:
+			hasAnyTaskUnblocked := false
+			defer func() {
+				if err == nil && hasAnyTaskUnblocked {
+					p.InitialDagIns(dagIns)
+				}
+			}()
+
+			taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+				IDs:    dagIns.Cmd.TargetTaskInsIDs,
+				Status: []entity.TaskInstanceStatus{entity.TaskInstanceStatusBlocked, entity.TaskInstanceStatusRunning},
+			})
+			if err != nil {
+				return err
+			}
+
+			decision := entity.ApprovalDecisionApproved
+			if dagIns.Cmd.Name == entity.CommandNameReject {
+				decision = entity.ApprovalDecisionRejected
+			}
+			for _, t := range taskIns {
+				approval := entity.NewApproval(decision, dagIns.Cmd.Operator, dagIns.Cmd.Comment)
+				switch t.Status {
+				case entity.TaskInstanceStatusRunning:
+					// the approval action is waiting for the decision, it will trace the decision by itself
+					if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+						BaseInfo: t.BaseInfo,
+						Approval: approval,
+					}); err != nil {
+						return err
+					}
+				case entity.TaskInstanceStatusBlocked:
+					t.Approval = approval
+					t.Traces = append(t.Traces, entity.TraceInfo{
+						Time:    approval.Time,
+						Message: approval.String(),
+					})
+					t.Status = entity.TaskInstanceStatusInit
+					t.Reason = ""
+					if !approval.IsApproved() {
+						t.Status = entity.TaskInstanceStatusFailed
+						t.Reason = approval.String()
+					}
+					if err := GetStore().UpdateTaskIns(t); err != nil {
+						return err
+					}
+					hasAnyTaskUnblocked = true
+				}
+			}
+			if hasAnyTaskUnblocked {
+				dagIns.Run()
+			}
+		case entity.CommandNameCancelAll:
+			if err := p.cancelDagIns(dagIns); err != nil {
+				return err
+			}
+		case entity.CommandNameSkip, entity.CommandNameMarkSuccess, entity.CommandNameForceFail:
+			needInitial := false
+			defer func() {
+				if err == nil && needInitial {
+					p.InitialDagIns(dagIns)
+				}
+			}()
+			if needInitial, err = p.forceTaskStatus(dagIns); err != nil {
+				return err
+			}
+		case entity.CommandNameRerun:
+			defer func() {
+				if err == nil {
+					p.InitialDagIns(dagIns)
+				}
+			}()
+			if err := p.rerunTasks(dagIns); err != nil {
+				return err
+			}
+		case entity.CommandNamePause:
+			if tree, ok := p.getTaskTree(dagIns.ID); ok {
+				tree.Pause()
+			}
+			dagIns.Status = entity.DagInstanceStatusPaused
+		case entity.CommandNameCompensate:
+			if err := p.compensateDagIns(dagIns); err != nil {
+				return err
+			}
+		case entity.CommandNameResume:
+			defer func() {
+				if err == nil {
+					p.InitialDagIns(dagIns)
+				}
+			}()
+			dagIns.Run()
 		}
 
 		dagIns.Cmd = nil
@@ -453,12 +988,240 @@ func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 	return nil
 }
 
+// forceTaskStatus set the status of tasks by command, the tasks of running tree will be entried again
+// so that downstream tasks can continue, otherwise the dag instance need to be initialized again
+func (p *DefParser) forceTaskStatus(dagIns *entity.DagInstance) (needInitial bool, err error) {
+	var status entity.TaskInstanceStatus
+	var verb string
+	switch dagIns.Cmd.Name {
+	case entity.CommandNameSkip:
+		status, verb = entity.TaskInstanceStatusSkipped, "skipped"
+	case entity.CommandNameMarkSuccess:
+		status, verb = entity.TaskInstanceStatusSuccess, "marked success"
+	case entity.CommandNameForceFail:
+		status, verb = entity.TaskInstanceStatusFailed, "force failed"
+	}
+	msg := fmt.Sprintf("%s by %s", verb, dagIns.Cmd.Operator)
+	if dagIns.Cmd.Comment != "" {
+		msg = fmt.Sprintf("%s: %s", msg, dagIns.Cmd.Comment)
+	}
+
+	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		IDs: dagIns.Cmd.TargetTaskInsIDs,
+		Status: []entity.TaskInstanceStatus{
+			entity.TaskInstanceStatusInit,
+			entity.TaskInstanceStatusBlocked,
+			entity.TaskInstanceStatusFailed,
+			entity.TaskInstanceStatusCanceled,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	tree, hasTree := p.getTaskTree(dagIns.ID)
+	for _, t := range taskIns {
+		t.Status = status
+		t.Reason = msg
+		t.Traces = append(t.Traces, entity.TraceInfo{
+			Time:    time.Now().Unix(),
+			Message: msg,
+		})
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: t.BaseInfo,
+			Status:   t.Status,
+			Reason:   t.Reason,
+			Traces:   t.Traces,
+		}); err != nil {
+			return false, err
+		}
+		if hasTree {
+			tree.Force(t.ID)
+			p.EntryTaskIns(t)
+		}
+	}
+
+	// the paused dag instance will be initialized when it is resumed
+	if hasTree || len(taskIns) == 0 || dagIns.Status == entity.DagInstanceStatusPaused {
+		return false, nil
+	}
+	dagIns.Run()
+	return true, nil
+}
+
+// rerunTasks reset the target task and its downstream tasks to init, the previous executions are kept in history,
+// and the share data written by them is cleared if needed
+func (p *DefParser) rerunTasks(dagIns *entity.DagInstance) error {
+	if len(dagIns.Cmd.TargetTaskInsIDs) == 0 {
+		return fmt.Errorf("rerun command has no target task instance")
+	}
+	if dagIns.HandlerStatus == entity.DagInstanceStatusRunning {
+		return fmt.Errorf("dag instance[%s] is running handlers, cannot rerun tasks", dagIns.ID)
+	}
+	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: dagIns.ID,
+	})
+	if err != nil {
+		return err
+	}
+	// only the main tasks can be rerun, the handlers will run again after them
+	taskIns, _ = splitHandlerTasks(taskIns)
+	root, err := BuildRootNode(MapTaskInsToGetter(taskIns))
+	if err != nil {
+		return err
+	}
+	ids, find := root.GetRerunTaskIds(dagIns.Cmd.TargetTaskInsIDs[0], dagIns.Cmd.IncludeDownstream)
+	if !find {
+		return fmt.Errorf("task instance[%s] does not found normal node", dagIns.Cmd.TargetTaskInsIDs[0])
+	}
+
+	tasksMap := getTasksMap(taskIns)
+	var keys []string
+	for _, id := range ids {
+		t := tasksMap[id]
+		keys = append(keys, t.ShareDataKeys...)
+		t.Reset()
+		if err := GetStore().UpdateTaskIns(t); err != nil {
+			return err
+		}
+	}
+	if dagIns.Cmd.ClearShareData && len(keys) > 0 && dagIns.ShareData != nil {
+		dagIns.ShareData.Delete(keys...)
+		if err := GetStore().PatchDagIns(&entity.DagInstance{
+			BaseInfo:  dagIns.BaseInfo,
+			ShareData: dagIns.ShareData,
+		}); err != nil {
+			return err
+		}
+	}
+	dagIns.Run()
+	return nil
+}
+
+// compensateDagIns undo the succeeded main tasks in reverse topological order in background
+func (p *DefParser) compensateDagIns(dagIns *entity.DagInstance) error {
+	if _, ok := p.compensating.LoadOrStore(dagIns.ID, struct{}{}); ok {
+		log.Warnf("dag instance[%s] is already compensating", dagIns.ID)
+		return nil
+	}
+
+	tasks, err := p.listCompensateTasks(dagIns)
+	if err != nil {
+		p.compensating.Delete(dagIns.ID)
+		return err
+	}
+	go p.runCompensations(dagIns, tasks)
+	return nil
+}
+
+// listCompensateTasks return the task instances which need to be compensated in order
+func (p *DefParser) listCompensateTasks(dagIns *entity.DagInstance) ([]*entity.TaskInstance, error) {
+	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: dagIns.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the handlers are not a part of the work which should be undone
+	mainTasks, _ := splitHandlerTasks(taskIns)
+	root, err := BuildRootNode(MapTaskInsToGetter(mainTasks))
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []*entity.TaskInstance
+	taskMap := getTasksMap(mainTasks)
+	for _, id := range root.GetCompensateTaskIds() {
+		if t := taskMap[id]; t.CanCompensate() {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, nil
+}
+
+// runCompensations compensate the tasks one by one, it stops at the first failed one,
+// so that the upstream tasks are never undone before their downstream tasks
+func (p *DefParser) runCompensations(dagIns *entity.DagInstance, tasks []*entity.TaskInstance) {
+	defer p.compensating.Delete(dagIns.ID)
+	for _, t := range tasks {
+		select {
+		case <-p.closeCh:
+			log.Info("parser has already closed, so will not compensate next task instances")
+			return
+		default:
+		}
+
+		if err := GetExecutor().Compensate(dagIns, t); err != nil {
+			log.Errorf("compensate task instance[%s] failed, the remaining are stopped: %s", t.ID, err)
+			return
+		}
+	}
+}
+
+// cancelDagIns cancel the unfinished tasks of dag instance, the running tasks of this worker are canceled by executor,
+// and the tree will fail the dag instance after they completed
+func (p *DefParser) cancelDagIns(dagIns *entity.DagInstance) error {
+	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: dagIns.ID,
+		Status: []entity.TaskInstanceStatus{
+			entity.TaskInstanceStatusInit,
+			entity.TaskInstanceStatusRetrying,
+			entity.TaskInstanceStatusBlocked,
+			entity.TaskInstanceStatusRunning,
+			entity.TaskInstanceStatusEnding,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	tree, hasTree := p.getTaskTree(dagIns.ID)
+	if hasTree {
+		tree.Cancel()
+	}
+	var runningIds []string
+	for _, t := range taskIns {
+		isRunning := t.Status == entity.TaskInstanceStatusRunning || t.Status == entity.TaskInstanceStatusEnding
+		// the running tasks of dead worker have no chance to complete, so cancel them directly,
+		// and the running group is canceled directly too, because only its mapped tasks are executed by executor
+		if hasTree && isRunning && !t.IsForeachGroup() {
+			runningIds = append(runningIds, t.ID)
+			continue
+		}
+		// the handlers still run after the main tasks are canceled
+		if hasTree && !tree.handling && t.Handler != "" {
+			continue
+		}
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: t.BaseInfo,
+			Status:   entity.TaskInstanceStatusCanceled,
+			Reason:   ReasonDagInsCanceled,
+		}); err != nil {
+			return err
+		}
+	}
+	if len(runningIds) > 0 {
+		return GetExecutor().CancelTaskIns(runningIds)
+	}
+
+	p.dropTree(dagIns.ID)
+	if hasTree {
+		return p.completeCanceledTree(tree, dagIns)
+	}
+	dagIns.Fail(ReasonDagInsCanceled)
+	return nil
+}
+
 // Close
 func (p *DefParser) Close() {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
 	close(p.closeCh)
+	p.taskTrees.Range(func(key, value interface{}) bool {
+		value.(*TaskTree).StopRetryTimers()
+		return true
+	})
 	for i := range p.workerQueue {
 		close(p.workerQueue[i])
 	}
@@ -8,7 +8,9 @@ import (
 	"time"
 
 	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/entity/run"
 	"github.com/linclin/fastflow/pkg/log"
+	"github.com/linclin/fastflow/pkg/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -379,6 +381,34 @@ func TestDefParser_executeNext(t *testing.T) {
 			wantPatchStatus: entity.DagInstanceStatusFailed,
 			wantPatchCalled: true,
 		},
+		{
+			caseDesc:   "mapped tasks completed",
+			giveParser: &DefParser{},
+			giveTaskTreeMap: map[string]*TaskTree{
+				"dag1": {
+					DagIns: &entity.DagInstance{
+						BaseInfo: entity.BaseInfo{ID: "dag1"},
+						Status:   entity.DagInstanceStatusRunning,
+					},
+					Root: MustBuildRootNode(MapMockTasksToGetter([]*MockTaskInfoGetter{
+						{ID: "group", Status: entity.TaskInstanceStatusRunning},
+						{ID: "mapped-0", Status: entity.TaskInstanceStatusSuccess, MappedFrom: "group"},
+						{ID: "mapped-1", Status: entity.TaskInstanceStatusRunning, MappedFrom: "group"},
+						{ID: "child", Status: entity.TaskInstanceStatusInit, Depend: []string{"group"}},
+					})),
+				},
+			},
+			giveTaskIns: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "mapped-1",
+				},
+				DagInsID:   "dag1",
+				MappedFrom: "group",
+				Status:     entity.TaskInstanceStatusSuccess,
+			},
+			wantPushCalled:     true,
+			wantListTaskCalled: true,
+		},
 		{
 			caseDesc:   "child block but parent not success",
 			giveParser: &DefParser{},
@@ -412,6 +442,8 @@ func TestDefParser_executeNext(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.caseDesc, func(t *testing.T) {
 			for k, v := range tc.giveTaskTreeMap {
+				// trigger rules are evaluated by parents, so link them
+				linkParents(v.Root)
 				tc.giveParser.taskTrees.Store(k, v)
 			}
 
@@ -425,6 +457,7 @@ func TestDefParser_executeNext(t *testing.T) {
 			mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
 				calledList = true
 			}).Return([]*entity.TaskInstance{preTask}, tc.giveListErr)
+			mStore.On("PatchTaskIns", mock.Anything).Return(nil)
 			SetStore(mStore)
 
 			mExecutor := &MockExecutor{}
@@ -446,6 +479,494 @@ func TestDefParser_executeNext(t *testing.T) {
 	}
 }
 
+func TestDefParser_releaseHaltedTree(t *testing.T) {
+	tests := []struct {
+		caseDesc        string
+		giveCanceled    bool
+		giveRunning     []*entity.TaskInstance
+		wantReleased    bool
+		wantPatchDagIns *entity.DagInstance
+	}{
+		{
+			caseDesc:    "tasks are still running",
+			giveRunning: []*entity.TaskInstance{{BaseInfo: entity.BaseInfo{ID: "task1"}}},
+		},
+		{
+			caseDesc:     "paused",
+			wantReleased: true,
+		},
+		{
+			caseDesc:     "canceled",
+			giveCanceled: true,
+			wantReleased: true,
+			wantPatchDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusFailed,
+				Reason:   ReasonDagInsCanceled,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patchDagIns *entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return(tc.giveRunning, nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				patchDagIns = args.Get(0).(*entity.DagInstance)
+			}).Return(nil)
+			SetStore(mStore)
+
+			tree := &TaskTree{
+				DagIns: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusRunning},
+				Root:   MustBuildRootNode(MapMockTasksToGetter([]*MockTaskInfoGetter{{ID: "task1"}})),
+			}
+			tree.Pause()
+			if tc.giveCanceled {
+				tree.Cancel()
+			}
+			p := &DefParser{}
+			p.taskTrees.Store("dag1", tree)
+
+			err := p.executeNext(&entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "task1"},
+				DagInsID: "dag1",
+				Status:   entity.TaskInstanceStatusSuccess,
+			})
+			assert.NoError(t, err)
+			_, ok := p.getTaskTree("dag1")
+			assert.Equal(t, tc.wantReleased, !ok)
+			assert.Equal(t, tc.wantPatchDagIns, patchDagIns)
+		})
+	}
+}
+
+func TestDefParser_forceTaskStatus(t *testing.T) {
+	log.SetLogger(&log.StdoutLogger{})
+	tests := []struct {
+		caseDesc       string
+		giveTaskID     string
+		wantNodeStatus entity.TaskInstanceStatus
+		wantPushed     bool
+	}{
+		{
+			caseDesc:       "task is executable",
+			giveTaskID:     "blocked",
+			wantNodeStatus: entity.TaskInstanceStatusSkipped,
+			wantPushed:     true,
+		},
+		{
+			caseDesc:       "task is not executable yet",
+			giveTaskID:     "waiting",
+			wantNodeStatus: entity.TaskInstanceStatusSkipped,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			taskIns := &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: tc.giveTaskID}, DagInsID: "dag1"}
+			pushed := false
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return([]*entity.TaskInstance{taskIns}, nil)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patch := args.Get(0).(*entity.TaskInstance)
+				assert.Equal(t, entity.TaskInstanceStatusSkipped, patch.Status)
+				assert.Equal(t, "skipped by ops", patch.Reason)
+			}).Return(nil)
+			SetStore(mStore)
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				pushed = true
+			})
+			SetExecutor(mExecutor)
+
+			dagIns := &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusRunning,
+				Cmd:      &entity.Command{Name: entity.CommandNameSkip, TargetTaskInsIDs: []string{tc.giveTaskID}, Operator: "ops"},
+			}
+			tree := &TaskTree{
+				DagIns: dagIns,
+				Root: MustBuildRootNode(MapMockTasksToGetter([]*MockTaskInfoGetter{
+					{ID: "running", Status: entity.TaskInstanceStatusRunning},
+					{ID: "waiting", Status: entity.TaskInstanceStatusInit, Depend: []string{"running"}},
+					{ID: "blocked", Status: entity.TaskInstanceStatusBlocked},
+					{ID: "child", Status: entity.TaskInstanceStatusInit, Depend: []string{"blocked"}},
+				})),
+			}
+			p := &DefParser{
+				workerNumber: 1,
+				workerQueue:  []chan *entity.TaskInstance{make(chan *entity.TaskInstance, 1)},
+				closeCh:      make(chan struct{}),
+			}
+			p.taskTrees.Store("dag1", tree)
+
+			needInitial, err := p.forceTaskStatus(dagIns)
+			assert.NoError(t, err)
+			assert.False(t, needInitial)
+			assert.NoError(t, p.executeNext(<-p.workerQueue[0]))
+			assert.Equal(t, tc.wantNodeStatus, tree.Root.findNode(tc.giveTaskID).Status)
+			assert.Equal(t, tc.wantPushed, pushed)
+		})
+	}
+}
+
+func TestDefParser_skipUnselectedBranches(t *testing.T) {
+	tests := []struct {
+		caseDesc        string
+		giveSelected    entity.StringArray
+		wantPatched     map[string]entity.TaskInstanceStatus
+		wantPushed      []string
+		wantDagInsPatch entity.DagInstanceStatus
+	}{
+		{
+			caseDesc:     "skip unselected",
+			giveSelected: entity.StringArray{"continue"},
+			wantPatched: map[string]entity.TaskInstanceStatus{
+				"rollback-ins": entity.TaskInstanceStatusSkipped,
+				"revert-ins":   entity.TaskInstanceStatusSkipped,
+			},
+			wantPushed: []string{"continue-ins"},
+		},
+		{
+			caseDesc:     "select not child",
+			giveSelected: entity.StringArray{"revert"},
+			wantPatched: map[string]entity.TaskInstanceStatus{
+				"check-ins": entity.TaskInstanceStatusFailed,
+			},
+			wantDagInsPatch: entity.DagInstanceStatusFailed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			tasks := []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "check-ins"}, TaskID: "check", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "continue-ins"}, TaskID: "continue", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusInit, DependOn: []string{"check"}},
+				{BaseInfo: entity.BaseInfo{ID: "rollback-ins"}, TaskID: "rollback", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusInit, DependOn: []string{"check"}},
+				{BaseInfo: entity.BaseInfo{ID: "revert-ins"}, TaskID: "revert", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusInit, DependOn: []string{"rollback"}},
+			}
+			tree := &TaskTree{
+				DagIns: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag-ins"}, Status: entity.DagInstanceStatusRunning},
+				Root:   MustBuildRootNode(MapTaskInsToGetter(tasks)),
+			}
+			p := &DefParser{}
+			p.taskTrees.Store("dag-ins", tree)
+
+			patched := map[string]entity.TaskInstanceStatus{}
+			var dagInsStatus entity.DagInstanceStatus
+			var pushed []string
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return(func(input *ListTaskInstanceInput) []*entity.TaskInstance {
+				if len(input.IDs) == 0 {
+					return tasks
+				}
+				var ret []*entity.TaskInstance
+				for _, t := range tasks {
+					if utils.StringsContain(input.IDs, t.ID) {
+						ret = append(ret, t)
+					}
+				}
+				return ret
+			}, nil)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				ins := args.Get(0).(*entity.TaskInstance)
+				patched[ins.ID] = ins.Status
+			}).Return(nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				dagInsStatus = args.Get(0).(*entity.DagInstance).Status
+			}).Return(nil)
+			SetStore(mStore)
+
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				pushed = append(pushed, args.Get(1).(*entity.TaskInstance).ID)
+			})
+			SetExecutor(mExecutor)
+
+			assert.NoError(t, p.executeNext(&entity.TaskInstance{
+				BaseInfo:         entity.BaseInfo{ID: "check-ins"},
+				TaskID:           "check",
+				DagInsID:         "dag-ins",
+				Status:           entity.TaskInstanceStatusSuccess,
+				SelectedBranches: tc.giveSelected,
+			}))
+			assert.Equal(t, tc.wantPatched, patched)
+			assert.Equal(t, tc.wantPushed, pushed)
+			assert.Equal(t, tc.wantDagInsPatch, dagInsStatus)
+		})
+	}
+}
+
+func TestDefParser_completeTree(t *testing.T) {
+	tests := []struct {
+		caseDesc          string
+		giveStatus        entity.TaskInstanceStatus
+		giveHandling      bool
+		wantPatched       map[string]entity.TaskInstanceStatus
+		wantPushed        []string
+		wantStatus        entity.DagInstanceStatus
+		wantHandlerStatus entity.DagInstanceStatus
+		wantHandlerReason string
+		wantPatchFields   []string
+	}{
+		{
+			caseDesc:   "main tasks succeeded",
+			giveStatus: entity.TaskInstanceStatusSuccess,
+			wantPatched: map[string]entity.TaskInstanceStatus{
+				"alert-ins": entity.TaskInstanceStatusSkipped,
+			},
+			wantPushed:        []string{"notify-ins", "cleanup-ins"},
+			wantHandlerStatus: entity.DagInstanceStatusRunning,
+			wantPatchFields:   []string{"HandlerReason"},
+		},
+		{
+			caseDesc:   "main tasks failed",
+			giveStatus: entity.TaskInstanceStatusFailed,
+			wantPatched: map[string]entity.TaskInstanceStatus{
+				"notify-ins": entity.TaskInstanceStatusSkipped,
+			},
+			wantPushed:        []string{"alert-ins", "cleanup-ins"},
+			wantHandlerStatus: entity.DagInstanceStatusRunning,
+			wantPatchFields:   []string{"HandlerReason"},
+		},
+		{
+			caseDesc:          "handler failed",
+			giveStatus:        entity.TaskInstanceStatusFailed,
+			giveHandling:      true,
+			wantPatched:       map[string]entity.TaskInstanceStatus{},
+			wantStatus:        entity.DagInstanceStatusSuccess,
+			wantHandlerStatus: entity.DagInstanceStatusFailed,
+			wantHandlerReason: "task[cleanup-ins] failed or canceled",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			tasks := []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "deploy-ins"}, TaskID: "deploy", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusRunning},
+			}
+			handlers := []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "notify-ins"}, TaskID: "notify", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusInit, Handler: entity.DagHandlerOnSuccess},
+				{BaseInfo: entity.BaseInfo{ID: "alert-ins"}, TaskID: "alert", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusInit, Handler: entity.DagHandlerOnFailure},
+				{BaseInfo: entity.BaseInfo{ID: "cleanup-ins"}, TaskID: "cleanup", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusInit, Handler: entity.DagHandlerFinally},
+				{BaseInfo: entity.BaseInfo{ID: "report-ins"}, TaskID: "report", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusInit, Handler: entity.DagHandlerFinally, DependOn: []string{"cleanup"}},
+			}
+			// the dag instance is retried after its last handlers failed
+			tree := &TaskTree{
+				DagIns: &entity.DagInstance{
+					BaseInfo:      entity.BaseInfo{ID: "dag-ins"},
+					Status:        entity.DagInstanceStatusRunning,
+					HandlerStatus: entity.DagInstanceStatusFailed,
+					HandlerReason: "last handlers failed",
+				},
+				Root:     MustBuildRootNode(MapTaskInsToGetter(tasks)),
+				handlers: handlers,
+			}
+			completed := tasks[0]
+			if tc.giveHandling {
+				// the main tasks succeeded and only the finally handlers are running
+				tasks[0].Status = entity.TaskInstanceStatusSuccess
+				handlers[2].Status = entity.TaskInstanceStatusRunning
+				tree.Root = MustBuildRootNode(MapTaskInsToGetter(handlers[2:]))
+				tree.handling, tree.mainStatus = true, TreeStatusSuccess
+				completed = handlers[2]
+			}
+			p := &DefParser{}
+			p.taskTrees.Store("dag-ins", tree)
+
+			patched := map[string]entity.TaskInstanceStatus{}
+			var dagIns *entity.DagInstance
+			var pushed, patchFields []string
+			mStore := &MockStore{}
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				ins := args.Get(0).(*entity.TaskInstance)
+				patched[ins.ID] = ins.Status
+			}).Return(nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				dagIns = args.Get(0).(*entity.DagInstance)
+			}).Return(nil)
+			mStore.On("PatchDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				dagIns = args.Get(0).(*entity.DagInstance)
+				patchFields = append(patchFields, args.String(1))
+			}).Return(nil)
+			SetStore(mStore)
+
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				pushed = append(pushed, args.Get(1).(*entity.TaskInstance).ID)
+			})
+			SetExecutor(mExecutor)
+
+			assert.NoError(t, p.executeNext(&entity.TaskInstance{
+				BaseInfo: completed.BaseInfo,
+				TaskID:   completed.TaskID,
+				DagInsID: "dag-ins",
+				Status:   tc.giveStatus,
+			}))
+			assert.Equal(t, tc.wantPatched, patched)
+			assert.Equal(t, tc.wantPushed, pushed)
+			assert.Equal(t, tc.wantStatus, dagIns.Status)
+			assert.Equal(t, tc.wantHandlerStatus, dagIns.HandlerStatus)
+			// the reason of last handlers must be cleared when the handlers start again
+			assert.Equal(t, tc.wantHandlerReason, dagIns.HandlerReason)
+			assert.Equal(t, tc.wantPatchFields, patchFields)
+			_, hasTree := p.getTaskTree("dag-ins")
+			assert.Equal(t, tc.wantStatus == "", hasTree)
+		})
+	}
+}
+
+func TestDefParser_compensateDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc        string
+		giveErr         error
+		wantCompensated []string
+	}{
+		{
+			caseDesc:        "reverse order",
+			wantCompensated: []string{"subnet-ins", "vpc-ins"},
+		},
+		{
+			caseDesc:        "stop at failed",
+			giveErr:         fmt.Errorf("compensate failed"),
+			wantCompensated: []string{"subnet-ins"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			compensate := &entity.Compensate{}
+			tasks := []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "vpc-ins"}, TaskID: "vpc", Status: entity.TaskInstanceStatusSuccess, Compensate: compensate},
+				{BaseInfo: entity.BaseInfo{ID: "subnet-ins"}, TaskID: "subnet", Status: entity.TaskInstanceStatusSuccess, Compensate: compensate, DependOn: []string{"vpc"}},
+				{BaseInfo: entity.BaseInfo{ID: "dns-ins"}, TaskID: "dns", Status: entity.TaskInstanceStatusSuccess, DependOn: []string{"vpc"}},
+				{
+					BaseInfo:     entity.BaseInfo{ID: "sg-ins"},
+					TaskID:       "sg",
+					Status:       entity.TaskInstanceStatusSuccess,
+					Compensate:   compensate,
+					Compensation: &entity.Compensation{Status: entity.CompensationStatusSuccess},
+					DependOn:     []string{"vpc"},
+				},
+				{BaseInfo: entity.BaseInfo{ID: "vm-ins"}, TaskID: "vm", Status: entity.TaskInstanceStatusFailed, Compensate: compensate, DependOn: []string{"subnet"}},
+				{BaseInfo: entity.BaseInfo{ID: "notify-ins"}, TaskID: "notify", Status: entity.TaskInstanceStatusSuccess, Compensate: compensate, Handler: entity.DagHandlerFinally},
+			}
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return(tasks, nil)
+			SetStore(mStore)
+
+			var compensated []string
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Compensate", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				compensated = append(compensated, args.Get(1).(*entity.TaskInstance).ID)
+			}).Return(tc.giveErr)
+			SetExecutor(mExecutor)
+
+			p := &DefParser{closeCh: make(chan struct{})}
+			dagIns := &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag-ins"}, Status: entity.DagInstanceStatusFailed}
+			assert.NoError(t, p.compensateDagIns(dagIns))
+			assert.Eventually(t, func() bool {
+				_, ok := p.compensating.Load("dag-ins")
+				return !ok
+			}, time.Second, 10*time.Millisecond)
+			assert.Equal(t, tc.wantCompensated, compensated)
+		})
+	}
+}
+
+func TestDefParser_expandForeach(t *testing.T) {
+	tests := []struct {
+		caseDesc        string
+		giveVars        entity.DagInstanceVars
+		giveMaxParallel int
+		wantCreated     []string
+		wantPushed      []string
+		wantGroupStatus entity.TaskInstanceStatus
+		wantEntry       bool
+	}{
+		{
+			caseDesc:        "expand with max parallel",
+			giveVars:        entity.DagInstanceVars{"hosts": {Value: `["h1","h2","h3"]`}},
+			giveMaxParallel: 2,
+			wantCreated:     []string{"task[0]", "task[1]", "task[2]"},
+			wantPushed:      []string{"task[0]", "task[1]"},
+			wantGroupStatus: entity.TaskInstanceStatusRunning,
+		},
+		{
+			caseDesc:        "empty list",
+			giveVars:        entity.DagInstanceVars{"hosts": {Value: `[]`}},
+			wantGroupStatus: entity.TaskInstanceStatusSuccess,
+			wantEntry:       true,
+		},
+		{
+			caseDesc:        "items not found",
+			giveVars:        entity.DagInstanceVars{},
+			wantGroupStatus: entity.TaskInstanceStatusFailed,
+			wantEntry:       true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			group := &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "group"},
+				TaskID:   "task",
+				DagInsID: "dag-ins",
+				Status:   entity.TaskInstanceStatusInit,
+				Foreach: &entity.Foreach{
+					Source:      entity.TaskConditionSourceVars,
+					Key:         "hosts",
+					MaxParallel: tc.giveMaxParallel,
+				},
+			}
+			tree := &TaskTree{
+				DagIns: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag-ins"}, Vars: tc.giveVars},
+				Root:   MustBuildRootNode(MapTaskInsToGetter([]*entity.TaskInstance{group})),
+			}
+
+			var created, pushed []string
+			var groupStatus entity.TaskInstanceStatus
+			mStore := &MockStore{}
+			mStore.On("BatchCreatTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				for _, ins := range args.Get(0).([]*entity.TaskInstance) {
+					assert.Equal(t, "task", ins.MappedFrom)
+					ins.ID = ins.TaskID
+					created = append(created, ins.TaskID)
+				}
+			}).Return(nil)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				ins := args.Get(0).(*entity.TaskInstance)
+				if ins.ID == "group" {
+					groupStatus = ins.Status
+				}
+			}).Return(nil)
+			mStore.On("ListTaskInstance", mock.Anything).Return(func(input *ListTaskInstanceInput) []*entity.TaskInstance {
+				var ret []*entity.TaskInstance
+				for _, id := range input.IDs {
+					ret = append(ret, &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: id}, MappedFrom: "task"})
+				}
+				return ret
+			}, nil)
+			SetStore(mStore)
+
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				pushed = append(pushed, args.Get(1).(*entity.TaskInstance).ID)
+			})
+			SetExecutor(mExecutor)
+
+			queue := make(chan *entity.TaskInstance, 1)
+			p := &DefParser{workerNumber: 1, workerQueue: []chan *entity.TaskInstance{queue}, closeCh: make(chan struct{})}
+			assert.NoError(t, p.expandForeach(tree, group))
+			assert.Equal(t, tc.wantCreated, created)
+			assert.Equal(t, tc.wantPushed, pushed)
+			assert.Equal(t, tc.wantGroupStatus, groupStatus)
+			assert.Equal(t, tc.wantEntry, len(queue) == 1)
+		})
+	}
+}
+
 func TestDefParser_EntryTaskIns(t *testing.T) {
 	tests := []struct {
 		caseDesc    string
@@ -579,6 +1100,7 @@ func TestDefParser_InitialDagIns(t *testing.T) {
 					ID: "test-dag",
 				},
 				Status: entity.DagInstanceStatusFailed,
+				Reason: "initial failed because task ins[root-1-ins]",
 			},
 			wantPatchCalled: true,
 		},
@@ -740,6 +1262,7 @@ func TestDefParser_WatchScheduledDagIns(t *testing.T) {
 			mKeeper.On("WorkerKey").Run(func(args mock.Arguments) {
 				calledKeeper = true
 			}).Return(tc.giveWorkerKey)
+			mKeeper.On("IsDraining").Return(false)
 			SetKeeper(mKeeper)
 
 			p := &DefParser{}
@@ -1088,13 +1611,16 @@ func TestDefParser_ParseCmd(t *testing.T) {
 		givePushErr          error
 		wantErr              error
 		wantGetTaskId        string
+		wantListInput        *ListTaskInstanceInput
 		wantUpdateDagIns     *entity.DagInstance
 		wantUpdateTask       *entity.TaskInstance
 		wantCancelTaskId     []string
 		wantUpdateTaskCalled bool
+		wantPatchTaskCalled  bool
 		wantUpdateDagCalled  bool
 		wantCancelCalled     bool
 		wantListCallCnt      int
+		wantShareData        map[string]string
 	}{
 		{
 			caseDesc: "retry failed task",
@@ -1161,6 +1687,162 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			wantCancelTaskId:  []string{"task1"},
 			wantCancelCalled:  true,
 		},
+		{
+			caseDesc: "approve blocked task",
+			giveDagIns: &entity.DagInstance{
+				Status: entity.DagInstanceStatusBlocked,
+				Cmd: &entity.Command{Name: entity.CommandNameApprove, TargetTaskInsIDs: []string{"task1"},
+					Operator: "ops", Comment: "lgtm"}},
+			giveTask: []*entity.TaskInstance{
+				{Status: entity.TaskInstanceStatusBlocked},
+			},
+			wantListCallCnt: 2,
+			wantUpdateTask: &entity.TaskInstance{
+				Status:   entity.TaskInstanceStatusInit,
+				Approval: &entity.Approval{Decision: entity.ApprovalDecisionApproved, Operator: "ops", Comment: "lgtm"},
+				Traces:   []entity.TraceInfo{{Message: "approved by ops: lgtm"}},
+			},
+			wantUpdateTaskCalled: true,
+			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagCalled:  true,
+		},
+		{
+			caseDesc: "reject blocked task",
+			giveDagIns: &entity.DagInstance{
+				Status: entity.DagInstanceStatusBlocked,
+				Cmd: &entity.Command{Name: entity.CommandNameReject, TargetTaskInsIDs: []string{"task1"},
+					Operator: "ops"}},
+			giveTask: []*entity.TaskInstance{
+				{Status: entity.TaskInstanceStatusBlocked},
+			},
+			wantListCallCnt: 2,
+			wantUpdateTask: &entity.TaskInstance{
+				Status:   entity.TaskInstanceStatusFailed,
+				Reason:   "rejected by ops",
+				Approval: &entity.Approval{Decision: entity.ApprovalDecisionRejected, Operator: "ops"},
+				Traces:   []entity.TraceInfo{{Message: "rejected by ops"}},
+			},
+			wantUpdateTaskCalled: true,
+			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagCalled:  true,
+		},
+		{
+			caseDesc: "approve waiting task",
+			giveDagIns: &entity.DagInstance{
+				Status: entity.DagInstanceStatusRunning,
+				Cmd:    &entity.Command{Name: entity.CommandNameApprove, TargetTaskInsIDs: []string{"task1"}}},
+			giveTask: []*entity.TaskInstance{
+				{Status: entity.TaskInstanceStatusRunning},
+			},
+			wantListCallCnt:     1,
+			wantPatchTaskCalled: true,
+			wantUpdateDagIns:    &entity.DagInstance{Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagCalled: true,
+		},
+		{
+			caseDesc: "pause",
+			giveDagIns: &entity.DagInstance{
+				Status: entity.DagInstanceStatusRunning,
+				Cmd:    &entity.Command{Name: entity.CommandNamePause}},
+			wantUpdateDagIns:    &entity.DagInstance{Status: entity.DagInstanceStatusPaused},
+			wantUpdateDagCalled: true,
+		},
+		{
+			caseDesc: "resume",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusPaused,
+				Cmd:      &entity.Command{Name: entity.CommandNameResume}},
+			wantListInput:       &ListTaskInstanceInput{DagInsID: "dag1"},
+			wantListCallCnt:     1,
+			wantUpdateDagIns:    &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagCalled: true,
+		},
+		{
+			caseDesc: "cancel all without task tree",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusRunning,
+				Cmd:      &entity.Command{Name: entity.CommandNameCancelAll}},
+			giveTask: []*entity.TaskInstance{
+				{Status: entity.TaskInstanceStatusRunning},
+				{Status: entity.TaskInstanceStatusInit},
+			},
+			wantListInput: &ListTaskInstanceInput{
+				DagInsID: "dag1",
+				Status: []entity.TaskInstanceStatus{
+					entity.TaskInstanceStatusInit,
+					entity.TaskInstanceStatusRetrying,
+					entity.TaskInstanceStatusBlocked,
+					entity.TaskInstanceStatusRunning,
+					entity.TaskInstanceStatusEnding,
+				},
+			},
+			wantListCallCnt:     1,
+			wantPatchTaskCalled: true,
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusFailed,
+				Reason:   ReasonDagInsCanceled,
+			},
+			wantUpdateDagCalled: true,
+		},
+		{
+			caseDesc: "mark success without task tree",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusFailed,
+				Cmd: &entity.Command{Name: entity.CommandNameMarkSuccess, TargetTaskInsIDs: []string{"task1"},
+					Operator: "ops", Comment: "done by hand"}},
+			giveTask: []*entity.TaskInstance{
+				{Status: entity.TaskInstanceStatusFailed},
+			},
+			wantListInput: &ListTaskInstanceInput{
+				IDs: []string{"task1"},
+				Status: []entity.TaskInstanceStatus{
+					entity.TaskInstanceStatusInit,
+					entity.TaskInstanceStatusBlocked,
+					entity.TaskInstanceStatusFailed,
+					entity.TaskInstanceStatusCanceled,
+				},
+			},
+			wantListCallCnt:     2,
+			wantPatchTaskCalled: true,
+			wantUpdateDagIns:    &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagCalled: true,
+		},
+		{
+			caseDesc: "rerun success task",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo:  entity.BaseInfo{ID: "dag1"},
+				Status:    entity.DagInstanceStatusSuccess,
+				ShareData: &entity.ShareData{Dict: map[string]string{"k1": "v1", "k2": "v2"}},
+				Cmd: &entity.Command{Name: entity.CommandNameRerun, TargetTaskInsIDs: []string{"task1"},
+					IncludeDownstream: true, ClearShareData: true}},
+			giveTask: []*entity.TaskInstance{
+				{
+					BaseInfo:      entity.BaseInfo{ID: "task1"},
+					TaskID:        "task1",
+					Status:        entity.TaskInstanceStatusSuccess,
+					Traces:        []entity.TraceInfo{{Message: "done"}},
+					ShareDataKeys: []string{"k1"},
+				},
+			},
+			wantListInput:   &ListTaskInstanceInput{DagInsID: "dag1"},
+			wantListCallCnt: 2,
+			wantUpdateTask: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "task1"},
+				TaskID:   "task1",
+				Status:   entity.TaskInstanceStatusInit,
+				History: entity.TaskInsHistories{
+					{Status: entity.TaskInstanceStatusSuccess, Traces: []entity.TraceInfo{{Message: "done"}}},
+				},
+			},
+			wantUpdateTaskCalled: true,
+			wantUpdateDagIns:     &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagCalled:  true,
+			wantShareData:        map[string]string{"k2": "v2"},
+		},
 		{
 			caseDesc:   "no cmd",
 			giveDagIns: &entity.DagInstance{},
@@ -1169,24 +1851,58 @@ func TestDefParser_ParseCmd(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.caseDesc, func(t *testing.T) {
-			calledUpdateTask, calledCancel, calledUpdateDag := false, false, false
+			calledUpdateTask, calledPatchTask, calledCancel, calledUpdateDag := false, false, false, false
 			listTaskCallCnt := 0
 			mStore := &MockStore{}
 			mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
 				listTaskCallCnt++
-				if listTaskCallCnt == 1 {
+				if listTaskCallCnt == 1 && tc.wantListInput != nil {
+					assert.Equal(t, tc.wantListInput, args.Get(0))
+				} else if listTaskCallCnt == 1 {
+					wantStatus := []entity.TaskInstanceStatus{entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled}
+					if tc.giveDagIns.Cmd.Name != entity.CommandNameRetry {
+						wantStatus = []entity.TaskInstanceStatus{entity.TaskInstanceStatusBlocked, entity.TaskInstanceStatusRunning}
+					}
 					assert.Equal(t, &ListTaskInstanceInput{
 						IDs:    tc.giveDagIns.Cmd.TargetTaskInsIDs,
-						Status: []entity.TaskInstanceStatus{entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled},
+						Status: wantStatus,
 					}, args.Get(0))
 				}
 			}).Return(tc.giveTask, tc.giveTaskErr)
 
 			mStore.On("UpdateTaskIns", mock.Anything).Run(func(args mock.Arguments) {
 				calledUpdateTask = true
-				assert.Equal(t, tc.wantUpdateTask, args.Get(0))
+				taskIns := args.Get(0).(*entity.TaskInstance)
+				// the time of approval is not deterministic
+				if taskIns.Approval != nil {
+					taskIns.Approval.Time = 0
+					for i := range taskIns.Traces {
+						taskIns.Traces[i].Time = 0
+					}
+				}
+				for i := range taskIns.History {
+					taskIns.History[i].Time = 0
+				}
+				assert.Equal(t, tc.wantUpdateTask, taskIns)
 			}).Return(tc.giveUpdateTaskErr)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				calledPatchTask = true
+				taskIns := args.Get(0).(*entity.TaskInstance)
+				switch tc.giveDagIns.Cmd.Name {
+				case entity.CommandNameCancelAll:
+					assert.Equal(t, entity.TaskInstanceStatusCanceled, taskIns.Status)
+					return
+				case entity.CommandNameMarkSuccess:
+					assert.Equal(t, entity.TaskInstanceStatusSuccess, taskIns.Status)
+					assert.Equal(t, "marked success by ops: done by hand", taskIns.Reason)
+					assert.Equal(t, "marked success by ops: done by hand", taskIns.Traces[0].Message)
+					return
+				}
+				assert.Equal(t, entity.ApprovalDecisionApproved, taskIns.Approval.Decision)
+			}).Return(nil)
 
+			// the dag instance is finished after the blocked task rejected
+			mStore.On("PatchDagIns", mock.Anything).Return(nil)
 			mStore.On("PatchDagIns", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 				calledUpdateDag = true
 				assert.Equal(t, tc.wantUpdateDagIns, args.Get(0))
@@ -1209,8 +1925,12 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			assert.Equal(t, tc.wantErr, err)
 			assert.Equal(t, tc.wantListCallCnt, listTaskCallCnt)
 			assert.Equal(t, tc.wantUpdateTaskCalled, calledUpdateTask)
+			assert.Equal(t, tc.wantPatchTaskCalled, calledPatchTask)
 			assert.Equal(t, tc.wantCancelCalled, calledCancel)
 			assert.Equal(t, tc.wantUpdateDagCalled, calledUpdateDag)
+			if tc.wantShareData != nil {
+				assert.Equal(t, tc.wantShareData, tc.giveDagIns.ShareData.Dict)
+			}
 		})
 	}
 }
@@ -1250,3 +1970,100 @@ func TestDefParser(t *testing.T) {
 	wg.Wait()
 	def.Close()
 }
+
+type failoverAction struct {
+	policy run.FailoverPolicy
+}
+
+func (a *failoverAction) Name() string {
+	return string(a.policy)
+}
+
+func (a *failoverAction) Run(ctx run.ExecuteContext, params interface{}) error {
+	return nil
+}
+
+func (a *failoverAction) FailoverPolicy() run.FailoverPolicy {
+	return a.policy
+}
+
+func TestDefParser_failoverTasks(t *testing.T) {
+	ActionMap["rerun"] = &failoverAction{policy: run.FailoverPolicyRerun}
+	ActionMap["resume"] = &failoverAction{policy: run.FailoverPolicyResume}
+	defer func() {
+		delete(ActionMap, "rerun")
+		delete(ActionMap, "resume")
+	}()
+
+	tests := []struct {
+		caseDesc      string
+		giveTasks     []*entity.TaskInstance
+		givePatchErr  error
+		wantPatchTask []*entity.TaskInstance
+		wantErr       error
+	}{
+		{
+			caseDesc: "sanity",
+			giveTasks: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, ActionName: "rerun", Status: entity.TaskInstanceStatusSuccess},
+				{BaseInfo: entity.BaseInfo{ID: "task2"}, ActionName: "rerun", Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "task3"}, ActionName: "resume", Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "task4"}, ActionName: "no-policy", Status: entity.TaskInstanceStatusEnding},
+				{BaseInfo: entity.BaseInfo{ID: "task5"}, ActionName: "rerun", Status: entity.TaskInstanceStatusInit},
+			},
+			wantPatchTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task2"}, Status: entity.TaskInstanceStatusInit,
+					Traces: []entity.TraceInfo{{Message: "the worker is dead, failover with policy[rerun]"}}},
+				{BaseInfo: entity.BaseInfo{ID: "task3"}, Status: entity.TaskInstanceStatusEnding,
+					Traces: []entity.TraceInfo{{Message: "the worker is dead, failover with policy[resume]"}}},
+				{BaseInfo: entity.BaseInfo{ID: "task4"}, Status: entity.TaskInstanceStatusFailed, Reason: ReasonWorkerDead,
+					Traces: []entity.TraceInfo{{Message: "the worker is dead, failover with policy[fail]"}}},
+			},
+		},
+		{
+			caseDesc: "group is computed by mapped tasks",
+			giveTasks: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "group"}, TaskID: "group", ActionName: "rerun", Status: entity.TaskInstanceStatusRunning,
+					Foreach: &entity.Foreach{Key: "items"}},
+				{BaseInfo: entity.BaseInfo{ID: "mapped"}, TaskID: "group[0]", ActionName: "rerun", Status: entity.TaskInstanceStatusRunning,
+					Foreach: &entity.Foreach{Key: "items"}, MappedFrom: "group"},
+			},
+			wantPatchTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "mapped"}, Status: entity.TaskInstanceStatusInit,
+					Traces: []entity.TraceInfo{{Message: "the worker is dead, failover with policy[rerun]"}}},
+			},
+		},
+		{
+			caseDesc: "patch failed",
+			giveTasks: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, ActionName: "rerun", Status: entity.TaskInstanceStatusRunning},
+			},
+			givePatchErr: fmt.Errorf("patch failed"),
+			wantPatchTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, Status: entity.TaskInstanceStatusInit,
+					Traces: []entity.TraceInfo{{Message: "the worker is dead, failover with policy[rerun]"}}},
+			},
+			wantErr: fmt.Errorf("failover task instance[task1] failed: %w", fmt.Errorf("patch failed")),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched []*entity.TaskInstance
+			mStore := &MockStore{}
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				taskIns := args.Get(0).(*entity.TaskInstance)
+				for i := range taskIns.Traces {
+					taskIns.Traces[i].Time = 0
+				}
+				patched = append(patched, taskIns)
+			}).Return(tc.givePatchErr)
+			SetStore(mStore)
+
+			p := &DefParser{}
+			err := p.failoverTasks(tc.giveTasks)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantPatchTask, patched)
+		})
+	}
+}
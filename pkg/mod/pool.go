@@ -0,0 +1,266 @@
+package mod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/event"
+	"github.com/linclin/fastflow/pkg/log"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/shiningrush/goevent"
+)
+
+var (
+	// poolRetryInterval is the initial interval of waking the parked task instances up,
+	// because the slots may be released by other workers
+	poolRetryInterval = time.Second
+	// poolMaxRetryInterval is the max interval of waking the parked task instances up,
+	// the interval doubles every time the parked task instances are woken up by it
+	poolMaxRetryInterval = 30 * time.Second
+	// poolSlotTTLMargin is added to the timeout of task instance as the ttl of slot,
+	// so that the slots of a crashed worker are released eventually
+	poolSlotTTLMargin = time.Minute
+)
+
+// resourcePool is a named pool whose slots are shared by the whole cluster,
+// each slot is a distributed mutex created by keeper.
+// The count of slots comes from the options of the process, so all workers should define the same pools
+type resourcePool struct {
+	name  string
+	slots int
+
+	mutex sync.Mutex
+	inUse int
+	// waiting is the task instances waiting for slots, they are parked or requeued to try again
+	waiting  map[string]struct{}
+	parked   []*parkedTaskIns
+	timer    *time.Timer
+	backoff  time.Duration
+	closed   bool
+	draining bool
+}
+
+// parkedTaskIns is a task instance which does not occupy an executor worker while waiting for slots
+type parkedTaskIns struct {
+	taskIns *entity.TaskInstance
+	resume  func()
+	stop    func() bool
+}
+
+// newResourcePools
+func newResourcePools(pools map[string]int) map[string]*resourcePool {
+	ret := map[string]*resourcePool{}
+	for name, slots := range pools {
+		ret[name] = &resourcePool{name: name, slots: slots, waiting: map[string]struct{}{}}
+	}
+	return ret
+}
+
+// poolSlotKey
+func poolSlotKey(pool string, slot int) string {
+	return fmt.Sprintf("fastflow-pool-%s-%d", pool, slot)
+}
+
+// tryAcquire try to acquire the slots which task instance needs without waiting,
+// it returns nil release function when the slots are not enough, the returned function releases the slots
+func (p *resourcePool) tryAcquire(taskIns *entity.TaskInstance) (func(), error) {
+	need := taskIns.PoolSlots
+	if need <= 0 {
+		need = 1
+	}
+	if need > p.slots {
+		return nil, fmt.Errorf("task instance needs %d slots, but pool[%s] only has %d", need, p.name, p.slots)
+	}
+
+	ctx := taskIns.Context.Context()
+	if err := ctx.Err(); err != nil {
+		p.mutex.Lock()
+		delete(p.waiting, taskIns.ID)
+		p.mutex.Unlock()
+		p.publishUsage()
+		return nil, fmt.Errorf("acquire slots of pool[%s] failed: %w", p.name, err)
+	}
+	var ops []LockOptionOp
+	if deadline, ok := ctx.Deadline(); ok {
+		ops = append(ops, LockTTL(time.Until(deadline)+poolSlotTTLMargin))
+	}
+
+	mutexes := p.tryLockSlots(ctx, need, ops)
+	if len(mutexes) < need {
+		// release the partial slots, otherwise task instances may wait for each other
+		p.unlockSlots(mutexes)
+		return nil, nil
+	}
+
+	p.mutex.Lock()
+	p.inUse += need
+	p.backoff = 0
+	delete(p.waiting, taskIns.ID)
+	p.mutex.Unlock()
+	p.publishUsage()
+	return func() {
+		p.unlockSlots(mutexes)
+		p.mutex.Lock()
+		p.inUse -= need
+		p.mutex.Unlock()
+		p.publishUsage()
+		p.wake()
+	}, nil
+}
+
+// park the task instance until the slots may be free, resume is called once to try again
+// when the slots are released by this worker, the retry interval is reached or the task instance is canceled.
+// it returns false if the pool is closed or draining, the task instance is not parked then
+func (p *resourcePool) park(taskIns *entity.TaskInstance, resume func()) bool {
+	p.mutex.Lock()
+	if p.closed || p.draining {
+		delete(p.waiting, taskIns.ID)
+		p.mutex.Unlock()
+		p.publishUsage()
+		return false
+	}
+	_, traced := p.waiting[taskIns.ID]
+	p.waiting[taskIns.ID] = struct{}{}
+	w := &parkedTaskIns{taskIns: taskIns, resume: resume}
+	p.parked = append(p.parked, w)
+	w.stop = context.AfterFunc(taskIns.Context.Context(), func() {
+		p.unpark(w)
+	})
+	if p.timer == nil {
+		if p.backoff == 0 {
+			p.backoff = poolRetryInterval
+		}
+		p.timer = time.AfterFunc(p.backoff, p.wakeByTimer)
+	}
+	p.mutex.Unlock()
+	p.publishUsage()
+
+	if !traced {
+		taskIns.Trace(fmt.Sprintf("waiting for %d slots of pool[%s]", max(taskIns.PoolSlots, 1), p.name))
+	}
+	return true
+}
+
+// unpark resume the task instance if it is still parked
+func (p *resourcePool) unpark(w *parkedTaskIns) {
+	p.mutex.Lock()
+	found := false
+	for i := range p.parked {
+		if p.parked[i] == w {
+			p.parked = append(p.parked[:i], p.parked[i+1:]...)
+			found = true
+			break
+		}
+	}
+	p.mutex.Unlock()
+	if found {
+		w.resume()
+	}
+}
+
+// wake resume all parked task instances to try again
+func (p *resourcePool) wake() {
+	p.mutex.Lock()
+	parked := p.parked
+	p.parked = nil
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mutex.Unlock()
+	for _, w := range parked {
+		w.stop()
+		w.resume()
+	}
+}
+
+func (p *resourcePool) wakeByTimer() {
+	p.mutex.Lock()
+	p.backoff *= 2
+	if p.backoff > poolMaxRetryInterval {
+		p.backoff = poolMaxRetryInterval
+	}
+	p.mutex.Unlock()
+	p.wake()
+}
+
+// drain drop the parked task instances and stop parking new ones, the dropped ones are returned
+func (p *resourcePool) drain() []*entity.TaskInstance {
+	p.mutex.Lock()
+	p.draining = true
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	var dropped []*entity.TaskInstance
+	for _, w := range p.parked {
+		w.stop()
+		delete(p.waiting, w.taskIns.ID)
+		dropped = append(dropped, w.taskIns)
+	}
+	p.parked = nil
+	p.mutex.Unlock()
+	p.publishUsage()
+	return dropped
+}
+
+// close drop the parked task instances, they are taken over by other workers after this worker exits
+func (p *resourcePool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	for _, w := range p.parked {
+		w.stop()
+	}
+	p.parked = nil
+}
+
+// tryLockSlots try to lock the slots from a random one without waiting, and return the locked slots,
+// the slot kept by others is skipped at once, so the executor worker is not blocked by the occupied slots
+func (p *resourcePool) tryLockSlots(ctx context.Context, need int, ops []LockOptionOp) []DistributedMutex {
+	ops = append(ops, LockNoWait())
+	var locked []DistributedMutex
+	start := rand.Intn(p.slots)
+	for i := 0; i < p.slots && len(locked) < need; i++ {
+		m := GetKeeper().NewMutex(poolSlotKey(p.name, (start+i)%p.slots))
+		err := m.Lock(ctx, ops...)
+		if err == nil {
+			locked = append(locked, m)
+			continue
+		}
+		if !errors.Is(err, data.ErrMutexLocked) {
+			log.Warnf("lock slot of pool[%s] failed: %s", p.name, err)
+		}
+	}
+	return locked
+}
+
+func (p *resourcePool) unlockSlots(mutexes []DistributedMutex) {
+	for _, m := range mutexes {
+		if err := m.Unlock(context.TODO()); err != nil {
+			log.Warnf("unlock slot of pool[%s] failed: %s", p.name, err)
+		}
+	}
+}
+
+func (p *resourcePool) publishUsage() {
+	p.mutex.Lock()
+	e := &event.PoolUsageChanged{
+		WorkerKey:      GetKeeper().WorkerKey(),
+		Pool:           p.name,
+		Slots:          p.slots,
+		InUseSlots:     p.inUse,
+		WaitingTaskCnt: len(p.waiting),
+	}
+	p.mutex.Unlock()
+	goevent.Publish(e)
+}
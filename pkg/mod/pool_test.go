@@ -0,0 +1,180 @@
+package mod
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/entity/run"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeSlots is a mutex set within process which simulates the distributed mutex of keeper
+type fakeSlots struct {
+	mux    sync.Mutex
+	locked map[string]bool
+}
+
+type fakeSlotMutex struct {
+	key   string
+	slots *fakeSlots
+}
+
+func (m *fakeSlotMutex) Lock(ctx context.Context, ops ...LockOptionOp) error {
+	m.slots.mux.Lock()
+	if !m.slots.locked[m.key] {
+		m.slots.locked[m.key] = true
+		m.slots.mux.Unlock()
+		return nil
+	}
+	m.slots.mux.Unlock()
+	if NewLockOption(ops).NoWait {
+		return data.ErrMutexLocked
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (m *fakeSlotMutex) Unlock(ctx context.Context) error {
+	m.slots.mux.Lock()
+	defer m.slots.mux.Unlock()
+	delete(m.slots.locked, m.key)
+	return nil
+}
+
+func (s *fakeSlots) lockedCnt() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.locked)
+}
+
+func TestResourcePool_TryAcquire(t *testing.T) {
+	oldRetryInterval := poolRetryInterval
+	poolRetryInterval = time.Hour
+	defer func() {
+		poolRetryInterval = oldRetryInterval
+	}()
+
+	slots := &fakeSlots{locked: map[string]bool{}}
+	mKeeper := &MockKeeper{}
+	mKeeper.On("WorkerKey").Return("worker-1")
+	mKeeper.On("NewMutex", mock.Anything).Return(func(key string) DistributedMutex {
+		return &fakeSlotMutex{key: key, slots: slots}
+	})
+	SetKeeper(mKeeper)
+
+	newTaskIns := func(id string, poolSlots int) (*entity.TaskInstance, context.CancelFunc) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		t.Cleanup(cancel)
+		taskIns := &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: id}, Pool: "api", PoolSlots: poolSlots}
+		taskIns.InitialDep(run.NewDefExecuteContext(ctx, nil, nil, nil, nil, nil), func(*entity.TaskInstance) error {
+			return nil
+		}, nil)
+		return taskIns, cancel
+	}
+
+	pool := newResourcePools(map[string]int{"api": 3})["api"]
+	ins1, _ := newTaskIns("1", 0)
+	release, err := pool.tryAcquire(ins1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, slots.lockedCnt())
+
+	ins2, _ := newTaskIns("2", 2)
+	release2, err := pool.tryAcquire(ins2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, slots.lockedCnt())
+
+	// the slots are not enough, the task instance is parked and resumed after the slots are released,
+	// the occupied slots are skipped at once instead of blocking the worker
+	waitingIns, _ := newTaskIns("3", 1)
+	start := time.Now()
+	waitRelease, err := pool.tryAcquire(waitingIns)
+	assert.NoError(t, err)
+	assert.Nil(t, waitRelease)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	resumed := make(chan string, 2)
+	pool.park(waitingIns, func() { resumed <- waitingIns.ID })
+	assert.Len(t, waitingIns.Traces, 1)
+	assert.Equal(t, 1, len(pool.waiting))
+
+	// the partial slots are released when the slots are not enough
+	canceledIns, cancel := newTaskIns("4", 3)
+	canceledRelease, err := pool.tryAcquire(canceledIns)
+	assert.NoError(t, err)
+	assert.Nil(t, canceledRelease)
+	assert.Equal(t, 3, slots.lockedCnt())
+	pool.park(canceledIns, func() { resumed <- canceledIns.ID })
+
+	// the canceled task instance is resumed and fails to acquire the slots
+	cancel()
+	assert.Equal(t, canceledIns.ID, <-resumed)
+	_, err = pool.tryAcquire(canceledIns)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	release()
+	assert.Equal(t, waitingIns.ID, <-resumed)
+	waitRelease, err = pool.tryAcquire(waitingIns)
+	assert.NoError(t, err)
+	assert.NotNil(t, waitRelease)
+	assert.Equal(t, 3, slots.lockedCnt())
+	assert.Len(t, waitingIns.Traces, 1)
+
+	waitRelease()
+	release2()
+	assert.Equal(t, 0, slots.lockedCnt())
+	ins5, _ := newTaskIns("5", 3)
+	release3, err := pool.tryAcquire(ins5)
+	assert.NoError(t, err)
+	release3()
+
+	ins6, _ := newTaskIns("6", 4)
+	_, err = pool.tryAcquire(ins6)
+	assert.Error(t, err)
+	assert.Equal(t, 0, pool.inUse)
+	assert.Equal(t, 0, len(pool.waiting))
+	assert.Len(t, resumed, 0)
+}
+
+func TestResourcePool_WakeByTimer(t *testing.T) {
+	oldRetryInterval := poolRetryInterval
+	poolRetryInterval = 10 * time.Millisecond
+	defer func() {
+		poolRetryInterval = oldRetryInterval
+	}()
+
+	mKeeper := &MockKeeper{}
+	mKeeper.On("WorkerKey").Return("worker-1")
+	SetKeeper(mKeeper)
+
+	taskIns := &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "1"}, Pool: "api"}
+	taskIns.InitialDep(run.NewDefExecuteContext(context.Background(), nil, nil, nil, nil, nil), func(*entity.TaskInstance) error {
+		return nil
+	}, nil)
+	pool := newResourcePools(map[string]int{"api": 1})["api"]
+	resumed := make(chan struct{}, 1)
+	pool.park(taskIns, func() { resumed <- struct{}{} })
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("parked task instance is not resumed by timer")
+	}
+	assert.Equal(t, 2*poolRetryInterval, pool.backoff)
+
+	// the closed pool drops the parked task instances
+	pool.park(taskIns, func() { resumed <- struct{}{} })
+	pool.close()
+	pool.park(taskIns, func() { resumed <- struct{}{} })
+	time.Sleep(5 * poolRetryInterval)
+	assert.Len(t, resumed, 0)
+	assert.Len(t, pool.parked, 0)
+}
+
+func TestDefExecutor_acquirePoolSlots(t *testing.T) {
+	e := NewDefExecutor(time.Minute, 1, WithPools(map[string]int{"api": 1}))
+	_, err := e.acquirePoolSlots(&entity.TaskInstance{Pool: "not-exist"})
+	assert.EqualError(t, err, "pool[not-exist] is not defined")
+}
@@ -0,0 +1,97 @@
+package mod
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/linclin/fastflow/pkg/entity"
+)
+
+// taskInsQueue is a blocking priority queue of task instances,
+// the task instance of higher priority dag instance is popped first, and it is FIFO for the same priority
+type taskInsQueue struct {
+	items  taskInsHeap
+	seq    uint64
+	closed bool
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+}
+
+type taskInsItem struct {
+	taskIns  *entity.TaskInstance
+	priority int
+	seq      uint64
+}
+
+// newTaskInsQueue
+func newTaskInsQueue() *taskInsQueue {
+	q := &taskInsQueue{}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push a task instance, it never blocks
+func (q *taskInsQueue) Push(taskIns *entity.TaskInstance, priority int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.seq++
+	heap.Push(&q.items, &taskInsItem{taskIns: taskIns, priority: priority, seq: q.seq})
+	q.cond.Signal()
+}
+
+// Pop the task instance which has the highest priority, it blocks until there is one,
+// and return false when the queue is closed and empty
+func (q *taskInsQueue) Pop() (*entity.TaskInstance, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.items) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	return heap.Pop(&q.items).(*taskInsItem).taskIns, true
+}
+
+// Len
+func (q *taskInsQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// Close the queue, the remaining task instances can still be popped
+func (q *taskInsQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// taskInsHeap implements heap.Interface
+type taskInsHeap []*taskInsItem
+
+func (h taskInsHeap) Len() int { return len(h) }
+
+func (h taskInsHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h taskInsHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *taskInsHeap) Push(x interface{}) {
+	*h = append(*h, x.(*taskInsItem))
+}
+
+func (h *taskInsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
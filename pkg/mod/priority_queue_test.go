@@ -0,0 +1,47 @@
+package mod
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskInsQueue(t *testing.T) {
+	q := newTaskInsQueue()
+	q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "low-1"}}, 0)
+	q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "high-1"}}, 10)
+	q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "low-2"}}, 0)
+	q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "high-2"}}, 10)
+	q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "middle"}}, 5)
+	assert.Equal(t, 5, q.Len())
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		taskIns, ok := q.Pop()
+		assert.True(t, ok)
+		ids = append(ids, taskIns.ID)
+	}
+	assert.Equal(t, []string{"high-1", "high-2", "middle", "low-1", "low-2"}, ids)
+
+	// pop blocks until a task instance is pushed
+	popped := make(chan string)
+	go func() {
+		taskIns, ok := q.Pop()
+		assert.True(t, ok)
+		popped <- taskIns.ID
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "late"}}, 0)
+	assert.Equal(t, "late", <-popped)
+
+	// the remaining task instances can be popped after closed
+	q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "remaining"}}, 0)
+	q.Close()
+	taskIns, ok := q.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, "remaining", taskIns.ID)
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
@@ -0,0 +1,211 @@
+package mod
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/log"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// maxCatchUpSlots limit the slots fired in one round, prevent from creating too many instances
+	// when leader has been down for a long time
+	maxCatchUpSlots = 100
+)
+
+var cronParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// ParseCron parse cron expression with timezone, it support standard 5 fields or 6 fields(with seconds)
+func ParseCron(expr, timezone string) (cron.Schedule, error) {
+	if timezone != "" && !strings.HasPrefix(expr, "TZ=") && !strings.HasPrefix(expr, "CRON_TZ=") {
+		expr = fmt.Sprintf("CRON_TZ=%s %s", timezone, expr)
+	}
+	return cronParser.Parse(expr)
+}
+
+// DefScheduler used to fire dag instances according to the cron of dag, it should only work at leader
+type DefScheduler struct {
+	// missThreshold indicate how long a slot can be delayed before it is regarded as missed
+	missThreshold time.Duration
+	now           func() time.Time
+
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDefScheduler
+func NewDefScheduler(missThreshold time.Duration) *DefScheduler {
+	return &DefScheduler{
+		missThreshold: missThreshold,
+		now:           time.Now,
+		closeCh:       make(chan struct{}),
+	}
+}
+
+// Init
+func (s *DefScheduler) Init() {
+	s.wg.Add(1)
+	go s.watchCronDags()
+}
+
+func (s *DefScheduler) watchCronDags() {
+	closed := false
+	timerCh := time.Tick(time.Second)
+	for !closed {
+		select {
+		case <-s.closeCh:
+			closed = true
+		case <-timerCh:
+			if err := s.Do(); err != nil {
+				s.handleErr(err)
+			}
+		}
+	}
+	s.wg.Done()
+}
+
+// Do fire all due slots of cron dags
+func (s *DefScheduler) Do() error {
+	dags, err := GetStore().ListDag(&ListDagInput{HasCron: true})
+	if err != nil {
+		return err
+	}
+
+	errs := &data.Errors{}
+	for i := range dags {
+		if dags[i].Cron == "" || dags[i].Status != entity.DagStatusNormal {
+			continue
+		}
+		if err := s.scheduleDag(dags[i]); err != nil {
+			errs.Append(fmt.Errorf("schedule dag[%s] failed: %w", dags[i].ID, err))
+		}
+	}
+	if errs.Len() > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *DefScheduler) scheduleDag(dag *entity.Dag) error {
+	sched, err := ParseCron(dag.Cron, dag.CronTimezone)
+	if err != nil {
+		return fmt.Errorf("parse cron failed: %w", err)
+	}
+
+	now := s.now()
+	schedule, err := GetStore().GetDagSchedule(dag.ID)
+	if err != nil && !errors.Is(err, data.ErrDataNotFound) {
+		return err
+	}
+	// the first time we see the dag, start from now instead of backfilling the history
+	if schedule == nil {
+		return GetStore().SaveDagSchedule(&entity.DagSchedule{
+			BaseInfo:    entity.BaseInfo{ID: dag.ID},
+			LastFiredAt: now.Unix(),
+		})
+	}
+
+	slots := dueSlots(sched, time.Unix(schedule.LastFiredAt, 0), now)
+	if len(slots) == 0 {
+		return nil
+	}
+
+	for _, slot := range s.filterSlots(dag.CronCatchUp, slots, now) {
+		if err := fireSlot(dag, slot); err != nil {
+			return err
+		}
+	}
+
+	schedule.LastFiredAt = slots[len(slots)-1].Unix()
+	return GetStore().SaveDagSchedule(schedule)
+}
+
+// dueSlots return the latest maxCatchUpSlots slots in (last, now], it walks from a window before now
+// which is doubled until it covers enough slots or reaches last, so that the slots missed during
+// a long downtime are not walked one by one
+func dueSlots(sched cron.Schedule, last, now time.Time) []time.Time {
+	first := sched.Next(last)
+	if first.IsZero() || first.After(now) {
+		return nil
+	}
+	window := sched.Next(first).Sub(first)
+	if window <= 0 {
+		window = now.Sub(last)
+	}
+	for {
+		start := now.Add(-window)
+		if !start.After(last) {
+			start = last
+		}
+		var slots []time.Time
+		for next := sched.Next(start); !next.IsZero() && !next.After(now); next = sched.Next(next) {
+			slots = append(slots, next)
+			// only keep the latest slots
+			if len(slots) > maxCatchUpSlots {
+				slots = slots[1:]
+			}
+		}
+		if len(slots) >= maxCatchUpSlots || start.Equal(last) {
+			return slots
+		}
+		window *= 2
+	}
+}
+
+func (s *DefScheduler) filterSlots(policy entity.CronCatchUpPolicy, slots []time.Time, now time.Time) []time.Time {
+	switch policy {
+	case entity.CronCatchUpAll:
+		return slots
+	case entity.CronCatchUpOnce:
+		return slots[len(slots)-1:]
+	default:
+		latest := slots[len(slots)-1]
+		if now.Sub(latest) > s.missThreshold {
+			return nil
+		}
+		return []time.Time{latest}
+	}
+}
+
+// fireSlot create the dag instance of the slot, the id of instance is generated by slot,
+// so the slot which has been fired by previous leader will be conflicted
+func fireSlot(dag *entity.Dag, slot time.Time) error {
+	dagIns, err := dag.Run(entity.TriggerCron, nil)
+	if err != nil {
+		return err
+	}
+	dagIns.ID = CronDagInsID(dag.ID, slot)
+	if err := GetStore().CreateDagIns(dagIns); err != nil {
+		if errors.Is(err, data.ErrDataConflicted) {
+			log.Infof("slot[%s] of dag[%s] has already been fired", slot, dag.ID)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// CronDagInsID generate the id of dag instance fired by cron
+func CronDagInsID(dagId string, slot time.Time) string {
+	return fmt.Sprintf("%s-cron-%d", dagId, slot.Unix())
+}
+
+func (s *DefScheduler) handleErr(err error) {
+	log.Error("schedule cron dag failed",
+		"module", "scheduler",
+		"err", err)
+}
+
+// Close component
+func (s *DefScheduler) Close() {
+	close(s.closeCh)
+	s.wg.Wait()
+}
@@ -0,0 +1,266 @@
+package mod
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/log"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveExpr     string
+		giveTimezone string
+		giveLast     time.Time
+		wantNext     time.Time
+		wantErr      bool
+	}{
+		{
+			caseDesc: "five fields",
+			giveExpr: "0 2 * * *",
+			giveLast: time.Date(2022, 1, 1, 3, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2022, 1, 2, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			caseDesc: "six fields",
+			giveExpr: "30 0 2 * * *",
+			giveLast: time.Date(2022, 1, 1, 3, 0, 0, 0, time.UTC),
+			wantNext: time.Date(2022, 1, 2, 2, 0, 30, 0, time.UTC),
+		},
+		{
+			caseDesc:     "timezone",
+			giveExpr:     "0 2 * * *",
+			giveTimezone: "Asia/Shanghai",
+			giveLast:     time.Date(2022, 1, 1, 3, 0, 0, 0, time.UTC),
+			wantNext:     time.Date(2022, 1, 1, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			caseDesc:     "timezone in expression has priority",
+			giveExpr:     "CRON_TZ=UTC 0 2 * * *",
+			giveTimezone: "Asia/Shanghai",
+			giveLast:     time.Date(2022, 1, 1, 3, 0, 0, 0, time.UTC),
+			wantNext:     time.Date(2022, 1, 2, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			caseDesc: "invalid",
+			giveExpr: "0 2 * *",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			sched, err := ParseCron(tc.giveExpr, tc.giveTimezone)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tc.wantNext.Equal(sched.Next(tc.giveLast)), sched.Next(tc.giveLast).String())
+		})
+	}
+}
+
+func TestDueSlots(t *testing.T) {
+	now := time.Date(2022, 1, 10, 10, 0, 30, 0, time.UTC)
+	tests := []struct {
+		caseDesc  string
+		giveExpr  string
+		giveLast  time.Time
+		wantLen   int
+		wantFirst time.Time
+	}{
+		{
+			caseDesc:  "few slots",
+			giveExpr:  "0 * * * *",
+			giveLast:  time.Date(2022, 1, 10, 7, 30, 0, 0, time.UTC),
+			wantLen:   3,
+			wantFirst: time.Date(2022, 1, 10, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			caseDesc:  "long downtime",
+			giveExpr:  "* * * * *",
+			giveLast:  time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantLen:   maxCatchUpSlots,
+			wantFirst: now.Truncate(time.Minute).Add(-(maxCatchUpSlots - 1) * time.Minute),
+		},
+		{
+			caseDesc:  "uneven intervals",
+			giveExpr:  "0 9 * * 1-5",
+			giveLast:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantLen:   maxCatchUpSlots,
+			wantFirst: time.Date(2021, 8, 24, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			caseDesc: "not due",
+			giveExpr: "0 * * * *",
+			giveLast: time.Date(2022, 1, 10, 10, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			sched, err := ParseCron(tc.giveExpr, "")
+			assert.NoError(t, err)
+			slots := dueSlots(sched, tc.giveLast, now)
+			assert.Len(t, slots, tc.wantLen)
+			if tc.wantLen > 0 {
+				assert.True(t, tc.wantFirst.Equal(slots[0]), slots[0].String())
+				assert.False(t, slots[len(slots)-1].After(now))
+			}
+		})
+	}
+}
+
+func TestDefScheduler_Do(t *testing.T) {
+	now := time.Date(2022, 1, 1, 10, 0, 10, 0, time.UTC)
+	tests := []struct {
+		caseDesc         string
+		giveDags         []*entity.Dag
+		giveListErr      error
+		giveSchedule     *entity.DagSchedule
+		giveGetErr       error
+		giveCreateErr    error
+		wantErr          error
+		wantCreatedIDs   []string
+		wantSavedLastAt  int64
+		wantSaveSchedule bool
+	}{
+		{
+			caseDesc:    "list failed",
+			giveListErr: fmt.Errorf("list failed"),
+			wantErr:     fmt.Errorf("list failed"),
+		},
+		{
+			caseDesc: "first seen",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "0 * * * *", Status: entity.DagStatusNormal},
+			},
+			giveGetErr:       data.ErrDataNotFound,
+			wantSaveSchedule: true,
+			wantSavedLastAt:  now.Unix(),
+		},
+		{
+			caseDesc: "on time",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "0 * * * *", Status: entity.DagStatusNormal},
+			},
+			giveSchedule:     &entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag"}, LastFiredAt: now.Add(-time.Hour).Unix()},
+			wantCreatedIDs:   []string{CronDagInsID("dag", now.Add(-10*time.Second))},
+			wantSaveSchedule: true,
+			wantSavedLastAt:  now.Add(-10 * time.Second).Unix(),
+		},
+		{
+			caseDesc: "not due",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "0 * * * *", Status: entity.DagStatusNormal},
+			},
+			giveSchedule: &entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag"}, LastFiredAt: now.Add(-10 * time.Second).Unix()},
+		},
+		{
+			caseDesc: "stopped dag",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "0 * * * *", Status: entity.DagStatusStopped},
+			},
+		},
+		{
+			caseDesc: "skip missed",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "30 * * * *", Status: entity.DagStatusNormal},
+			},
+			giveSchedule:     &entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag"}, LastFiredAt: now.Add(-3 * time.Hour).Unix()},
+			wantSaveSchedule: true,
+			wantSavedLastAt:  time.Date(2022, 1, 1, 9, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "catch up once",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "30 * * * *", Status: entity.DagStatusNormal, CronCatchUp: entity.CronCatchUpOnce},
+			},
+			giveSchedule: &entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag"}, LastFiredAt: now.Add(-3 * time.Hour).Unix()},
+			wantCreatedIDs: []string{
+				CronDagInsID("dag", time.Date(2022, 1, 1, 9, 30, 0, 0, time.UTC)),
+			},
+			wantSaveSchedule: true,
+			wantSavedLastAt:  time.Date(2022, 1, 1, 9, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "catch up all",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "30 * * * *", Status: entity.DagStatusNormal, CronCatchUp: entity.CronCatchUpAll},
+			},
+			giveSchedule: &entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag"}, LastFiredAt: now.Add(-3 * time.Hour).Unix()},
+			wantCreatedIDs: []string{
+				CronDagInsID("dag", time.Date(2022, 1, 1, 7, 30, 0, 0, time.UTC)),
+				CronDagInsID("dag", time.Date(2022, 1, 1, 8, 30, 0, 0, time.UTC)),
+				CronDagInsID("dag", time.Date(2022, 1, 1, 9, 30, 0, 0, time.UTC)),
+			},
+			wantSaveSchedule: true,
+			wantSavedLastAt:  time.Date(2022, 1, 1, 9, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "already fired by previous leader",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "0 * * * *", Status: entity.DagStatusNormal},
+			},
+			giveSchedule:     &entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag"}, LastFiredAt: now.Add(-time.Hour).Unix()},
+			giveCreateErr:    fmt.Errorf("conflicted: %w", data.ErrDataConflicted),
+			wantCreatedIDs:   []string{CronDagInsID("dag", now.Add(-10*time.Second))},
+			wantSaveSchedule: true,
+			wantSavedLastAt:  now.Add(-10 * time.Second).Unix(),
+		},
+		{
+			caseDesc: "create failed",
+			giveDags: []*entity.Dag{
+				{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "0 * * * *", Status: entity.DagStatusNormal},
+			},
+			giveSchedule:   &entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag"}, LastFiredAt: now.Add(-time.Hour).Unix()},
+			giveCreateErr:  fmt.Errorf("create failed"),
+			wantCreatedIDs: []string{CronDagInsID("dag", now.Add(-10*time.Second))},
+			wantErr: func() error {
+				errs := &data.Errors{}
+				errs.Append(fmt.Errorf("schedule dag[dag] failed: %w", fmt.Errorf("create failed")))
+				return errs
+			}(),
+		},
+	}
+
+	log.SetLogger(&log.StdoutLogger{})
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var createdIDs []string
+			var saved *entity.DagSchedule
+			mStore := &MockStore{}
+			mStore.On("ListDag", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, &ListDagInput{HasCron: true}, args.Get(0))
+			}).Return(tc.giveDags, tc.giveListErr)
+			mStore.On("GetDagSchedule", mock.Anything).Return(tc.giveSchedule, tc.giveGetErr)
+			mStore.On("CreateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				dagIns := args.Get(0).(*entity.DagInstance)
+				assert.Equal(t, entity.TriggerCron, dagIns.Trigger)
+				createdIDs = append(createdIDs, dagIns.ID)
+			}).Return(tc.giveCreateErr)
+			mStore.On("SaveDagSchedule", mock.Anything).Run(func(args mock.Arguments) {
+				saved = args.Get(0).(*entity.DagSchedule)
+			}).Return(nil)
+			SetStore(mStore)
+
+			s := NewDefScheduler(30 * time.Second)
+			s.now = func() time.Time {
+				return now
+			}
+			err := s.Do()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantCreatedIDs, createdIDs)
+			assert.Equal(t, tc.wantSaveSchedule, saved != nil)
+			if saved != nil {
+				assert.Equal(t, tc.wantSavedLastAt, saved.LastFiredAt)
+			}
+		})
+	}
+}
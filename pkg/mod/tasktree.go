@@ -3,19 +3,34 @@ package mod
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/utils"
 )
 
 const (
 	virtualTaskRootID = "_virtual_root"
 )
 
+const (
+	treeActive int32 = iota
+	treePaused
+	treeCanceled
+)
+
 // TaskInfoGetter
 type TaskInfoGetter interface {
 	GetDepend() []string
 	GetID() string
 	GetGraphID() string
 	GetStatus() entity.TaskInstanceStatus
+	GetTriggerRule() entity.TriggerRule
+	GetForeach() *entity.Foreach
+	GetMappedFrom() string
+	GetPreChecks() entity.PreChecks
 }
 
 // MapTaskInsToGetter
@@ -63,6 +78,16 @@ func BuildRootNode(tasks []TaskInfoGetter) (*TaskNode, error) {
 	}
 
 	for i := range tasks {
+		// mapped tasks are not in the graph, they belong to the task which they are mapped from
+		if tasks[i].GetMappedFrom() != "" {
+			group, ok := m[tasks[i].GetMappedFrom()]
+			if !ok {
+				return nil, fmt.Errorf("does not find task[%s] mapped from: %s", tasks[i].GetGraphID(), tasks[i].GetMappedFrom())
+			}
+			group.AppendMapped(m[tasks[i].GetGraphID()])
+			continue
+		}
+
 		if len(tasks[i].GetDepend()) == 0 {
 			n := m[tasks[i].GetGraphID()]
 			n.AppendParent(root)
@@ -92,12 +117,60 @@ func BuildRootNode(tasks []TaskInfoGetter) (*TaskNode, error) {
 	return root, nil
 }
 
+// ValidateDag check the cron and its timezone can be parsed, the main tasks and every list of handler tasks
+// are valid graphs, and the task ids are unique in the whole dag
+func ValidateDag(dag *entity.Dag) error {
+	if dag.Cron != "" {
+		if _, err := ParseCron(dag.Cron, dag.CronTimezone); err != nil {
+			return fmt.Errorf("cron[%s] is invalid: %w", dag.Cron, err)
+		}
+	} else if dag.CronTimezone != "" {
+		if _, err := time.LoadLocation(dag.CronTimezone); err != nil {
+			return fmt.Errorf("cron timezone[%s] is invalid: %w", dag.CronTimezone, err)
+		}
+	}
+	if _, err := BuildRootNode(MapTasksToGetter(dag.Tasks)); err != nil {
+		return err
+	}
+	ids := map[string]struct{}{}
+	for i := range dag.Tasks {
+		ids[dag.Tasks[i].ID] = struct{}{}
+	}
+	for _, h := range entity.DagHandlerTypes {
+		tasks := dag.HandlerTasks(h)
+		if len(tasks) == 0 {
+			continue
+		}
+		for i := range tasks {
+			if _, ok := ids[tasks[i].ID]; ok {
+				return fmt.Errorf("task id is repeat, id: %s", tasks[i].ID)
+			}
+			ids[tasks[i].ID] = struct{}{}
+		}
+		if _, err := BuildRootNode(MapTasksToGetter(tasks)); err != nil {
+			return fmt.Errorf("%s tasks are invalid: %w", h, err)
+		}
+	}
+	return nil
+}
+
 func buildGraphNodeMap(tasks []TaskInfoGetter) (map[string]*TaskNode, error) {
 	m := map[string]*TaskNode{}
 	for i := range tasks {
 		if _, ok := m[tasks[i].GetGraphID()]; ok {
 			return nil, fmt.Errorf("task id is repeat, id: %s", tasks[i].GetGraphID())
 		}
+		if !tasks[i].GetTriggerRule().IsValid() {
+			return nil, fmt.Errorf("task[%s] trigger rule is invalid: %s", tasks[i].GetGraphID(), tasks[i].GetTriggerRule())
+		}
+		if f := tasks[i].GetForeach(); f != nil {
+			if err := f.Validate(); err != nil {
+				return nil, fmt.Errorf("task[%s] foreach is invalid: %w", tasks[i].GetGraphID(), err)
+			}
+		}
+		if err := tasks[i].GetPreChecks().Validate(); err != nil {
+			return nil, fmt.Errorf("task[%s] %w", tasks[i].GetGraphID(), err)
+		}
 		m[tasks[i].GetGraphID()] = NewTaskNodeFromGetter(tasks[i])
 	}
 	return m, nil
@@ -107,23 +180,117 @@ func buildGraphNodeMap(tasks []TaskInfoGetter) (map[string]*TaskNode, error) {
 type TaskTree struct {
 	DagIns *entity.DagInstance
 	Root   *TaskNode
+
+	// halted tree is paused or canceled, it will not push any new task
+	halted int32
+	// forced is the task instances whose status is forced by command(skip, mark success or force fail)
+	forced sync.Map
+	// retryTimers are the timers of task instances waiting for the backoff of automatic retry,
+	// they are stopped when the tree is halted or dropped
+	retryTimers map[string]*time.Timer
+	timerLock   sync.Mutex
+
+	// handlers are the handler task instances of dag, the triggered ones replace the root after the main tasks
+	// completed, and mainStatus and mainReason keep the result of main tasks while they are running
+	handlers   []*entity.TaskInstance
+	handling   bool
+	mainStatus TreeStatus
+	mainReason string
+}
+
+// Force mark the status of task instance is forced by command, it will be applied when the task instance entried
+func (t *TaskTree) Force(taskInsId string) {
+	t.forced.Store(taskInsId, struct{}{})
+}
+
+// Pause the tree, running tasks will continue but no new task will be pushed
+func (t *TaskTree) Pause() {
+	atomic.CompareAndSwapInt32(&t.halted, treeActive, treePaused)
+	t.StopRetryTimers()
+}
+
+// Cancel the tree, no new task will be pushed and the dag instance will be failed after running tasks completed
+func (t *TaskTree) Cancel() {
+	atomic.StoreInt32(&t.halted, treeCanceled)
+	t.StopRetryTimers()
+}
+
+// AfterRetryBackoff call push after the backoff of task instance, the previous timer of it is replaced,
+// push is not called if the tree is halted by then
+func (t *TaskTree) AfterRetryBackoff(taskInsId string, backoff time.Duration, push func()) {
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+	if t.retryTimers == nil {
+		t.retryTimers = map[string]*time.Timer{}
+	}
+	if timer, ok := t.retryTimers[taskInsId]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(backoff, func() {
+		t.timerLock.Lock()
+		// the timer may be replaced or stopped while it is firing
+		if t.retryTimers[taskInsId] != timer {
+			t.timerLock.Unlock()
+			return
+		}
+		delete(t.retryTimers, taskInsId)
+		t.timerLock.Unlock()
+
+		if t.IsHalted() {
+			return
+		}
+		push()
+	})
+	t.retryTimers[taskInsId] = timer
+}
+
+// StopRetryTimers stop all task instances waiting for the backoff of automatic retry
+func (t *TaskTree) StopRetryTimers() {
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+	for id, timer := range t.retryTimers {
+		timer.Stop()
+		delete(t.retryTimers, id)
+	}
+}
+
+// IsHalted indicate if the tree is paused or canceled
+func (t *TaskTree) IsHalted() bool {
+	return atomic.LoadInt32(&t.halted) != treeActive
+}
+
+// IsCanceled
+func (t *TaskTree) IsCanceled() bool {
+	return atomic.LoadInt32(&t.halted) == treeCanceled
 }
 
 // NewTaskNodeFromGetter
 func NewTaskNodeFromGetter(instance TaskInfoGetter) *TaskNode {
-	return &TaskNode{
-		TaskInsID: instance.GetID(),
-		Status:    instance.GetStatus(),
+	node := &TaskNode{
+		TaskInsID:   instance.GetID(),
+		Status:      instance.GetStatus(),
+		TriggerRule: instance.GetTriggerRule(),
 	}
+	if f := instance.GetForeach(); f != nil {
+		node.maxParallel = f.MaxParallel
+	}
+	return node
 }
 
 // TaskNode
 type TaskNode struct {
-	TaskInsID string
-	Status    entity.TaskInstanceStatus
+	TaskInsID   string
+	Status      entity.TaskInstanceStatus
+	TriggerRule entity.TriggerRule
 
 	children []*TaskNode
 	parents  []*TaskNode
+
+	// mapped is the tasks expanded by foreach, group is the task which they are mapped from
+	mapped      []*TaskNode
+	group       *TaskNode
+	maxParallel int
 }
 
 type TreeStatus string
@@ -182,24 +349,26 @@ func bfsCheckCycle(waitQueue []*TaskNode, visited map[string]struct{}, incomplet
 
 // ComputeStatus
 func (t *TaskNode) ComputeStatus() (status TreeStatus, srcTaskInsId string) {
-	walkNode(t, func(node *TaskNode) bool {
+	e := stateEvaluator{}
+	for _, node := range t.allNodes() {
+		// the node which is not triggered does not affect the status of tree
+		if e.trigger(node) != triggerReady {
+			continue
+		}
 		switch node.Status {
 		case entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled:
-			status = TreeStatusFailed
-			srcTaskInsId = node.TaskInsID
-			return true
+			if !e.isFailureHandled(node) {
+				status = TreeStatusFailed
+				srcTaskInsId = node.TaskInsID
+			}
 		case entity.TaskInstanceStatusBlocked:
 			status = TreeStatusBlocked
 			srcTaskInsId = node.TaskInsID
-			return true
 		case entity.TaskInstanceStatusSuccess, entity.TaskInstanceStatusSkipped:
-			return true
 		default:
-			status = TreeStatusRunning
-			srcTaskInsId = node.TaskInsID
-			return false
+			return TreeStatusRunning, node.TaskInsID
 		}
-	}, false)
+	}
 	if srcTaskInsId != "" {
 		return
 	}
@@ -221,13 +390,9 @@ func dfsWalk(
 		}
 	}
 
-	// we cannot execute children, but should execute brother nodes
-	if !walkChildrenIgnoreStatus && !root.CanExecuteChild() {
-		return true
-	}
 	for _, c := range root.children {
-		// if children's parent is not just root, we must check it
-		if len(c.parents) > 1 && !c.CanBeExecuted() {
+		// we cannot execute the children whose trigger rule is not matched, but should execute brother nodes
+		if !walkChildrenIgnoreStatus && !c.CanBeExecuted() {
 			continue
 		}
 
@@ -238,6 +403,19 @@ func dfsWalk(
 	return true
 }
 
+// allNodes return all nodes of tree in the order of dfs, the node which has multiple parents only appear once
+func (t *TaskNode) allNodes() (nodes []*TaskNode) {
+	visited := map[*TaskNode]struct{}{}
+	walkNode(t, func(node *TaskNode) bool {
+		if _, ok := visited[node]; !ok {
+			visited[node] = struct{}{}
+			nodes = append(nodes, node)
+		}
+		return true
+	}, true)
+	return
+}
+
 // AppendChild
 func (t *TaskNode) AppendChild(task *TaskNode) {
 	t.children = append(t.children, task)
@@ -248,79 +426,433 @@ func (t *TaskNode) AppendParent(task *TaskNode) {
 	t.parents = append(t.parents, task)
 }
 
+// AppendMapped
+func (t *TaskNode) AppendMapped(task *TaskNode) {
+	t.mapped = append(t.mapped, task)
+	task.group = t
+}
+
 // CanExecuteChild
 func (t *TaskNode) CanExecuteChild() bool {
 	return t.Status == entity.TaskInstanceStatusSuccess || t.Status == entity.TaskInstanceStatusSkipped
 }
 
-// CanBeExecuted check whether task could be executed
+// CanBeExecuted check whether the trigger rule of task is matched
 func (t *TaskNode) CanBeExecuted() bool {
-	if len(t.parents) == 0 {
-		return true
-	}
-
-	for _, p := range t.parents {
-		if !p.CanExecuteChild() {
-			return false
-		}
-	}
-	return true
+	return stateEvaluator{}.trigger(t) == triggerReady
 }
 
 // GetExecutableTaskIds is unique task id map
 func (t *TaskNode) GetExecutableTaskIds() (executables []string) {
-	walkNode(t, func(node *TaskNode) bool {
-		if node.Executable() {
+	e := stateEvaluator{}
+	for _, node := range t.allNodes() {
+		if e.executable(node) {
 			executables = append(executables, node.TaskInsID)
 		}
-		return true
-	}, false)
+	}
 	return
 }
 
-// GetNextTaskIds
+// GetNextTaskIds return the tasks which become executable after the task completed
 func (t *TaskNode) GetNextTaskIds(completedOrRetryTask *entity.TaskInstance) (executable []string, find bool) {
-	walkNode(t, func(node *TaskNode) bool {
-		if completedOrRetryTask.ID == node.TaskInsID {
-			find = true
-			node.Status = completedOrRetryTask.Status
+	node := t.findNode(completedOrRetryTask.ID)
+	if node == nil || !node.CanBeExecuted() {
+		return
+	}
 
-			if node.Status == entity.TaskInstanceStatusInit {
-				executable = append(executable, node.TaskInsID)
-				return false
-			}
+	find = true
+	before := map[string]struct{}{}
+	for _, id := range t.GetExecutableTaskIds() {
+		before[id] = struct{}{}
+	}
+	node.Status = completedOrRetryTask.Status
+	if node.Status == entity.TaskInstanceStatusInit || node.Status == entity.TaskInstanceStatusRetrying {
+		executable = append(executable, node.TaskInsID)
+		return
+	}
 
-			if !node.CanExecuteChild() {
-				return false
+	// the tasks which are already executable before has been pushed, so only return the new ones
+	for _, id := range t.GetExecutableTaskIds() {
+		if _, ok := before[id]; !ok {
+			executable = append(executable, id)
+		}
+	}
+	return
+}
+
+// SkipUnselectedBranches mark the children which are not selected by the branch task as skipped,
+// so are the descendants whose parents are all skipped, the joins which have other parents are not affected
+func (t *TaskNode) SkipUnselectedBranches(branchTaskInsId string, selectedTaskInsIds []string) (skipped []string) {
+	node := t.findNode(branchTaskInsId)
+	if node == nil {
+		return
+	}
+
+	skip := map[*TaskNode]struct{}{}
+	for _, c := range node.children {
+		if !utils.StringsContain(selectedTaskInsIds, c.TaskInsID) {
+			skip[c] = struct{}{}
+		}
+	}
+	descendants := node.allNodes()
+	for changed := len(skip) > 0; changed; {
+		changed = false
+		for _, n := range descendants {
+			if _, ok := skip[n]; ok || n == node {
+				continue
 			}
-			for i := range node.children {
-				if node.children[i].Executable() {
-					executable = append(executable, node.children[i].TaskInsID)
+			allSkipped := true
+			for _, p := range n.parents {
+				if _, ok := skip[p]; !ok {
+					allSkipped = false
+					break
 				}
 			}
-			return false
+			if allSkipped {
+				skip[n] = struct{}{}
+				changed = true
+			}
 		}
-		return true
-	}, false)
+	}
 
+	// the tasks which have already been executed are kept
+	for _, n := range descendants {
+		if _, ok := skip[n]; ok && n.Status == entity.TaskInstanceStatusInit {
+			n.Status = entity.TaskInstanceStatusSkipped
+			skipped = append(skipped, n.TaskInsID)
+		}
+	}
 	return
 }
 
+// GetRerunTaskIds return the task and its descendants if includeDownstream is true,
+// the mapped tasks of them are also included because the groups will be expanded again
+func (t *TaskNode) GetRerunTaskIds(taskInsId string, includeDownstream bool) (ids []string, find bool) {
+	node := t.findNode(taskInsId)
+	if node == nil {
+		return
+	}
+
+	find = true
+	nodes := []*TaskNode{node}
+	if includeDownstream {
+		nodes = node.allNodes()
+	}
+	for _, n := range nodes {
+		ids = append(ids, n.TaskInsID)
+		for _, m := range n.mapped {
+			ids = append(ids, m.TaskInsID)
+		}
+	}
+	return
+}
+
+// GetCompensateTaskIds return the ids of all tasks in reverse topological order, so that the downstream tasks
+// are compensated before their upstream tasks, and the mapped tasks are before the task which they are mapped from
+func (t *TaskNode) GetCompensateTaskIds() (ids []string) {
+	visited := map[*TaskNode]struct{}{}
+	var visit func(node *TaskNode)
+	visit = func(node *TaskNode) {
+		if _, ok := visited[node]; ok {
+			return
+		}
+		visited[node] = struct{}{}
+		for _, c := range node.children {
+			visit(c)
+		}
+		if node.TaskInsID == virtualTaskRootID {
+			return
+		}
+		for i := len(node.mapped) - 1; i >= 0; i-- {
+			ids = append(ids, node.mapped[i].TaskInsID)
+		}
+		ids = append(ids, node.TaskInsID)
+	}
+	visit(t)
+	return
+}
+
+// GetNextMappedTaskIds return the mapped tasks which can be executed after the mapped task completed,
+// if all mapped tasks of the group completed, it returns the completed group
+func (t *TaskNode) GetNextMappedTaskIds(mappedTask *entity.TaskInstance) (
+	executable []string, completedGroup *entity.TaskInstance, find bool) {
+	node := t.findMappedNode(mappedTask.ID)
+	if node == nil {
+		return
+	}
+
+	find = true
+	node.Status = mappedTask.Status
+	if node.Status == entity.TaskInstanceStatusInit || node.Status == entity.TaskInstanceStatusRetrying {
+		node.Status = entity.TaskInstanceStatusRunning
+		executable = append(executable, node.TaskInsID)
+		return
+	}
+
+	executable = node.group.scheduleMapped()
+	if status, reason, done := node.group.mappedStatus(); done {
+		completedGroup = &entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: node.group.TaskInsID},
+			DagInsID: mappedTask.DagInsID,
+			Status:   status,
+			Reason:   reason,
+		}
+	}
+	return
+}
+
+// GetResumableMappedTaskIds return the mapped tasks which should be resumed when the tree is initialized,
+// and the mapped tasks of the groups which have already completed but not been handled
+func (t *TaskNode) GetResumableMappedTaskIds() (executable []string, completed []string) {
+	e := stateEvaluator{}
+	for _, node := range t.allNodes() {
+		if len(node.mapped) == 0 || node.Status != entity.TaskInstanceStatusRunning || e.trigger(node) != triggerReady {
+			continue
+		}
+		if _, _, done := node.mappedStatus(); done {
+			completed = append(completed, node.mapped[len(node.mapped)-1].TaskInsID)
+			continue
+		}
+		for _, m := range node.mapped {
+			if m.Status == entity.TaskInstanceStatusRetrying || m.Status == entity.TaskInstanceStatusEnding {
+				executable = append(executable, m.TaskInsID)
+			}
+		}
+		executable = append(executable, node.scheduleMapped()...)
+	}
+	return
+}
+
+// scheduleMapped return the mapped tasks in init status under the limit of max parallel,
+// and mark them as running. No more mapped task is scheduled once any of them failed.
+func (t *TaskNode) scheduleMapped() (ids []string) {
+	running := 0
+	for _, m := range t.mapped {
+		switch m.Status {
+		case entity.TaskInstanceStatusInit, entity.TaskInstanceStatusSuccess, entity.TaskInstanceStatusSkipped:
+		case entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled, entity.TaskInstanceStatusBlocked:
+			return nil
+		default:
+			running++
+		}
+	}
+
+	for _, m := range t.mapped {
+		if t.maxParallel > 0 && running >= t.maxParallel {
+			break
+		}
+		if m.Status == entity.TaskInstanceStatusInit {
+			m.Status = entity.TaskInstanceStatusRunning
+			ids = append(ids, m.TaskInsID)
+			running++
+		}
+	}
+	return
+}
+
+// mappedStatus compute the status of group by mapped tasks
+func (t *TaskNode) mappedStatus() (status entity.TaskInstanceStatus, reason string, done bool) {
+	var failed, blocked string
+	hasInit := false
+	for _, m := range t.mapped {
+		switch m.Status {
+		case entity.TaskInstanceStatusSuccess, entity.TaskInstanceStatusSkipped:
+		case entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled:
+			failed = m.TaskInsID
+		case entity.TaskInstanceStatusBlocked:
+			blocked = m.TaskInsID
+		case entity.TaskInstanceStatusInit:
+			hasInit = true
+		default:
+			return "", "", false
+		}
+	}
+
+	switch {
+	case failed != "":
+		return entity.TaskInstanceStatusFailed, fmt.Sprintf("mapped task instance[%s] failed", failed), true
+	case blocked != "":
+		return entity.TaskInstanceStatusBlocked, fmt.Sprintf("mapped task instance[%s] blocked", blocked), true
+	case hasInit:
+		return "", "", false
+	}
+	return entity.TaskInstanceStatusSuccess, "", true
+}
+
+func (t *TaskNode) findNode(taskInsId string) *TaskNode {
+	for _, node := range t.allNodes() {
+		if node.TaskInsID == taskInsId {
+			return node
+		}
+	}
+	return nil
+}
+
+func (t *TaskNode) findMappedNode(taskInsId string) *TaskNode {
+	for _, node := range t.allNodes() {
+		for _, m := range node.mapped {
+			if m.TaskInsID == taskInsId {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
 // Executable
 func (t *TaskNode) Executable() bool {
+	return stateEvaluator{}.executable(t)
+}
+
+// nodeState is the state of node used to evaluate trigger rules
+type nodeState int
+
+const (
+	nodeStatePending nodeState = iota
+	nodeStateSucceeded
+	// the node is skipped, it does not block downstream tasks but is not regarded as succeeded
+	nodeStateSkipped
+	nodeStateFailed
+	// the node will never be executed because upstream tasks failed
+	nodeStateUpstreamFailed
+	// the node will never be executed because its trigger rule cannot be matched
+	nodeStateNotTriggered
+)
+
+type triggerResult int
+
+const (
+	triggerWait triggerResult = iota
+	triggerReady
+	triggerUpstreamFailed
+	triggerNotTriggered
+)
+
+// stateEvaluator evaluate the trigger rules of nodes and cache the state of them,
+// it should be recreated after the status of nodes changed
+type stateEvaluator map[*TaskNode]nodeState
+
+func (e stateEvaluator) executable(t *TaskNode) bool {
 	if t.Status == entity.TaskInstanceStatusInit ||
 		t.Status == entity.TaskInstanceStatusRetrying ||
 		t.Status == entity.TaskInstanceStatusEnding {
-		if len(t.parents) == 0 {
-			return true
+		return e.trigger(t) == triggerReady
+	}
+	return false
+}
+
+func (e stateEvaluator) state(t *TaskNode) nodeState {
+	if s, ok := e[t]; ok {
+		return s
+	}
+
+	// the status of node is meaningless until its trigger rule is matched
+	s := nodeStatePending
+	switch e.trigger(t) {
+	case triggerUpstreamFailed:
+		s = nodeStateUpstreamFailed
+	case triggerNotTriggered:
+		s = nodeStateNotTriggered
+	case triggerReady:
+		switch t.Status {
+		case entity.TaskInstanceStatusSuccess:
+			s = nodeStateSucceeded
+		case entity.TaskInstanceStatusSkipped:
+			s = nodeStateSkipped
+		case entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled:
+			s = nodeStateFailed
 		}
+	}
+	e[t] = s
+	return s
+}
 
-		for i := range t.parents {
-			if !t.parents[i].CanExecuteChild() {
-				return false
-			}
+func (e stateEvaluator) trigger(t *TaskNode) triggerResult {
+	if len(t.parents) == 0 {
+		return triggerReady
+	}
+
+	var succeeded, skipped, failed, notTriggered, pending int
+	for _, p := range t.parents {
+		switch e.state(p) {
+		case nodeStateSucceeded:
+			succeeded++
+		case nodeStateSkipped:
+			skipped++
+		case nodeStateFailed, nodeStateUpstreamFailed:
+			failed++
+		case nodeStateNotTriggered:
+			notTriggered++
+		default:
+			pending++
+		}
+	}
+
+	switch t.TriggerRule {
+	case entity.TriggerRuleAllFailed:
+		if succeeded > 0 || notTriggered > 0 {
+			return triggerNotTriggered
+		}
+		if pending > 0 {
+			return triggerWait
+		}
+		// the skipped upstream tasks are ignored, but one failed upstream task is needed at least
+		if failed == 0 {
+			return triggerNotTriggered
+		}
+		return triggerReady
+	case entity.TriggerRuleAllDone:
+		if pending > 0 {
+			return triggerWait
+		}
+		return triggerReady
+	case entity.TriggerRuleOneSuccess:
+		if succeeded > 0 {
+			return triggerReady
+		}
+		if pending > 0 {
+			return triggerWait
+		}
+		if failed > 0 {
+			return triggerUpstreamFailed
+		}
+		return triggerNotTriggered
+	case entity.TriggerRuleOneFailed:
+		if failed > 0 {
+			return triggerReady
+		}
+		if pending > 0 {
+			return triggerWait
+		}
+		return triggerNotTriggered
+	case entity.TriggerRuleNoneFailed:
+		if failed > 0 {
+			return triggerUpstreamFailed
+		}
+		if pending > 0 {
+			return triggerWait
+		}
+		return triggerReady
+	default:
+		if failed > 0 {
+			return triggerUpstreamFailed
+		}
+		if notTriggered > 0 {
+			return triggerNotTriggered
+		}
+		if pending > 0 {
+			return triggerWait
+		}
+		return triggerReady
+	}
+}
+
+// isFailureHandled check if the failure of node is handled by children, such as a one_failed child
+func (e stateEvaluator) isFailureHandled(t *TaskNode) bool {
+	for _, c := range t.children {
+		if c.TriggerRule.HandleUpstreamFailure() && e.trigger(c) == triggerReady {
+			return true
 		}
-		return true
 	}
 	return false
 }
@@ -2,7 +2,9 @@ package mod
 
 import (
 	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/linclin/fastflow/pkg/entity"
 	"github.com/stretchr/testify/assert"
@@ -93,6 +95,149 @@ func TestTaskNode_ComputeStatus(t *testing.T) {
 			wantSrcId:  "task1",
 			wantStatus: TreeStatusBlocked,
 		},
+		{
+			caseDesc: "cleanup after upstream failed",
+			giveTaskIns: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "task1"},
+					TaskID:   "task1",
+					Status:   entity.TaskInstanceStatusFailed,
+				},
+				{
+					BaseInfo: entity.BaseInfo{ID: "task2"},
+					TaskID:   "task2",
+					DependOn: []string{"task1"},
+					Status:   entity.TaskInstanceStatusInit,
+				},
+				{
+					BaseInfo:    entity.BaseInfo{ID: "task3"},
+					TaskID:      "task3",
+					DependOn:    []string{"task2"},
+					Status:      entity.TaskInstanceStatusInit,
+					TriggerRule: entity.TriggerRuleAllDone,
+				},
+			},
+			wantSrcId:  "task3",
+			wantStatus: TreeStatusRunning,
+		},
+		{
+			caseDesc: "cleanup completed",
+			giveTaskIns: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "task1"},
+					TaskID:   "task1",
+					Status:   entity.TaskInstanceStatusFailed,
+				},
+				{
+					BaseInfo:    entity.BaseInfo{ID: "task2"},
+					TaskID:      "task2",
+					DependOn:    []string{"task1"},
+					Status:      entity.TaskInstanceStatusSuccess,
+					TriggerRule: entity.TriggerRuleAllDone,
+				},
+			},
+			wantSrcId:  "task1",
+			wantStatus: TreeStatusFailed,
+		},
+		{
+			caseDesc: "failure handled by one_success join",
+			giveTaskIns: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "task1"},
+					TaskID:   "task1",
+					Status:   entity.TaskInstanceStatusFailed,
+				},
+				{
+					BaseInfo: entity.BaseInfo{ID: "task2"},
+					TaskID:   "task2",
+					Status:   entity.TaskInstanceStatusSuccess,
+				},
+				{
+					BaseInfo:    entity.BaseInfo{ID: "task3"},
+					TaskID:      "task3",
+					DependOn:    []string{"task1", "task2"},
+					Status:      entity.TaskInstanceStatusSuccess,
+					TriggerRule: entity.TriggerRuleOneSuccess,
+				},
+			},
+			wantSrcId:  "",
+			wantStatus: TreeStatusSuccess,
+		},
+		{
+			caseDesc: "all branches of one_success join failed",
+			giveTaskIns: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "task1"},
+					TaskID:   "task1",
+					Status:   entity.TaskInstanceStatusFailed,
+				},
+				{
+					BaseInfo: entity.BaseInfo{ID: "task2"},
+					TaskID:   "task2",
+					Status:   entity.TaskInstanceStatusFailed,
+				},
+				{
+					BaseInfo:    entity.BaseInfo{ID: "task3"},
+					TaskID:      "task3",
+					DependOn:    []string{"task1", "task2"},
+					Status:      entity.TaskInstanceStatusInit,
+					TriggerRule: entity.TriggerRuleOneSuccess,
+				},
+			},
+			wantSrcId:  "task2",
+			wantStatus: TreeStatusFailed,
+		},
+		{
+			caseDesc: "one_failed not triggered",
+			giveTaskIns: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "task1"},
+					TaskID:   "task1",
+					Status:   entity.TaskInstanceStatusSuccess,
+				},
+				{
+					BaseInfo:    entity.BaseInfo{ID: "task2"},
+					TaskID:      "task2",
+					DependOn:    []string{"task1"},
+					Status:      entity.TaskInstanceStatusInit,
+					TriggerRule: entity.TriggerRuleOneFailed,
+				},
+				{
+					BaseInfo: entity.BaseInfo{ID: "task3"},
+					TaskID:   "task3",
+					DependOn: []string{"task2"},
+					Status:   entity.TaskInstanceStatusInit,
+				},
+			},
+			wantSrcId:  "",
+			wantStatus: TreeStatusSuccess,
+		},
+		{
+			caseDesc: "none_failed after not triggered branch",
+			giveTaskIns: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "task1"},
+					TaskID:   "task1",
+					Status:   entity.TaskInstanceStatusSuccess,
+				},
+				{
+					BaseInfo:    entity.BaseInfo{ID: "task2"},
+					TaskID:      "task2",
+					DependOn:    []string{"task1"},
+					Status:      entity.TaskInstanceStatusInit,
+					TriggerRule: entity.TriggerRuleAllFailed,
+				},
+				{
+					BaseInfo:    entity.BaseInfo{ID: "task3"},
+					TaskID:      "task3",
+					DependOn:    []string{"task1", "task2"},
+					Status:      entity.TaskInstanceStatusInit,
+					TriggerRule: entity.TriggerRuleNoneFailed,
+				},
+			},
+			wantSrcId:  "task3",
+			wantStatus: TreeStatusRunning,
+		},
 	}
 
 	for _, tc := range tests {
@@ -268,6 +413,100 @@ func TestBuildRootNode(t *testing.T) {
 			wantRoot: nil,
 			wantErr:  fmt.Errorf("dag has cycle at: child1"),
 		},
+		{
+			caseDesc: "invalid trigger rule",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "id",
+				},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{
+						ID: "root",
+					},
+					TaskID:      "root",
+					TriggerRule: "no_such_rule",
+				},
+			},
+			wantRoot: nil,
+			wantErr:  fmt.Errorf("task[root] trigger rule is invalid: no_such_rule"),
+		},
+		{
+			caseDesc: "mapped tasks",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "id",
+				},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{
+						ID: "root",
+					},
+					TaskID:  "root",
+					Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars, Key: "hosts"},
+				},
+				{
+					BaseInfo: entity.BaseInfo{
+						ID: "mapped",
+					},
+					TaskID:     "root[0]",
+					MappedFrom: "root",
+				},
+			},
+			wantRoot: func() *TaskNode {
+				mapped := &TaskNode{TaskInsID: "mapped"}
+				group := &TaskNode{TaskInsID: "root", mapped: []*TaskNode{mapped}}
+				mapped.group = group
+				return &TaskNode{
+					TaskInsID: virtualTaskRootID,
+					Status:    entity.TaskInstanceStatusSuccess,
+					children:  []*TaskNode{group},
+				}
+			}(),
+		},
+		{
+			caseDesc: "invalid foreach",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "id",
+				},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{
+						ID: "root",
+					},
+					TaskID:  "root",
+					Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars},
+				},
+			},
+			wantRoot: nil,
+			wantErr:  fmt.Errorf("task[root] foreach is invalid: %w", fmt.Errorf("foreach key cannot be empty")),
+		},
+		{
+			caseDesc: "invalid pre-check",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "id",
+				},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{
+					BaseInfo: entity.BaseInfo{
+						ID: "root",
+					},
+					TaskID: "root",
+					PreChecks: entity.PreChecks{
+						"check": {Expr: "vars.a ==", Act: entity.ActiveActionSkip},
+					},
+				},
+			},
+			wantRoot: nil,
+			wantErr: fmt.Errorf("task[root] %w", fmt.Errorf("pre-check[check] is invalid: %w",
+				fmt.Errorf("compile expression[vars.a ==] failed: %w", fmt.Errorf("unexpected end of expression")))),
+		},
 		{
 			caseDesc: "branch should not error",
 			giveDagIns: &entity.DagInstance{
@@ -354,6 +593,24 @@ func TestBuildRootNode(t *testing.T) {
 	}
 }
 
+func linkParents(node *TaskNode) {
+	for _, c := range node.children {
+		if !containsNode(c.parents, node) {
+			c.parents = append(c.parents, node)
+		}
+		linkParents(c)
+	}
+}
+
+func containsNode(nodes []*TaskNode, node *TaskNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
 func checkParentAndRemoveIt(t *testing.T, node, pNode *TaskNode) {
 	if pNode != nil {
 		find := false
@@ -755,6 +1012,129 @@ func TestTaskNode_GetNextTaskIds(t *testing.T) {
 			wantFind: true,
 			wantRet:  []string{"child1"},
 		},
+		{
+			caseDesc: "failed task trigger one_failed child",
+			giveTask: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "root",
+				},
+				Status: entity.TaskInstanceStatusFailed,
+			},
+			giveTasks: []*MockTaskInfoGetter{
+				{
+					ID:     "root",
+					Status: entity.TaskInstanceStatusRunning,
+				},
+				{
+					ID:     "child1",
+					Status: entity.TaskInstanceStatusInit,
+					Depend: []string{"root"},
+				},
+				{
+					ID:          "child2",
+					Status:      entity.TaskInstanceStatusInit,
+					Depend:      []string{"root"},
+					TriggerRule: entity.TriggerRuleOneFailed,
+				},
+				{
+					ID:          "c1-child1",
+					Status:      entity.TaskInstanceStatusInit,
+					Depend:      []string{"child1"},
+					TriggerRule: entity.TriggerRuleAllDone,
+				},
+			},
+			wantTaskNode: &TaskNode{
+				TaskInsID: "root",
+				Status:    entity.TaskInstanceStatusFailed,
+				children: []*TaskNode{
+					{TaskInsID: "child1", Status: entity.TaskInstanceStatusInit, children: []*TaskNode{
+						{TaskInsID: "c1-child1", Status: entity.TaskInstanceStatusInit, TriggerRule: entity.TriggerRuleAllDone},
+					}},
+					{TaskInsID: "child2", Status: entity.TaskInstanceStatusInit, TriggerRule: entity.TriggerRuleOneFailed},
+				},
+			},
+			wantFind: true,
+			wantRet:  []string{"c1-child1", "child2"},
+		},
+		{
+			caseDesc: "one_success join should not be returned twice",
+			giveTask: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "child2",
+				},
+				Status: entity.TaskInstanceStatusSuccess,
+			},
+			giveTasks: []*MockTaskInfoGetter{
+				{
+					ID:     "root",
+					Status: entity.TaskInstanceStatusSuccess,
+				},
+				{
+					ID:     "child1",
+					Status: entity.TaskInstanceStatusSuccess,
+					Depend: []string{"root"},
+				},
+				{
+					ID:     "child2",
+					Status: entity.TaskInstanceStatusRunning,
+					Depend: []string{"root"},
+				},
+				{
+					ID:          "join",
+					Status:      entity.TaskInstanceStatusInit,
+					Depend:      []string{"child1", "child2"},
+					TriggerRule: entity.TriggerRuleOneSuccess,
+				},
+			},
+			wantTaskNode: func() *TaskNode {
+				join := &TaskNode{TaskInsID: "join", Status: entity.TaskInstanceStatusInit, TriggerRule: entity.TriggerRuleOneSuccess}
+				return &TaskNode{
+					TaskInsID: "root",
+					Status:    entity.TaskInstanceStatusSuccess,
+					children: []*TaskNode{
+						{TaskInsID: "child1", Status: entity.TaskInstanceStatusSuccess, children: []*TaskNode{join}},
+						{TaskInsID: "child2", Status: entity.TaskInstanceStatusSuccess, children: []*TaskNode{join}},
+					},
+				}
+			}(),
+			wantFind: true,
+		},
+		{
+			caseDesc: "auto retry node",
+			giveTask: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "child1",
+				},
+				Status: entity.TaskInstanceStatusRetrying,
+			},
+			giveTasks: []*MockTaskInfoGetter{
+				{
+					ID:     "root",
+					Status: entity.TaskInstanceStatusSuccess,
+				},
+				{
+					ID:     "child1",
+					Status: entity.TaskInstanceStatusRunning,
+					Depend: []string{"root"},
+				},
+				{
+					ID:     "c1-child1",
+					Status: entity.TaskInstanceStatusInit,
+					Depend: []string{"child1"},
+				},
+			},
+			wantTaskNode: &TaskNode{
+				TaskInsID: "root",
+				Status:    entity.TaskInstanceStatusSuccess,
+				children: []*TaskNode{
+					{TaskInsID: "child1", Status: entity.TaskInstanceStatusRetrying, children: []*TaskNode{
+						{TaskInsID: "c1-child1", Status: entity.TaskInstanceStatusInit},
+					}},
+				},
+			},
+			wantFind: true,
+			wantRet:  []string{"child1"},
+		},
 	}
 
 	for _, tc := range tests {
@@ -1023,6 +1403,52 @@ func TestTaskNode_Executable(t *testing.T) {
 			},
 			wantRet: true,
 		},
+		{
+			caseDesc: "all success task has skipped parents",
+			giveTaskNode: &TaskNode{
+				Status: entity.TaskInstanceStatusInit,
+				parents: []*TaskNode{
+					{Status: entity.TaskInstanceStatusSuccess},
+					{Status: entity.TaskInstanceStatusSkipped},
+				},
+			},
+			wantRet: true,
+		},
+		{
+			caseDesc: "one success task has skipped and running parents",
+			giveTaskNode: &TaskNode{
+				Status:      entity.TaskInstanceStatusInit,
+				TriggerRule: entity.TriggerRuleOneSuccess,
+				parents: []*TaskNode{
+					{Status: entity.TaskInstanceStatusSkipped},
+					{Status: entity.TaskInstanceStatusRunning},
+				},
+			},
+			wantRet: false,
+		},
+		{
+			caseDesc: "all failed task has skipped and failed parents",
+			giveTaskNode: &TaskNode{
+				Status:      entity.TaskInstanceStatusInit,
+				TriggerRule: entity.TriggerRuleAllFailed,
+				parents: []*TaskNode{
+					{Status: entity.TaskInstanceStatusSkipped},
+					{Status: entity.TaskInstanceStatusFailed},
+				},
+			},
+			wantRet: true,
+		},
+		{
+			caseDesc: "all failed task has skipped parents only",
+			giveTaskNode: &TaskNode{
+				Status:      entity.TaskInstanceStatusInit,
+				TriggerRule: entity.TriggerRuleAllFailed,
+				parents: []*TaskNode{
+					{Status: entity.TaskInstanceStatusSkipped},
+				},
+			},
+			wantRet: false,
+		},
 	}
 
 	for _, tc := range tests {
@@ -1031,3 +1457,426 @@ func TestTaskNode_Executable(t *testing.T) {
 		})
 	}
 }
+
+func TestTaskNode_GetNextMappedTaskIds(t *testing.T) {
+	tests := []struct {
+		caseDesc         string
+		giveMaxParallel  int
+		giveMapped       []entity.TaskInstanceStatus
+		giveTask         *entity.TaskInstance
+		wantRet          []string
+		wantGroup        *entity.TaskInstance
+		wantFind         bool
+		wantMappedStatus []entity.TaskInstanceStatus
+	}{
+		{
+			caseDesc:        "schedule next under max parallel",
+			giveMaxParallel: 2,
+			giveMapped: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusInit,
+				entity.TaskInstanceStatusInit,
+			},
+			giveTask: &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "m0"}, Status: entity.TaskInstanceStatusSuccess},
+			wantRet:  []string{"m2"},
+			wantFind: true,
+			wantMappedStatus: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusSuccess,
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusInit,
+			},
+		},
+		{
+			caseDesc: "retry mapped task",
+			giveMapped: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusSuccess,
+			},
+			giveTask: &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "m0"}, Status: entity.TaskInstanceStatusRetrying},
+			wantRet:  []string{"m0"},
+			wantFind: true,
+			wantMappedStatus: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusSuccess,
+			},
+		},
+		{
+			caseDesc: "all succeed",
+			giveMapped: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusSkipped,
+				entity.TaskInstanceStatusRunning,
+			},
+			giveTask: &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "m1"}, DagInsID: "dag-ins", Status: entity.TaskInstanceStatusSuccess},
+			wantGroup: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "group"},
+				DagInsID: "dag-ins",
+				Status:   entity.TaskInstanceStatusSuccess,
+			},
+			wantFind: true,
+			wantMappedStatus: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusSkipped,
+				entity.TaskInstanceStatusSuccess,
+			},
+		},
+		{
+			caseDesc:        "failed and stop scheduling",
+			giveMaxParallel: 2,
+			giveMapped: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusInit,
+			},
+			giveTask: &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "m0"}, Status: entity.TaskInstanceStatusFailed},
+			wantFind: true,
+			wantMappedStatus: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusFailed,
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusInit,
+			},
+		},
+		{
+			caseDesc: "failed and all completed",
+			giveMapped: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusFailed,
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusInit,
+			},
+			giveTask: &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "m1"}, Status: entity.TaskInstanceStatusSuccess},
+			wantGroup: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "group"},
+				Status:   entity.TaskInstanceStatusFailed,
+				Reason:   "mapped task instance[m0] failed",
+			},
+			wantFind: true,
+			wantMappedStatus: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusFailed,
+				entity.TaskInstanceStatusSuccess,
+				entity.TaskInstanceStatusInit,
+			},
+		},
+		{
+			caseDesc: "not found",
+			giveMapped: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusRunning,
+			},
+			giveTask: &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "other"}, Status: entity.TaskInstanceStatusSuccess},
+			wantMappedStatus: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusRunning,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			giveTasks := []*MockTaskInfoGetter{
+				{ID: "root", Status: entity.TaskInstanceStatusSuccess},
+				{
+					ID:      "group",
+					Status:  entity.TaskInstanceStatusRunning,
+					Depend:  []string{"root"},
+					Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars, Key: "k", MaxParallel: tc.giveMaxParallel},
+				},
+			}
+			for i, s := range tc.giveMapped {
+				giveTasks = append(giveTasks, &MockTaskInfoGetter{ID: fmt.Sprintf("m%d", i), Status: s, MappedFrom: "group"})
+			}
+			root, err := BuildRootNode(MapMockTasksToGetter(giveTasks))
+			assert.NoError(t, err)
+
+			ret, group, find := root.GetNextMappedTaskIds(tc.giveTask)
+			assert.Equal(t, tc.wantRet, ret)
+			assert.Equal(t, tc.wantGroup, group)
+			assert.Equal(t, tc.wantFind, find)
+			groupNode := root.findNode("group")
+			var mappedStatus []entity.TaskInstanceStatus
+			for _, m := range groupNode.mapped {
+				assert.Equal(t, groupNode, m.group)
+				mappedStatus = append(mappedStatus, m.Status)
+			}
+			assert.Equal(t, tc.wantMappedStatus, mappedStatus)
+		})
+	}
+}
+
+func TestTaskNode_GetResumableMappedTaskIds(t *testing.T) {
+	root, err := BuildRootNode(MapMockTasksToGetter([]*MockTaskInfoGetter{
+		{
+			ID:      "group1",
+			Status:  entity.TaskInstanceStatusRunning,
+			Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars, Key: "k", MaxParallel: 2},
+		},
+		{ID: "g1-m0", Status: entity.TaskInstanceStatusEnding, MappedFrom: "group1"},
+		{ID: "g1-m1", Status: entity.TaskInstanceStatusInit, MappedFrom: "group1"},
+		{ID: "g1-m2", Status: entity.TaskInstanceStatusInit, MappedFrom: "group1"},
+		{
+			ID:      "group2",
+			Status:  entity.TaskInstanceStatusRunning,
+			Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars, Key: "k"},
+		},
+		{ID: "g2-m0", Status: entity.TaskInstanceStatusSuccess, MappedFrom: "group2"},
+		{ID: "g2-m1", Status: entity.TaskInstanceStatusSuccess, MappedFrom: "group2"},
+	}))
+	assert.NoError(t, err)
+	executable, completed := root.GetResumableMappedTaskIds()
+	assert.Equal(t, []string{"g1-m0", "g1-m1"}, executable)
+	assert.Equal(t, []string{"g2-m1"}, completed)
+}
+
+func TestTaskNode_GetRerunTaskIds(t *testing.T) {
+	root, err := BuildRootNode(MapMockTasksToGetter([]*MockTaskInfoGetter{
+		{ID: "task1", Status: entity.TaskInstanceStatusSuccess},
+		{ID: "task2", Status: entity.TaskInstanceStatusSuccess, Depend: []string{"task1"}},
+		{ID: "task3", Status: entity.TaskInstanceStatusSkipped, Depend: []string{"task1"}},
+		{ID: "task4", Status: entity.TaskInstanceStatusSuccess, Depend: []string{"task2", "task3"}},
+		{ID: "task5", Status: entity.TaskInstanceStatusSuccess},
+		{
+			ID:      "group",
+			Status:  entity.TaskInstanceStatusSuccess,
+			Depend:  []string{"task5"},
+			Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars, Key: "k"},
+		},
+		{ID: "m0", Status: entity.TaskInstanceStatusSuccess, MappedFrom: "group"},
+	}))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		caseDesc              string
+		giveTaskInsId         string
+		giveIncludeDownstream bool
+		wantIds               []string
+		wantFind              bool
+	}{
+		{
+			caseDesc:              "include downstream",
+			giveTaskInsId:         "task1",
+			giveIncludeDownstream: true,
+			wantIds:               []string{"task1", "task2", "task4", "task3"},
+			wantFind:              true,
+		},
+		{
+			caseDesc:      "only the task",
+			giveTaskInsId: "task2",
+			wantIds:       []string{"task2"},
+			wantFind:      true,
+		},
+		{
+			caseDesc:              "include mapped tasks",
+			giveTaskInsId:         "task5",
+			giveIncludeDownstream: true,
+			wantIds:               []string{"task5", "group", "m0"},
+			wantFind:              true,
+		},
+		{
+			caseDesc:      "mapped task",
+			giveTaskInsId: "m0",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			ids, find := root.GetRerunTaskIds(tc.giveTaskInsId, tc.giveIncludeDownstream)
+			assert.Equal(t, tc.wantIds, ids)
+			assert.Equal(t, tc.wantFind, find)
+		})
+	}
+}
+
+func TestTaskNode_SkipUnselectedBranches(t *testing.T) {
+	buildRoot := func() *TaskNode {
+		return MustBuildRootNode(MapMockTasksToGetter([]*MockTaskInfoGetter{
+			{ID: "other", Status: entity.TaskInstanceStatusSuccess},
+			{ID: "check", Status: entity.TaskInstanceStatusRunning},
+			{ID: "continue", Status: entity.TaskInstanceStatusInit, Depend: []string{"check"}},
+			{ID: "rollback", Status: entity.TaskInstanceStatusInit, Depend: []string{"check"}},
+			{ID: "deploy", Status: entity.TaskInstanceStatusInit, Depend: []string{"continue"}},
+			{ID: "revert", Status: entity.TaskInstanceStatusInit, Depend: []string{"rollback"}},
+			{ID: "done", Status: entity.TaskInstanceStatusInit, Depend: []string{"deploy", "revert"}},
+			{ID: "audit", Status: entity.TaskInstanceStatusInit, Depend: []string{"rollback", "other"}},
+			{ID: "merge", Status: entity.TaskInstanceStatusInit, Depend: []string{"deploy", "revert"}, TriggerRule: entity.TriggerRuleOneSuccess},
+		}))
+	}
+
+	tests := []struct {
+		caseDesc        string
+		giveSelected    []string
+		wantSkipped     []string
+		wantNextTaskIds []string
+		// the one_success join is executed only after one of its parents really succeeded
+		wantMergeAfter string
+		wantStatus     TreeStatus
+	}{
+		{
+			caseDesc:     "select one",
+			giveSelected: []string{"continue"},
+			wantSkipped:  []string{"rollback", "revert"},
+			// audit has another parent, so it is not blocked by the skipped side
+			wantNextTaskIds: []string{"continue", "audit"},
+			// the join of both sides is executed after the selected side completed
+			wantMergeAfter: "deploy",
+			wantStatus:     TreeStatusSuccess,
+		},
+		{
+			caseDesc:        "select none",
+			wantSkipped:     []string{"continue", "deploy", "done", "merge", "rollback", "revert"},
+			wantNextTaskIds: []string{"audit"},
+			wantStatus:      TreeStatusSuccess,
+		},
+		{
+			caseDesc:        "select all",
+			giveSelected:    []string{"continue", "rollback"},
+			wantNextTaskIds: []string{"continue", "rollback"},
+			wantStatus:      TreeStatusSuccess,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			root := buildRoot()
+			skipped := root.SkipUnselectedBranches("check", tc.giveSelected)
+			assert.Equal(t, tc.wantSkipped, skipped)
+
+			ids, find := root.GetNextTaskIds(&entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "check"},
+				Status:   entity.TaskInstanceStatusSuccess,
+			})
+			assert.True(t, find)
+			assert.ElementsMatch(t, tc.wantNextTaskIds, ids)
+
+			// complete all executable tasks until the tree is done
+			var completed []string
+			for len(ids) > 0 {
+				id := ids[0]
+				if id == "merge" && tc.wantMergeAfter != "" {
+					assert.Contains(t, completed, tc.wantMergeAfter)
+				}
+				completed = append(completed, id)
+				next, find := root.GetNextTaskIds(&entity.TaskInstance{
+					BaseInfo: entity.BaseInfo{ID: id},
+					Status:   entity.TaskInstanceStatusSuccess,
+				})
+				assert.True(t, find)
+				ids = append(ids[1:], next...)
+			}
+			status, _ := root.ComputeStatus()
+			assert.Equal(t, tc.wantStatus, status)
+		})
+	}
+
+	// the unknown branch task does nothing
+	assert.Empty(t, buildRoot().SkipUnselectedBranches("unknown", nil))
+}
+
+func TestValidateDag(t *testing.T) {
+	tests := []struct {
+		caseDesc string
+		giveDag  *entity.Dag
+		wantErr  string
+	}{
+		{
+			caseDesc: "valid",
+			giveDag: &entity.Dag{
+				Tasks:     []entity.Task{{ID: "deploy"}},
+				OnFailure: entity.TaskList{{ID: "rollback"}, {ID: "alert", DependOn: []string{"rollback"}}},
+				Finally:   entity.TaskList{{ID: "cleanup"}},
+			},
+		},
+		{
+			caseDesc: "repeat id",
+			giveDag: &entity.Dag{
+				Tasks:   []entity.Task{{ID: "deploy"}},
+				Finally: entity.TaskList{{ID: "deploy"}},
+			},
+			wantErr: "task id is repeat, id: deploy",
+		},
+		{
+			caseDesc: "depend on main task",
+			giveDag: &entity.Dag{
+				Tasks:     []entity.Task{{ID: "deploy"}},
+				OnSuccess: entity.TaskList{{ID: "notify", DependOn: []string{"deploy"}}},
+			},
+			wantErr: "onSuccess tasks are invalid: does not find task[notify] depend: deploy",
+		},
+		{
+			caseDesc: "valid cron",
+			giveDag: &entity.Dag{
+				Cron:         "0 */5 * * * *",
+				CronTimezone: "Asia/Shanghai",
+				Tasks:        []entity.Task{{ID: "deploy"}},
+			},
+		},
+		{
+			caseDesc: "invalid cron",
+			giveDag: &entity.Dag{
+				Cron:  "61 * * * *",
+				Tasks: []entity.Task{{ID: "deploy"}},
+			},
+			wantErr: "cron[61 * * * *] is invalid: end of range (61) above maximum (59): 61",
+		},
+		{
+			caseDesc: "invalid timezone",
+			giveDag: &entity.Dag{
+				CronTimezone: "Mars/Olympus",
+				Tasks:        []entity.Task{{ID: "deploy"}},
+			},
+			wantErr: "cron timezone[Mars/Olympus] is invalid: unknown time zone Mars/Olympus",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			err := ValidateDag(tc.giveDag)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestTaskNode_GetCompensateTaskIds(t *testing.T) {
+	root := MustBuildRootNode(MapMockTasksToGetter([]*MockTaskInfoGetter{
+		{ID: "create-vpc", Status: entity.TaskInstanceStatusSuccess},
+		{ID: "create-subnet", Status: entity.TaskInstanceStatusSuccess, Depend: []string{"create-vpc"}},
+		{ID: "create-sg", Status: entity.TaskInstanceStatusSuccess, Depend: []string{"create-vpc"}},
+		{
+			ID:      "create-vm",
+			Status:  entity.TaskInstanceStatusFailed,
+			Depend:  []string{"create-subnet", "create-sg"},
+			Foreach: &entity.Foreach{Source: entity.TaskConditionSourceVars, Key: "hosts"},
+		},
+		{ID: "vm-0", Status: entity.TaskInstanceStatusSuccess, MappedFrom: "create-vm"},
+		{ID: "vm-1", Status: entity.TaskInstanceStatusFailed, MappedFrom: "create-vm"},
+		{ID: "create-bucket", Status: entity.TaskInstanceStatusSuccess},
+	}))
+	assert.Equal(t, []string{
+		"vm-1", "vm-0", "create-vm", "create-subnet", "create-sg", "create-vpc", "create-bucket",
+	}, root.GetCompensateTaskIds())
+}
+
+func TestTaskTree_AfterRetryBackoff(t *testing.T) {
+	var pushed int32
+	push := func() {
+		atomic.AddInt32(&pushed, 1)
+	}
+
+	tree := &TaskTree{}
+	tree.AfterRetryBackoff("task1", 10*time.Millisecond, push)
+	// the previous timer is replaced
+	tree.AfterRetryBackoff("task1", 10*time.Millisecond, push)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushed))
+
+	// the timers are stopped when the tree is paused
+	tree.AfterRetryBackoff("task1", 10*time.Millisecond, push)
+	tree.AfterRetryBackoff("task2", 10*time.Millisecond, push)
+	tree.Pause()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushed))
+
+	// the halted tree does not push after the backoff
+	tree = &TaskTree{}
+	tree.AfterRetryBackoff("task1", 10*time.Millisecond, push)
+	atomic.StoreInt32(&tree.halted, treeCanceled)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushed))
+}
@@ -4,11 +4,19 @@ import (
 	"fmt"
 	"github.com/linclin/fastflow/pkg/entity"
 	"github.com/linclin/fastflow/pkg/log"
+	"github.com/linclin/fastflow/pkg/utils"
+	"github.com/linclin/fastflow/pkg/utils/data"
 	"sync"
 	"time"
 )
 
-const DefFailedReason = "force failed by watch dog because it execute too long"
+const deadWorkerListLimit = 1000
+
+const (
+	DefFailedReason        = "force failed by watch dog because it execute too long"
+	ReasonWorkerDead       = "force failed because the worker is dead"
+	ReasonDagInsWorkerDead = "the worker is dead, wait for dispatching again"
+)
 
 // DefWatchDog
 type DefWatchDog struct {
@@ -32,6 +40,8 @@ func (wd *DefWatchDog) Init() {
 	go wd.watchWrapper(wd.handleExpiredTaskIns)
 	wd.wg.Add(1)
 	go wd.watchWrapper(wd.handleLeftBehindDagIns)
+	wd.wg.Add(1)
+	go wd.watchWrapper(wd.handleDeadWorkerDagIns)
 }
 
 // Close
@@ -102,12 +112,70 @@ func (wd *DefWatchDog) handleLeftBehindDagIns() error {
 	for i := range dagIns {
 		dagIns[i].Status = entity.DagInstanceStatusInit
 	}
-	if err := GetStore().BatchUpdateDagIns(dagIns); err != nil {
+	if err := GetStore().BatchUpdateDagIns(dagIns, WithLeaderEpoch(GetKeeper().LeaderEpoch())); err != nil {
 		return err
 	}
 	return nil
 }
 
+// handleDeadWorkerDagIns give the running dag instances of dead workers back to dispatcher,
+// so that they are placed by its candidate selection and strategy like the new ones,
+// the new worker will handle the running task instances when it parses the scheduled dag instance
+func (wd *DefWatchDog) handleDeadWorkerDagIns() error {
+	var dagIns []*entity.DagInstance
+	lastID := ""
+	for {
+		ret, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+			Status:    []entity.DagInstanceStatus{entity.DagInstanceStatusRunning},
+			Limit:     deadWorkerListLimit,
+			OrderByID: true,
+			AfterID:   lastID,
+		})
+		if err != nil {
+			return err
+		}
+		dagIns = append(dagIns, ret...)
+		if len(ret) < deadWorkerListLimit {
+			break
+		}
+		lastID = ret[len(ret)-1].ID
+	}
+	if len(dagIns) == 0 {
+		return nil
+	}
+
+	nodes, err := GetKeeper().AliveNodesWithLabels()
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return data.ErrNoAliveNodes
+	}
+	aliveNodes := map[string]struct{}{}
+	for _, n := range nodes {
+		aliveNodes[n.WorkerKey] = struct{}{}
+	}
+
+	var orphans []*entity.DagInstance
+	for i := range dagIns {
+		if _, ok := aliveNodes[dagIns[i].Worker]; ok {
+			continue
+		}
+		log.Warn("worker is dead, dispatch its dag instance again",
+			"module", "watchdog",
+			utils.LogKeyDagInsID, dagIns[i].ID,
+			"worker", dagIns[i].Worker)
+		dagIns[i].Status = entity.DagInstanceStatusInit
+		dagIns[i].Worker = ""
+		dagIns[i].Reason = ReasonDagInsWorkerDead
+		orphans = append(orphans, dagIns[i])
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	return GetStore().BatchUpdateDagIns(orphans, WithLeaderEpoch(GetKeeper().LeaderEpoch()))
+}
+
 func (wd *DefWatchDog) handleErr(err error) {
 	log.Error("here are some errors",
 		"module", "watchdog",
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/utils/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -261,11 +262,16 @@ func TestDefWatchDog_HandleLeftBehindDagIns(t *testing.T) {
 			assert.Equal(t, tc.wantListInput, args.Get(0), tc.caseDesc)
 		}).Return(tc.giveListRet, tc.giveListRetErr)
 
-		mStore.On("BatchUpdateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+		mStore.On("BatchUpdateDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 			calledBatch = true
 			assert.Equal(t, tc.wantBatchInput, args.Get(0), tc.caseDesc)
+			opt := NewUpdateOption([]UpdateOptionOp{args.Get(1).(UpdateOptionOp)})
+			assert.Equal(t, int64(2), opt.LeaderEpoch, tc.caseDesc)
 		}).Return(tc.giveBatchUpdateErr)
 		SetStore(mStore)
+		mKeeper := &MockKeeper{}
+		mKeeper.On("LeaderEpoch").Return(int64(2))
+		SetKeeper(mKeeper)
 
 		err := tc.giveWd.handleLeftBehindDagIns()
 		assert.Equal(t, tc.wantErr, err, tc.caseDesc)
@@ -274,6 +280,102 @@ func TestDefWatchDog_HandleLeftBehindDagIns(t *testing.T) {
 	}
 }
 
+func TestDefWatchDog_HandleDeadWorkerDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc           string
+		giveListRet        []*entity.DagInstance
+		giveListRetErr     error
+		giveAliveNodes     []Node
+		giveBatchUpdateErr error
+		wantErr            error
+		wantBatchInput     []*entity.DagInstance
+		wantBatchCalled    bool
+	}{
+		{
+			caseDesc: "sanity",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusRunning, Worker: "worker-1"},
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.DagInstanceStatusRunning, Worker: "worker-2"},
+				{BaseInfo: entity.BaseInfo{ID: "3"}, Status: entity.DagInstanceStatusRunning, Worker: "worker-1"},
+				{BaseInfo: entity.BaseInfo{ID: "4"}, Status: entity.DagInstanceStatusRunning, Worker: "worker-4"},
+			},
+			giveAliveNodes: []Node{{WorkerKey: "worker-2"}, {WorkerKey: "worker-3"}},
+			wantBatchInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusInit, Reason: ReasonDagInsWorkerDead},
+				{BaseInfo: entity.BaseInfo{ID: "3"}, Status: entity.DagInstanceStatusInit, Reason: ReasonDagInsWorkerDead},
+				{BaseInfo: entity.BaseInfo{ID: "4"}, Status: entity.DagInstanceStatusInit, Reason: ReasonDagInsWorkerDead},
+			},
+			wantBatchCalled: true,
+		},
+		{
+			caseDesc: "all workers are alive",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusRunning, Worker: "worker-1"},
+			},
+			giveAliveNodes: []Node{{WorkerKey: "worker-1"}},
+		},
+		{
+			caseDesc:       "no running dag instance",
+			giveAliveNodes: []Node{{WorkerKey: "worker-1"}},
+		},
+		{
+			caseDesc: "no alive nodes",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusRunning, Worker: "worker-1"},
+			},
+			wantErr: data.ErrNoAliveNodes,
+		},
+		{
+			caseDesc:       "list failed",
+			giveListRetErr: fmt.Errorf("list failed"),
+			wantErr:        fmt.Errorf("list failed"),
+		},
+		{
+			caseDesc: "update failed",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusRunning, Worker: "worker-1"},
+			},
+			giveAliveNodes: []Node{{WorkerKey: "worker-2"}},
+			wantBatchInput: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusInit, Reason: ReasonDagInsWorkerDead},
+			},
+			giveBatchUpdateErr: fmt.Errorf("batch update failed"),
+			wantErr:            fmt.Errorf("batch update failed"),
+			wantBatchCalled:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			calledBatch := false
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, &ListDagInstanceInput{
+					Status:    []entity.DagInstanceStatus{entity.DagInstanceStatusRunning},
+					Limit:     deadWorkerListLimit,
+					OrderByID: true,
+				}, args.Get(0))
+			}).Return(tc.giveListRet, tc.giveListRetErr)
+			mStore.On("BatchUpdateDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				calledBatch = true
+				assert.Equal(t, tc.wantBatchInput, args.Get(0))
+				opt := NewUpdateOption([]UpdateOptionOp{args.Get(1).(UpdateOptionOp)})
+				assert.Equal(t, int64(2), opt.LeaderEpoch)
+			}).Return(tc.giveBatchUpdateErr)
+			SetStore(mStore)
+			mKeeper := &MockKeeper{}
+			mKeeper.On("AliveNodesWithLabels").Return(tc.giveAliveNodes, nil)
+			mKeeper.On("LeaderEpoch").Return(int64(2))
+			SetKeeper(mKeeper)
+
+			wd := NewDefWatchDog(time.Minute)
+			err := wd.handleDeadWorkerDagIns()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantBatchCalled, calledBatch)
+		})
+	}
+}
+
 func TestDefWatchDog(t *testing.T) {
 	calledListDag, calledListTask := false, false
 	mStore := &MockStore{}
@@ -12,6 +12,7 @@ var (
 	ErrNoAliveNodes   = errors.New("no alive nodes, stop dispatch")
 
 	ErrMutexAlreadyUnlock = errors.New("mutex is already unlocked")
+	ErrMutexLocked        = errors.New("mutex is locked by others")
 )
 
 // Errors
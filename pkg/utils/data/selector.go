@@ -6,6 +6,7 @@ import (
 	"strings"
 )
 
+// Selector is a label requirement, such as "zone=a" or "zone in (a,b)"
 type Selector struct {
 	Key    string
 	Op     SelectorOp
@@ -19,6 +20,8 @@ const (
 	SelectorOpIn    SelectorOp = "in"
 )
 
+// PareSelectors parse the selector expression like "key1=value, key2 in (a,b)",
+// requirements are separated by comma and all of them must be satisfied
 func PareSelectors(selector string) (selectors []Selector, err error) {
 	if selector == "" {
 		return nil, errors.New("selector expression can not be empty")
@@ -28,7 +31,6 @@ func PareSelectors(selector string) (selectors []Selector, err error) {
 	if err != nil {
 		return nil, err
 	}
-	var rs []Selector
 	selectorExprs := splitStringsWithIdx(selector, idx)
 	for i := range selectorExprs {
 		eqIdx := strings.Index(selectorExprs[i], string(SelectorOpEqual))
@@ -49,16 +51,47 @@ func PareSelectors(selector string) (selectors []Selector, err error) {
 		}
 
 		key, val := getTrimKeyValue(selectorExprs[i], opIdx, opLen)
+		if key == "" || val == "" {
+			return nil, fmt.Errorf("selector string '%v' key or value is empty", selectorExprs[i])
+		}
 		s.Key = key
 		if s.Op == SelectorOpEqual {
 			s.Values = []string{val}
 		} else {
-			s.Values = strings.Split(val[1:len(val)-1], ",")
+			if len(val) < 2 || val[0] != '(' || val[len(val)-1] != ')' {
+				return nil, fmt.Errorf("selector string '%v' values of 'in' must be wrapped by brackets", selectorExprs[i])
+			}
+			for _, v := range strings.Split(val[1:len(val)-1], ",") {
+				s.Values = append(s.Values, strings.TrimSpace(v))
+			}
 		}
-		s.Values = strings.Split(val, ",")
 		selectors = append(selectors, s)
 	}
-	return rs, nil
+	return selectors, nil
+}
+
+// Match check if the labels satisfy the selector
+func (s Selector) Match(labels map[string]string) bool {
+	v, ok := labels[s.Key]
+	if !ok {
+		return false
+	}
+	for i := range s.Values {
+		if s.Values[i] == v {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchSelectors check if the labels satisfy all selectors
+func MatchSelectors(selectors []Selector, labels map[string]string) bool {
+	for i := range selectors {
+		if !selectors[i].Match(labels) {
+			return false
+		}
+	}
+	return true
 }
 func scanAllSplits(s string) ([]int, error) {
 	multipleValueStart := false
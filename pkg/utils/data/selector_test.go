@@ -0,0 +1,100 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPareSelectors(t *testing.T) {
+	tests := []struct {
+		caseDesc  string
+		giveStr   string
+		wantRet   []Selector
+		wantError bool
+	}{
+		{
+			caseDesc: "equal",
+			giveStr:  "zone=a",
+			wantRet:  []Selector{{Key: "zone", Op: SelectorOpEqual, Values: []string{"a"}}},
+		},
+		{
+			caseDesc: "multiple",
+			giveStr:  "zone in (a, b), os = linux",
+			wantRet: []Selector{
+				{Key: "zone", Op: SelectorOpIn, Values: []string{"a", "b"}},
+				{Key: "os", Op: SelectorOpEqual, Values: []string{"linux"}},
+			},
+		},
+		{
+			caseDesc:  "empty",
+			giveStr:   "",
+			wantError: true,
+		},
+		{
+			caseDesc:  "unknown operator",
+			giveStr:   "zone>a",
+			wantError: true,
+		},
+		{
+			caseDesc:  "bracket not closed",
+			giveStr:   "zone in (a,b",
+			wantError: true,
+		},
+		{
+			caseDesc:  "no bracket",
+			giveStr:   "zone in a",
+			wantError: true,
+		},
+		{
+			caseDesc:  "empty value",
+			giveStr:   "zone=",
+			wantError: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			ret, err := PareSelectors(tc.giveStr)
+			if tc.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRet, ret)
+		})
+	}
+}
+
+func TestMatchSelectors(t *testing.T) {
+	selectors, err := PareSelectors("zone in (a,b), os=linux")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		caseDesc   string
+		giveLabels map[string]string
+		wantRet    bool
+	}{
+		{
+			caseDesc:   "matched",
+			giveLabels: map[string]string{"zone": "b", "os": "linux", "other": "x"},
+			wantRet:    true,
+		},
+		{
+			caseDesc:   "value not matched",
+			giveLabels: map[string]string{"zone": "c", "os": "linux"},
+		},
+		{
+			caseDesc:   "key missing",
+			giveLabels: map[string]string{"zone": "a"},
+		},
+		{
+			caseDesc: "no labels",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.wantRet, MatchSelectors(selectors, tc.giveLabels))
+		})
+	}
+	assert.True(t, MatchSelectors(nil, nil))
+}
@@ -0,0 +1,413 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func eval(n node, env map[string]interface{}) (interface{}, error) {
+	switch n := n.(type) {
+	case *literalNode:
+		return n.value, nil
+	case *identNode:
+		v, ok := env[n.name]
+		if !ok {
+			return nil, fmt.Errorf("identifier %s is not defined", n.name)
+		}
+		return normalize(v), nil
+	case *memberNode:
+		target, err := eval(n.target, env)
+		if err != nil {
+			return nil, err
+		}
+		return index(target, n.name)
+	case *indexNode:
+		target, err := eval(n.target, env)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := eval(n.index, env)
+		if err != nil {
+			return nil, err
+		}
+		return index(target, idx)
+	case *listNode:
+		items := make([]interface{}, 0, len(n.items))
+		for _, item := range n.items {
+			v, err := eval(item, env)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	case *callNode:
+		args := make([]interface{}, 0, len(n.args))
+		for _, arg := range n.args {
+			v, err := eval(arg, env)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+		}
+		return functions[n.name].call(args)
+	case *unaryNode:
+		v, err := eval(n.operand, env)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "!" {
+			b, err := toBool(v)
+			if err != nil {
+				return nil, err
+			}
+			return !b, nil
+		}
+		f, err := toNumber(v)
+		if err != nil {
+			return nil, err
+		}
+		return -f, nil
+	case *binaryNode:
+		return evalBinary(n, env)
+	default:
+		return nil, fmt.Errorf("unknown node %T", n)
+	}
+}
+
+func evalBinary(n *binaryNode, env map[string]interface{}) (interface{}, error) {
+	left, err := eval(n.left, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// short circuit
+	if n.op == "&&" || n.op == "||" {
+		l, err := toBool(left)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "&&" && !l || n.op == "||" && l {
+			return l, nil
+		}
+		right, err := eval(n.right, env)
+		if err != nil {
+			return nil, err
+		}
+		return toBool(right)
+	}
+
+	right, err := eval(n.right, env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case ">", ">=", "<", "<=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case ">":
+			return c > 0, nil
+		case ">=":
+			return c >= 0, nil
+		case "<":
+			return c < 0, nil
+		default:
+			return c <= 0, nil
+		}
+	case "=~", "!~":
+		pattern, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("the pattern of %s must be a string", n.op)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		matched := re.MatchString(toString(left))
+		return matched == (n.op == "=~"), nil
+	case "in", "not in":
+		found, err := contains(right, left)
+		if err != nil {
+			return nil, err
+		}
+		return found == (n.op == "in"), nil
+	case "+":
+		// join strings unless one of them is a number
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if lok && rok {
+			return ls + rs, nil
+		}
+		return arithmetic(n.op, left, right)
+	default:
+		return arithmetic(n.op, left, right)
+	}
+}
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	l, err := toNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	r, err := toNumber(right)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	default:
+		return nil, fmt.Errorf("unknown operator %s", op)
+	}
+}
+
+// index get the field of map or the element of slice, it returns nil if it is not found,
+// so that the optional keys can be compared with null
+func index(target, idx interface{}) (interface{}, error) {
+	switch t := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		key, ok := idx.(string)
+		if !ok {
+			return nil, fmt.Errorf("the key of map must be a string, but got %v", idx)
+		}
+		return normalize(t[key]), nil
+	case []interface{}:
+		f, ok := idx.(float64)
+		if !ok || f != math.Trunc(f) {
+			return nil, fmt.Errorf("the index of list must be an integer, but got %v", idx)
+		}
+		i := int(f)
+		if i < 0 {
+			i += len(t)
+		}
+		if i < 0 || i >= len(t) {
+			return nil, nil
+		}
+		return normalize(t[i]), nil
+	default:
+		return nil, fmt.Errorf("cannot get %v of %s", idx, typeName(target))
+	}
+}
+
+// normalize convert the values to nil, bool, float64, string, []interface{} and map[string]interface{}
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil, bool, float64, string, []interface{}, map[string]interface{}:
+		return v
+	case json.Number:
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t.String()
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = normalize(rv.Index(i).Interface())
+		}
+		return items
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = normalize(iter.Value().Interface())
+		}
+		return m
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return normalize(rv.Elem().Interface())
+	default:
+		return v
+	}
+}
+
+// equal compare the values, the number and the bool are equal to the strings which can be parsed to them,
+// because the vars and share data are strings
+func equal(left, right interface{}) bool {
+	left, right = normalize(left), normalize(right)
+	switch l := left.(type) {
+	case float64:
+		if r, err := toNumber(right); err == nil {
+			return l == r
+		}
+		return false
+	case bool:
+		if r, ok := right.(string); ok {
+			b, err := strconv.ParseBool(r)
+			return err == nil && b == l
+		}
+	case string:
+		switch right.(type) {
+		case float64, bool:
+			return equal(right, left)
+		}
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// compare the values as numbers if they can be parsed to numbers, otherwise as strings
+func compare(left, right interface{}) (int, error) {
+	l, lErr := toNumber(left)
+	r, rErr := toNumber(right)
+	if lErr == nil && rErr == nil {
+		switch {
+		case l < r:
+			return -1, nil
+		case l > r:
+			return 1, nil
+		default:
+			return 0, nil
+		}
+	}
+
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok && rok {
+		return strings.Compare(ls, rs), nil
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", typeName(left), typeName(right))
+}
+
+// contains check if the collection contains the element, the collection can be a list, a map or a string
+func contains(collection, elem interface{}) (bool, error) {
+	switch c := collection.(type) {
+	case []interface{}:
+		for _, item := range c {
+			if equal(item, elem) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		key, ok := elem.(string)
+		if !ok {
+			return false, nil
+		}
+		_, ok = c[key]
+		return ok, nil
+	case string:
+		return strings.Contains(c, toString(elem)), nil
+	case nil:
+		return false, nil
+	default:
+		return false, fmt.Errorf("operator in does not support %s", typeName(collection))
+	}
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case nil:
+		return false, nil
+	case string:
+		b, err := strconv.ParseBool(t)
+		if err != nil {
+			return false, fmt.Errorf("cannot convert %q to bool", t)
+		}
+		return b, nil
+	case float64:
+		return t != 0, nil
+	default:
+		return false, fmt.Errorf("cannot convert %s to bool", typeName(v))
+	}
+}
+
+func toNumber(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot convert %q to number", t)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("cannot convert %s to number", typeName(v))
+	}
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		bs, err := json.Marshal(t)
+		if err != nil {
+			return fmt.Sprint(t)
+		}
+		return string(bs)
+	}
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
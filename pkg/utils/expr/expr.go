@@ -0,0 +1,75 @@
+// Package expr is a small expression engine which is used by the pre-checks of tasks,
+// it supports comparison, boolean, numeric, regular expression and json path operators, for example:
+//
+//	vars.replicas > 3 && vars.env != "prod"
+//	shareData.version =~ "^v\d+" || jsonPath(shareData.result, "$.items[0].ready") == true
+//	"linux" in tasks["get-os"].outputs.platforms
+package expr
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Expression is a compiled expression, it is safe for concurrent use
+type Expression struct {
+	src   string
+	root  node
+	roots []string
+}
+
+// Compile parse the expression
+func Compile(src string) (*Expression, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, fmt.Errorf("compile expression[%s] failed: %w", src, err)
+	}
+	p := &parser{tokens: tokens, roots: map[string]bool{}}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compile expression[%s] failed: %w", src, err)
+	}
+
+	e := &Expression{src: src, root: root}
+	for name := range p.roots {
+		e.roots = append(e.roots, name)
+	}
+	sort.Strings(e.roots)
+	return e, nil
+}
+
+// String return the source of expression
+func (e *Expression) String() string {
+	return e.src
+}
+
+// Roots return the root identifiers referenced by the expression, such as "vars"
+func (e *Expression) Roots() []string {
+	return e.roots
+}
+
+// Eval evaluate the expression with the identifiers of env,
+// the values of env can be nil, bool, number, string and the maps and slices of them
+func (e *Expression) Eval(env map[string]interface{}) (interface{}, error) {
+	v, err := eval(e.root, env)
+	if err != nil {
+		return nil, fmt.Errorf("evaluate expression[%s] failed: %w", e.src, err)
+	}
+	return v, nil
+}
+
+// EvalBool evaluate the expression and convert the result to bool
+func (e *Expression) EvalBool(env map[string]interface{}) (bool, error) {
+	v, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, err := toBool(v)
+	if err != nil {
+		return false, fmt.Errorf("evaluate expression[%s] failed: %w", e.src, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,144 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpression_EvalBool(t *testing.T) {
+	env := map[string]interface{}{
+		"vars": map[string]string{
+			"replicas": "5",
+			"env":      "test",
+			"debug":    "true",
+			"version":  "v1.2.0",
+		},
+		"shareData": map[string]string{
+			"result": `{"items":[{"name":"a","ready":true},{"name":"b","ready":false}],"count":2}`,
+		},
+		"tasks": map[string]interface{}{
+			"get-os": map[string]interface{}{
+				"outputs": map[string]interface{}{
+					"platforms": []string{"linux", "darwin"},
+					"cores":     8,
+				},
+			},
+		},
+	}
+	tests := []struct {
+		caseDesc string
+		giveExpr string
+		wantRet  bool
+		wantErr  string
+	}{
+		{caseDesc: "numeric string", giveExpr: `vars.replicas > 3 && vars.env != "prod"`, wantRet: true},
+		{caseDesc: "keywords", giveExpr: `vars.replicas > 3 and not (vars.env == "test")`, wantRet: false},
+		{caseDesc: "or", giveExpr: `vars.replicas >= 10 || vars.env == 'test'`, wantRet: true},
+		{caseDesc: "numeric compare", giveExpr: `vars.replicas < 10`, wantRet: true},
+		{caseDesc: "string compare", giveExpr: `vars.env < "zoo"`, wantRet: true},
+		{caseDesc: "arithmetic", giveExpr: `vars.replicas * 2 - 1 == 9 && 7 % 4 == 3 && -vars.replicas / 5 == -1`, wantRet: true},
+		{caseDesc: "concat", giveExpr: `vars.env + "-a" == "test-a"`, wantRet: true},
+		{caseDesc: "bool string", giveExpr: `vars.debug == true && vars.debug`, wantRet: true},
+		{caseDesc: "regex", giveExpr: `vars.version =~ "^v\d+\.\d+\.\d+$"`, wantRet: true},
+		{caseDesc: "not regex", giveExpr: `vars.version !~ "^v2"`, wantRet: true},
+		{caseDesc: "json path", giveExpr: `jsonPath(shareData.result, "$.items[0].ready") == true`, wantRet: true},
+		{caseDesc: "json path number", giveExpr: `jsonPath(shareData.result, "$.count") > 1`, wantRet: true},
+		{caseDesc: "json path wildcard", giveExpr: `"b" in jsonPath(shareData.result, "$.items[*].name")`, wantRet: true},
+		{caseDesc: "json path negative index", giveExpr: `jsonPath(shareData.result, "$['items'][-1].name") == "b"`, wantRet: true},
+		{caseDesc: "json path not found", giveExpr: `jsonPath(shareData.result, "$.items[5].name") == null`, wantRet: true},
+		{caseDesc: "in list", giveExpr: `"linux" in tasks["get-os"].outputs.platforms`, wantRet: true},
+		{caseDesc: "not in list", giveExpr: `"windows" not in tasks["get-os"].outputs.platforms`, wantRet: true},
+		{caseDesc: "in literal list", giveExpr: `vars.env in ["test", "dev"]`, wantRet: true},
+		{caseDesc: "in string", giveExpr: `"1.2" in vars.version`, wantRet: true},
+		{caseDesc: "output number", giveExpr: `tasks["get-os"].outputs.cores == 8`, wantRet: true},
+		{caseDesc: "missing key", giveExpr: `vars.missing == nil && !vars.missing`, wantRet: true},
+		{caseDesc: "functions", giveExpr: `len(tasks["get-os"].outputs.platforms) == 2 && upper(vars.env) == "TEST" && startsWith(vars.version, "v1")`, wantRet: true},
+		{caseDesc: "short circuit", giveExpr: `false && unknown.key`, wantRet: false},
+		{caseDesc: "undefined identifier", giveExpr: `unknown.key == 1`, wantErr: "evaluate expression[unknown.key == 1] failed: identifier unknown is not defined"},
+		{caseDesc: "cannot compare", giveExpr: `vars.env > 1`, wantErr: `evaluate expression[vars.env > 1] failed: cannot compare string with number`},
+		{caseDesc: "not bool", giveExpr: `vars.env`, wantErr: `evaluate expression[vars.env] failed: cannot convert "test" to bool`},
+		{caseDesc: "division by zero", giveExpr: `vars.replicas / 0 > 1`, wantErr: "evaluate expression[vars.replicas / 0 > 1] failed: division by zero"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			e, err := Compile(tc.giveExpr)
+			assert.NoError(t, err)
+			ret, err := e.EvalBool(env)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRet, ret)
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		caseDesc  string
+		giveExpr  string
+		wantRoots []string
+		wantErr   string
+	}{
+		{
+			caseDesc:  "normal",
+			giveExpr:  `vars.a > 1 && jsonPath(shareData.b, "$.c") in tasks["t"].outputs.d`,
+			wantRoots: []string{"shareData", "tasks", "vars"},
+		},
+		{
+			caseDesc: "unexpected end",
+			giveExpr: `vars.a >`,
+			wantErr:  "compile expression[vars.a >] failed: unexpected end of expression",
+		},
+		{
+			caseDesc: "unexpected token",
+			giveExpr: `vars.a 1`,
+			wantErr:  `compile expression[vars.a 1] failed: unexpected token "1" at 7`,
+		},
+		{
+			caseDesc: "unterminated string",
+			giveExpr: `vars.a == "b`,
+			wantErr:  "compile expression[vars.a == \"b] failed: unterminated string at 10",
+		},
+		{
+			caseDesc: "invalid pattern",
+			giveExpr: `vars.a =~ "("`,
+			wantErr:  "compile expression[vars.a =~ \"(\"] failed: invalid pattern \"(\": error parsing regexp: missing closing ): `(`",
+		},
+		{
+			caseDesc: "invalid json path",
+			giveExpr: `jsonPath(vars.a, "items")`,
+			wantErr:  "compile expression[jsonPath(vars.a, \"items\")] failed: json path[items] must start with $",
+		},
+		{
+			caseDesc: "undefined function",
+			giveExpr: `exec("rm")`,
+			wantErr:  "compile expression[exec(\"rm\")] failed: function exec is not defined",
+		},
+		{
+			caseDesc: "wrong argument count",
+			giveExpr: `len(vars.a, vars.b) > 1`,
+			wantErr:  "compile expression[len(vars.a, vars.b) > 1] failed: function len needs 1 arguments, but got 2",
+		},
+		{
+			caseDesc: "unexpected character",
+			giveExpr: `vars.a & 1`,
+			wantErr:  "compile expression[vars.a & 1] failed: unexpected character '&' at 7",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			e, err := Compile(tc.giveExpr)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRoots, e.Roots())
+		})
+	}
+}
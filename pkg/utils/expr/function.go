@@ -0,0 +1,68 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type function struct {
+	argCnt int
+	call   func(args []interface{}) (interface{}, error)
+}
+
+// functions are the built-in functions of expression
+var functions = map[string]function{
+	// jsonPath query the value by json path such as `$.items[0].name`, the value can be a json string
+	"jsonPath": {argCnt: 2, call: func(args []interface{}) (interface{}, error) {
+		path, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("json path must be a string")
+		}
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		doc := args[0]
+		if s, ok := doc.(string); ok {
+			if err := json.Unmarshal([]byte(s), &doc); err != nil {
+				return nil, fmt.Errorf("unmarshal json failed: %w", err)
+			}
+			doc = normalize(doc)
+		}
+		return queryJSONPath(doc, segments)
+	}},
+	// len return the length of string, list or map
+	"len": {argCnt: 1, call: func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		default:
+			return nil, fmt.Errorf("len does not support %s", typeName(v))
+		}
+	}},
+	"number": {argCnt: 1, call: func(args []interface{}) (interface{}, error) {
+		return toNumber(args[0])
+	}},
+	"string": {argCnt: 1, call: func(args []interface{}) (interface{}, error) {
+		return toString(args[0]), nil
+	}},
+	"lower": {argCnt: 1, call: func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(toString(args[0])), nil
+	}},
+	"upper": {argCnt: 1, call: func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(args[0])), nil
+	}},
+	"startsWith": {argCnt: 2, call: func(args []interface{}) (interface{}, error) {
+		return strings.HasPrefix(toString(args[0]), toString(args[1])), nil
+	}},
+	"endsWith": {argCnt: 2, call: func(args []interface{}) (interface{}, error) {
+		return strings.HasSuffix(toString(args[0]), toString(args[1])), nil
+	}},
+}
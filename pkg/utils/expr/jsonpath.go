@@ -0,0 +1,127 @@
+package expr
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPathSegment is a step of json path, it is a key, an index or a wildcard
+type jsonPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parse the json path like `$.items[0].name`, `$['a key'][-1]` or `$.items[*].name`
+func parseJSONPath(path string) ([]jsonPathSegment, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("json path[%s] must start with $", path)
+	}
+	var segments []jsonPathSegment
+	for i := 1; i < len(path); {
+		switch path[i] {
+		case '.':
+			start := i + 1
+			i = start
+			for i < len(path) && path[i] != '.' && path[i] != '[' {
+				i++
+			}
+			key := path[start:i]
+			if key == "" {
+				return nil, fmt.Errorf("json path[%s] has an empty key at %d", path, start)
+			}
+			if key == "*" {
+				segments = append(segments, jsonPathSegment{wildcard: true})
+				continue
+			}
+			segments = append(segments, jsonPathSegment{key: key})
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path[%s] has an unclosed bracket at %d", path, i)
+			}
+			inner := strings.TrimSpace(path[i+1 : i+end])
+			i += end + 1
+			switch {
+			case inner == "*":
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				segments = append(segments, jsonPathSegment{key: inner[1 : len(inner)-1]})
+			default:
+				idx, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("json path[%s] has an invalid index %q", path, inner)
+				}
+				segments = append(segments, jsonPathSegment{index: idx, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("json path[%s] has an unexpected character %q at %d", path, path[i], i)
+		}
+	}
+	return segments, nil
+}
+
+// queryJSONPath return nil if the path is not found, and return a list if the path has wildcards
+func queryJSONPath(doc interface{}, segments []jsonPathSegment) (interface{}, error) {
+	if len(segments) == 0 {
+		return doc, nil
+	}
+	seg, rest := segments[0], segments[1:]
+	if seg.wildcard {
+		var items []interface{}
+		switch d := doc.(type) {
+		case []interface{}:
+			items = d
+		case map[string]interface{}:
+			// sort by keys, so that the result is stable
+			keys := make([]string, 0, len(d))
+			for k := range d {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				items = append(items, d[k])
+			}
+		default:
+			return nil, nil
+		}
+		ret := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			v, err := queryJSONPath(item, rest)
+			if err != nil {
+				return nil, err
+			}
+			if v != nil {
+				ret = append(ret, v)
+			}
+		}
+		return ret, nil
+	}
+
+	var next interface{}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if seg.isIndex {
+			return nil, nil
+		}
+		next = d[seg.key]
+	case []interface{}:
+		if !seg.isIndex {
+			return nil, nil
+		}
+		i := seg.index
+		if i < 0 {
+			i += len(d)
+		}
+		if i < 0 || i >= len(d) {
+			return nil, nil
+		}
+		next = d[i]
+	default:
+		return nil, nil
+	}
+	return queryJSONPath(next, rest)
+}
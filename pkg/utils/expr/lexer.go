@@ -0,0 +1,127 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+// operators sorted by length, so that the longest one is matched first
+var operators = []string{
+	"==", "!=", ">=", "<=", "=~", "!~", "&&", "||",
+	">", "<", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", ".",
+}
+
+// keywords are the operators spelled as words
+var keywords = map[string]string{
+	"and": "&&",
+	"or":  "||",
+	"not": "!",
+	"in":  "in",
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			num, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at %d", src[start:i], start)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[start:i], num: num, pos: start})
+		case c == '"' || c == '\'':
+			s, end, err := readString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s, pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			word := src[start:i]
+			if op, ok := keywords[word]; ok {
+				tokens = append(tokens, token{kind: tokenOperator, text: op, pos: start})
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: word, pos: start})
+		default:
+			op := matchOperator(src[i:])
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+func matchOperator(s string) string {
+	for _, op := range operators {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// readString read a quoted string which starts at src[start], and return the string and the end position
+func readString(src string, start int) (string, int, error) {
+	quote := src[start]
+	var sb strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case quote:
+			return sb.String(), i + 1, nil
+		case '\\':
+			if i+1 >= len(src) {
+				break
+			}
+			i++
+			switch src[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case quote, '\\':
+				sb.WriteByte(src[i])
+			default:
+				// keep the backslash, so that regular expressions like `\d` can be written directly
+				sb.WriteByte('\\')
+				sb.WriteByte(src[i])
+			}
+		default:
+			sb.WriteByte(src[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at %d", start)
+}
@@ -0,0 +1,341 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// node is a node of the syntax tree
+type node interface{}
+
+type literalNode struct {
+	value interface{}
+}
+
+type identNode struct {
+	name string
+}
+
+type memberNode struct {
+	target node
+	name   string
+}
+
+type indexNode struct {
+	target node
+	index  node
+}
+
+type listNode struct {
+	items []node
+}
+
+type callNode struct {
+	name string
+	args []node
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	roots  map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consume the next token if it is one of the operators
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *parser) unexpected() error {
+	t := p.peek()
+	if t.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected token %q at %d", t.text, t.pos)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	if _, ok := p.accept("!"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: "!", operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", ">=", "<=", ">", "<", "=~", "!~", "in")
+	if !ok {
+		// "not in" is spelled as two keywords
+		if t := p.peek(); t.kind == tokenOperator && t.text == "!" && p.tokens[p.pos+1].text == "in" {
+			p.pos += 2
+			op = "not in"
+		} else {
+			return left, nil
+		}
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	// check the literal pattern when compiling, so that a broken one is rejected up front
+	if lit, ok := right.(*literalNode); ok && (op == "=~" || op == "!~") {
+		pattern, ok := lit.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("the pattern of %s must be a string", op)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return &binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: "-", operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("."); ok {
+			if p.peek().kind != tokenIdent {
+				return nil, p.unexpected()
+			}
+			t := p.next()
+			n = &memberNode{target: n, name: t.text}
+			continue
+		}
+		if _, ok := p.accept("["); ok {
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{target: n, index: index}
+			continue
+		}
+		return n, nil
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		return &literalNode{value: t.num}, nil
+	case tokenString:
+		return &literalNode{value: t.text}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null", "nil":
+			return &literalNode{value: nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(t)
+		}
+		p.roots[t.text] = true
+		return &identNode{name: t.text}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			items, err := p.parseArgs("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listNode{items: items}, nil
+		}
+	}
+	if t.kind != tokenEOF {
+		p.pos--
+	}
+	return nil, p.unexpected()
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("function %s is not defined", name.text)
+	}
+	args, err := p.parseArgs(")")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != fn.argCnt {
+		return nil, fmt.Errorf("function %s needs %d arguments, but got %d", name.text, fn.argCnt, len(args))
+	}
+	// check the literal json path when compiling
+	if name.text == "jsonPath" {
+		if lit, ok := args[1].(*literalNode); ok {
+			path, ok := lit.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("json path must be a string")
+			}
+			if _, err := parseJSONPath(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &callNode{name: name.text, args: args}, nil
+}
+
+// parseArgs parse the comma separated expressions until the end operator
+func (p *parser) parseArgs(end string) ([]node, error) {
+	var args []node
+	if _, ok := p.accept(end); ok {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if _, ok := p.accept(end); ok {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package gormstore
+
+import (
+	"errors"
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/event"
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/shiningrush/goevent"
+	"go.mongodb.org/mongo-driver/bson"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// StoreOption
+type StoreOption struct {
+	// the prefix will append to the tables
+	Prefix string
+	// IsDuplicateKeyError check if the error is caused by a duplicate primary key, it depends on the driver
+	IsDuplicateKeyError func(err error) bool
+	// MaxIdleConns, MaxOpenConns and ConnMaxLifetime configure the connection pool, zero means use default
+	MaxIdleConns    int
+	MaxOpenConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// taskInsStateColumns are the columns of task instance which are changed by its execution and reset by retry or rerun
+var taskInsStateColumns = []string{
+	"updated_at", "status", "reason", "traces", "attempts", "next_retry_at", "approval",
+	"share_data_keys", "outputs", "selected_branches", "compensation", "history",
+}
+
+// LeaderFenceKey is the id of the row which keeps the highest leader epoch
+const LeaderFenceKey = "leader"
+
+// LeaderFence keeps the highest leader epoch which has been seen, it is used to reject the writes of stale leader
+type LeaderFence struct {
+	ID    string `gorm:"column:id;primaryKey;size:64"`
+	Epoch int64  `gorm:"column:epoch"`
+}
+
+// Store is the common gorm-based implementation of mod.Store,
+// the relational stores just need to open it with the dialector of their database
+type Store struct {
+	opt *StoreOption
+	db  *gorm.DB
+}
+
+// NewStore
+func NewStore(option *StoreOption) *Store {
+	return &Store{
+		opt: option,
+	}
+}
+
+// Open connect to the database by dialector and create the tables
+func (s *Store) Open(dialector gorm.Dialector) error {
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: gormlogger.New(stdlog.New(os.Stdout, "\r\n", stdlog.LstdFlags), gormlogger.Config{
+		SlowThreshold: 200 * time.Millisecond,
+		LogLevel:      gormlogger.Warn,
+		// not found is a normal case for us, it will be returned as an error
+		IgnoreRecordNotFoundError: true,
+		Colorful:                  true,
+	})})
+	if err != nil {
+		return fmt.Errorf("connect client failed: %w", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("get db failed: %w", err)
+	}
+	if s.opt.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(s.opt.MaxIdleConns)
+	}
+	if s.opt.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(s.opt.MaxOpenConns)
+	}
+	if s.opt.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(s.opt.ConnMaxLifetime)
+	}
+	s.db = db
+
+	// create tables automatically
+	tables := map[string]interface{}{
+		s.tableName("dag"):           &entity.Dag{},
+		s.tableName("task"):          &entity.Task{},
+		s.tableName("dag_instance"):  &entity.DagInstance{},
+		s.tableName("task_instance"): &entity.TaskInstance{},
+		s.tableName("dag_schedule"):  &entity.DagSchedule{},
+		s.tableName("leader_fence"):  &LeaderFence{},
+	}
+	for name, model := range tables {
+		if err := s.db.Table(name).AutoMigrate(model); err != nil {
+			return fmt.Errorf("migrate table %s failed: %w", name, err)
+		}
+	}
+	// create the fence row in advance, so that the leaders always have a row to lock
+	err = s.db.Table(s.tableName("leader_fence")).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&LeaderFence{ID: LeaderFenceKey}).Error
+	if err != nil {
+		return fmt.Errorf("create leader fence failed: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) tableName(name string) string {
+	return s.opt.Prefix + "_" + name
+}
+
+// DB return the gorm db, it is nil before the store opened
+func (s *Store) DB() *gorm.DB {
+	return s.db
+}
+
+// Close component when we not use it anymore
+func (s *Store) Close() {
+	if s.db == nil {
+		return
+	}
+	if sqlDB, err := s.db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func (s *Store) isDuplicateKeyError(err error) bool {
+	return s.opt.IsDuplicateKeyError != nil && s.opt.IsDuplicateKeyError(err)
+}
+
+// CreateDag
+func (s *Store) CreateDag(dag *entity.Dag) error {
+	// check task's connection
+	err := mod.ValidateDag(dag)
+	if err != nil {
+		return err
+	}
+	baseInfo := dag.GetBaseInfo()
+	baseInfo.Initial()
+	err = s.db.Table(s.tableName("dag")).Create(&dag).Error
+	if err != nil {
+		if s.isDuplicateKeyError(err) {
+			return fmt.Errorf("dag key[ %s ] already existed: %w", baseInfo.ID, data.ErrDataConflicted)
+		}
+		return fmt.Errorf("insert Dag failed: %w", err)
+	}
+	for _, task := range dag.Tasks {
+		task.DagID = dag.ID
+		err = s.db.Table(s.tableName("task")).Create(&task).Error
+		if err != nil {
+			return fmt.Errorf("insert Task failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// CreateDagIns
+func (s *Store) CreateDagIns(dagIns *entity.DagInstance) error {
+	baseInfo := dagIns.GetBaseInfo()
+	baseInfo.Initial()
+	err := s.db.Table(s.tableName("dag_instance")).Create(&dagIns).Error
+	if err != nil {
+		if s.isDuplicateKeyError(err) {
+			return fmt.Errorf("dag instance key[ %s ] already existed: %w", baseInfo.ID, data.ErrDataConflicted)
+		}
+		return fmt.Errorf("insert DagInstance failed: %w", err)
+	}
+	return nil
+}
+
+// CreateTaskIns
+func (s *Store) CreateTaskIns(taskIns *entity.TaskInstance) error {
+	baseInfo := taskIns.GetBaseInfo()
+	baseInfo.Initial()
+	err := s.db.Table(s.tableName("task_instance")).Create(&taskIns).Error
+	if err != nil {
+		return fmt.Errorf("insert TaskInstance failed: %w", err)
+	}
+	return nil
+}
+
+// BatchCreatTaskIns
+func (s *Store) BatchCreatTaskIns(taskIns []*entity.TaskInstance) error {
+	for i := range taskIns {
+		if err := s.CreateTaskIns(taskIns[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PatchTaskIns
+func (s *Store) PatchTaskIns(taskIns *entity.TaskInstance) error {
+	if taskIns.ID == "" {
+		return fmt.Errorf("id cannot be empty")
+	}
+	taskIns.Update()
+	err := s.db.Table(s.tableName("task_instance")).Where("id = ?", taskIns.ID).Updates(&taskIns).Error
+	if err != nil {
+		return fmt.Errorf("patch TaskInstance failed: %w", err)
+	}
+	return nil
+}
+
+// PatchDagIns
+func (s *Store) PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ...string) error {
+	update := map[string]interface{}{
+		"updated_at": time.Now().Unix(),
+	}
+	if dagIns.ShareData != nil {
+		update["share_data"] = dagIns.ShareData
+	}
+	if dagIns.Status != "" {
+		update["status"] = dagIns.Status
+	}
+	if utils.StringsContain(mustsPatchFields, "Cmd") || dagIns.Cmd != nil {
+		update["cmd"] = dagIns.Cmd
+	}
+	if dagIns.Worker != "" {
+		update["worker"] = dagIns.Worker
+	}
+	if utils.StringsContain(mustsPatchFields, "Reason") || dagIns.Reason != "" {
+		update["reason"] = dagIns.Reason
+	}
+	if dagIns.HandlerStatus != "" {
+		update["handler_status"] = dagIns.HandlerStatus
+	}
+	if utils.StringsContain(mustsPatchFields, "HandlerReason") || dagIns.HandlerReason != "" {
+		update["handler_reason"] = dagIns.HandlerReason
+	}
+	err := s.db.Table(s.tableName("dag_instance")).Where("id = ?", dagIns.ID).Updates(update).Error
+	if err != nil {
+		return fmt.Errorf("patch DagInstance failed: %w", err)
+	}
+	goevent.Publish(&event.DagInstancePatched{
+		Payload:         dagIns,
+		MustPatchFields: mustsPatchFields,
+	})
+	return nil
+}
+
+// UpdateDag
+func (s *Store) UpdateDag(dag *entity.Dag) error {
+	// check task's connection
+	err := mod.ValidateDag(dag)
+	if err != nil {
+		return err
+	}
+	dag.Update()
+	err = s.db.Table(s.tableName("dag")).Where("id = ?", dag.ID).Updates(&dag).Error
+	if err != nil {
+		return fmt.Errorf("patch Dag failed: %w", err)
+	}
+	oldTasks := []entity.Task{}
+	err = s.db.Table(s.tableName("task")).Where("dag_id = ?", dag.ID).Find(&oldTasks).Error
+	if err != nil {
+		return fmt.Errorf("get task failed: %w", err)
+	}
+	for _, task := range dag.Tasks {
+		task.DagID = dag.ID
+		exits := false
+		for _, oldTask := range oldTasks {
+			if task.ID == oldTask.ID {
+				exits = true
+			}
+		}
+		if exits {
+			err = s.db.Table(s.tableName("task")).Where("id = ?", task.ID).Updates(&task).Error
+			if err != nil {
+				return fmt.Errorf("update Task failed: %w", err)
+			}
+		} else {
+			err = s.db.Table(s.tableName("task")).Create(&task).Error
+			if err != nil {
+				return fmt.Errorf("insert Task failed: %w", err)
+			}
+		}
+	}
+	for _, oldTask := range oldTasks {
+		exits := false
+		for _, task := range dag.Tasks {
+			if task.ID == oldTask.ID {
+				exits = true
+			}
+		}
+		if !exits {
+			err = s.db.Table(s.tableName("task")).Unscoped().Delete(&oldTask).Error
+			if err != nil {
+				return fmt.Errorf("delete Task failed: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateDagIns
+func (s *Store) UpdateDagIns(dagIns *entity.DagInstance) error {
+	dagIns.Update()
+	// update all fields, so that the zero values such as cmd can be reset
+	err := s.db.Table(s.tableName("dag_instance")).Where("id = ?", dagIns.ID).Select("*").Updates(&dagIns).Error
+	if err != nil {
+		return fmt.Errorf("update DagInstance failed: %w", err)
+	}
+	goevent.Publish(&event.DagInstanceUpdated{Payload: dagIns})
+	return nil
+}
+
+// UpdateTaskIns
+func (s *Store) UpdateTaskIns(taskIns *entity.TaskInstance) error {
+	taskIns.Update()
+	// only update the execution state including the zero values, so that the reset of task instance takes effect,
+	// and the definition such as params will not be overwritten
+	err := s.db.Table(s.tableName("task_instance")).Where("id = ?", taskIns.ID).Select(taskInsStateColumns).Updates(&taskIns).Error
+	if err != nil {
+		return fmt.Errorf("update TaskInstance failed: %w", err)
+	}
+	return nil
+}
+
+// BatchUpdateDagIns
+func (s *Store) BatchUpdateDagIns(dagIns []*entity.DagInstance, ops ...mod.UpdateOptionOp) error {
+	opt := mod.NewUpdateOption(ops)
+	// the fence row is locked until the updates committed, so a stale leader cannot write between them
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.fenceLeaderEpoch(tx, opt.LeaderEpoch); err != nil {
+			return err
+		}
+		for i := range dagIns {
+			if err := s.updateDagInsState(tx, dagIns[i], opt.ClearCmd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updateDagInsState only update the fields changed by leader,
+// so that the cmd and share data written by others at the same time will not be overwritten unless clearCmd is true
+func (s *Store) updateDagInsState(tx *gorm.DB, dagIns *entity.DagInstance, clearCmd bool) error {
+	dagIns.Update()
+	fields := map[string]interface{}{
+		"status":     dagIns.Status,
+		"worker":     dagIns.Worker,
+		"reason":     dagIns.Reason,
+		"updated_at": dagIns.UpdatedAt,
+	}
+	if clearCmd {
+		fields["cmd"] = nil
+	}
+	err := tx.Table(s.tableName("dag_instance")).Where("id = ?", dagIns.ID).Updates(fields).Error
+	if err != nil {
+		return fmt.Errorf("update DagInstance failed: %w", err)
+	}
+	return nil
+}
+
+// fenceLeaderEpoch lock the fence row and record the epoch if it is not less than the highest one, otherwise reject it
+func (s *Store) fenceLeaderEpoch(tx *gorm.DB, epoch int64) error {
+	if epoch == 0 {
+		return nil
+	}
+	fence := LeaderFence{}
+	err := tx.Table(s.tableName("leader_fence")).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", LeaderFenceKey).
+		Take(&fence).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// the fence row is created when the store opened, it is missing only if someone deleted it
+		err = tx.Table(s.tableName("leader_fence")).Create(&LeaderFence{ID: LeaderFenceKey, Epoch: epoch}).Error
+		if err != nil {
+			return fmt.Errorf("create leader fence failed: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get leader fence failed: %w", err)
+	}
+	if fence.Epoch > epoch {
+		return fmt.Errorf("leader epoch[ %d ] is stale, current is %d: %w", epoch, fence.Epoch, data.ErrDataConflicted)
+	}
+	if fence.Epoch == epoch {
+		return nil
+	}
+	if err := tx.Table(s.tableName("leader_fence")).Where("id = ?", LeaderFenceKey).Update("epoch", epoch).Error; err != nil {
+		return fmt.Errorf("update leader fence failed: %w", err)
+	}
+	return nil
+}
+
+// BatchUpdateTaskIns
+func (s *Store) BatchUpdateTaskIns(taskIns []*entity.TaskInstance) error {
+	for i := range taskIns {
+		if err := s.UpdateTaskIns(taskIns[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTaskIns
+func (s *Store) GetTaskIns(taskInsId string) (*entity.TaskInstance, error) {
+	ret := new(entity.TaskInstance)
+	if err := s.genericGet(s.tableName("task_instance"), taskInsId, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetDag
+func (s *Store) GetDag(dagId string) (*entity.Dag, error) {
+	dag := new(entity.Dag)
+	if err := s.genericGet(s.tableName("dag"), dagId, dag); err != nil {
+		return nil, err
+	}
+	task := []entity.Task{}
+	err := s.db.Table(s.tableName("task")).Where("dag_id = ?", dagId).Find(&task).Error
+	if err != nil {
+		return nil, err
+	}
+	dag.Tasks = task
+	return dag, nil
+}
+
+// GetDagInstance
+func (s *Store) GetDagInstance(dagInsId string) (*entity.DagInstance, error) {
+	ret := new(entity.DagInstance)
+	if err := s.genericGet(s.tableName("dag_instance"), dagInsId, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetDagSchedule
+func (s *Store) GetDagSchedule(dagId string) (*entity.DagSchedule, error) {
+	ret := new(entity.DagSchedule)
+	if err := s.genericGet(s.tableName("dag_schedule"), dagId, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *Store) genericGet(tableName, id string, ret interface{}) error {
+	err := s.db.Table(tableName).Where("id = ?", id).First(ret).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%s key[ %s ] not found: %w", tableName, id, data.ErrDataNotFound)
+		}
+		return err
+	}
+	return nil
+}
+
+// SaveDagSchedule
+func (s *Store) SaveDagSchedule(schedule *entity.DagSchedule) error {
+	if schedule.ID == "" {
+		return fmt.Errorf("id cannot be empty")
+	}
+	if schedule.CreatedAt == 0 {
+		schedule.Initial()
+	}
+	schedule.Update()
+	err := s.db.Table(s.tableName("dag_schedule")).Save(schedule).Error
+	if err != nil {
+		return fmt.Errorf("save DagSchedule failed: %w", err)
+	}
+	return nil
+}
+
+// ListDag
+func (s *Store) ListDag(input *mod.ListDagInput) ([]*entity.Dag, error) {
+	query := s.db.Table(s.tableName("dag"))
+	if input.HasCron {
+		query = query.Where("cron IS NOT NULL AND cron <> ''")
+	}
+	var ret []*entity.Dag
+	err := query.Find(&ret).Error
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ListDagInstance
+func (s *Store) ListDagInstance(input *mod.ListDagInstanceInput) ([]*entity.DagInstance, error) {
+	filterExp := []string{}
+	filterArgs := []interface{}{}
+	if len(input.Status) > 0 {
+		filterExp = append(filterExp, "status in (?) ")
+		filterArgs = append(filterArgs, input.Status)
+	}
+	if input.Worker != "" {
+		filterExp = append(filterExp, "worker = ? ")
+		filterArgs = append(filterArgs, input.Worker)
+	}
+	if input.DagID != "" {
+		filterExp = append(filterExp, "dag_id = ? ")
+		filterArgs = append(filterArgs, input.DagID)
+	}
+	if input.ConcurrencyKey != "" {
+		filterExp = append(filterExp, "concurrency_key = ? ")
+		filterArgs = append(filterArgs, input.ConcurrencyKey)
+	}
+	if input.UpdatedEnd > 0 {
+		filterExp = append(filterExp, "updated_at <= ? ")
+		filterArgs = append(filterArgs, input.UpdatedEnd)
+	}
+	if input.HasCmd {
+		filterExp = append(filterExp, "cmd IS NOT NULL ")
+	}
+	if input.ParentDagInsID != "" {
+		filterExp = append(filterExp, "parent_dag_ins_id = ? ")
+		filterArgs = append(filterArgs, input.ParentDagInsID)
+	}
+	if input.ParentTaskInsID != "" {
+		filterExp = append(filterExp, "parent_task_ins_id = ? ")
+		filterArgs = append(filterArgs, input.ParentTaskInsID)
+	}
+	if input.OrderByID && input.AfterID != "" {
+		filterExp = append(filterExp, "id > ? ")
+		filterArgs = append(filterArgs, input.AfterID)
+	}
+	limit := 10
+	if input.Limit > 0 {
+		limit = int(input.Limit)
+	}
+	query := s.db.Table(s.tableName("dag_instance"))
+	if len(filterExp) > 0 {
+		query = query.Where(strings.Join(filterExp, " AND "), filterArgs...)
+	}
+	var ret []*entity.DagInstance
+	switch {
+	case input.OrderByPriority:
+		query = query.Order("priority DESC").Order("created_at")
+	case input.OrderByID:
+	default:
+		query = query.Order("updated_at DESC")
+	}
+	err := query.Offset(int(input.Offset)).Limit(limit).Order("id").Find(&ret).Error
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ListTaskInstance
+func (s *Store) ListTaskInstance(input *mod.ListTaskInstanceInput) ([]*entity.TaskInstance, error) {
+	filterExp := []string{}
+	filterArgs := []interface{}{}
+	if len(input.IDs) > 0 {
+		filterExp = append(filterExp, "id in (?) ")
+		filterArgs = append(filterArgs, input.IDs)
+	}
+	if len(input.Status) > 0 {
+		filterExp = append(filterExp, "status in (?) ")
+		filterArgs = append(filterArgs, input.Status)
+	}
+	if input.Expired {
+		// delay is prevent watch dog conflicted with task's context timeout
+		filterExp = append(filterExp, "updated_at <= ? - timeout_secs ")
+		filterArgs = append(filterArgs, time.Now().Unix()-5)
+	}
+	if input.DagInsID != "" {
+		filterExp = append(filterExp, "dag_ins_id = ? ")
+		filterArgs = append(filterArgs, input.DagInsID)
+	}
+	query := s.db.Table(s.tableName("task_instance"))
+	if len(filterExp) > 0 {
+		query = query.Where(strings.Join(filterExp, " AND "), filterArgs...)
+	}
+	var ret []*entity.TaskInstance
+	err := query.Order("updated_at DESC").Find(&ret).Error
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// BatchDeleteDag
+func (s *Store) BatchDeleteDag(ids []string) error {
+	return s.db.Table(s.tableName("dag")).Delete(&entity.Dag{}, "id in (?)", ids).Error
+}
+
+// BatchDeleteDagIns
+func (s *Store) BatchDeleteDagIns(ids []string) error {
+	return s.db.Table(s.tableName("dag_instance")).Delete(&entity.DagInstance{}, "id in (?)", ids).Error
+}
+
+// BatchDeleteTaskIns
+func (s *Store) BatchDeleteTaskIns(ids []string) error {
+	return s.db.Table(s.tableName("task_instance")).Delete(&entity.TaskInstance{}, "id in (?)", ids).Error
+}
+
+// Marshal
+func (s *Store) Marshal(obj interface{}) ([]byte, error) {
+	return bson.Marshal(obj)
+}
+
+// Unmarshal
+func (s *Store) Unmarshal(bytes []byte, ptr interface{}) error {
+	return bson.Unmarshal(bytes, ptr)
+}
@@ -0,0 +1,567 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/event"
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/shiningrush/goevent"
+)
+
+const (
+	dagClsName         = "dag"
+	dagInsClsName      = "dag_instance"
+	taskInsClsName     = "task_instance"
+	dagScheduleClsName = "dag_schedule"
+)
+
+// Store keeps all data in the memory of process, it is used for single process and testing,
+// all data will be lost after the process exited
+type Store struct {
+	collections map[string]*collection
+	// leaderEpoch is the highest leader epoch which has been seen
+	leaderEpoch int64
+	mutex       sync.RWMutex
+}
+
+// collection keeps the encoded documents in the order of insertion,
+// so that the caller can never modify the stored data by the returned pointer
+type collection struct {
+	ids  []string
+	docs map[string][]byte
+}
+
+// NewStore
+func NewStore() *Store {
+	return &Store{}
+}
+
+// Init store
+func (s *Store) Init() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.collections = map[string]*collection{}
+	for _, name := range []string{dagClsName, dagInsClsName, taskInsClsName, dagScheduleClsName} {
+		s.collections[name] = &collection{docs: map[string][]byte{}}
+	}
+	return nil
+}
+
+// Close component when we not use it anymore
+func (s *Store) Close() {
+
+}
+
+// CreateDag
+func (s *Store) CreateDag(dag *entity.Dag) error {
+	// check task's connection
+	err := mod.ValidateDag(dag)
+	if err != nil {
+		return err
+	}
+	return s.genericCreate(dag, dagClsName)
+}
+
+// CreateDagIns
+func (s *Store) CreateDagIns(dagIns *entity.DagInstance) error {
+	return s.genericCreate(dagIns, dagInsClsName)
+}
+
+// CreateTaskIns
+func (s *Store) CreateTaskIns(taskIns *entity.TaskInstance) error {
+	return s.genericCreate(taskIns, taskInsClsName)
+}
+
+func (s *Store) genericCreate(input entity.BaseInfoGetter, clsName string) error {
+	baseInfo := input.GetBaseInfo()
+	baseInfo.Initial()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cls := s.collections[clsName]
+	if _, ok := cls.docs[baseInfo.ID]; ok {
+		return fmt.Errorf("%s key[ %s ] already existed: %w", clsName, baseInfo.ID, data.ErrDataConflicted)
+	}
+	return cls.put(baseInfo.ID, input)
+}
+
+// BatchCreatTaskIns
+func (s *Store) BatchCreatTaskIns(taskIns []*entity.TaskInstance) error {
+	for i := range taskIns {
+		if err := s.CreateTaskIns(taskIns[i]); err != nil {
+			return fmt.Errorf("insert task instance failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// PatchTaskIns
+func (s *Store) PatchTaskIns(taskIns *entity.TaskInstance) error {
+	if taskIns.ID == "" {
+		return fmt.Errorf("id cannot be empty")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cls := s.collections[taskInsClsName]
+	old := new(entity.TaskInstance)
+	if err := cls.get(taskInsClsName, taskIns.ID, old); err != nil {
+		return err
+	}
+	old.UpdatedAt = time.Now().Unix()
+	if taskIns.Status != "" {
+		old.Status = taskIns.Status
+	}
+	if taskIns.Reason != "" {
+		old.Reason = taskIns.Reason
+	}
+	if len(taskIns.Traces) > 0 {
+		old.Traces = taskIns.Traces
+	}
+	if taskIns.Attempts != 0 {
+		old.Attempts = taskIns.Attempts
+	}
+	if taskIns.NextRetryAt != 0 {
+		old.NextRetryAt = taskIns.NextRetryAt
+	}
+	if taskIns.Approval != nil {
+		old.Approval = taskIns.Approval
+	}
+	if len(taskIns.ShareDataKeys) > 0 {
+		old.ShareDataKeys = taskIns.ShareDataKeys
+	}
+	if len(taskIns.Outputs) > 0 {
+		old.Outputs = taskIns.Outputs
+	}
+	if len(taskIns.SelectedBranches) > 0 {
+		old.SelectedBranches = taskIns.SelectedBranches
+	}
+	if taskIns.Compensation != nil {
+		old.Compensation = taskIns.Compensation
+	}
+	return cls.put(old.ID, old)
+}
+
+// PatchDagIns
+func (s *Store) PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ...string) error {
+	if err := s.patchDagIns(dagIns, mustsPatchFields); err != nil {
+		return err
+	}
+
+	goevent.Publish(&event.DagInstancePatched{
+		Payload:         dagIns,
+		MustPatchFields: mustsPatchFields,
+	})
+	return nil
+}
+
+func (s *Store) patchDagIns(dagIns *entity.DagInstance, mustsPatchFields []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cls := s.collections[dagInsClsName]
+	old := new(entity.DagInstance)
+	if err := cls.get(dagInsClsName, dagIns.ID, old); err != nil {
+		return fmt.Errorf("patch dag instance failed: %w", err)
+	}
+	old.UpdatedAt = time.Now().Unix()
+	if dagIns.ShareData != nil {
+		old.ShareData = dagIns.ShareData
+	}
+	if dagIns.Status != "" {
+		old.Status = dagIns.Status
+	}
+	if utils.StringsContain(mustsPatchFields, "Cmd") || dagIns.Cmd != nil {
+		old.Cmd = dagIns.Cmd
+	}
+	if dagIns.Worker != "" {
+		old.Worker = dagIns.Worker
+	}
+	if utils.StringsContain(mustsPatchFields, "Reason") || dagIns.Reason != "" {
+		old.Reason = dagIns.Reason
+	}
+	if dagIns.HandlerStatus != "" {
+		old.HandlerStatus = dagIns.HandlerStatus
+	}
+	if utils.StringsContain(mustsPatchFields, "HandlerReason") || dagIns.HandlerReason != "" {
+		old.HandlerReason = dagIns.HandlerReason
+	}
+	return cls.put(old.ID, old)
+}
+
+// UpdateDag
+func (s *Store) UpdateDag(dag *entity.Dag) error {
+	// check task's connection
+	err := mod.ValidateDag(dag)
+	if err != nil {
+		return err
+	}
+	return s.genericUpdate(dag, dagClsName)
+}
+
+// UpdateDagIns
+func (s *Store) UpdateDagIns(dagIns *entity.DagInstance) error {
+	if err := s.genericUpdate(dagIns, dagInsClsName); err != nil {
+		return err
+	}
+
+	goevent.Publish(&event.DagInstanceUpdated{Payload: dagIns})
+	return nil
+}
+
+// UpdateTaskIns
+func (s *Store) UpdateTaskIns(taskIns *entity.TaskInstance) error {
+	return s.genericUpdate(taskIns, taskInsClsName)
+}
+
+// genericUpdate
+func (s *Store) genericUpdate(input entity.BaseInfoGetter, clsName string) error {
+	baseInfo := input.GetBaseInfo()
+	baseInfo.Update()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cls := s.collections[clsName]
+	if _, ok := cls.docs[baseInfo.ID]; !ok {
+		return fmt.Errorf("%s has no key[ %s ] to update: %w", clsName, baseInfo.ID, data.ErrDataNotFound)
+	}
+	return cls.put(baseInfo.ID, input)
+}
+
+// BatchUpdateDagIns
+func (s *Store) BatchUpdateDagIns(dagIns []*entity.DagInstance, ops ...mod.UpdateOptionOp) error {
+	opt := mod.NewUpdateOption(ops)
+	if err := s.checkLeaderEpoch(opt.LeaderEpoch); err != nil {
+		return err
+	}
+	for i := range dagIns {
+		if err := s.updateDagInsState(dagIns[i], opt.ClearCmd); err != nil {
+			return fmt.Errorf("batch update dag instance failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// updateDagInsState only update the fields changed by leader,
+// so that the cmd and share data written by others at the same time will not be overwritten unless clearCmd is true
+func (s *Store) updateDagInsState(dagIns *entity.DagInstance, clearCmd bool) error {
+	dagIns.Update()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cls := s.collections[dagInsClsName]
+	old := new(entity.DagInstance)
+	if err := cls.get(dagInsClsName, dagIns.ID, old); err != nil {
+		return err
+	}
+	old.UpdatedAt = dagIns.UpdatedAt
+	old.Status = dagIns.Status
+	old.Worker = dagIns.Worker
+	old.Reason = dagIns.Reason
+	if clearCmd {
+		old.Cmd = nil
+	}
+	return cls.put(old.ID, old)
+}
+
+// checkLeaderEpoch reject the epoch which is less than the highest one
+func (s *Store) checkLeaderEpoch(epoch int64) error {
+	if epoch == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if epoch < s.leaderEpoch {
+		return fmt.Errorf("leader epoch[ %d ] is stale, current is %d: %w", epoch, s.leaderEpoch, data.ErrDataConflicted)
+	}
+	s.leaderEpoch = epoch
+	return nil
+}
+
+// BatchUpdateTaskIns
+func (s *Store) BatchUpdateTaskIns(taskIns []*entity.TaskInstance) error {
+	for i := range taskIns {
+		if err := s.genericUpdate(taskIns[i], taskInsClsName); err != nil {
+			return fmt.Errorf("batch update task instance failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetTaskIns
+func (s *Store) GetTaskIns(taskInsId string) (*entity.TaskInstance, error) {
+	ret := new(entity.TaskInstance)
+	if err := s.genericGet(taskInsClsName, taskInsId, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// GetDag
+func (s *Store) GetDag(dagId string) (*entity.Dag, error) {
+	ret := new(entity.Dag)
+	if err := s.genericGet(dagClsName, dagId, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// GetDagInstance
+func (s *Store) GetDagInstance(dagInsId string) (*entity.DagInstance, error) {
+	ret := new(entity.DagInstance)
+	if err := s.genericGet(dagInsClsName, dagInsId, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// GetDagSchedule
+func (s *Store) GetDagSchedule(dagId string) (*entity.DagSchedule, error) {
+	ret := new(entity.DagSchedule)
+	if err := s.genericGet(dagScheduleClsName, dagId, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// SaveDagSchedule
+func (s *Store) SaveDagSchedule(schedule *entity.DagSchedule) error {
+	if schedule.ID == "" {
+		return fmt.Errorf("id cannot be empty")
+	}
+	if schedule.CreatedAt == 0 {
+		schedule.Initial()
+	}
+	schedule.Update()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.collections[dagScheduleClsName].put(schedule.ID, schedule)
+}
+
+func (s *Store) genericGet(clsName, id string, ret interface{}) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.collections[clsName].get(clsName, id, ret)
+}
+
+// ListDag
+func (s *Store) ListDag(input *mod.ListDagInput) ([]*entity.Dag, error) {
+	var ret []*entity.Dag
+	err := s.genericList(dagClsName, func() interface{} {
+		return new(entity.Dag)
+	}, func(doc interface{}) bool {
+		dag := doc.(*entity.Dag)
+		if input.HasCron && dag.Cron == "" {
+			return false
+		}
+		ret = append(ret, dag)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ListDagInstance
+func (s *Store) ListDagInstance(input *mod.ListDagInstanceInput) ([]*entity.DagInstance, error) {
+	var ret []*entity.DagInstance
+	err := s.genericList(dagInsClsName, func() interface{} {
+		return new(entity.DagInstance)
+	}, func(doc interface{}) bool {
+		dagIns := doc.(*entity.DagInstance)
+		if len(input.Status) > 0 && !containsDagInsStatus(input.Status, dagIns.Status) {
+			return false
+		}
+		if input.Worker != "" && dagIns.Worker != input.Worker {
+			return false
+		}
+		if input.DagID != "" && dagIns.DagID != input.DagID {
+			return false
+		}
+		if input.ConcurrencyKey != "" && dagIns.ConcurrencyKey != input.ConcurrencyKey {
+			return false
+		}
+		if input.UpdatedEnd > 0 && dagIns.UpdatedAt > input.UpdatedEnd {
+			return false
+		}
+		if input.HasCmd && dagIns.Cmd == nil {
+			return false
+		}
+		if input.ParentDagInsID != "" && dagIns.ParentDagInsID != input.ParentDagInsID {
+			return false
+		}
+		if input.ParentTaskInsID != "" && dagIns.ParentTaskInsID != input.ParentTaskInsID {
+			return false
+		}
+		if input.OrderByID && dagIns.ID <= input.AfterID {
+			return false
+		}
+		ret = append(ret, dagIns)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if input.OrderByPriority {
+		sort.SliceStable(ret, func(i, j int) bool {
+			if ret[i].Priority != ret[j].Priority {
+				return ret[i].Priority > ret[j].Priority
+			}
+			if ret[i].CreatedAt != ret[j].CreatedAt {
+				return ret[i].CreatedAt < ret[j].CreatedAt
+			}
+			return ret[i].ID < ret[j].ID
+		})
+	} else if input.OrderByID {
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].ID < ret[j].ID
+		})
+	}
+	if input.Offset >= int64(len(ret)) {
+		return nil, nil
+	}
+	ret = ret[input.Offset:]
+	if input.Limit > 0 && int64(len(ret)) > input.Limit {
+		ret = ret[:input.Limit]
+	}
+	return ret, nil
+}
+
+// ListTaskInstance
+func (s *Store) ListTaskInstance(input *mod.ListTaskInstanceInput) ([]*entity.TaskInstance, error) {
+	var ret []*entity.TaskInstance
+	err := s.genericList(taskInsClsName, func() interface{} {
+		return new(entity.TaskInstance)
+	}, func(doc interface{}) bool {
+		taskIns := doc.(*entity.TaskInstance)
+		if len(input.IDs) > 0 && !utils.StringsContain(input.IDs, taskIns.ID) {
+			return false
+		}
+		if len(input.Status) > 0 && !containsTaskInsStatus(input.Status, taskIns.Status) {
+			return false
+		}
+		// delay is prevent watch dog conflicted with task's context timeout
+		if input.Expired && taskIns.UpdatedAt > time.Now().Unix()-5-int64(taskIns.TimeoutSecs) {
+			return false
+		}
+		if input.DagInsID != "" && taskIns.DagInsID != input.DagInsID {
+			return false
+		}
+		ret = append(ret, taskIns)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// genericList decode the documents of collection one by one, filter decide if the document is needed
+func (s *Store) genericList(clsName string, newFunc func() interface{}, filter func(doc interface{}) bool) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	cls := s.collections[clsName]
+	for _, id := range cls.ids {
+		doc := newFunc()
+		if err := cls.get(clsName, id, doc); err != nil {
+			return fmt.Errorf("decode failed: %w", err)
+		}
+		filter(doc)
+	}
+	return nil
+}
+
+func containsDagInsStatus(status []entity.DagInstanceStatus, s entity.DagInstanceStatus) bool {
+	for i := range status {
+		if status[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTaskInsStatus(status []entity.TaskInstanceStatus, s entity.TaskInstanceStatus) bool {
+	for i := range status {
+		if status[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// BatchDeleteDag
+func (s *Store) BatchDeleteDag(ids []string) error {
+	return s.genericBatchDelete(ids, dagClsName)
+}
+
+// BatchDeleteDagIns
+func (s *Store) BatchDeleteDagIns(ids []string) error {
+	return s.genericBatchDelete(ids, dagInsClsName)
+}
+
+// BatchDeleteTaskIns
+func (s *Store) BatchDeleteTaskIns(ids []string) error {
+	return s.genericBatchDelete(ids, taskInsClsName)
+}
+
+func (s *Store) genericBatchDelete(ids []string, clsName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cls := s.collections[clsName]
+	for _, id := range ids {
+		delete(cls.docs, id)
+	}
+	remains := cls.ids[:0]
+	for _, id := range cls.ids {
+		if _, ok := cls.docs[id]; ok {
+			remains = append(remains, id)
+		}
+	}
+	cls.ids = remains
+	return nil
+}
+
+// Marshal
+func (s *Store) Marshal(obj interface{}) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+// Unmarshal
+func (s *Store) Unmarshal(bytes []byte, ptr interface{}) error {
+	return json.Unmarshal(bytes, ptr)
+}
+
+func (c *collection) put(id string, doc interface{}) error {
+	bs, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("encode failed: %w", err)
+	}
+	if _, ok := c.docs[id]; !ok {
+		c.ids = append(c.ids, id)
+	}
+	c.docs[id] = bs
+	return nil
+}
+
+func (c *collection) get(clsName, id string, ret interface{}) error {
+	bs, ok := c.docs[id]
+	if !ok {
+		return fmt.Errorf("%s key[ %s ] not found: %w", clsName, id, data.ErrDataNotFound)
+	}
+	return json.Unmarshal(bs, ret)
+}
@@ -0,0 +1,297 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func initStore(t *testing.T) *Store {
+	s := NewStore()
+	assert.NoError(t, s.Init())
+	entity.StoreMarshal = s.Marshal
+	entity.StoreUnmarshal = s.Unmarshal
+	return s
+}
+
+func TestStore_Dag(t *testing.T) {
+	s := initStore(t)
+	giveDags := []*entity.Dag{
+		{BaseInfo: entity.BaseInfo{ID: "test1"}, Name: "test1", Cron: "* * * * *", Tasks: []entity.Task{{ID: "task1"}}},
+		{BaseInfo: entity.BaseInfo{ID: "test2"}, Name: "test2", Tasks: []entity.Task{{ID: "task1"}}},
+	}
+	for i := range giveDags {
+		assert.NoError(t, s.CreateDag(giveDags[i]))
+	}
+	err := s.CreateDag(&entity.Dag{BaseInfo: entity.BaseInfo{ID: "test1"}, Tasks: []entity.Task{{ID: "task1"}}})
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+
+	// the broken pre-check expression is rejected when the dag is created
+	err = s.CreateDag(&entity.Dag{BaseInfo: entity.BaseInfo{ID: "test3"}, Tasks: []entity.Task{{
+		ID:        "task1",
+		PreChecks: entity.PreChecks{"check": {Expr: "vars.a >", Act: entity.ActiveActionSkip}},
+	}}})
+	assert.EqualError(t, err, "task[task1] pre-check[check] is invalid: compile expression[vars.a >] failed: unexpected end of expression")
+
+	ret, err := s.ListDag(&mod.ListDagInput{HasCron: true})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+	assert.Equal(t, "test1", ret[0].ID)
+
+	// the returned dag is a copy, modify it will not change the stored one
+	ret[0].Desc = "desc"
+	dag, err := s.GetDag("test1")
+	assert.NoError(t, err)
+	assert.Empty(t, dag.Desc)
+	assert.NoError(t, s.UpdateDag(ret[0]))
+	dag, err = s.GetDag("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, "desc", dag.Desc)
+
+	assert.NoError(t, s.BatchDeleteDag([]string{"test1"}))
+	_, err = s.GetDag("test1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+	err = s.UpdateDag(&entity.Dag{BaseInfo: entity.BaseInfo{ID: "test1"}, Tasks: []entity.Task{{ID: "task1"}}})
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+	ret, err = s.ListDag(&mod.ListDagInput{})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+}
+
+func TestStore_DagIns(t *testing.T) {
+	s := initStore(t)
+	giveDagIns := []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "test1"}, DagID: "dag1", Status: entity.DagInstanceStatusInit},
+		{BaseInfo: entity.BaseInfo{ID: "test2"}, DagID: "dag1", Status: entity.DagInstanceStatusRunning, Worker: "worker-1", ConcurrencyKey: "key1"},
+		{BaseInfo: entity.BaseInfo{ID: "test3"}, DagID: "dag2", Status: entity.DagInstanceStatusRunning, ParentTaskInsID: "task1", Priority: 1},
+	}
+	for i := range giveDagIns {
+		assert.NoError(t, s.CreateDagIns(giveDagIns[i]))
+	}
+
+	tests := []struct {
+		caseDesc  string
+		giveInput *mod.ListDagInstanceInput
+		wantIds   []string
+	}{
+		{
+			caseDesc:  "all",
+			giveInput: &mod.ListDagInstanceInput{},
+			wantIds:   []string{"test1", "test2", "test3"},
+		},
+		{
+			caseDesc:  "status",
+			giveInput: &mod.ListDagInstanceInput{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}},
+			wantIds:   []string{"test2", "test3"},
+		},
+		{
+			caseDesc:  "worker and dag",
+			giveInput: &mod.ListDagInstanceInput{Worker: "worker-1", DagID: "dag1"},
+			wantIds:   []string{"test2"},
+		},
+		{
+			caseDesc:  "concurrency key",
+			giveInput: &mod.ListDagInstanceInput{ConcurrencyKey: "key1"},
+			wantIds:   []string{"test2"},
+		},
+		{
+			caseDesc:  "parent",
+			giveInput: &mod.ListDagInstanceInput{ParentTaskInsID: "task1"},
+			wantIds:   []string{"test3"},
+		},
+		{
+			caseDesc:  "order by priority",
+			giveInput: &mod.ListDagInstanceInput{OrderByPriority: true},
+			wantIds:   []string{"test3", "test1", "test2"},
+		},
+		{
+			caseDesc:  "limit and offset",
+			giveInput: &mod.ListDagInstanceInput{Limit: 1, Offset: 1},
+			wantIds:   []string{"test2"},
+		},
+		{
+			caseDesc:  "after id",
+			giveInput: &mod.ListDagInstanceInput{OrderByID: true, AfterID: "test1", Limit: 1},
+			wantIds:   []string{"test2"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			ret, err := s.ListDagInstance(tc.giveInput)
+			assert.NoError(t, err)
+			var ids []string
+			for i := range ret {
+				ids = append(ids, ret[i].ID)
+			}
+			assert.Equal(t, tc.wantIds, ids)
+		})
+	}
+
+	// patch
+	err := s.PatchDagIns(&entity.DagInstance{
+		BaseInfo:  entity.BaseInfo{ID: "test1"},
+		Status:    entity.DagInstanceStatusFailed,
+		Reason:    "failed",
+		Cmd:       &entity.Command{Name: entity.CommandNameRetry},
+		ShareData: &entity.ShareData{Dict: map[string]string{"key": "value"}},
+	})
+	assert.NoError(t, err)
+	dagIns, err := s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusFailed, dagIns.Status)
+	assert.Equal(t, "dag1", dagIns.DagID)
+	assert.Equal(t, &entity.Command{Name: entity.CommandNameRetry}, dagIns.Cmd)
+	v, ok := dagIns.ShareData.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "value", v)
+	ret, err := s.ListDagInstance(&mod.ListDagInstanceInput{HasCmd: true})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+
+	// the must patch fields will be patched even if they are empty
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}}, "Cmd", "Reason")
+	assert.NoError(t, err)
+	dagIns, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Nil(t, dagIns.Cmd)
+	assert.Empty(t, dagIns.Reason)
+	assert.Equal(t, entity.DagInstanceStatusFailed, dagIns.Status)
+
+	// the handler reason is kept when only the handler status is patched, unless it must be patched
+	err = s.PatchDagIns(&entity.DagInstance{
+		BaseInfo:      entity.BaseInfo{ID: "test1"},
+		HandlerStatus: entity.DagInstanceStatusFailed,
+		HandlerReason: "handler failed",
+	})
+	assert.NoError(t, err)
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, HandlerStatus: entity.DagInstanceStatusRunning})
+	assert.NoError(t, err)
+	dagIns, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusRunning, dagIns.HandlerStatus)
+	assert.Equal(t, "handler failed", dagIns.HandlerReason)
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, HandlerStatus: entity.DagInstanceStatusRunning}, "HandlerReason")
+	assert.NoError(t, err)
+	dagIns, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusRunning, dagIns.HandlerStatus)
+	assert.Empty(t, dagIns.HandlerReason)
+
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "not-existed"}})
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+
+	// update
+	dagIns.Worker = "worker-2"
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}))
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{Worker: "worker-2"})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+
+	// the writes of stale leader are rejected
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(2)))
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(2)))
+	dagIns.Worker = "worker-3"
+	err = s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(1))
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{Worker: "worker-3"})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 0)
+
+	// the cmd written by others is kept when leader updates the state, unless it is cleared
+	stored, err := s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	stored.Cmd = &entity.Command{Name: entity.CommandNameCancelAll}
+	assert.NoError(t, s.UpdateDagIns(stored))
+	dagIns.Status = entity.DagInstanceStatusScheduled
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(2)))
+	stored, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusScheduled, stored.Status)
+	assert.NotNil(t, stored.Cmd)
+	dagIns.Status = entity.DagInstanceStatusFailed
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(2), mod.WithClearCmd()))
+	stored, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusFailed, stored.Status)
+	assert.Nil(t, stored.Cmd)
+}
+
+func TestStore_TaskIns(t *testing.T) {
+	s := initStore(t)
+	giveTaskIns := []*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, DagInsID: "dag1", Status: entity.TaskInstanceStatusInit},
+		{BaseInfo: entity.BaseInfo{ID: "task2"}, DagInsID: "dag1", Status: entity.TaskInstanceStatusRunning},
+		{BaseInfo: entity.BaseInfo{ID: "task3"}, DagInsID: "dag2", Status: entity.TaskInstanceStatusRunning},
+	}
+	assert.NoError(t, s.BatchCreatTaskIns(giveTaskIns))
+
+	ret, err := s.ListTaskInstance(&mod.ListTaskInstanceInput{
+		DagInsID: "dag1",
+		Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+	assert.Equal(t, "task2", ret[0].ID)
+	ret, err = s.ListTaskInstance(&mod.ListTaskInstanceInput{IDs: []string{"task1", "task3"}})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 2)
+	ret, err = s.ListTaskInstance(&mod.ListTaskInstanceInput{Expired: true})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 0)
+
+	err = s.PatchTaskIns(&entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task1"},
+		Status:   entity.TaskInstanceStatusFailed,
+		Reason:   "failed",
+		Traces:   []entity.TraceInfo{{Message: "trace"}},
+		Attempts: 1,
+		Outputs:  entity.StringMap{"version": "v1"},
+	})
+	assert.NoError(t, err)
+	err = s.PatchTaskIns(&entity.TaskInstance{
+		BaseInfo:     entity.BaseInfo{ID: "task1"},
+		Compensation: &entity.Compensation{Status: entity.CompensationStatusSuccess},
+	})
+	assert.NoError(t, err)
+	taskIns, err := s.GetTaskIns("task1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.TaskInstanceStatusFailed, taskIns.Status)
+	assert.Equal(t, "failed", taskIns.Reason)
+	assert.Equal(t, "dag1", taskIns.DagInsID)
+	assert.Equal(t, 1, taskIns.Attempts)
+	assert.Len(t, taskIns.Traces, 1)
+	assert.Equal(t, entity.StringMap{"version": "v1"}, taskIns.Outputs)
+	assert.Equal(t, &entity.Compensation{Status: entity.CompensationStatusSuccess}, taskIns.Compensation)
+	assert.Equal(t, fmt.Errorf("id cannot be empty"), s.PatchTaskIns(&entity.TaskInstance{}))
+
+	// update all fields
+	taskIns.Attempts = 0
+	taskIns.Reason = ""
+	assert.NoError(t, s.UpdateTaskIns(taskIns))
+	taskIns, err = s.GetTaskIns("task1")
+	assert.NoError(t, err)
+	assert.Zero(t, taskIns.Attempts)
+	assert.Empty(t, taskIns.Reason)
+
+	assert.NoError(t, s.BatchDeleteTaskIns([]string{"task1", "task2"}))
+	ret, err = s.ListTaskInstance(&mod.ListTaskInstanceInput{})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+}
+
+func TestStore_DagSchedule(t *testing.T) {
+	s := initStore(t)
+	_, err := s.GetDagSchedule("dag1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+
+	assert.NoError(t, s.SaveDagSchedule(&entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag1"}, LastFiredAt: 1}))
+	assert.NoError(t, s.SaveDagSchedule(&entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag1"}, LastFiredAt: 2}))
+	schedule, err := s.GetDagSchedule("dag1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), schedule.LastFiredAt)
+}
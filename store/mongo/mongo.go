@@ -15,10 +15,12 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"sync"
 	"time"
 )
 
+// LeaderFenceKey is the id of the document which keeps the highest leader epoch
+const LeaderFenceKey = "leader"
+
 // StoreOption
 type StoreOption struct {
 	// mongo connection string
@@ -32,10 +34,12 @@ type StoreOption struct {
 
 // Store
 type Store struct {
-	opt            *StoreOption
-	dagClsName     string
-	dagInsClsName  string
-	taskInsClsName string
+	opt                *StoreOption
+	dagClsName         string
+	dagInsClsName      string
+	taskInsClsName     string
+	dagScheduleClsName string
+	leaderFenceClsName string
 
 	mongoClient *mongo.Client
 	mongoDb     *mongo.Database
@@ -83,10 +87,14 @@ func (s *Store) readOpt() error {
 	s.dagClsName = "dag"
 	s.dagInsClsName = "dag_instance"
 	s.taskInsClsName = "task_instance"
+	s.dagScheduleClsName = "dag_schedule"
+	s.leaderFenceClsName = "leader_fence"
 	if s.opt.Prefix != "" {
 		s.dagClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.dagClsName)
 		s.dagInsClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.dagInsClsName)
 		s.taskInsClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.taskInsClsName)
+		s.dagScheduleClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.dagScheduleClsName)
+		s.leaderFenceClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.leaderFenceClsName)
 	}
 
 	return nil
@@ -105,7 +113,7 @@ func (s *Store) Close() {
 // CreateDag
 func (s *Store) CreateDag(dag *entity.Dag) error {
 	// check task's connection
-	_, err := mod.BuildRootNode(mod.MapTasksToGetter(dag.Tasks))
+	err := mod.ValidateDag(dag)
 	if err != nil {
 		return err
 	}
@@ -170,6 +178,27 @@ func (s *Store) PatchTaskIns(taskIns *entity.TaskInstance) error {
 	if len(taskIns.Traces) > 0 {
 		update["traces"] = taskIns.Traces
 	}
+	if taskIns.Attempts != 0 {
+		update["attempts"] = taskIns.Attempts
+	}
+	if taskIns.NextRetryAt != 0 {
+		update["nextRetryAt"] = taskIns.NextRetryAt
+	}
+	if taskIns.Approval != nil {
+		update["approval"] = taskIns.Approval
+	}
+	if len(taskIns.ShareDataKeys) > 0 {
+		update["shareDataKeys"] = taskIns.ShareDataKeys
+	}
+	if len(taskIns.Outputs) > 0 {
+		update["outputs"] = taskIns.Outputs
+	}
+	if len(taskIns.SelectedBranches) > 0 {
+		update["selectedBranches"] = taskIns.SelectedBranches
+	}
+	if taskIns.Compensation != nil {
+		update["compensation"] = taskIns.Compensation
+	}
 	update = bson.M{
 		"$set": update,
 	}
@@ -203,6 +232,12 @@ func (s *Store) PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ...stri
 	if utils.StringsContain(mustsPatchFields, "Reason") || dagIns.Reason != "" {
 		update["reason"] = dagIns.Reason
 	}
+	if dagIns.HandlerStatus != "" {
+		update["handlerStatus"] = dagIns.HandlerStatus
+	}
+	if utils.StringsContain(mustsPatchFields, "HandlerReason") || dagIns.HandlerReason != "" {
+		update["handlerReason"] = dagIns.HandlerReason
+	}
 
 	update = bson.M{
 		"$set": update,
@@ -224,7 +259,7 @@ func (s *Store) PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ...stri
 // UpdateDag
 func (s *Store) UpdateDag(dag *entity.Dag) error {
 	// check task's connection
-	_, err := mod.BuildRootNode(mod.MapTasksToGetter(dag.Tasks))
+	err := mod.ValidateDag(dag)
 	if err != nil {
 		return err
 	}
@@ -264,34 +299,74 @@ func (s *Store) genericUpdate(input entity.BaseInfoGetter, clsName string) error
 }
 
 // BatchUpdateDagIns
-func (s *Store) BatchUpdateDagIns(dagIns []*entity.DagInstance) error {
+func (s *Store) BatchUpdateDagIns(dagIns []*entity.DagInstance, ops ...mod.UpdateOptionOp) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
 	defer cancel()
 
-	errChan := make(chan error)
-	defer close(errChan)
+	opt := mod.NewUpdateOption(ops)
+	if opt.LeaderEpoch == 0 {
+		return s.updateDagInsState(ctx, dagIns, opt.ClearCmd)
+	}
+	// the fence and the updates are committed in one transaction, a stale leader will conflict on the fence document,
+	// so the mongodb must be deployed as replica set or sharded cluster when the leader epoch is used
+	return s.mongoClient.UseSession(ctx, func(sessCtx mongo.SessionContext) error {
+		_, err := sessCtx.WithTransaction(sessCtx, func(txCtx mongo.SessionContext) (interface{}, error) {
+			if err := s.fenceLeaderEpoch(txCtx, opt.LeaderEpoch); err != nil {
+				return nil, err
+			}
+			return nil, s.updateDagInsState(txCtx, dagIns, opt.ClearCmd)
+		})
+		return err
+	})
+}
+
+// updateDagInsState only update the fields changed by leader,
+// so that the cmd and share data written by others at the same time will not be overwritten unless clearCmd is true
+func (s *Store) updateDagInsState(ctx context.Context, dagIns []*entity.DagInstance, clearCmd bool) error {
+	for _, dag := range dagIns {
+		dag.Update()
+		fields := bson.M{
+			"status":    dag.Status,
+			"worker":    dag.Worker,
+			"reason":    dag.Reason,
+			"updatedAt": dag.UpdatedAt,
+		}
+		if clearCmd {
+			fields["cmd"] = nil
+		}
+		ret, err := s.mongoDb.Collection(s.dagInsClsName).UpdateOne(ctx,
+			bson.M{"_id": dag.ID},
+			bson.M{"$set": fields})
+		if err != nil {
+			return fmt.Errorf("batch update dag instance failed: %w", err)
+		}
+		if ret.MatchedCount == 0 {
+			return fmt.Errorf("%s has no key[ %s ] to update: %w", s.dagInsClsName, dag.ID, data.ErrDataNotFound)
+		}
+	}
+	return nil
+}
 
-	errs := &data.Errors{}
-	go func() {
-		for err := range errChan {
-			errs.Append(err)
+// fenceLeaderEpoch record the epoch if it is not less than the highest one, otherwise reject it
+func (s *Store) fenceLeaderEpoch(ctx context.Context, epoch int64) error {
+	_, err := s.mongoDb.Collection(s.leaderFenceClsName).UpdateOne(ctx,
+		bson.M{
+			"_id":   LeaderFenceKey,
+			"epoch": bson.M{"$lte": epoch},
+		},
+		bson.M{
+			"$set": bson.M{"epoch": epoch},
+			// always write the document even if the epoch is not changed, so that concurrent transactions conflict on it
+			"$inc": bson.M{"writes": 1},
+		},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		// the filter does not match because the epoch is stale, so upsert conflicts with the existed one
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("leader epoch[ %d ] is stale: %w", epoch, data.ErrDataConflicted)
 		}
-	}()
-
-	wg := sync.WaitGroup{}
-	for i := range dagIns {
-		wg.Add(1)
-		go func(dag *entity.DagInstance, ch chan error) {
-			dag.Update()
-			if _, err := s.mongoDb.Collection(s.dagInsClsName).ReplaceOne(
-				ctx,
-				bson.M{"_id": dag.ID}, dag); err != nil {
-				errChan <- fmt.Errorf("batch update dag instance failed: %w", err)
-			}
-			wg.Done()
-		}(dagIns[i], errChan)
+		return fmt.Errorf("update leader fence failed: %w", err)
 	}
-	wg.Wait()
 	return nil
 }
 
@@ -340,6 +415,37 @@ func (s *Store) GetDagInstance(dagInsId string) (*entity.DagInstance, error) {
 	return ret, nil
 }
 
+// GetDagSchedule
+func (s *Store) GetDagSchedule(dagId string) (*entity.DagSchedule, error) {
+	ret := new(entity.DagSchedule)
+	if err := s.genericGet(s.dagScheduleClsName, dagId, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// SaveDagSchedule
+func (s *Store) SaveDagSchedule(schedule *entity.DagSchedule) error {
+	if schedule.ID == "" {
+		return fmt.Errorf("id cannot be empty")
+	}
+	if schedule.CreatedAt == 0 {
+		schedule.Initial()
+	}
+	schedule.Update()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+	if _, err := s.mongoDb.Collection(s.dagScheduleClsName).ReplaceOne(
+		ctx,
+		bson.M{"_id": schedule.ID}, schedule,
+		options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("save dag schedule failed: %w", err)
+	}
+	return nil
+}
+
 func (s *Store) genericGet(clsName, id string, ret interface{}) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
 	defer cancel()
@@ -357,6 +463,11 @@ func (s *Store) genericGet(clsName, id string, ret interface{}) error {
 // ListDag
 func (s *Store) ListDag(input *mod.ListDagInput) ([]*entity.Dag, error) {
 	query := bson.M{}
+	if input.HasCron {
+		query["cron"] = bson.M{
+			"$nin": bson.A{nil, ""},
+		}
+	}
 
 	var ret []*entity.Dag
 	err := s.genericList(&ret, s.dagClsName, query)
@@ -387,10 +498,35 @@ func (s *Store) ListDagInstance(input *mod.ListDagInstanceInput) ([]*entity.DagI
 			"$ne": nil,
 		}
 	}
+	if input.ParentDagInsID != "" {
+		query["parentDagInsId"] = input.ParentDagInsID
+	}
+	if input.ParentTaskInsID != "" {
+		query["parentTaskInsId"] = input.ParentTaskInsID
+	}
+	if input.DagID != "" {
+		query["dagId"] = input.DagID
+	}
+	if input.ConcurrencyKey != "" {
+		query["concurrencyKey"] = input.ConcurrencyKey
+	}
+	if input.OrderByID && input.AfterID != "" {
+		query["_id"] = bson.M{
+			"$gt": input.AfterID,
+		}
+	}
 	opt := &options.FindOptions{}
 	if input.Limit > 0 {
 		opt.Limit = &input.Limit
 	}
+	if input.Offset > 0 {
+		opt.Skip = &input.Offset
+	}
+	if input.OrderByPriority {
+		opt.Sort = bson.D{{Key: "priority", Value: -1}, {Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}
+	} else if input.OrderByID {
+		opt.Sort = bson.D{{Key: "_id", Value: 1}}
+	}
 
 	var ret []*entity.DagInstance
 	err := s.genericList(&ret, s.dagInsClsName, query, opt)
@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/linclin/fastflow/store/gormstore"
+	"gorm.io/driver/postgres"
+)
+
+// StoreOption
+type StoreOption struct {
+	// postgres connection string, such as "host=localhost user=fastflow password=fastflow dbname=fastflow port=5432"
+	ConnStr string
+	// the prefix will append to the tables
+	Prefix string
+}
+
+// Store
+type Store struct {
+	*gormstore.Store
+	opt *StoreOption
+}
+
+// NewStore
+func NewStore(option *StoreOption) *Store {
+	return &Store{
+		Store: gormstore.NewStore(&gormstore.StoreOption{
+			Prefix:              option.Prefix,
+			IsDuplicateKeyError: isDuplicateKeyError,
+			MaxIdleConns:        10,
+			MaxOpenConns:        500,
+			ConnMaxLifetime:     time.Hour,
+		}),
+		opt: option,
+	}
+}
+
+// Init store
+func (s *Store) Init() error {
+	return s.Open(postgres.Open(s.opt.ConnStr))
+}
+
+func isDuplicateKeyError(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23505 is the code of unique violation
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
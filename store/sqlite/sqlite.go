@@ -0,0 +1,47 @@
+package sqlite
+
+import (
+	"errors"
+
+	"github.com/linclin/fastflow/store/gormstore"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"gorm.io/driver/sqlite"
+)
+
+// StoreOption
+type StoreOption struct {
+	// sqlite database file path or dsn, such as "fastflow.db" or "file::memory:?cache=shared"
+	Path string
+	// the prefix will append to the tables
+	Prefix string
+}
+
+// Store
+type Store struct {
+	*gormstore.Store
+	opt *StoreOption
+}
+
+// NewStore
+func NewStore(option *StoreOption) *Store {
+	return &Store{
+		Store: gormstore.NewStore(&gormstore.StoreOption{
+			Prefix:              option.Prefix,
+			IsDuplicateKeyError: isDuplicateKeyError,
+			// sqlite only allows one writer at a time, so share a single connection to avoid "database is locked"
+			MaxOpenConns: 1,
+		}),
+		opt: option,
+	}
+}
+
+// Init store
+func (s *Store) Init() error {
+	return s.Open(sqlite.Open(s.opt.Path))
+}
+
+func isDuplicateKeyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
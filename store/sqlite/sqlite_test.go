@@ -0,0 +1,334 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/linclin/fastflow/pkg/entity"
+	"github.com/linclin/fastflow/pkg/mod"
+	"github.com/linclin/fastflow/pkg/utils/data"
+	"github.com/linclin/fastflow/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func initStore(t *testing.T) *Store {
+	store.InitFlakeGenerator(0)
+	s := NewStore(&StoreOption{
+		Path:   filepath.Join(t.TempDir(), "fastflow.db"),
+		Prefix: "test",
+	})
+	assert.NoError(t, s.Init())
+	t.Cleanup(s.Close)
+	entity.StoreMarshal = s.Marshal
+	entity.StoreUnmarshal = s.Unmarshal
+	return s
+}
+
+func TestStore_Dag(t *testing.T) {
+	s := initStore(t)
+	giveDags := []*entity.Dag{
+		{
+			BaseInfo: entity.BaseInfo{ID: "test1"},
+			Name:     "test1",
+			Cron:     "* * * * *",
+			Vars:     entity.DagVars{"var1": {Desc: "desc", DefaultValue: "value"}},
+			Tasks:    []entity.Task{{ID: "task1", ActionName: "action"}, {ID: "task2", ActionName: "action", DependOn: []string{"task1"}}},
+			Finally:  entity.TaskList{{ID: "cleanup", ActionName: "action"}},
+		},
+		{BaseInfo: entity.BaseInfo{ID: "test2"}, Name: "test2", Tasks: []entity.Task{{ID: "task3", ActionName: "action"}}},
+	}
+	for i := range giveDags {
+		assert.NoError(t, s.CreateDag(giveDags[i]))
+	}
+	err := s.CreateDag(&entity.Dag{BaseInfo: entity.BaseInfo{ID: "test1"}, Tasks: []entity.Task{{ID: "task4"}}})
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+
+	// the broken pre-check expression is rejected when the dag is created
+	err = s.CreateDag(&entity.Dag{BaseInfo: entity.BaseInfo{ID: "test3"}, Tasks: []entity.Task{{
+		ID:        "task1",
+		PreChecks: entity.PreChecks{"check": {Expr: "vars.a >", Act: entity.ActiveActionSkip}},
+	}}})
+	assert.EqualError(t, err, "task[task1] pre-check[check] is invalid: compile expression[vars.a >] failed: unexpected end of expression")
+
+	ret, err := s.ListDag(&mod.ListDagInput{HasCron: true})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+	assert.Equal(t, "test1", ret[0].ID)
+
+	dag, err := s.GetDag("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, giveDags[0].Vars, dag.Vars)
+	assert.Len(t, dag.Tasks, 2)
+	assert.Equal(t, []string{"task1"}, []string(dag.Tasks[1].DependOn))
+	assert.Equal(t, giveDags[0].Finally, dag.Finally)
+
+	// remove task2 and add task5
+	dag.Desc = "desc"
+	dag.Tasks = []entity.Task{{ID: "task1", ActionName: "action"}, {ID: "task5", ActionName: "action", DependOn: []string{"task1"}}}
+	assert.NoError(t, s.UpdateDag(dag))
+	dag, err = s.GetDag("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, "desc", dag.Desc)
+	var taskIds []string
+	for _, task := range dag.Tasks {
+		taskIds = append(taskIds, task.ID)
+	}
+	assert.ElementsMatch(t, []string{"task1", "task5"}, taskIds)
+
+	assert.NoError(t, s.BatchDeleteDag([]string{"test1"}))
+	_, err = s.GetDag("test1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+	ret, err = s.ListDag(&mod.ListDagInput{})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+}
+
+func TestStore_DagIns(t *testing.T) {
+	s := initStore(t)
+	giveDagIns := []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "test1"}, DagID: "dag1", Status: entity.DagInstanceStatusInit},
+		{BaseInfo: entity.BaseInfo{ID: "test2"}, DagID: "dag1", Status: entity.DagInstanceStatusRunning, Worker: "worker-1", ConcurrencyKey: "key1"},
+		{BaseInfo: entity.BaseInfo{ID: "test3"}, DagID: "dag2", Status: entity.DagInstanceStatusRunning, ParentTaskInsID: "task1", Priority: 1},
+	}
+	for i := range giveDagIns {
+		assert.NoError(t, s.CreateDagIns(giveDagIns[i]))
+	}
+	err := s.CreateDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}})
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+
+	tests := []struct {
+		caseDesc  string
+		giveInput *mod.ListDagInstanceInput
+		wantIds   []string
+	}{
+		{
+			caseDesc:  "all",
+			giveInput: &mod.ListDagInstanceInput{},
+			wantIds:   []string{"test1", "test2", "test3"},
+		},
+		{
+			caseDesc:  "status",
+			giveInput: &mod.ListDagInstanceInput{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}},
+			wantIds:   []string{"test2", "test3"},
+		},
+		{
+			caseDesc:  "worker and dag",
+			giveInput: &mod.ListDagInstanceInput{Worker: "worker-1", DagID: "dag1"},
+			wantIds:   []string{"test2"},
+		},
+		{
+			caseDesc:  "concurrency key",
+			giveInput: &mod.ListDagInstanceInput{ConcurrencyKey: "key1"},
+			wantIds:   []string{"test2"},
+		},
+		{
+			caseDesc:  "parent",
+			giveInput: &mod.ListDagInstanceInput{ParentTaskInsID: "task1"},
+			wantIds:   []string{"test3"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			ret, err := s.ListDagInstance(tc.giveInput)
+			assert.NoError(t, err)
+			var ids []string
+			for i := range ret {
+				ids = append(ids, ret[i].ID)
+			}
+			assert.ElementsMatch(t, tc.wantIds, ids)
+		})
+	}
+	ret, err := s.ListDagInstance(&mod.ListDagInstanceInput{Limit: 2, Offset: 2})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{OrderByID: true, AfterID: "test1", Limit: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, ret, 1) {
+		assert.Equal(t, "test2", ret[0].ID)
+	}
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{OrderByPriority: true, Offset: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, ret, 2) {
+		assert.Equal(t, "test1", ret[0].ID)
+		assert.Equal(t, "test2", ret[1].ID)
+	}
+
+	// patch
+	err = s.PatchDagIns(&entity.DagInstance{
+		BaseInfo:  entity.BaseInfo{ID: "test1"},
+		Status:    entity.DagInstanceStatusFailed,
+		Reason:    "failed",
+		Cmd:       &entity.Command{Name: entity.CommandNameRetry, TargetTaskInsIDs: []string{"task1"}},
+		ShareData: &entity.ShareData{Dict: map[string]string{"key": "value"}},
+	})
+	assert.NoError(t, err)
+	dagIns, err := s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusFailed, dagIns.Status)
+	assert.Equal(t, "dag1", dagIns.DagID)
+	assert.Equal(t, &entity.Command{Name: entity.CommandNameRetry, TargetTaskInsIDs: []string{"task1"}}, dagIns.Cmd)
+	v, ok := dagIns.ShareData.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "value", v)
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{HasCmd: true})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+
+	// the must patch fields will be patched even if they are empty
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}}, "Cmd", "Reason")
+	assert.NoError(t, err)
+	dagIns, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Nil(t, dagIns.Cmd)
+	assert.Empty(t, dagIns.Reason)
+	assert.Equal(t, entity.DagInstanceStatusFailed, dagIns.Status)
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{HasCmd: true})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 0)
+
+	// the handler reason is kept when only the handler status is patched, unless it must be patched
+	err = s.PatchDagIns(&entity.DagInstance{
+		BaseInfo:      entity.BaseInfo{ID: "test1"},
+		HandlerStatus: entity.DagInstanceStatusFailed,
+		HandlerReason: "handler failed",
+	})
+	assert.NoError(t, err)
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, HandlerStatus: entity.DagInstanceStatusRunning})
+	assert.NoError(t, err)
+	dagIns, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusRunning, dagIns.HandlerStatus)
+	assert.Equal(t, "handler failed", dagIns.HandlerReason)
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, HandlerStatus: entity.DagInstanceStatusRunning}, "HandlerReason")
+	assert.NoError(t, err)
+	dagIns, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusRunning, dagIns.HandlerStatus)
+	assert.Empty(t, dagIns.HandlerReason)
+
+	// update
+	dagIns.Worker = "worker-2"
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}))
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{Worker: "worker-2"})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+
+	// the writes of stale leader are rejected
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(2)))
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(2)))
+	dagIns.Worker = "worker-3"
+	err = s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(1))
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{Worker: "worker-3"})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 0)
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(3)))
+
+	// the cmd written by others is kept when leader updates the state
+	stored, err := s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	stored.Cmd = &entity.Command{Name: entity.CommandNameCancel}
+	assert.NoError(t, s.UpdateDagIns(stored))
+	dagIns.Status = entity.DagInstanceStatusScheduled
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(3)))
+	stored, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusScheduled, stored.Status)
+	if assert.NotNil(t, stored.Cmd) {
+		assert.EqualValues(t, entity.CommandNameCancel, stored.Cmd.Name)
+	}
+	// the cmd is cleared when leader handles it by itself
+	dagIns.Status = entity.DagInstanceStatusFailed
+	assert.NoError(t, s.BatchUpdateDagIns([]*entity.DagInstance{dagIns}, mod.WithLeaderEpoch(3), mod.WithClearCmd()))
+	stored, err = s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusFailed, stored.Status)
+	assert.Nil(t, stored.Cmd)
+
+	_, err = s.GetDagInstance("not-existed")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+	assert.NoError(t, s.BatchDeleteDagIns([]string{"test1"}))
+	_, err = s.GetDagInstance("test1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+}
+
+func TestStore_TaskIns(t *testing.T) {
+	s := initStore(t)
+	giveTaskIns := []*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, DagInsID: "dag1", Status: entity.TaskInstanceStatusInit, TimeoutSecs: 30},
+		{BaseInfo: entity.BaseInfo{ID: "task2"}, DagInsID: "dag1", Status: entity.TaskInstanceStatusRunning, TimeoutSecs: 30},
+		{BaseInfo: entity.BaseInfo{ID: "task3"}, DagInsID: "dag2", Status: entity.TaskInstanceStatusRunning, TimeoutSecs: 30},
+	}
+	assert.NoError(t, s.BatchCreatTaskIns(giveTaskIns))
+
+	ret, err := s.ListTaskInstance(&mod.ListTaskInstanceInput{
+		DagInsID: "dag1",
+		Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 1)
+	assert.Equal(t, "task2", ret[0].ID)
+	ret, err = s.ListTaskInstance(&mod.ListTaskInstanceInput{IDs: []string{"task1", "task3"}})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 2)
+	ret, err = s.ListTaskInstance(&mod.ListTaskInstanceInput{Expired: true})
+	assert.NoError(t, err)
+	assert.Len(t, ret, 0)
+
+	err = s.PatchTaskIns(&entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task1"},
+		Status:   entity.TaskInstanceStatusFailed,
+		Reason:   "failed",
+		Traces:   []entity.TraceInfo{{Message: "trace"}},
+		Attempts: 1,
+		Outputs:  entity.StringMap{"version": "v1"},
+	})
+	assert.NoError(t, err)
+	err = s.PatchTaskIns(&entity.TaskInstance{
+		BaseInfo:     entity.BaseInfo{ID: "task1"},
+		Compensation: &entity.Compensation{Status: entity.CompensationStatusSuccess},
+	})
+	assert.NoError(t, err)
+	taskIns, err := s.GetTaskIns("task1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.TaskInstanceStatusFailed, taskIns.Status)
+	assert.Equal(t, "failed", taskIns.Reason)
+	assert.Equal(t, "dag1", taskIns.DagInsID)
+	assert.Equal(t, 1, taskIns.Attempts)
+	assert.Equal(t, []entity.TraceInfo{{Message: "trace"}}, []entity.TraceInfo(taskIns.Traces))
+	assert.Equal(t, entity.StringMap{"version": "v1"}, taskIns.Outputs)
+	assert.Equal(t, &entity.Compensation{Status: entity.CompensationStatusSuccess}, taskIns.Compensation)
+	assert.Equal(t, fmt.Errorf("id cannot be empty"), s.PatchTaskIns(&entity.TaskInstance{}))
+
+	// update the execution state, the zero values are reset but the definition is kept
+	taskIns.Reset()
+	taskIns.DagInsID = ""
+	assert.NoError(t, s.UpdateTaskIns(taskIns))
+	taskIns, err = s.GetTaskIns("task1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.TaskInstanceStatusInit, taskIns.Status)
+	assert.Zero(t, taskIns.Attempts)
+	assert.Empty(t, taskIns.Reason)
+	assert.Empty(t, taskIns.Outputs)
+	assert.Nil(t, taskIns.Compensation)
+	assert.Len(t, taskIns.History, 1)
+	assert.Equal(t, "dag1", taskIns.DagInsID)
+
+	assert.NoError(t, s.BatchDeleteTaskIns([]string{"task1"}))
+	_, err = s.GetTaskIns("task1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+}
+
+func TestStore_DagSchedule(t *testing.T) {
+	s := initStore(t)
+	_, err := s.GetDagSchedule("dag1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+
+	assert.NoError(t, s.SaveDagSchedule(&entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag1"}, LastFiredAt: 1}))
+	assert.NoError(t, s.SaveDagSchedule(&entity.DagSchedule{BaseInfo: entity.BaseInfo{ID: "dag1"}, LastFiredAt: 2}))
+	schedule, err := s.GetDagSchedule("dag1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), schedule.LastFiredAt)
+}